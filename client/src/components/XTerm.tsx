@@ -7,7 +7,7 @@ import '@xterm/xterm/css/xterm.css'
 import type { TerminalTheme } from '../lib/itermThemeParser'
 
 export interface XTermHandle {
-  write: (data: string) => void
+  write: (data: string, callback?: () => void) => void
   fit: () => { cols: number; rows: number }
   focus: () => void
 }
@@ -94,10 +94,12 @@ const XTerm = forwardRef<XTermHandle, XTermProps>(({ onData, onResize, onFileDro
   }, [onFileDrop])
 
   useImperativeHandle(ref, () => ({
-    write: (data: string) => {
+    write: (data: string, callback?: () => void) => {
       const filtered = filterTerminalResponses(data)
-      if (filtered) {
-        terminalRef.current?.write(filtered)
+      if (filtered && terminalRef.current) {
+        terminalRef.current.write(filtered, callback)
+      } else {
+        callback?.()
       }
     },
     fit: () => {
@@ -25,6 +25,7 @@ export function useTerminal({ token, sessionId, onExit, onError, onClose, onFile
   const connRef = useRef<ShellConnection | null>(null)
   const [connected, setConnected] = useState(false)
   const [exitCode, setExitCode] = useState<number | null>(null)
+  const [rtt, setRtt] = useState<number | null>(null)
   const [fileUpload, setFileUpload] = useState<FileUploadState | null>(null)
 
   // Store callbacks in refs to avoid reconnection on callback changes
@@ -46,8 +47,8 @@ export function useTerminal({ token, sessionId, onExit, onError, onClose, onFile
     if (!token) return
 
     const conn = connectShell(token, {
-      onData: (data) => {
-        termRef.current?.write(data)
+      onData: (data, processed) => {
+        termRef.current?.write(data, processed)
       },
       onExit: (code) => {
         setExitCode(code)
@@ -60,8 +61,12 @@ export function useTerminal({ token, sessionId, onExit, onError, onClose, onFile
       },
       onClose: (reason) => {
         setConnected(false)
+        setRtt(null)
         onCloseRef.current?.(reason)
       },
+      onRtt: (ms) => {
+        setRtt(ms)
+      },
       onOpen: () => {
         // Send initial size immediately on connection
         const size = termRef.current?.fit()
@@ -159,6 +164,7 @@ export function useTerminal({ token, sessionId, onExit, onError, onClose, onFile
     termRef,
     connected,
     exitCode,
+    rtt,
     fileUpload,
     handleData,
     handleResize,
@@ -58,8 +58,26 @@ export interface AddKeyBeginResponse {
 export interface SessionInfo {
   id: string
   name: string
+  profile?: string
+  sandbox?: string
   createdAt: string
   attached: boolean
+  viewers: number
+  owner?: string
+  readOnly?: boolean
+  usage?: SessionUsage
+  tmux?: string // tmux session, for tmux windows
+  target?: string // SSH target the session runs on
+  container?: string // Container the session runs in
+}
+
+// Present when the server enforces resource limits; limits are 0 when unlimited
+export interface SessionUsage {
+  memoryBytes: number
+  memoryMax: number
+  cpuUsec: number
+  pids: number
+  pidsMax: number
 }
 
 export interface ListSessionsResponse {
@@ -71,6 +89,114 @@ export interface CreateSessionResponse {
   name: string
 }
 
+export interface LaunchProfile {
+  name: string
+  command?: string
+  args?: string[]
+  dir?: string
+  env?: Record<string, string>
+  term?: string
+  startup?: string
+  sandbox?: string
+}
+
+export interface ListProfilesResponse {
+  profiles: LaunchProfile[]
+}
+
+export interface CreateSessionOptions {
+  name?: string
+  profile?: string
+  dir?: string
+  env?: Record<string, string>
+  tmux?: string // Open a window in this tmux session, created if needed
+  target?: string // Open the session on this SSH target
+  container?: string // Open the session in this container, by name or ID
+}
+
+export interface SSHTarget {
+  name: string
+  host: string
+  user: string // Remote account
+}
+
+export interface ListTargetsResponse {
+  targets: SSHTarget[]
+}
+
+export interface ContainerInfo {
+  id: string
+  name: string
+  image: string
+  state: string
+}
+
+export interface ListContainersResponse {
+  containers: ContainerInfo[]
+}
+
+export interface ScrollbackPage {
+  offset: number
+  start: number
+  end: number
+  data: string // base64
+}
+
+export interface SessionProcess {
+  pid: number
+  ppid: number
+  pgid: number
+  command: string
+  args?: string[]
+  state: string
+  cpuSeconds: number
+  rssBytes: number
+  elapsedSeconds: number
+  foreground?: boolean
+}
+
+export interface ListProcessesResponse {
+  foreground: number
+  processes: SessionProcess[]
+}
+
+// From shells with OSC 133 / OSC 7 integration
+export interface CommandEvent {
+  kind: 'prompt' | 'start' | 'finish' | 'cwd'
+  session?: string // History searches only
+  time: string
+  offset: number // Output offset, as used by getScrollback
+  command?: string
+  cwd?: string
+  exitCode?: number
+  duration?: number // Seconds
+}
+
+export interface CommandEventsResponse {
+  events: CommandEvent[]
+}
+
+export interface SearchMatch {
+  session: string
+  source: 'scrollback' | 'recording'
+  offset: number // Offset of the line, as used by getScrollback
+  time?: number // Seconds into the recording
+  line: string
+  column: number
+  before?: string[]
+  after?: string[]
+}
+
+export interface SearchResponse {
+  matches: SearchMatch[]
+  truncated: boolean
+}
+
+export interface SearchOptions {
+  context?: number
+  limit?: number
+}
+
 export interface ThemeInfo {
   name: string
 }
@@ -196,6 +322,42 @@ export const api = {
       body: JSON.stringify({ name }),
     }),
 
+  createSessionWithOptions: (token: string, options: CreateSessionOptions) =>
+    request<CreateSessionResponse>('/shell/sessions', {
+      method: 'POST',
+      headers: { Authorization: `Bearer ${token}` },
+      body: JSON.stringify(options),
+    }),
+
+  listProfiles: (token: string) =>
+    request<ListProfilesResponse>('/shell/profiles', {
+      headers: { Authorization: `Bearer ${token}` },
+    }),
+
+  listTargets: (token: string) =>
+    request<ListTargetsResponse>('/shell/targets', {
+      headers: { Authorization: `Bearer ${token}` },
+    }),
+
+  listContainers: (token: string) =>
+    request<ListContainersResponse>('/shell/containers', {
+      headers: { Authorization: `Bearer ${token}` },
+    }),
+
+  saveProfile: (token: string, profile: LaunchProfile) =>
+    request<void>('/shell/profiles/save', {
+      method: 'POST',
+      headers: { Authorization: `Bearer ${token}` },
+      body: JSON.stringify(profile),
+    }),
+
+  deleteProfile: (token: string, name: string) =>
+    request<void>('/shell/profiles/delete', {
+      method: 'POST',
+      headers: { Authorization: `Bearer ${token}` },
+      body: JSON.stringify({ name }),
+    }),
+
   renameSession: (token: string, id: string, name: string) =>
     request<void>('/shell/sessions/rename', {
       method: 'POST',
@@ -203,8 +365,70 @@ export const api = {
       body: JSON.stringify({ id, name }),
     }),
 
+  getScrollback: (token: string, id: string, offset?: number, limit?: number) => {
+    const params = new URLSearchParams({ id })
+    if (offset !== undefined) params.set('offset', String(offset))
+    if (limit !== undefined) params.set('limit', String(limit))
+    return request<ScrollbackPage>(`/shell/sessions/scrollback?${params}`, {
+      headers: { Authorization: `Bearer ${token}` },
+    })
+  },
+
+  listProcesses: (token: string, id: string) =>
+    request<ListProcessesResponse>(`/shell/sessions/processes?id=${encodeURIComponent(id)}`, {
+      headers: { Authorization: `Bearer ${token}` },
+    }),
+
+  // Signals the foreground job unless pid is given
+  signalSession: (token: string, id: string, signal: string, pid?: number) =>
+    request<void>('/shell/sessions/signal', {
+      method: 'POST',
+      headers: { Authorization: `Bearer ${token}` },
+      body: JSON.stringify({ id, signal, pid }),
+    }),
+
+  // A link the browser can download from directly, with its own progress
+  // and cancel
+  downloadUrl: (token: string, id: string, name: string) => {
+    const params = new URLSearchParams({ id, name, token })
+    return `${API_BASE}/shell/sessions/download?${params}`
+  },
+
+  listSessionEvents: (token: string, id: string) =>
+    request<CommandEventsResponse>(`/shell/sessions/events?id=${encodeURIComponent(id)}`, {
+      headers: { Authorization: `Bearer ${token}` },
+    }),
+
+  searchHistory: (token: string, query?: string, limit?: number) => {
+    const params = new URLSearchParams()
+    if (query) params.set('q', query)
+    if (limit !== undefined) params.set('limit', String(limit))
+    return request<CommandEventsResponse>(`/shell/history?${params}`, {
+      headers: { Authorization: `Bearer ${token}` },
+    })
+  },
+
+  searchSession: (token: string, id: string, query: string, opts: SearchOptions = {}) => {
+    const params = new URLSearchParams({ id, q: query })
+    if (opts.context !== undefined) params.set('context', String(opts.context))
+    if (opts.limit !== undefined) params.set('limit', String(opts.limit))
+    return request<SearchResponse>(`/shell/sessions/search?${params}`, {
+      headers: { Authorization: `Bearer ${token}` },
+    })
+  },
+
+  searchOutput: (token: string, query: string, opts: SearchOptions = {}) => {
+    const params = new URLSearchParams({ q: query })
+    if (opts.context !== undefined) params.set('context', String(opts.context))
+    if (opts.limit !== undefined) params.set('limit', String(opts.limit))
+    return request<SearchResponse>(`/shell/search?${params}`, {
+      headers: { Authorization: `Bearer ${token}` },
+    })
+  },
+
+  // Resolves once the session's processes are gone
   deleteSession: (token: string, id: string) =>
-    request<void>('/shell/sessions/delete', {
+    request<{ terminated: number }>('/shell/sessions/delete', {
       method: 'POST',
       headers: { Authorization: `Bearer ${token}` },
       body: JSON.stringify({ id }),
@@ -0,0 +1,104 @@
+// Incremental SHA-256. WebCrypto only hashes whole buffers, which for a
+// multi-GB upload would mean holding the file in memory.
+
+const K = new Uint32Array([
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+])
+
+export class Sha256 {
+  private h = new Uint32Array([
+    0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+  ])
+  private w = new Uint32Array(64)
+  private block = new Uint8Array(64)
+  private blockLen = 0
+  private length = 0 // Bytes hashed
+
+  update(data: Uint8Array): this {
+    let i = 0
+    this.length += data.length
+    // Fill up a partial block first, then hash whole blocks in place
+    if (this.blockLen > 0) {
+      const n = Math.min(64 - this.blockLen, data.length)
+      this.block.set(data.subarray(0, n), this.blockLen)
+      this.blockLen += n
+      i = n
+      if (this.blockLen < 64) return this
+      this.compress(this.block, 0)
+      this.blockLen = 0
+    }
+    for (; i + 64 <= data.length; i += 64) {
+      this.compress(data, i)
+    }
+    this.block.set(data.subarray(i))
+    this.blockLen = data.length - i
+    return this
+  }
+
+  digest(): Uint8Array {
+    // Padding: a 1 bit, zeros, and the length in bits as a 64-bit number
+    const bits = this.length * 8
+    const padLen = this.blockLen < 56 ? 56 - this.blockLen : 120 - this.blockLen
+    const pad = new Uint8Array(padLen + 8)
+    pad[0] = 0x80
+    const view = new DataView(pad.buffer)
+    view.setUint32(padLen, Math.floor(bits / 0x100000000), false) // big endian
+    view.setUint32(padLen + 4, bits >>> 0, false)
+    this.update(pad)
+
+    const out = new Uint8Array(32)
+    const outView = new DataView(out.buffer)
+    for (let i = 0; i < 8; i++) {
+      outView.setUint32(i * 4, this.h[i], false)
+    }
+    return out
+  }
+
+  private compress(data: Uint8Array, off: number) {
+    const w = this.w
+    for (let i = 0; i < 16; i++) {
+      const j = off + i * 4
+      w[i] = (data[j] << 24) | (data[j + 1] << 16) | (data[j + 2] << 8) | data[j + 3]
+    }
+    for (let i = 16; i < 64; i++) {
+      const a = w[i - 15]
+      const b = w[i - 2]
+      const s0 = ((a >>> 7) | (a << 25)) ^ ((a >>> 18) | (a << 14)) ^ (a >>> 3)
+      const s1 = ((b >>> 17) | (b << 15)) ^ ((b >>> 19) | (b << 13)) ^ (b >>> 10)
+      w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0
+    }
+
+    let [a, b, c, d, e, f, g, h] = this.h
+    for (let i = 0; i < 64; i++) {
+      const s1 = ((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7))
+      const ch = (e & f) ^ (~e & g)
+      const t1 = (h + s1 + ch + K[i] + w[i]) | 0
+      const s0 = ((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10))
+      const maj = (a & b) ^ (a & c) ^ (b & c)
+      const t2 = (s0 + maj) | 0
+      h = g
+      g = f
+      f = e
+      e = (d + t1) | 0
+      d = c
+      c = b
+      b = a
+      a = (t1 + t2) | 0
+    }
+    this.h[0] += a
+    this.h[1] += b
+    this.h[2] += c
+    this.h[3] += d
+    this.h[4] += e
+    this.h[5] += f
+    this.h[6] += g
+    this.h[7] += h
+  }
+}
@@ -1,14 +1,51 @@
+import type { CommandEvent } from './api'
+import { Sha256 } from './sha256'
+
 // Frame types matching server protocol
 export const FrameType = {
   STDIN: 0x01,
   STDOUT: 0x02,
   RESIZE: 0x04,
   EXIT: 0x05,
+  EVENT: 0x06,
+  ACK: 0x07,
+  HELLO: 0x08,
+  RTT: 0x09,
   FILE_START: 0x10,
   FILE_CHUNK: 0x11,
   FILE_ACK: 0x12,
+  FILE_END: 0x13,
+} as const
+
+// Stream protocol version this client speaks, sent in its HELLO
+const PROTOCOL_VERSION = 1
+
+// Close codes the server uses, besides the standard ones
+export const CloseCode = {
+  INVALID_REQUEST: 4000,
+  UNSUPPORTED_VERSION: 4001,
+  PROTOCOL_ERROR: 4002,
+  FORBIDDEN: 4003,
+  NOT_FOUND: 4004,
+  SESSION_CLOSED: 4010,
 } as const
 
+// The server's answer to our HELLO
+export interface ServerHello {
+  version: number
+  features: string[]
+  frames: number[]
+  compression: boolean
+  readOnly: boolean
+  window?: number
+  minWindow: number
+  maxWindow: number
+  maxFrameSize: number
+  maxFileSize: number // 0 for no limit
+  fileChunkSize: number
+  pingInterval: number
+}
+
 // File ACK status codes
 export const FileAckStatus = {
   SUCCESS: 0x00,
@@ -19,6 +56,13 @@ export const FileAckStatus = {
 // File transfer constants
 const FILE_CHUNK_SIZE = 32 * 1024 // 32KB
 const MAX_FILE_SIZE = 100 * 1024 * 1024 // 100MB
+const UPLOAD_WINDOW = 4 * 1024 * 1024 // Sent but not yet acknowledged
+const HASH_READ_SIZE = 4 * 1024 * 1024 // When hashing what a resumed upload skips
+
+// Flow control: the server pauses the shell once this much output is
+// unacknowledged; output is acknowledged once the terminal has rendered it
+const OUTPUT_WINDOW = 256 * 1024
+const ACK_THRESHOLD = OUTPUT_WINDOW / 4
 
 export interface FileTransferCallbacks {
   onProgress?: (bytesUploaded: number, totalBytes: number) => void
@@ -34,11 +78,14 @@ export interface ShellConnection {
 }
 
 export interface ShellCallbacks {
-  onData: (data: string) => void
+  onData: (data: string, processed: () => void) => void
   onExit: (code: number) => void
   onError: (error: Error) => void
-  onClose: (reason?: string) => void
+  onClose: (reason?: string, code?: number) => void
   onOpen?: () => void
+  onHello?: (hello: ServerHello) => void
+  onRtt?: (ms: number) => void
+  onEvent?: (event: CommandEvent) => void
 }
 
 export function connectShell(token: string, callbacks: ShellCallbacks, sessionId?: string): ShellConnection {
@@ -54,14 +101,34 @@ export function connectShell(token: string, callbacks: ShellCallbacks, sessionId
   // TextDecoder for converting binary to string
   const textDecoder = new TextDecoder('utf-8')
 
-  // File transfer state
-  let fileTransferCallbacks: FileTransferCallbacks | null = null
-  let fileTransferResolve: (() => void) | null = null
-  let fileTransferReject: ((error: Error) => void) | null = null
-  let fileTransferBytesUploaded = 0
-  let fileTransferTotalBytes = 0
+  // File transfer state: FILE_ACKs go to the upload in progress
+  let fileAck: ((status: number, message: string, received: number) => void) | null = null
+  // Servers without a HELLO don't tell their limits, nor resume uploads
+  let maxFileSize = MAX_FILE_SIZE
+  let fileChunkSize = FILE_CHUNK_SIZE
+  let resumableUploads = false
+
+  // Output processed but not yet acknowledged
+  let unacked = 0
+  const ack = (bytes: number) => {
+    unacked += bytes
+    if (unacked < ACK_THRESHOLD || ws.readyState !== WebSocket.OPEN) return
+
+    const frame = new Uint8Array(5)
+    frame[0] = FrameType.ACK
+    new DataView(frame.buffer).setUint32(1, unacked, false) // big endian
+    ws.send(frame)
+    unacked = 0
+  }
 
   ws.onopen = () => {
+    // The HELLO has to come before the first resize starts the output
+    const hello = JSON.stringify({ version: PROTOCOL_VERSION, features: ['flowControl', 'rtt', 'uploads'], window: OUTPUT_WINDOW })
+    const encoded = new TextEncoder().encode(hello)
+    const frame = new Uint8Array(1 + encoded.length)
+    frame[0] = FrameType.HELLO
+    frame.set(encoded, 1)
+    ws.send(frame)
     callbacks.onOpen?.()
   }
 
@@ -75,7 +142,7 @@ export function connectShell(token: string, callbacks: ShellCallbacks, sessionId
     switch (frameType) {
       case FrameType.STDOUT:
         // Use stream mode to handle multi-byte characters split across chunks
-        callbacks.onData(textDecoder.decode(payload, { stream: true }))
+        callbacks.onData(textDecoder.decode(payload, { stream: true }), () => ack(payload.length))
         break
 
       case FrameType.EXIT:
@@ -86,31 +153,42 @@ export function connectShell(token: string, callbacks: ShellCallbacks, sessionId
         }
         break
 
+      case FrameType.EVENT:
+        try {
+          callbacks.onEvent?.(JSON.parse(new TextDecoder().decode(payload)))
+        } catch {
+          // Ignore malformed events
+        }
+        break
+
+      case FrameType.HELLO:
+        try {
+          const hello: ServerHello = JSON.parse(new TextDecoder().decode(payload))
+          maxFileSize = hello.maxFileSize
+          resumableUploads = hello.features.includes('uploads')
+          if (resumableUploads) fileChunkSize = hello.fileChunkSize
+          callbacks.onHello?.(hello)
+        } catch {
+          // Ignore a malformed HELLO
+        }
+        break
+
+      case FrameType.RTT:
+        if (payload.length >= 4) {
+          const view = new DataView(payload.buffer, payload.byteOffset)
+          callbacks.onRtt?.(view.getUint32(0, false) / 1000) // big endian, microseconds
+        }
+        break
+
       case FrameType.FILE_ACK:
         if (payload.length >= 1) {
           const status = payload[0]
-          const message = payload.length > 1 ? textDecoder.decode(payload.slice(1)) : ''
-
-          switch (status) {
-            case FileAckStatus.SUCCESS:
-              fileTransferCallbacks?.onComplete?.(message)
-              fileTransferResolve?.()
-              fileTransferCallbacks = null
-              fileTransferResolve = null
-              fileTransferReject = null
-              break
-
-            case FileAckStatus.PROGRESS:
-              fileTransferCallbacks?.onProgress?.(fileTransferBytesUploaded, fileTransferTotalBytes)
-              break
-
-            case FileAckStatus.ERROR:
-              fileTransferCallbacks?.onError?.(message || 'Upload failed')
-              fileTransferReject?.(new Error(message || 'Upload failed'))
-              fileTransferCallbacks = null
-              fileTransferResolve = null
-              fileTransferReject = null
-              break
+          if (status === FileAckStatus.PROGRESS) {
+            // With resumable uploads, progress carries the bytes received
+            const view = new DataView(payload.buffer, payload.byteOffset)
+            fileAck?.(status, '', payload.length >= 9 ? Number(view.getBigUint64(1, false)) : -1)
+          } else {
+            fileAck?.(status, new TextDecoder().decode(payload.slice(1)), -1)
           }
         }
         break
@@ -122,14 +200,10 @@ export function connectShell(token: string, callbacks: ShellCallbacks, sessionId
   }
 
   ws.onclose = (event) => {
-    callbacks.onClose(event.reason || undefined)
-    // Reject any pending file transfer
-    if (fileTransferReject) {
-      fileTransferReject(new Error('Connection closed'))
-      fileTransferCallbacks = null
-      fileTransferResolve = null
-      fileTransferReject = null
-    }
+    callbacks.onClose(event.reason || undefined, event.code)
+    // Fail any pending file transfer; a resumable one continues where it
+    // stopped when the file is sent again
+    fileAck?.(FileAckStatus.ERROR, 'Connection closed', -1)
   }
 
   const send = (data: string) => {
@@ -158,73 +232,115 @@ export function connectShell(token: string, callbacks: ShellCallbacks, sessionId
       throw new Error('Not connected')
     }
 
-    if (file.size > MAX_FILE_SIZE) {
-      throw new Error('File too large (max 100MB)')
+    if (maxFileSize > 0 && file.size > maxFileSize) {
+      throw new Error(`File too large (max ${Math.floor(maxFileSize / (1024 * 1024))}MB)`)
     }
 
-    // Store callbacks for ACK handler
-    fileTransferCallbacks = transferCallbacks || null
-    fileTransferBytesUploaded = 0
-    fileTransferTotalBytes = file.size
+    // Frame layouts differ in the width of sizes and offsets
+    const wide = resumableUploads
+    const chunkSize = fileChunkSize
 
-    return new Promise((resolve, reject) => {
-      fileTransferResolve = resolve
-      fileTransferReject = reject
+    // ACKs come in order, one per frame; they queue until waited for
+    const acks: { status: number; message: string; received: number }[] = []
+    let wake: (() => void) | null = null
+    fileAck = (status, message, received) => {
+      acks.push({ status, message, received })
+      wake?.()
+    }
+    const nextAck = () =>
+      new Promise<{ status: number; message: string; received: number }>((resolve) => {
+        if (acks.length > 0) {
+          resolve(acks.shift()!)
+          return
+        }
+        wake = () => {
+          wake = null
+          resolve(acks.shift()!)
+        }
+      })
+    const read = async (start: number, end: number) => new Uint8Array(await file.slice(start, end).arrayBuffer())
 
-      // Send FILE_START frame: [0x10][size:u32][name_len:u16][name:utf8]
+    try {
+      // Send FILE_START frame: [0x10][size:u32][name_len:u16][name:utf8],
+      // with resumable uploads [0x10][size:u64][name_len:u16][name:utf8]
       const nameBytes = new TextEncoder().encode(file.name)
-      const startFrame = new Uint8Array(1 + 4 + 2 + nameBytes.length)
+      const sizeLen = wide ? 8 : 4
+      const startFrame = new Uint8Array(1 + sizeLen + 2 + nameBytes.length)
       startFrame[0] = FrameType.FILE_START
       const startView = new DataView(startFrame.buffer)
-      startView.setUint32(1, file.size, false) // big endian
-      startView.setUint16(5, nameBytes.length, false) // big endian
-      startFrame.set(nameBytes, 7)
+      if (wide) {
+        startView.setBigUint64(1, BigInt(file.size), false) // big endian
+      } else {
+        startView.setUint32(1, file.size, false) // big endian
+      }
+      startView.setUint16(1 + sizeLen, nameBytes.length, false) // big endian
+      startFrame.set(nameBytes, 1 + sizeLen + 2)
       ws.send(startFrame)
 
-      // Read and send file in chunks
-      const reader = new FileReader()
-      let offset = 0
-
-      const sendNextChunk = () => {
-        if (offset >= file.size) {
-          return // All chunks sent, wait for final ACK
+      let reply = await nextAck()
+      if (reply.status === FileAckStatus.PROGRESS) {
+        // A resumed upload starts where the server's partial file ends;
+        // the checksum still covers all of the file
+        let offset = wide ? reply.received : 0
+        const hash = new Sha256()
+        for (let pos = 0; pos < offset; pos += HASH_READ_SIZE) {
+          hash.update(await read(pos, Math.min(pos + HASH_READ_SIZE, offset)))
         }
+        transferCallbacks?.onProgress?.(offset, file.size)
+
+        // Chunks are sent ahead up to the window, then one per ACK
+        let acked = offset
+        const sent: number[] = []
+        while (acked < file.size) {
+          if (offset < file.size && offset - acked < UPLOAD_WINDOW) {
+            const chunkData = await read(offset, Math.min(offset + chunkSize, file.size))
+            if (wide) hash.update(chunkData)
+
+            // Send FILE_CHUNK frame: [0x11][offset:u32][data...], with
+            // resumable uploads [0x11][offset:u64][data...]
+            const offsetLen = wide ? 8 : 4
+            const chunkFrame = new Uint8Array(1 + offsetLen + chunkData.length)
+            chunkFrame[0] = FrameType.FILE_CHUNK
+            const chunkView = new DataView(chunkFrame.buffer)
+            if (wide) {
+              chunkView.setBigUint64(1, BigInt(offset), false) // big endian
+            } else {
+              chunkView.setUint32(1, offset, false) // big endian
+            }
+            chunkFrame.set(chunkData, 1 + offsetLen)
+            ws.send(chunkFrame)
+
+            offset += chunkData.length
+            sent.push(offset)
+            continue
+          }
 
-        const chunkSize = Math.min(FILE_CHUNK_SIZE, file.size - offset)
-        const blob = file.slice(offset, offset + chunkSize)
-        reader.readAsArrayBuffer(blob)
-      }
-
-      reader.onload = () => {
-        if (!reader.result) return
-
-        const chunkData = new Uint8Array(reader.result as ArrayBuffer)
-
-        // Send FILE_CHUNK frame: [0x11][offset:u32][data...]
-        const chunkFrame = new Uint8Array(1 + 4 + chunkData.length)
-        chunkFrame[0] = FrameType.FILE_CHUNK
-        const chunkView = new DataView(chunkFrame.buffer)
-        chunkView.setUint32(1, offset, false) // big endian
-        chunkFrame.set(chunkData, 5)
-        ws.send(chunkFrame)
-
-        offset += chunkData.length
-        fileTransferBytesUploaded = offset
+          reply = await nextAck()
+          if (reply.status !== FileAckStatus.PROGRESS) break
+          acked = sent.shift()!
+          transferCallbacks?.onProgress?.(acked, file.size)
+        }
 
-        // Send next chunk
-        sendNextChunk()
+        // The server checks the file against our checksum before putting
+        // it in place; older servers finish with the last chunk
+        if (wide && reply.status === FileAckStatus.PROGRESS) {
+          const endFrame = new Uint8Array(1 + 32)
+          endFrame[0] = FrameType.FILE_END
+          endFrame.set(hash.digest(), 1)
+          ws.send(endFrame)
+          reply = await nextAck()
+        }
       }
 
-      reader.onerror = () => {
-        reject(new Error('Failed to read file'))
-        fileTransferCallbacks = null
-        fileTransferResolve = null
-        fileTransferReject = null
+      if (reply.status !== FileAckStatus.SUCCESS) {
+        const message = reply.message || 'Upload failed'
+        transferCallbacks?.onError?.(message)
+        throw new Error(message)
       }
-
-      // Start sending chunks
-      sendNextChunk()
-    })
+      transferCallbacks?.onComplete?.(reply.message)
+    } finally {
+      fileAck = null
+    }
   }
 
   const close = () => {
@@ -19,6 +19,9 @@ interface Toast {
   persistent?: boolean
 }
 
+// Round trip times from this on are shown on the terminal
+const SLOW_RTT_MS = 250
+
 function TerminalTab({
   token,
   sessionId,
@@ -44,7 +47,7 @@ function TerminalTab({
   onFileComplete?: (filename: string) => void
   onFileError?: (error: string) => void
 }) {
-  const { termRef, handleData, handleResize, handleFileDrop, fileUpload } = useTerminal({
+  const { termRef, handleData, handleResize, handleFileDrop, fileUpload, rtt } = useTerminal({
     token,
     sessionId,
     onExit,
@@ -61,6 +64,11 @@ function TerminalTab({
   return (
     <div className="relative h-full w-full">
       <XTerm ref={termRef} onData={handleData} onResize={handleResize} onFileDrop={handleFileDrop} theme={theme} fontFamily={fontFamily} fontSize={fontSize} isActive={isActive} />
+      {rtt !== null && rtt >= SLOW_RTT_MS && (
+        <div className="pointer-events-none absolute right-3 top-2 rounded bg-[var(--theme-bg-secondary)] px-2 py-0.5 text-xs text-amber-400 opacity-80">
+          {Math.round(rtt)} ms
+        </div>
+      )}
       {fileUpload && (
         <div className="absolute bottom-4 right-4 rounded-lg bg-[var(--theme-bg-secondary)] px-4 py-3 shadow-lg">
           <div className="mb-1 text-sm text-[var(--theme-fg)]">
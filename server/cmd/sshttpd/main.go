@@ -18,15 +18,67 @@ import (
 	"github.com/eddison/sshttp/server/internal/auth"
 	"github.com/eddison/sshttp/server/internal/config"
 	"github.com/eddison/sshttp/server/internal/mds"
+	"github.com/eddison/sshttp/server/internal/privsep"
 	"github.com/eddison/sshttp/server/internal/pty"
 	"github.com/eddison/sshttp/server/internal/store"
+	"github.com/eddison/sshttp/server/internal/transfer"
 )
 
 func main() {
-	register := flag.Bool("register", false, "Generate one-time registration link for current user")
+	register := flag.Bool("register", false, "Generate one-time registration link for a user (default: current user)")
+	dataDir := flag.String("data-dir", "", "Data directory (default ~/.sshttp)")
+	hold := flag.Bool("hold", false, "Host a single PTY session (started internally by the daemon)")
+	spawner := flag.Bool("spawner", false, "Start processes as other users (started internally by the daemon)")
+	receive := flag.Bool("receive", false, "Receive an uploaded file (started internally by the daemon)")
+	send := flag.Bool("send", false, "Send a file for download (started internally by the daemon)")
+	sandbox := flag.Bool("sandbox", false, "Set up a sandbox and start a process in it (started internally)")
 	flag.Parse()
 
-	cfg := config.Load()
+	// Session holder processes are the daemon binary re-executed, and so
+	// are the helpers below
+	if *hold {
+		if err := pty.RunHolder(); err != nil {
+			log.Fatalf("holder: %v", err)
+		}
+		return
+	}
+	if *spawner {
+		if err := privsep.RunSpawner(); err != nil {
+			log.Fatalf("spawner: %v", err)
+		}
+		return
+	}
+	if *receive {
+		if err := transfer.RunReceiver(flag.Args()); err != nil {
+			log.Fatalf("receive: %v", err)
+		}
+		return
+	}
+	if *send {
+		if err := transfer.RunSender(flag.Args()); err != nil {
+			log.Fatalf("send: %v", err)
+		}
+		return
+	}
+	if *sandbox {
+		err := privsep.RunSandbox(flag.Args())
+		log.Fatalf("sandbox: %v", err)
+	}
+
+	cfg := config.Load(*dataDir)
+
+	// In multi-user mode only the spawner keeps root; everything else,
+	// including registration, runs as the unprivileged daemon account
+	var starter privsep.Starter = privsep.Local{}
+	if cfg.MultiUser {
+		sp, err := dropPrivileges(cfg, !*register)
+		if err != nil {
+			log.Fatalf("multi_user: %v", err)
+		}
+		if sp != nil {
+			starter = sp
+		}
+	}
 
 	// Initialize store
 	s, err := store.NewSQLiteStore(cfg.DataDir)
@@ -37,12 +89,24 @@ func main() {
 
 	// Handle registration command
 	if *register {
-		// Get current Unix user
-		currentUser, err := user.Current()
-		if err != nil {
-			log.Fatalf("failed to get current user: %v", err)
+		username := flag.Arg(0)
+		if username == "" {
+			// Get current Unix user
+			currentUser, err := user.Current()
+			if err != nil {
+				log.Fatalf("failed to get current user: %v", err)
+			}
+			username = currentUser.Username
+		}
+		// Users sign in to the Unix account of the same name
+		if cfg.MultiUser {
+			if account, err := privsep.LookupAccount(username); err != nil {
+				log.Fatalf("cannot register %s: %v", username, err)
+			} else if account.Uid == 0 {
+				log.Fatalf("cannot register %s: sessions never run as root", username)
+			}
 		}
-		if err := generateRegistration(s, currentUser.Username, cfg); err != nil {
+		if err := generateRegistration(s, username, cfg); err != nil {
 			log.Fatalf("failed to create registration: %v", err)
 		}
 		return
@@ -57,15 +121,16 @@ func main() {
 	// Initialize token manager
 	tm := auth.NewTokenManager(cfg.JWTSecret, cfg.TokenExpiryMins)
 
-	// Initialize session manager
-	sm := pty.NewSessionManager()
+	// Initialize session manager and reattach shells that survived a restart
+	sm := pty.NewSessionManager(cfg, starter)
+	sm.Recover()
 
 	// Initialize MDS client for authenticator metadata
 	mdsClient := mds.New(cfg.DataDir)
 	mdsClient.Load()
 
 	// Create server
-	srv := api.NewServer(cfg, s, wa, tm, sm, mdsClient)
+	srv := api.NewServer(cfg, s, wa, tm, sm, mdsClient, starter)
 
 	// Set embedded filesystem if available
 	srv.SetEmbeddedFS(StaticFS)
@@ -78,7 +143,9 @@ func main() {
 	}
 
 	// Graceful shutdown
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
@@ -87,6 +154,11 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		httpServer.Shutdown(ctx)
+
+		// Holders keep shells alive across restarts unless told otherwise
+		if !cfg.PersistSessions {
+			sm.CloseAll()
+		}
 	}()
 
 	// Start cleanup goroutines
@@ -96,6 +168,7 @@ func main() {
 		for range ticker.C {
 			wa.CleanupExpiredSessions()
 			sm.CloseIdleSessions(time.Duration(cfg.SessionIdleTimeoutMins) * time.Minute)
+			sm.PruneHistory()
 		}
 	}()
 
@@ -105,12 +178,53 @@ func main() {
 		if err := httpServer.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey); err != http.ErrServerClosed {
 			log.Fatalf("server error: %v", err)
 		}
+		<-shutdownDone
 	} else {
 		log.Printf("starting HTTP server on %s (WebAuthn requires HTTPS!)", cfg.Addr)
 		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 			log.Fatalf("server error: %v", err)
 		}
+		<-shutdownDone
+	}
+}
+
+// dropPrivileges switches a daemon started as root to the run_as account,
+// which takes over the data directory. Unless only registering, it first
+// starts the spawner that keeps root to start sessions as their users.
+func dropPrivileges(cfg *config.Config, withSpawner bool) (*privsep.Spawner, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("sshttpd must be started as root")
+	}
+	account, err := privsep.LookupAccount(cfg.RunAs)
+	if err != nil {
+		return nil, fmt.Errorf("run_as: %w", err)
+	}
+	if account.Uid == 0 {
+		return nil, fmt.Errorf("run_as must not be root")
+	}
+	if err := privsep.ChownTree(cfg.DataDir, account); err != nil {
+		return nil, fmt.Errorf("chown data directory: %w", err)
+	}
+	if cfg.CgroupRoot != "" {
+		if err := privsep.DelegateCgroup(cfg.CgroupRoot, account); err != nil {
+			return nil, fmt.Errorf("delegate cgroup_root: %w", err)
+		}
+	}
+
+	var sp *privsep.Spawner
+	if withSpawner {
+		if sp, err = privsep.StartSpawner(account, cfg.CgroupRoot); err != nil {
+			return nil, err
+		}
+	}
+	if err := privsep.DropPrivileges(account); err != nil {
+		return nil, err
+	}
+	if _, err := os.ReadDir(cfg.DataDir); err != nil {
+		return nil, fmt.Errorf("data directory %s is not accessible to %s, choose another with --data-dir", cfg.DataDir, account.Username)
 	}
+	log.Printf("multi-user mode: running as %s", account.Username)
+	return sp, nil
 }
 
 func generateRegistration(s *store.SQLiteStore, username string, cfg *config.Config) error {
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/eddison/sshttp/server/internal/auth"
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/pty"
+)
+
+// containerInfo is a running container a user can open sessions in
+type containerInfo struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	State string `json:"state"`
+}
+
+type listContainersResponse struct {
+	Containers []containerInfo `json:"containers"`
+}
+
+// containers lists the running containers a user may open shells in
+func (s *Server) containers(claims *auth.Claims) ([]pty.Container, error) {
+	all, err := s.sessionManager.Containers()
+	if err != nil {
+		return nil, err
+	}
+	var allowed []pty.Container
+	for _, c := range all {
+		if s.cfg.ContainerAllowed(claims.Username, c.Name, c.Labels) {
+			allowed = append(allowed, c)
+		}
+	}
+	return allowed, nil
+}
+
+// container finds a container a user may open shells in by name or ID
+func (s *Server) container(claims *auth.Claims, ref string) (*pty.Container, error) {
+	containers, err := s.containers(claims)
+	if err != nil {
+		return nil, err
+	}
+	for i := range containers {
+		if containers[i].Name == ref || containers[i].ID == ref {
+			return &containers[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// handleListContainers lists the running containers the user may open
+// sessions in, to pass as container when creating a session
+func (s *Server) handleListContainers(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	containers, err := s.containers(claims)
+	if err != nil {
+		if errors.Is(err, pty.ErrContainersDisabled) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("list containers error: %v", err)
+		http.Error(w, "failed to list containers", http.StatusBadGateway)
+		return
+	}
+	resp := listContainersResponse{Containers: make([]containerInfo, len(containers))}
+	for i, c := range containers {
+		resp.Containers[i] = containerInfo{ID: c.ID, Name: c.Name, Image: c.Image, State: c.State}
+	}
+	sort.Slice(resp.Containers, func(i, j int) bool { return resp.Containers[i].Name < resp.Containers[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/transfer"
+)
+
+// handleDownloadFile streams a file from the session shell's working
+// directory. Browsers can follow the link directly with ?token=, show
+// progress from Content-Length, and cancel by dropping the connection.
+func (s *Server) handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, ok := s.sessionManager.Get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	allowed, readOnly := session.Access(claims.UserID)
+	if !allowed {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	// Files are read as the session's account, which read-only viewers
+	// only get to watch
+	if readOnly {
+		http.Error(w, "read-only access", http.StatusForbidden)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if err := validateFilename(name); err != nil {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+	if session.ShellPid() == 0 {
+		http.Error(w, "downloads are not supported for this session", http.StatusBadRequest)
+		return
+	}
+
+	download, err := transfer.StartDownload(s.starter, session.Account, session.ShellPid(), name)
+	if err != nil {
+		if errors.Is(err, transfer.ErrNoSuchFile) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer download.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Content-Length", strconv.FormatInt(download.Size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	log.Printf("user %s downloading %s (%d bytes, session: %s)", claims.Username, download.Path, download.Size, session.ID)
+	n, err := io.Copy(w, download)
+	if err != nil || n < download.Size {
+		log.Printf("file download cancelled: %s (%d of %d bytes)", download.Path, n, download.Size)
+		return
+	}
+	log.Printf("file download complete: %s", download.Path)
+}
@@ -0,0 +1,425 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/privsep"
+	"github.com/gorilla/websocket"
+)
+
+// Exec limits
+const (
+	defaultExecTimeout = 60 * time.Second
+	maxExecTimeout     = time.Hour
+	maxExecOutput      = 10 * 1024 * 1024 // Per stream, for the non-streaming endpoint
+	maxExecRequestSize = 16 * 1024 * 1024
+)
+
+type execRequest struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Dir     string            `json:"dir,omitempty"` // Absolute or ~/relative, empty for $HOME
+	Env     map[string]string `json:"env,omitempty"`
+	Stdin   []byte            `json:"stdin,omitempty"`   // Base64 encoded; not used when streaming
+	Timeout int               `json:"timeout,omitempty"` // Seconds
+}
+
+type execResponse struct {
+	ExitCode  int     `json:"exitCode"`
+	Stdout    []byte  `json:"stdout"` // Base64 encoded
+	Stderr    []byte  `json:"stderr"` // Base64 encoded
+	Truncated bool    `json:"truncated,omitempty"`
+	TimedOut  bool    `json:"timedOut,omitempty"`
+	Duration  float64 `json:"duration"` // Seconds
+}
+
+// limitedBuffer keeps the first max bytes written and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.Buffer.Write(p[:max(room, 0)])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// frameWriter sends everything written to it as frames of one type
+type frameWriter struct {
+	conn  *safeConn
+	frame byte
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	frame := make([]byte, 1+len(p))
+	frame[0] = f.frame
+	copy(frame[1:], p)
+	if err := f.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// execCmd is a command started by the exec API
+type execCmd struct {
+	proc     *privsep.Process
+	stdin    *os.File
+	pipes    []*os.File // Read ends of stdout and stderr
+	outputs  sync.WaitGroup
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+// newExecSpec validates an exec request and builds the process to start as
+// the account
+func newExecSpec(req *execRequest, account *privsep.Account) (*privsep.Spec, error) {
+	if req.Command == "" {
+		return nil, fmt.Errorf("command required")
+	}
+	if err := validateDir(req.Dir); err != nil {
+		return nil, err
+	}
+	if err := validateEnv(req.Env); err != nil {
+		return nil, err
+	}
+	dir := account.ExpandHome(req.Dir)
+	if dir == "" {
+		dir = account.Home
+	}
+
+	spec := &privsep.Spec{
+		User:    account.Username,
+		Args:    req.Args,
+		Env:     account.Environ(),
+		Dir:     dir,
+		Setpgid: true,
+	}
+	for k, v := range req.Env {
+		spec.Env = append(spec.Env, k+"="+v)
+	}
+	// The command is looked up in the PATH it runs with, the account's or
+	// the request's, not the daemon's
+	path, err := lookPath(req.Command, spec.Env)
+	if err != nil {
+		return nil, fmt.Errorf("command %q not found", req.Command)
+	}
+	spec.Path = path
+	return spec, nil
+}
+
+// lookPath finds an executable like exec.LookPath, but in the PATH of env.
+// Relative names with a slash are left to the exec, which resolves them
+// against the working directory.
+func lookPath(file string, env []string) (string, error) {
+	if filepath.IsAbs(file) {
+		if !isExecutable(file) {
+			return "", exec.ErrNotFound
+		}
+		return file, nil
+	}
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	var path string
+	for _, kv := range env {
+		// Later entries win, as in the process's environment
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = v
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		// Relative entries would resolve against the daemon's directory
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		if p := filepath.Join(dir, file); isExecutable(p) {
+			return p, nil
+		}
+	}
+	return "", exec.ErrNotFound
+}
+
+// isExecutable reports whether path is a file with an execute bit. Whether
+// the account may run it is up to the exec.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// startExec starts a command in its own process group, copying its output
+// to stdout and stderr. The group is killed when ctx is done or the
+// timeout expires.
+func (s *Server) startExec(ctx context.Context, spec *privsep.Spec, timeout time.Duration, stdout, stderr io.Writer) (*execCmd, error) {
+	var child, parent [3]*os.File
+	for i := range child {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeAll(child[:i])
+			closeAll(parent[:i])
+			return nil, err
+		}
+		if i == 0 {
+			child[i], parent[i] = r, w
+		} else {
+			child[i], parent[i] = w, r
+		}
+	}
+	proc, err := s.starter.Start(spec, child[:])
+	closeAll(child[:])
+	if err != nil {
+		closeAll(parent[:])
+		return nil, err
+	}
+
+	c := &execCmd{proc: proc, stdin: parent[0], pipes: parent[1:]}
+	c.outputs.Add(2)
+	for i, w := range []io.Writer{stdout, stderr} {
+		go func() {
+			defer c.outputs.Done()
+			io.Copy(w, c.pipes[i])
+		}()
+	}
+	c.timer = time.AfterFunc(timeout, func() {
+		c.timedOut.Store(true)
+		c.kill()
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.kill()
+		case <-proc.Done():
+		}
+	}()
+	return c, nil
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func (c *execCmd) kill() {
+	c.proc.Signal(syscall.SIGKILL, true)
+}
+
+// wait waits for the command to exit and returns its exit status, or -1 if
+// it didn't exit normally
+func (c *execCmd) wait() int {
+	code := c.proc.Wait()
+	c.timer.Stop()
+
+	// Background children holding stdout open must not block us forever
+	done := make(chan struct{})
+	go func() {
+		c.outputs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		closeAll(c.pipes)
+		<-done
+	}
+	closeAll(c.pipes)
+	c.stdin.Close()
+	return code
+}
+
+// execTimeout returns the requested timeout within the limits
+func execTimeout(req *execRequest) time.Duration {
+	if req.Timeout > 0 {
+		return min(time.Duration(req.Timeout)*time.Second, maxExecTimeout)
+	}
+	return defaultExecTimeout
+}
+
+// handleExec runs a command without a PTY and returns its output once it
+// exits
+func (s *Server) handleExec(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req execRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxExecRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	account, err := s.account(claims)
+	if err != nil {
+		log.Printf("exec error: %v", err)
+		http.Error(w, "no unix account for user", http.StatusForbidden)
+		return
+	}
+	spec, err := newExecSpec(&req, account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if spec.Sandbox, err = s.sandbox(claims, nil); err != nil {
+		log.Printf("exec error: %v", err)
+		http.Error(w, "sandbox not available", http.StatusForbidden)
+		return
+	}
+	if spec.Cgroup, err = s.sessionManager.ExecCgroup(claims.UserID, s.cfg.LimitsFor(claims.Username)); err != nil {
+		log.Printf("exec error: %v", err)
+		http.Error(w, "failed to start command", http.StatusInternalServerError)
+		return
+	}
+
+	stdout := &limitedBuffer{max: maxExecOutput}
+	stderr := &limitedBuffer{max: maxExecOutput}
+
+	log.Printf("user %s exec: %s %q", claims.Username, req.Command, req.Args)
+	start := time.Now()
+	// Killed along with the request if the client goes away
+	cmd, err := s.startExec(r.Context(), spec, execTimeout(&req), stdout, stderr)
+	if err != nil {
+		log.Printf("exec start error: %v", err)
+		http.Error(w, "failed to start command", http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		cmd.stdin.Write(req.Stdin)
+		cmd.stdin.Close()
+	}()
+	code := cmd.wait()
+
+	resp := execResponse{
+		ExitCode:  code,
+		Stdout:    stdout.Bytes(),
+		Stderr:    stderr.Bytes(),
+		Truncated: stdout.truncated || stderr.truncated,
+		TimedOut:  cmd.timedOut.Load(),
+		Duration:  time.Since(start).Seconds(),
+	}
+	log.Printf("user %s exec finished: %s (exit %d, %.1fs)", claims.Username, req.Command, resp.ExitCode, resp.Duration)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleExecStream runs a command without a PTY over a WebSocket. The
+// client sends the execRequest as the first (text) message, then STDIN
+// frames; an empty STDIN frame closes the command's stdin. The server
+// sends STDOUT and STDERR frames and finally an EXIT frame.
+func (s *Server) handleExecStream(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	upgrader := s.newUpgrader()
+	wsConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("websocket upgrade error: %v", err)
+		return
+	}
+	conn := &safeConn{Conn: wsConn}
+	defer conn.Close()
+
+	var req execRequest
+	conn.SetReadLimit(maxExecRequestSize)
+	if _, data, err := conn.ReadMessage(); err != nil || json.Unmarshal(data, &req) != nil {
+		closeStream(conn, CloseInvalidRequest, "invalid request")
+		return
+	}
+
+	account, err := s.account(claims)
+	if err != nil {
+		log.Printf("exec error: %v", err)
+		closeStream(conn, CloseForbidden, "no unix account for user")
+		return
+	}
+	spec, err := newExecSpec(&req, account)
+	if err != nil {
+		closeStream(conn, CloseInvalidRequest, err.Error())
+		return
+	}
+	if spec.Sandbox, err = s.sandbox(claims, nil); err != nil {
+		log.Printf("exec error: %v", err)
+		closeStream(conn, CloseForbidden, "sandbox not available")
+		return
+	}
+	if spec.Cgroup, err = s.sessionManager.ExecCgroup(claims.UserID, s.cfg.LimitsFor(claims.Username)); err != nil {
+		log.Printf("exec error: %v", err)
+		closeStream(conn, websocket.CloseInternalServerErr, "failed to start command")
+		return
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	log.Printf("user %s exec stream: %s %q", claims.Username, req.Command, req.Args)
+	start := time.Now()
+	cmd, err := s.startExec(ctx, spec, execTimeout(&req),
+		&frameWriter{conn: conn, frame: FrameStdout},
+		&frameWriter{conn: conn, frame: FrameStderr})
+	if err != nil {
+		log.Printf("exec start error: %v", err)
+		closeStream(conn, websocket.CloseInternalServerErr, "failed to start command")
+		return
+	}
+	stdin := cmd.stdin
+
+	// WebSocket -> stdin. The command is killed if the client goes away.
+	go func() {
+		defer stdin.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				stop()
+				return
+			}
+			if messageType != websocket.BinaryMessage || len(data) < 1 || data[0] != FrameStdin {
+				continue
+			}
+			if len(data) == 1 {
+				stdin.Close()
+				continue
+			}
+			if _, err := stdin.Write(data[1:]); err != nil {
+				continue // Command closed its stdin; keep watching for disconnect
+			}
+		}
+	}()
+
+	code := cmd.wait()
+	log.Printf("user %s exec stream finished: %s (exit %d, %.1fs)", claims.Username, req.Command, code, time.Since(start).Seconds())
+
+	exitFrame := make([]byte, 5)
+	exitFrame[0] = FrameExit
+	binary.BigEndian.PutUint32(exitFrame[1:], uint32(int32(code)))
+	conn.WriteMessage(websocket.BinaryMessage, exitFrame)
+
+	reason := ""
+	if cmd.timedOut.Load() {
+		reason = "timeout"
+	}
+	closeStream(conn, websocket.CloseNormalClosure, reason)
+}
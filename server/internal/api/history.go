@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/pty"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+type eventsResponse struct {
+	Events []pty.CommandEvent `json:"events"`
+}
+
+// handleSessionEvents returns a session's command events, oldest first
+func (s *Server) handleSessionEvents(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, ok := s.sessionManager.Get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if allowed, _ := session.Access(claims.UserID); !allowed {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	events, err := session.Events()
+	if err != nil {
+		log.Printf("read session events error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []pty.CommandEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(eventsResponse{Events: events})
+}
+
+// handleCommandHistory searches the commands the user ran in any of their
+// sessions, newest first
+func (s *Server) handleCommandHistory(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxHistoryLimit)
+	}
+	commands, err := s.sessionManager.CommandHistory(claims.UserID, r.URL.Query().Get("q"), limit)
+	if err != nil {
+		log.Printf("command history error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if commands == nil {
+		commands = []pty.CommandEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(eventsResponse{Events: commands})
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/pty"
+)
+
+// sessionSignals are the signals clients may send to a session's processes
+var sessionSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGSTOP": syscall.SIGSTOP,
+	"SIGCONT": syscall.SIGCONT,
+}
+
+type processInfo struct {
+	Pid        int      `json:"pid"`
+	PPid       int      `json:"ppid"`
+	Pgid       int      `json:"pgid"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args,omitempty"`
+	State      string   `json:"state"`
+	CPUSeconds float64  `json:"cpuSeconds"`
+	RSSBytes   int64    `json:"rssBytes"`
+	Elapsed    float64  `json:"elapsedSeconds"`
+	Foreground bool     `json:"foreground,omitempty"`
+}
+
+type processesResponse struct {
+	Foreground int           `json:"foreground"` // Process group in the terminal's foreground
+	Processes  []processInfo `json:"processes"`  // The shell first, parents before children
+}
+
+type signalRequest struct {
+	ID     string `json:"id"`
+	Pid    int    `json:"pid,omitempty"` // Omitted for the foreground job
+	Signal string `json:"signal"`        // e.g. "SIGINT" or "INT"
+}
+
+func (s *Server) handleListProcesses(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, ok := s.sessionManager.Get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if allowed, _ := session.Access(claims.UserID); !allowed {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	procs, foreground, err := session.Processes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	resp := processesResponse{Foreground: foreground, Processes: make([]processInfo, len(procs))}
+	now := time.Now()
+	for i, p := range procs {
+		resp.Processes[i] = processInfo{
+			Pid:        p.Pid,
+			PPid:       p.PPid,
+			Pgid:       p.Pgid,
+			Command:    p.Command,
+			Args:       p.Args,
+			State:      p.State,
+			CPUSeconds: p.CPUTime.Seconds(),
+			RSSBytes:   p.RSS,
+			Elapsed:    max(now.Sub(p.Started).Seconds(), 0),
+			Foreground: p.Foreground,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleSignalSession(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req signalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	name := strings.ToUpper(req.Signal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := sessionSignals[name]
+	if !ok {
+		http.Error(w, "unsupported signal", http.StatusBadRequest)
+		return
+	}
+	if req.Pid < 0 {
+		http.Error(w, "invalid pid", http.StatusBadRequest)
+		return
+	}
+
+	session, ok := s.sessionManager.Get(req.ID)
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	allowed, readOnly := session.Access(claims.UserID)
+	if !allowed {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if readOnly {
+		http.Error(w, "read-only access", http.StatusForbidden)
+		return
+	}
+
+	if err := session.Signal(req.Pid, sig); err != nil {
+		if errors.Is(err, pty.ErrNoSuchProcess) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("signal session error: %v", err)
+		http.Error(w, "failed to send signal", http.StatusInternalServerError)
+		return
+	}
+
+	target := "foreground job"
+	if req.Pid != 0 {
+		target = "pid " + strconv.Itoa(req.Pid)
+	}
+	log.Printf("user %s sent %s to %s of session %s", claims.Username, name, target, session.ID)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/eddison/sshttp/server/internal/auth"
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/pty"
+)
+
+var (
+	envNameRegex  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	termNameRegex = regexp.MustCompile(`^[a-zA-Z0-9.+_\-]+$`)
+)
+
+// launchProfile is a named recipe for new sessions. Each user has their own.
+type launchProfile struct {
+	Name    string            `json:"name"`
+	Command string            `json:"command,omitempty"` // Empty runs the login shell
+	Args    []string          `json:"args,omitempty"`
+	Dir     string            `json:"dir,omitempty"` // Absolute or ~/relative, empty for the home directory
+	Env     map[string]string `json:"env,omitempty"`
+	Term    string            `json:"term,omitempty"`
+	Startup string            `json:"startup,omitempty"` // Typed into the session once started
+	Sandbox string            `json:"sandbox,omitempty"` // Configured sandbox to start in
+}
+
+type listProfilesResponse struct {
+	Profiles []launchProfile `json:"profiles"`
+}
+
+type deleteProfileRequest struct {
+	Name string `json:"name"`
+}
+
+func (s *Server) getProfilesFile(userID string) string {
+	return filepath.Join(s.cfg.DataDir, "profiles", userID+".json")
+}
+
+func (s *Server) loadProfiles(userID string) ([]launchProfile, error) {
+	data, err := os.ReadFile(s.getProfilesFile(userID))
+	if os.IsNotExist(err) && !s.cfg.MultiUser {
+		// Profiles from before they were per user, when there is one user
+		data, err = os.ReadFile(filepath.Join(s.cfg.DataDir, "profiles.json"))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []launchProfile{}, nil
+		}
+		return nil, err
+	}
+	var profiles []launchProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func (s *Server) saveProfiles(userID string, profiles []launchProfile) error {
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := s.getProfilesFile(userID)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (s *Server) getProfile(userID, name string) (*launchProfile, error) {
+	profiles, err := s.loadProfiles(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return &profiles[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func validateDir(dir string) error {
+	if dir != "" && !filepath.IsAbs(dir) && dir != "~" && !strings.HasPrefix(dir, "~/") {
+		return fmt.Errorf("dir must be absolute or start with ~/")
+	}
+	return nil
+}
+
+func validateEnv(env map[string]string) error {
+	for k, v := range env {
+		if !envNameRegex.MatchString(k) {
+			return fmt.Errorf("invalid env name %q", k)
+		}
+		if strings.ContainsRune(v, 0) {
+			return fmt.Errorf("invalid env value for %s", k)
+		}
+	}
+	return nil
+}
+
+func validateProfile(p *launchProfile) error {
+	if p.Name == "" || !safeNameRegex.MatchString(p.Name) {
+		return fmt.Errorf("invalid profile name")
+	}
+	if p.Command == "" && len(p.Args) > 0 {
+		return fmt.Errorf("args require a command")
+	}
+	if p.Term != "" && !termNameRegex.MatchString(p.Term) {
+		return fmt.Errorf("invalid term")
+	}
+	if err := validateDir(p.Dir); err != nil {
+		return err
+	}
+	return validateEnv(p.Env)
+}
+
+// checkProfileSandbox rejects a profile sandbox other than the one the
+// user is confined to
+func (s *Server) checkProfileSandbox(claims *auth.Claims, name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := s.cfg.Sandboxes[name]; !ok {
+		return fmt.Errorf("sandbox %q is not configured", name)
+	}
+	if confined := s.cfg.SandboxFor(claims.Username); confined != "" && confined != name {
+		return fmt.Errorf("sandbox %q is not available", name)
+	}
+	return nil
+}
+
+// sessionOptions resolves a create request, applying the user's launch
+// profile and then the request's own overrides
+func (s *Server) sessionOptions(claims *auth.Claims, req *createSessionRequest) (pty.SessionOptions, error) {
+	opts := pty.SessionOptions{
+		Name:           req.Name,
+		ScrollbackSize: req.ScrollbackSize,
+		Tmux:           req.Tmux,
+	}
+	if err := validateDir(req.Dir); err != nil {
+		return opts, err
+	}
+	if err := validateEnv(req.Env); err != nil {
+		return opts, err
+	}
+
+	env := make(map[string]string)
+	if req.Profile != "" {
+		profile, err := s.getProfile(claims.UserID, req.Profile)
+		if err != nil {
+			return opts, fmt.Errorf("load profiles: %w", err)
+		}
+		if profile == nil {
+			return opts, fmt.Errorf("profile %q not found", req.Profile)
+		}
+		opts.Profile = profile.Name
+		opts.Command = profile.Command
+		opts.Args = profile.Args
+		opts.Dir = profile.Dir
+		opts.Term = profile.Term
+		opts.Startup = profile.Startup
+		if err := s.checkProfileSandbox(claims, profile.Sandbox); err != nil {
+			return opts, err
+		}
+		opts.Sandbox = s.cfg.Sandboxes[profile.Sandbox]
+		if opts.Name == "" {
+			opts.Name = profile.Name
+		}
+		for k, v := range profile.Env {
+			env[k] = v
+		}
+	}
+
+	if req.Dir != "" {
+		opts.Dir = req.Dir
+	}
+	for k, v := range req.Env {
+		env[k] = v
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		opts.Env = append(opts.Env, k+"="+env[k])
+	}
+	return opts, nil
+}
+
+func (s *Server) handleListProfiles(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	profiles, err := s.loadProfiles(claims.UserID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listProfilesResponse{Profiles: profiles})
+}
+
+func (s *Server) handleSaveProfile(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var profile launchProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := validateProfile(&profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkProfileSandbox(claims, profile.Sandbox); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.profilesMu.Lock()
+	defer s.profilesMu.Unlock()
+
+	profiles, err := s.loadProfiles(claims.UserID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	replaced := false
+	for i := range profiles {
+		if profiles[i].Name == profile.Name {
+			profiles[i] = profile
+			replaced = true
+		}
+	}
+	if !replaced {
+		profiles = append(profiles, profile)
+	}
+	if err := s.saveProfiles(claims.UserID, profiles); err != nil {
+		http.Error(w, "failed to save profile", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("user %s saved launch profile %q", claims.Username, profile.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req deleteProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	s.profilesMu.Lock()
+	defer s.profilesMu.Unlock()
+
+	profiles, err := s.loadProfiles(claims.UserID)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	kept := profiles[:0]
+	for _, p := range profiles {
+		if p.Name != req.Name {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(profiles) {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+	if err := s.saveProfiles(claims.UserID, kept); err != nil {
+		http.Error(w, "failed to delete profile", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("user %s deleted launch profile %q", claims.Username, req.Name)
+	w.WriteHeader(http.StatusOK)
+}
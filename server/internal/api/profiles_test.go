@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/eddison/sshttp/server/internal/config"
+)
+
+func TestProfilesPerUser(t *testing.T) {
+	alice := newTestServer(t)
+	bob := alice.as(t, "u2", "bob")
+
+	if status, resp := alice.do(t, "POST", "/v1/shell/profiles/save", `{"name":"logs","command":"tail","args":["-f","/var/log/syslog"]}`); status != http.StatusOK {
+		t.Fatalf("save: %d %s", status, resp)
+	}
+	if _, resp := alice.do(t, "GET", "/v1/shell/profiles", ""); !strings.Contains(resp, `"name":"logs"`) {
+		t.Fatalf("alice's profiles = %s, want logs", resp)
+	}
+
+	// Bob neither sees, runs, replaces nor deletes alice's profile
+	if _, resp := bob.do(t, "GET", "/v1/shell/profiles", ""); !strings.Contains(resp, `"profiles":[]`) {
+		t.Fatalf("bob's profiles = %s, want none", resp)
+	}
+	if status, _ := bob.do(t, "POST", "/v1/shell/sessions", `{"profile":"logs"}`); status != http.StatusBadRequest {
+		t.Fatalf("session from another user's profile: got %d, want %d", status, http.StatusBadRequest)
+	}
+	if status, _ := bob.do(t, "POST", "/v1/shell/profiles/delete", `{"name":"logs"}`); status != http.StatusNotFound {
+		t.Fatalf("delete another user's profile: got %d, want %d", status, http.StatusNotFound)
+	}
+	if status, resp := bob.do(t, "POST", "/v1/shell/profiles/save", `{"name":"logs","command":"sh"}`); status != http.StatusOK {
+		t.Fatalf("save: %d %s", status, resp)
+	}
+	if _, resp := alice.do(t, "GET", "/v1/shell/profiles", ""); !strings.Contains(resp, `"command":"tail"`) {
+		t.Fatalf("alice's profiles = %s, want hers unchanged", resp)
+	}
+}
+
+func TestProfileSandboxConfined(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.Sandboxes["open"] = &config.Sandbox{Name: "open"}
+	ts.cfg.Sandboxes["scratch"] = &config.Sandbox{Name: "scratch"}
+	if status, resp := ts.do(t, "POST", "/v1/shell/profiles/save", `{"name":"open","sandbox":"open"}`); status != http.StatusOK {
+		t.Fatalf("save: %d %s", status, resp)
+	}
+
+	// Once alice is confined, profiles may only name her sandbox
+	ts.cfg.UserSandboxes["alice"] = "scratch"
+	if status, _ := ts.do(t, "POST", "/v1/shell/sessions", `{"profile":"open"}`); status != http.StatusBadRequest {
+		t.Fatalf("session from a profile with another sandbox: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	if status, _ := ts.do(t, "POST", "/v1/shell/profiles/save", `{"name":"escape","sandbox":"open"}`); status != http.StatusBadRequest {
+		t.Fatalf("save with another sandbox: got %d, want %d", status, http.StatusBadRequest)
+	}
+	if status, resp := ts.do(t, "POST", "/v1/shell/profiles/save", `{"name":"scratch","sandbox":"scratch"}`); status != http.StatusOK {
+		t.Fatalf("save with own sandbox: %d %s", status, resp)
+	}
+}
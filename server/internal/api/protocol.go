@@ -0,0 +1,179 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stream protocol versions. Version 1 is the first with a HELLO; clients
+// that don't send one ask for features with query parameters instead.
+const (
+	ProtocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// Features a shell stream client can ask for in its HELLO
+const (
+	FeatureOffsets     = "offsets"     // STDOUT frames carry the output offset
+	FeatureResume      = "resume"      // Send the output missed since resumeFrom instead of a redraw
+	FeatureFlowControl = "flowControl" // The client acknowledges output with ACK frames
+	FeatureRTT         = "rtt"         // RTT frames with the round trip time of each ping
+	FeatureUploads     = "uploads"     // Resumable uploads with 64-bit sizes and checksums
+)
+
+// Close codes, from the range reserved for applications. The code tells
+// clients what went wrong; the reason is for people.
+const (
+	CloseInvalidRequest     = 4000 // Missing or invalid parameter or HELLO
+	CloseUnsupportedVersion = 4001 // The client's protocol version is too old
+	CloseProtocolError      = 4002 // A frame that is not allowed at this point
+	CloseForbidden          = 4003 // Not available to this user
+	CloseNotFound           = 4004 // No such session, or no access to it
+	CloseSessionClosed      = 4010 // The session is closing
+)
+
+// shellFrames are the frame types of the shell stream
+var shellFrames = []byte{
+	FrameStdin, FrameStdout, FrameResize, FrameExit, FrameEvent, FrameAck, FrameHello, FrameRTT,
+	FrameFileStart, FrameFileChunk, FrameFileAck, FrameFileEnd,
+}
+
+// closeStream closes a WebSocket stream with a close code and reason
+func closeStream(conn *safeConn, code int, reason string) {
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+// clientHello is the HELLO a client opens a shell stream with: the
+// protocol version it speaks and the features it wants
+type clientHello struct {
+	Version    int      `json:"version"`
+	Features   []string `json:"features"`
+	Window     int      `json:"window,omitempty"`     // With flowControl
+	ResumeFrom *uint64  `json:"resumeFrom,omitempty"` // With resume
+}
+
+// serverHello answers a client's HELLO with the protocol version and
+// features the stream uses, and the server's limits
+type serverHello struct {
+	Version       int      `json:"version"`
+	Features      []string `json:"features"`
+	Frames        []int    `json:"frames"`
+	Compression   bool     `json:"compression"` // permessage-deflate was negotiated
+	ReadOnly      bool     `json:"readOnly"`
+	Window        int      `json:"window,omitempty"` // Flow control window granted
+	MinWindow     int      `json:"minWindow"`
+	MaxWindow     int      `json:"maxWindow"`
+	MaxFrameSize  int      `json:"maxFrameSize"` // Of STDOUT data
+	MaxFileSize   int64    `json:"maxFileSize"`  // 0 for no limit
+	FileChunkSize int      `json:"fileChunkSize"`
+	PingInterval  int      `json:"pingInterval"` // Seconds, 0 without pings
+}
+
+// streamOptions are the features a shell stream uses
+type streamOptions struct {
+	offsets    bool
+	window     int // Flow control window, 0 for none
+	resume     bool
+	resumeFrom uint64
+	rtt        bool
+	uploads    bool
+}
+
+// queryStreamOptions reads the options of a client that doesn't send a
+// HELLO from the query parameters
+func queryStreamOptions(q url.Values) (streamOptions, error) {
+	var opts streamOptions
+	// Clients that track the output offset get it with every STDOUT frame,
+	// and can resume from the last one after reconnecting
+	opts.offsets, _ = strconv.ParseBool(q.Get("offsets"))
+	if v := q.Get("resumeFrom"); v != "" {
+		from, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, errors.New("invalid resumeFrom")
+		}
+		opts.resume, opts.resumeFrom, opts.offsets = true, from, true
+	}
+	// Clients that acknowledge output get flow control, so a slow link
+	// throttles the shell instead of queueing its output
+	if v := q.Get("window"); v != "" {
+		window, err := strconv.Atoi(v)
+		if err != nil || window < 1 {
+			return opts, errors.New("invalid window")
+		}
+		opts.window = min(max(window, minOutputWindow), maxOutputWindow)
+	}
+	return opts, nil
+}
+
+// helloStreamOptions reads the options a client asks for in its HELLO.
+// Features the server doesn't know are left out; read-only viewers don't
+// get flow control.
+func helloStreamOptions(hello clientHello, readOnly bool) (streamOptions, error) {
+	var opts streamOptions
+	opts.offsets = slices.Contains(hello.Features, FeatureOffsets)
+	if slices.Contains(hello.Features, FeatureResume) {
+		if hello.ResumeFrom == nil {
+			return opts, errors.New("resume needs resumeFrom")
+		}
+		opts.resume, opts.resumeFrom, opts.offsets = true, *hello.ResumeFrom, true
+	}
+	opts.rtt = slices.Contains(hello.Features, FeatureRTT)
+	opts.uploads = slices.Contains(hello.Features, FeatureUploads)
+	if slices.Contains(hello.Features, FeatureFlowControl) && !readOnly {
+		if hello.Window < 0 {
+			return opts, errors.New("invalid window")
+		}
+		opts.window = defaultOutputWindow
+		if hello.Window > 0 {
+			opts.window = min(max(hello.Window, minOutputWindow), maxOutputWindow)
+		}
+	}
+	return opts, nil
+}
+
+// features lists the features the options turn on
+func (o streamOptions) features() []string {
+	features := []string{}
+	if o.offsets {
+		features = append(features, FeatureOffsets)
+	}
+	if o.resume {
+		features = append(features, FeatureResume)
+	}
+	if o.window > 0 {
+		features = append(features, FeatureFlowControl)
+	}
+	if o.rtt {
+		features = append(features, FeatureRTT)
+	}
+	if o.uploads {
+		features = append(features, FeatureUploads)
+	}
+	return features
+}
+
+// hello builds the answer to a client's HELLO
+func (o streamOptions) hello(compression, readOnly bool, pingSecs int, maxFileSize int64) serverHello {
+	frames := make([]int, len(shellFrames))
+	for i, frame := range shellFrames {
+		frames[i] = int(frame)
+	}
+	return serverHello{
+		Version:       ProtocolVersion,
+		Features:      o.features(),
+		Frames:        frames,
+		Compression:   compression,
+		ReadOnly:      readOnly,
+		Window:        o.window,
+		MinWindow:     minOutputWindow,
+		MaxWindow:     maxOutputWindow,
+		MaxFrameSize:  maxOutputFrame,
+		MaxFileSize:   maxFileSize,
+		FileChunkSize: FileChunkSize,
+		PingInterval:  pingSecs,
+	}
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/recording"
+	"github.com/gorilla/websocket"
+)
+
+var recordingIDRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// Replay speed limits
+const (
+	minReplaySpeed = 0.1
+	maxReplaySpeed = 64
+)
+
+type recordingInfo struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	StartedAt time.Time `json:"startedAt"`
+	Size      int64     `json:"size"`
+	Active    bool      `json:"active"` // Session is still running and recording
+}
+
+type listRecordingsResponse struct {
+	Recordings []recordingInfo `json:"recordings"`
+}
+
+func (s *Server) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	infos, err := recording.List(s.sessionManager.RecordingsDir(claims.UserID))
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := listRecordingsResponse{Recordings: make([]recordingInfo, len(infos))}
+	for i, info := range infos {
+		_, active := s.sessionManager.Get(info.ID)
+		resp.Recordings[i] = recordingInfo{
+			ID:        info.ID,
+			Title:     info.Title,
+			StartedAt: info.StartedAt,
+			Size:      info.Size,
+			Active:    active,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// recordingPath validates a recording ID from the request and returns the
+// path of the caller's recording
+func (s *Server) recordingPath(w http.ResponseWriter, r *http.Request, userID string) (string, bool) {
+	id := r.URL.Query().Get("id")
+	if id == "" || !recordingIDRegex.MatchString(id) {
+		http.Error(w, "invalid recording id", http.StatusBadRequest)
+		return "", false
+	}
+	path := s.sessionManager.RecordingPath(userID, id)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return "", false
+	}
+	return path, true
+}
+
+func (s *Server) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path, ok := s.recordingPath(w, r, claims.UserID)
+	if !ok {
+		return
+	}
+
+	log.Printf("user %s downloaded recording %s", claims.Username, r.URL.Query().Get("id"))
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+r.URL.Query().Get("id")+`.cast"`)
+	http.ServeFile(w, r, path)
+}
+
+// replayResizeFrame is the RESIZE frame a replay sends for a terminal size
+func replayResizeFrame(cols, rows int) []byte {
+	frame := []byte{FrameResize}
+	frame = binary.BigEndian.AppendUint16(frame, uint16(min(cols, math.MaxUint16)))
+	return binary.BigEndian.AppendUint16(frame, uint16(min(rows, math.MaxUint16)))
+}
+
+func (s *Server) handleReplayRecording(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path, ok := s.recordingPath(w, r, claims.UserID)
+	if !ok {
+		return
+	}
+
+	speed := 1.0
+	if v, err := strconv.ParseFloat(r.URL.Query().Get("speed"), 64); err == nil {
+		speed = min(max(v, minReplaySpeed), maxReplaySpeed)
+	}
+	var maxIdle time.Duration
+	if v, err := strconv.ParseFloat(r.URL.Query().Get("maxIdle"), 64); err == nil && v > 0 {
+		maxIdle = time.Duration(v * float64(time.Second))
+	}
+
+	upgrader := s.newUpgrader()
+	wsConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("websocket upgrade error: %v", err)
+		return
+	}
+	conn := &safeConn{Conn: wsConn}
+	defer conn.Close()
+
+	log.Printf("user %s replaying recording %s (speed %.1fx)", claims.Username, r.URL.Query().Get("id"), speed)
+
+	// Stop playback when the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Replay uses the shell stream frames so the terminal view can render
+	// it, with RESIZE frames for the recorded size and its changes
+	if header, err := recording.ReadHeader(path); err == nil && header.Width > 0 && header.Height > 0 {
+		conn.WriteMessage(websocket.BinaryMessage, replayResizeFrame(header.Width, header.Height))
+	}
+	err = recording.Play(ctx, path, speed, maxIdle, func(ev recording.Event) error {
+		switch ev.Code {
+		case "o":
+			frame := make([]byte, 1+len(ev.Data))
+			frame[0] = FrameStdout
+			copy(frame[1:], ev.Data)
+			return conn.WriteMessage(websocket.BinaryMessage, frame)
+		case "r":
+			var cols, rows int
+			if _, err := fmt.Sscanf(ev.Data, "%dx%d", &cols, &rows); err != nil || cols <= 0 || rows <= 0 {
+				return nil
+			}
+			return conn.WriteMessage(websocket.BinaryMessage, replayResizeFrame(cols, rows))
+		}
+		return nil
+	})
+	if err != nil {
+		if err != context.Canceled {
+			log.Printf("replay error: %v", err)
+		}
+		return
+	}
+
+	conn.WriteMessage(websocket.BinaryMessage, []byte{FrameExit, 0, 0, 0, 0})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eddison/sshttp/server/internal/recording"
+	"github.com/gorilla/websocket"
+)
+
+func TestReplayRecording(t *testing.T) {
+	ts := newTestServer(t)
+	rec, err := recording.Create(filepath.Join(ts.cfg.DataDir, "recordings", "u1", "sess-1.cast"), "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Output([]byte("before\r\n"))
+	rec.Resize(120, 40)
+	rec.Output([]byte("after\r\n"))
+	rec.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/recordings/replay?id=sess-1&speed=64&token=" + ts.token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The size is set before the output it applies to
+	var frames [][]byte
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] == FrameExit {
+			break
+		}
+		frames = append(frames, data)
+	}
+	want := [][]byte{
+		append([]byte{FrameResize}, resizeFrame(80, 24)...),
+		append([]byte{FrameStdout}, "before\r\n"...),
+		append([]byte{FrameResize}, resizeFrame(120, 40)...),
+		append([]byte{FrameStdout}, "after\r\n"...),
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("frames = %q, want %q", frames, want)
+	}
+	for i := range want {
+		if !bytes.Equal(frames[i], want[i]) {
+			t.Fatalf("frame %d = %q, want %q", i, frames[i], want[i])
+		}
+	}
+}
@@ -1,17 +1,20 @@
 package api
 
 import (
+	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eddison/sshttp/server/internal/auth"
 	"github.com/eddison/sshttp/server/internal/config"
 	"github.com/eddison/sshttp/server/internal/mds"
 	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/privsep"
 	"github.com/eddison/sshttp/server/internal/pty"
 	"github.com/eddison/sshttp/server/internal/store"
 	"github.com/go-chi/chi/v5"
@@ -26,9 +29,11 @@ type Server struct {
 	mds            *mds.Client
 	rateLimiter    *middleware.RateLimiter
 	embeddedFS     fs.FS
+	profilesMu     sync.Mutex // Serializes updates to profiles/
+	starter        privsep.Starter
 }
 
-func NewServer(cfg *config.Config, s store.Store, wa *auth.WebAuthnHandler, tm *auth.TokenManager, sm *pty.SessionManager, mdsClient *mds.Client) *Server {
+func NewServer(cfg *config.Config, s store.Store, wa *auth.WebAuthnHandler, tm *auth.TokenManager, sm *pty.SessionManager, mdsClient *mds.Client, starter privsep.Starter) *Server {
 	return &Server{
 		cfg:            cfg,
 		store:          s,
@@ -37,6 +42,7 @@ func NewServer(cfg *config.Config, s store.Store, wa *auth.WebAuthnHandler, tm *
 		sessionManager: sm,
 		mds:            mdsClient,
 		rateLimiter:    middleware.NewRateLimiter(10, time.Minute),
+		starter:        starter,
 	}
 }
 
@@ -45,6 +51,29 @@ func (s *Server) SetEmbeddedFS(fsys fs.FS) {
 	s.embeddedFS = fsys
 }
 
+// account returns the Unix account a user's processes run as. In
+// multi_user mode sshttp users map to the Unix account of the same name.
+func (s *Server) account(claims *auth.Claims) (*privsep.Account, error) {
+	if !s.cfg.MultiUser {
+		return privsep.CurrentAccount()
+	}
+	return privsep.LookupAccount(claims.Username)
+}
+
+// sandbox returns the sandbox a user's process starts in: the one the user
+// is confined to, if any, otherwise the requested one
+func (s *Server) sandbox(claims *auth.Claims, requested *config.Sandbox) (*config.Sandbox, error) {
+	name := s.cfg.SandboxFor(claims.Username)
+	if name == "" {
+		return requested, nil
+	}
+	sb, ok := s.cfg.Sandboxes[name]
+	if !ok {
+		return nil, fmt.Errorf("sandbox %q for %s is not configured", name, claims.Username)
+	}
+	return sb, nil
+}
+
 func (s *Server) Router() http.Handler {
 	r := chi.NewRouter()
 
@@ -78,9 +107,39 @@ func (s *Server) Router() http.Handler {
 			r.Post("/sessions", s.handleCreateSession)
 			r.Post("/sessions/rename", s.handleRenameSession)
 			r.Post("/sessions/delete", s.handleDeleteSession)
+			r.Post("/sessions/share", s.handleShareSession)
+			r.Post("/sessions/unshare", s.handleUnshareSession)
+			r.Get("/sessions/scrollback", s.handleGetScrollback)
+			r.Get("/sessions/processes", s.handleListProcesses)
+			r.Post("/sessions/signal", s.handleSignalSession)
+			r.Get("/sessions/events", s.handleSessionEvents)
+			r.Get("/sessions/search", s.handleSearchSession)
+			r.Get("/sessions/download", s.handleDownloadFile)
+			r.Get("/search", s.handleSearchOutput)
+			r.Get("/history", s.handleCommandHistory)
+			r.Get("/profiles", s.handleListProfiles)
+			r.Post("/profiles/save", s.handleSaveProfile)
+			r.Post("/profiles/delete", s.handleDeleteProfile)
+			r.Get("/targets", s.handleListTargets)
+			r.Get("/containers", s.handleListContainers)
 			r.Get("/stream", s.handleShellStream)
 		})
 
+		// Command execution without a PTY (protected)
+		r.Route("/exec", func(r chi.Router) {
+			r.Use(middleware.Auth(s.tokenManager))
+			r.Post("/", s.handleExec)
+			r.Get("/stream", s.handleExecStream)
+		})
+
+		// Session recordings (protected)
+		r.Route("/recordings", func(r chi.Router) {
+			r.Use(middleware.Auth(s.tokenManager))
+			r.Get("/", s.handleListRecordings)
+			r.Get("/get", s.handleGetRecording)
+			r.Get("/replay", s.handleReplayRecording)
+		})
+
 		// Settings (protected)
 		r.Route("/settings", func(r chi.Router) {
 			r.Use(middleware.Auth(s.tokenManager))
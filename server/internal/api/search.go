@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/pty"
+	"github.com/eddison/sshttp/server/internal/recording"
+	"github.com/eddison/sshttp/server/internal/search"
+)
+
+const (
+	defaultSearchLimit   = 100
+	maxSearchLimit       = 1000
+	defaultSearchContext = 2
+	maxSearchContext     = 10
+	maxSearchQuery       = 256
+)
+
+type searchMatch struct {
+	Session string   `json:"session"`
+	Source  string   `json:"source"` // "scrollback" or "recording"
+	Offset  uint64   `json:"offset"`
+	Time    *float64 `json:"time,omitempty"` // Seconds into the recording
+	Line    string   `json:"line"`
+	Column  int      `json:"column"`
+	Before  []string `json:"before,omitempty"`
+	After   []string `json:"after,omitempty"`
+}
+
+type searchResponse struct {
+	Matches   []searchMatch `json:"matches"`
+	Truncated bool          `json:"truncated"` // More matches than the limit
+}
+
+// outputSearch collects matches across sessions up to a limit
+type outputSearch struct {
+	query   string
+	context int
+	limit   int
+	resp    searchResponse
+}
+
+// parseSearch reads the q, context and limit parameters
+func parseSearch(w http.ResponseWriter, r *http.Request) (*outputSearch, bool) {
+	q := r.URL.Query().Get("q")
+	if q == "" || len(q) > maxSearchQuery {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return nil, false
+	}
+	o := &outputSearch{query: q, context: defaultSearchContext, limit: defaultSearchLimit}
+	if v, err := strconv.Atoi(r.URL.Query().Get("context")); err == nil && v >= 0 {
+		o.context = min(v, maxSearchContext)
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		o.limit = min(v, maxSearchLimit)
+	}
+	o.resp.Matches = []searchMatch{}
+	return o, true
+}
+
+// searcher returns a searcher for the matches still wanted and one more,
+// which tells whether there are more than the limit, or nil once that is
+// known
+func (o *outputSearch) searcher() *search.Searcher {
+	if o.resp.Truncated {
+		return nil
+	}
+	return search.New(o.query, o.context, o.limit-len(o.resp.Matches)+1)
+}
+
+func (o *outputSearch) add(sessionID, source string, sr *search.Searcher) {
+	matches := sr.Matches()
+	if remaining := o.limit - len(o.resp.Matches); len(matches) > remaining {
+		matches = matches[:remaining]
+		o.resp.Truncated = true
+	}
+	for _, m := range matches {
+		match := searchMatch{
+			Session: sessionID,
+			Source:  source,
+			Offset:  m.Offset,
+			Line:    m.Line,
+			Column:  m.Column,
+			Before:  m.Before,
+			After:   m.After,
+		}
+		if source == "recording" {
+			match.Time = &m.Time
+		}
+		o.resp.Matches = append(o.resp.Matches, match)
+	}
+}
+
+// session searches a session's recording, if it has one, for output that
+// is no longer retained, then its scrollback if it is still running.
+// Recording offsets count recorded output, which misses output from while
+// the daemon was down.
+func (o *outputSearch) session(id string, session *pty.Session, recordingPath string) {
+	until := uint64(0)
+	if session != nil {
+		until = session.ScrollbackStart()
+	}
+	if session == nil || until > 0 {
+		if _, err := os.Stat(recordingPath); err == nil {
+			if sr := o.searcher(); sr != nil && recording.Search(recordingPath, sr, until) == nil {
+				o.add(id, "recording", sr)
+			}
+		}
+	}
+	if session != nil {
+		if sr := o.searcher(); sr != nil {
+			session.Search(sr)
+			o.add(id, "scrollback", sr)
+		}
+	}
+}
+
+func (s *Server) handleSearchSession(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if !recordingIDRegex.MatchString(id) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	query, ok := parseSearch(w, r)
+	if !ok {
+		return
+	}
+
+	// Sessions that are gone can still be searched through their recording
+	ownerID := claims.UserID
+	session, live := s.sessionManager.Get(id)
+	if live {
+		if allowed, _ := session.Access(claims.UserID); !allowed {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		ownerID = session.UserID
+	} else if _, err := os.Stat(s.sessionManager.RecordingPath(ownerID, id)); err != nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	query.session(id, session, s.sessionManager.RecordingPath(ownerID, id))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(query.resp)
+}
+
+// handleSearchOutput searches every running session the user can access,
+// then the recordings of their sessions that are gone, newest first
+func (s *Server) handleSearchOutput(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query, ok := parseSearch(w, r)
+	if !ok {
+		return
+	}
+
+	for _, info := range s.sessionManager.ListUserSessions(claims.UserID) {
+		session, ok := s.sessionManager.Get(info.ID)
+		if !ok {
+			continue
+		}
+		query.session(info.ID, session, s.sessionManager.RecordingPath(info.UserID, info.ID))
+	}
+	recordings, _ := recording.List(s.sessionManager.RecordingsDir(claims.UserID))
+	for _, info := range recordings {
+		if _, live := s.sessionManager.Get(info.ID); !live {
+			query.session(info.ID, nil, s.sessionManager.RecordingPath(claims.UserID, info.ID))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(query.resp)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/eddison/sshttp/server/internal/recording"
+)
+
+func TestSearchTruncated(t *testing.T) {
+	ts := newTestServer(t)
+	// Recordings of closed sessions, with two matches and one
+	for id, output := range map[string]string{
+		"sess-1": "match 1\r\nmatch 2\r\n",
+		"sess-2": "other\r\nmatch 3\r\n",
+	} {
+		rec, err := recording.Create(filepath.Join(ts.cfg.DataDir, "recordings", "u1", id+".cast"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Output([]byte(output))
+		rec.Close()
+	}
+
+	tests := []struct {
+		path      string
+		matches   int
+		truncated bool
+	}{
+		{"/v1/shell/sessions/search?id=sess-1&q=match&limit=1", 1, true},
+		{"/v1/shell/sessions/search?id=sess-1&q=match&limit=2", 2, false},
+		{"/v1/shell/sessions/search?id=sess-1&q=match&limit=3", 2, false},
+		{"/v1/shell/search?q=match&limit=2", 2, true},
+		{"/v1/shell/search?q=match&limit=3", 3, false},
+		{"/v1/shell/search?q=other&limit=1", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			status, body := ts.do(t, "GET", tt.path, "")
+			if status != http.StatusOK {
+				t.Fatalf("search: %d %s", status, body)
+			}
+			var resp searchResponse
+			if err := json.Unmarshal([]byte(body), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Matches) != tt.matches || resp.Truncated != tt.truncated {
+				t.Errorf("%d matches, truncated %v; want %d, %v", len(resp.Matches), resp.Truncated, tt.matches, tt.truncated)
+			}
+		})
+	}
+}
@@ -1,17 +1,25 @@
 package api
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/eddison/sshttp/server/internal/auth"
 	"github.com/eddison/sshttp/server/internal/middleware"
+	"github.com/eddison/sshttp/server/internal/privsep"
+	"github.com/eddison/sshttp/server/internal/pty"
+	"github.com/eddison/sshttp/server/internal/transfer"
 	"github.com/gorilla/websocket"
 )
 
@@ -19,11 +27,17 @@ import (
 const (
 	FrameStdin     byte = 0x01
 	FrameStdout    byte = 0x02
+	FrameStderr    byte = 0x03 // Exec only
 	FrameResize    byte = 0x04
 	FrameExit      byte = 0x05
+	FrameEvent     byte = 0x06 // JSON command event, from shell integration
+	FrameAck       byte = 0x07 // Output bytes processed, with flow control
+	FrameHello     byte = 0x08 // JSON handshake, see protocol.go
+	FrameRTT       byte = 0x09 // Measured round trip time, with the rtt feature
 	FrameFileStart byte = 0x10
 	FrameFileChunk byte = 0x11
 	FrameFileAck   byte = 0x12
+	FrameFileEnd   byte = 0x13 // Checksum after the last chunk, with the uploads feature
 )
 
 // File ACK status codes
@@ -33,22 +47,63 @@ const (
 	FileAckError    byte = 0x02
 )
 
-// File transfer limits
+// FileChunkSize is the size of the FILE_CHUNK frames clients should send
+const FileChunkSize = 256 * 1024
+
+// Scrollback page sizes
+const (
+	defaultScrollbackPage = 64 * 1024
+	maxScrollbackPage     = 1024 * 1024
+)
+
+// Screen redraw on attach
+const (
+	defaultRedrawHistory = 1000            // Scrollback lines sent with the screen
+	redrawDelay          = 2 * time.Second // Wait this long for the first resize
+)
+
+// Output coalescing: while output streams in, it is batched for up to
+// coalesceDelay into frames of up to maxOutputFrame; output that trickles
+// in, like the echo of a keystroke, is sent right away
+const (
+	coalesceDelay  = 5 * time.Millisecond
+	coalesceMin    = 4 * 1024 // Batches smaller than this don't wait
+	maxOutputFrame = 64 * 1024
+)
+
+// Frames smaller than this are sent uncompressed even when compression was
+// negotiated; deflate gains next to nothing on them
+const minCompressSize = 256
+
+// Flow control windows, in bytes of unacknowledged output
 const (
-	MaxFileSize   = 100 * 1024 * 1024 // 100MB
-	FileChunkSize = 32 * 1024         // 32KB
+	minOutputWindow     = 16 * 1024
+	maxOutputWindow     = 16 * 1024 * 1024
+	defaultOutputWindow = 256 * 1024 // For HELLOs that don't ask for one
 )
 
 // fileTransfer tracks an in-progress file upload
 type fileTransfer struct {
 	name     string
-	size     uint32
-	received uint32
-	file     *os.File
-	path     string
+	size     int64
+	received int64
+	wide     bool // Started with the uploads feature: 64-bit offsets and FILE_END
+	upload   *transfer.Upload
+}
+
+// finishUpload puts a completely received file in place and reports the
+// result to the client
+func finishUpload(conn *safeConn, t *fileTransfer, checksum []byte) {
+	if err := t.upload.Finish(checksum); err != nil {
+		log.Printf("file upload failed: %s: %v", t.upload.Path, err)
+		sendFileAck(conn, FileAckError, err.Error())
+		return
+	}
+	log.Printf("file upload complete: %s", t.upload.Path)
+	sendFileAck(conn, FileAckSuccess, t.name)
 }
 
-// validateFilename checks if a filename is safe for upload
+// validateFilename checks if a filename is safe for an upload or download
 func validateFilename(name string) error {
 	if name == "" {
 		return os.ErrInvalid
@@ -71,8 +126,102 @@ func validateFilename(name string) error {
 	return nil
 }
 
+// safeConn serializes writes to a WebSocket connection, which gorilla
+// only allows from one goroutine at a time
+type safeConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *safeConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Conn.EnableWriteCompression(len(data) >= minCompressSize)
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// outputBatcher merges a viewer's output chunks into fewer, larger frames
+type outputBatcher struct {
+	output <-chan pty.Chunk
+	held   *pty.Chunk // Received but not part of the last batch
+}
+
+// next returns the next item of output: a command event, or output with
+// the chunks queued behind it merged in. When the batch is big enough to
+// suggest output is streaming in, it waits up to coalesceDelay for more.
+func (b *outputBatcher) next() (pty.Chunk, bool) {
+	batch, ok := b.receive()
+	if !ok || batch.Event != nil {
+		return batch, ok
+	}
+	owned := false // batch.Data is shared with other viewers until copied
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for len(batch.Data) < maxOutputFrame {
+		var chunk pty.Chunk
+		select {
+		case chunk, ok = <-b.output:
+		default:
+			if len(batch.Data) < coalesceMin {
+				return batch, true
+			}
+			if timer == nil {
+				timer = time.NewTimer(coalesceDelay)
+			}
+			select {
+			case chunk, ok = <-b.output:
+			case <-timer.C:
+				return batch, true
+			}
+		}
+		if !ok {
+			// Sent before the viewer learns its output ended
+			return batch, true
+		}
+		if chunk.Event != nil || len(batch.Data)+len(chunk.Data) > maxOutputFrame {
+			b.held = &chunk
+			return batch, true
+		}
+		if !owned {
+			batch.Data = append(make([]byte, 0, maxOutputFrame), batch.Data...)
+			owned = true
+		}
+		batch.Data = append(batch.Data, chunk.Data...)
+		batch.Offset = chunk.Offset
+	}
+	return batch, true
+}
+
+func (b *outputBatcher) receive() (pty.Chunk, bool) {
+	if b.held != nil {
+		chunk := *b.held
+		b.held = nil
+		return chunk, true
+	}
+	chunk, ok := <-b.output
+	return chunk, ok
+}
+
+// sendFileProgress acknowledges the data received so far. Clients with
+// the uploads feature get the byte count, which after a FILE_START is where
+// to resume.
+func sendFileProgress(conn *safeConn, t *fileTransfer) error {
+	if !t.wide {
+		return sendFileAck(conn, FileAckProgress, "")
+	}
+	frame := make([]byte, 10)
+	frame[0] = FrameFileAck
+	frame[1] = FileAckProgress
+	binary.BigEndian.PutUint64(frame[2:], uint64(t.received))
+	return conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
 // sendFileAck sends a file acknowledgment frame
-func sendFileAck(conn *websocket.Conn, status byte, message string) error {
+func sendFileAck(conn *safeConn, status byte, message string) error {
 	var frame []byte
 	if message != "" {
 		msgBytes := []byte(message)
@@ -88,8 +237,9 @@ func sendFileAck(conn *websocket.Conn, status byte, message string) error {
 
 func (s *Server) newUpgrader() websocket.Upgrader {
 	return websocket.Upgrader{
-		ReadBufferSize:  32 * 1024,
-		WriteBufferSize: 32 * 1024,
+		ReadBufferSize:    32 * 1024,
+		WriteBufferSize:   32 * 1024,
+		EnableCompression: s.cfg.StreamCompression,
 		CheckOrigin: func(r *http.Request) bool {
 			origin := r.Header.Get("Origin")
 			if origin == "" {
@@ -108,8 +258,26 @@ func (s *Server) newUpgrader() websocket.Upgrader {
 type sessionInfo struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
+	Profile   string    `json:"profile,omitempty"`
+	Sandbox   string    `json:"sandbox,omitempty"`
 	CreatedAt time.Time `json:"createdAt"`
 	Attached  bool      `json:"attached"`
+	Viewers   int       `json:"viewers"`
+	Owner     string    `json:"owner,omitempty"` // Set for sessions shared by another user
+	ReadOnly  bool      `json:"readOnly,omitempty"`
+	Usage     *usage    `json:"usage,omitempty"`  // Set when resource limits are enabled
+	Tmux      string    `json:"tmux,omitempty"`   // tmux session, for tmux windows
+	Target    string    `json:"target,omitempty"` // SSH target the session runs on
+	Container string    `json:"container,omitempty"`
+}
+
+// usage is a session's current resource usage; limits are 0 when unlimited
+type usage struct {
+	MemoryBytes int64 `json:"memoryBytes"`
+	MemoryMax   int64 `json:"memoryMax"`
+	CPUUsec     int64 `json:"cpuUsec"`
+	Pids        int64 `json:"pids"`
+	PidsMax     int64 `json:"pidsMax"`
 }
 
 type listSessionsResponse struct {
@@ -123,14 +291,38 @@ func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.cfg.TmuxSessions {
+		s.syncTmux(claims)
+	}
 	sessions := s.sessionManager.ListUserSessions(claims.UserID)
 	resp := listSessionsResponse{Sessions: make([]sessionInfo, len(sessions))}
 	for i, sess := range sessions {
 		resp.Sessions[i] = sessionInfo{
 			ID:        sess.ID,
 			Name:      sess.Name,
+			Profile:   sess.Profile,
+			Sandbox:   sess.Sandbox,
 			CreatedAt: sess.CreatedAt,
 			Attached:  sess.Attached,
+			Viewers:   sess.Viewers,
+			ReadOnly:  sess.ReadOnly,
+			Tmux:      sess.Tmux,
+			Target:    sess.Target,
+			Container: sess.Container,
+		}
+		if u := sess.Usage; u != nil {
+			resp.Sessions[i].Usage = &usage{
+				MemoryBytes: u.MemoryBytes,
+				MemoryMax:   u.MemoryMax,
+				CPUUsec:     u.CPUUsec,
+				Pids:        u.Pids,
+				PidsMax:     u.PidsMax,
+			}
+		}
+		if sess.Shared {
+			if owner, err := s.store.GetUser(r.Context(), sess.UserID); err == nil && owner != nil {
+				resp.Sessions[i].Owner = owner.Username
+			}
 		}
 	}
 
@@ -138,8 +330,33 @@ func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// syncTmux picks up tmux sessions the user started outside sshttp. Users
+// confined to a sandbox don't get them, tmux runs outside of it.
+func (s *Server) syncTmux(claims *auth.Claims) {
+	if s.cfg.SandboxFor(claims.Username) != "" {
+		return
+	}
+	var account *privsep.Account
+	if s.cfg.MultiUser {
+		var err error
+		if account, err = s.account(claims); err != nil {
+			return
+		}
+	}
+	if err := s.sessionManager.SyncTmux(claims.UserID, account); err != nil {
+		log.Printf("list tmux sessions for user %s: %v", claims.Username, err)
+	}
+}
+
 type createSessionRequest struct {
-	Name string `json:"name,omitempty"`
+	Name           string            `json:"name,omitempty"`
+	Profile        string            `json:"profile,omitempty"`        // Launch profile to start from
+	Dir            string            `json:"dir,omitempty"`            // Overrides the profile's working directory
+	Env            map[string]string `json:"env,omitempty"`            // Added to the profile's environment
+	ScrollbackSize int               `json:"scrollbackSize,omitempty"` // Bytes kept in memory
+	Tmux           string            `json:"tmux,omitempty"`           // Open a window in this tmux session
+	Target         string            `json:"target,omitempty"`         // Open the session on this SSH target
+	Container      string            `json:"container,omitempty"`      // Open the session in this container, by name or ID
 }
 
 type createSessionResponse struct {
@@ -156,6 +373,98 @@ type deleteSessionRequest struct {
 	ID string `json:"id"`
 }
 
+type deleteSessionResponse struct {
+	Terminated int `json:"terminated"` // Processes that had to be terminated
+}
+
+type shareSessionRequest struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+func (s *Server) handleShareSession(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req shareSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session, ok := s.sessionManager.Get(req.ID)
+	if !ok || session.UserID != claims.UserID {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	user, err := s.store.GetUserByUsername(r.Context(), req.Username)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil || user.ID == claims.UserID {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	if err := session.Share(user.ID, req.ReadOnly); err != nil {
+		log.Printf("share session error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("user %s shared session %s with %s (read-only: %v)", claims.Username, session.ID, user.Username, req.ReadOnly)
+	w.WriteHeader(http.StatusOK)
+}
+
+type unshareSessionRequest struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+func (s *Server) handleUnshareSession(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req unshareSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	session, ok := s.sessionManager.Get(req.ID)
+	if !ok || session.UserID != claims.UserID {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	user, err := s.store.GetUserByUsername(r.Context(), req.Username)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	if err := session.Unshare(user.ID); err != nil {
+		log.Printf("unshare session error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
 	claims := middleware.GetClaims(r.Context())
 	if claims == nil {
@@ -175,8 +484,9 @@ func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.sessionManager.Delete(req.ID)
-	w.WriteHeader(http.StatusOK)
+	terminated, _ := s.sessionManager.Delete(req.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deleteSessionResponse{Terminated: terminated})
 }
 
 func (s *Server) handleRenameSession(w http.ResponseWriter, r *http.Request) {
@@ -212,8 +522,59 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	var req createSessionRequest
 	json.NewDecoder(r.Body).Decode(&req) // Ignore errors, name is optional
 
-	session, err := s.sessionManager.CreateNamed(claims.UserID, req.Name)
+	opts, err := s.sessionOptions(claims, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.cfg.MultiUser {
+		if opts.Account, err = s.account(claims); err != nil {
+			log.Printf("create session error: %v", err)
+			http.Error(w, "no unix account for user", http.StatusForbidden)
+			return
+		}
+	}
+	if opts.Sandbox, err = s.sandbox(claims, opts.Sandbox); err != nil {
+		log.Printf("create session error: %v", err)
+		http.Error(w, "sandbox not available", http.StatusForbidden)
+		return
+	}
+	opts.Limits = s.cfg.LimitsFor(claims.Username)
+	if req.Target != "" {
+		target, ok := s.cfg.Targets[req.Target]
+		if !ok || !target.Allows(claims.Username) {
+			http.Error(w, "target not found", http.StatusNotFound)
+			return
+		}
+		opts.Target = target.For(claims.Username)
+	}
+	if req.Container != "" {
+		container, err := s.container(claims, req.Container)
+		if errors.Is(err, pty.ErrContainersDisabled) || (err == nil && container == nil) {
+			http.Error(w, "container not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("list containers error: %v", err)
+			http.Error(w, "failed to list containers", http.StatusBadGateway)
+			return
+		}
+		opts.Container = container
+		opts.ContainerUser = s.cfg.ContainerUserFor(claims.Username)
+	}
+
+	session, err := s.sessionManager.CreateWithOptions(claims.UserID, opts)
 	if err != nil {
+		if errors.Is(err, pty.ErrInvalidOptions) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, pty.ErrTargetUnreachable) {
+			log.Printf("user %s could not open a session on %s: %v", claims.Username, req.Target, err)
+			http.Error(w, "failed to connect to target", http.StatusBadGateway)
+			return
+		}
+		log.Printf("create session error: %v", err)
 		http.Error(w, "failed to create session", http.StatusInternalServerError)
 		return
 	}
@@ -225,6 +586,56 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type scrollbackResponse struct {
+	Offset uint64 `json:"offset"` // Offset of the first byte of data
+	Start  uint64 `json:"start"`  // Oldest offset still available
+	End    uint64 `json:"end"`    // Offset just past the latest output
+	Data   []byte `json:"data"`   // Base64 encoded
+}
+
+// handleGetScrollback returns a page of a session's raw output so clients
+// can lazily load history older than what the redraw on attach includes
+func (s *Server) handleGetScrollback(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, ok := s.sessionManager.Get(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if allowed, _ := session.Access(claims.UserID); !allowed {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	offset := int64(-1) // Latest output
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	limit := defaultScrollbackPage
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxScrollbackPage)
+	}
+
+	page := session.ReadScrollback(offset, limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scrollbackResponse{
+		Offset: page.Offset,
+		Start:  page.Start,
+		End:    page.End,
+		Data:   page.Data,
+	})
+}
+
 func (s *Server) handleShellStream(w http.ResponseWriter, r *http.Request) {
 	claims := middleware.GetClaims(r.Context())
 	if claims == nil {
@@ -234,94 +645,119 @@ func (s *Server) handleShellStream(w http.ResponseWriter, r *http.Request) {
 
 	// Upgrade to WebSocket
 	upgrader := s.newUpgrader()
-	conn, err := upgrader.Upgrade(w, r, nil)
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("websocket upgrade error: %v", err)
 		return
 	}
+	conn := &safeConn{Conn: wsConn}
 	defer conn.Close()
 
 	// Get session ID - required
 	sessionID := r.URL.Query().Get("sessionId")
 	if sessionID == "" {
-		conn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "sessionId required"))
+		closeStream(conn, CloseInvalidRequest, "sessionId required")
 		return
 	}
 
-	// Try to connect to existing session
+	// Try to connect to existing session (own or shared with us)
 	session, ok := s.sessionManager.Get(sessionID)
-	if !ok || session.UserID != claims.UserID {
-		conn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session not found"))
+	if !ok {
+		closeStream(conn, CloseNotFound, "session not found")
+		return
+	}
+	allowed, readOnly := session.Access(claims.UserID)
+	if !allowed {
+		closeStream(conn, CloseNotFound, "session not found")
 		return
 	}
+	// Viewers may also ask for read-only access themselves
+	if ro, err := strconv.ParseBool(r.URL.Query().Get("readOnly")); err == nil && ro {
+		readOnly = true
+	}
 
-	// Channel to signal this connection was kicked by a new one
-	kicked := make(chan struct{})
+	history := defaultRedrawHistory
+	if v, err := strconv.Atoi(r.URL.Query().Get("history")); err == nil && v >= 0 {
+		history = v
+	}
+
+	// Clients that send a HELLO choose their features in it instead
+	opts, err := queryStreamOptions(r.URL.Query())
+	if err != nil {
+		closeStream(conn, CloseInvalidRequest, err.Error())
+		return
+	}
+	compression := s.cfg.StreamCompression &&
+		strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
 
-	if !session.Attach(func() {
-		// Called when a new connection kicks this one out
-		close(kicked)
-	}) {
-		conn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session closed"))
+	viewer, ok := session.Attach(claims.UserID, readOnly)
+	if !ok {
+		closeStream(conn, CloseSessionClosed, "session closed")
 		return
 	}
+	if opts.window > 0 {
+		session.SetWindow(viewer, opts.window)
+	}
 
 	// Track active file transfer
 	var activeTransfer *fileTransfer
 
 	// On disconnect, detach and cleanup
 	defer func() {
-		session.Detach()
+		session.Detach(viewer)
 		// Cleanup incomplete file transfer
-		if activeTransfer != nil && activeTransfer.file != nil {
-			activeTransfer.file.Close()
-			os.Remove(activeTransfer.path)
+		if activeTransfer != nil {
+			activeTransfer.upload.Abort()
 			activeTransfer = nil
 		}
 	}()
 
-	log.Printf("shell session started for user %s (session: %s)", claims.Username, session.ID)
-
-	// Scrollback is sent after the first resize to ensure correct terminal dimensions
-	scrollback := session.Scrollback()
-	scrollbackSent := len(scrollback) == 0 // Mark as sent if empty
-
-	// Channel to signal completion
-	done := make(chan struct{})
-
-	// Handle being kicked by a new connection
-	go func() {
-		select {
-		case <-kicked:
-			log.Printf("connection kicked for user %s (session: %s)", claims.Username, session.ID)
-			conn.WriteMessage(websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "kicked by new connection"))
-			conn.Close()
-		case <-done:
-			// PTY exited normally, nothing to do
+	log.Printf("shell session started for user %s (session: %s, read-only: %v)", claims.Username, session.ID, readOnly)
+
+	// The screen is redrawn after the first resize so it matches the
+	// client's dimensions; clients that never resize get it after a delay.
+	// The options are settled by then: a HELLO has to come first.
+	var startMu sync.Mutex
+	started, helloed := false, false
+	start := func() {
+		startMu.Lock()
+		defer startMu.Unlock()
+		if started {
+			return
 		}
-	}()
+		started = true
+		if !opts.resume {
+			session.Start(viewer, history)
+		} else if !session.Resume(viewer, opts.resumeFrom, history) {
+			log.Printf("session %s: output since %d is gone, redrawing", session.ID, opts.resumeFrom)
+		}
+	}
+	startTimer := time.AfterFunc(redrawDelay, start)
+	defer startTimer.Stop()
 
-	// Read from PTY, write to WebSocket
+	// Session output -> WebSocket
+	outputDone := make(chan struct{})
 	go func() {
-		defer close(done)
-		buf := make([]byte, 32*1024) // 32KB buffer
+		defer close(outputDone)
+		batcher := &outputBatcher{output: viewer.Output()}
+		// WriteMessage copies the frame, so one buffer does for all of them
+		frame := make([]byte, 0, 9+maxOutputFrame)
 		for {
-			n, err := session.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("pty read error: %v", err)
-				}
+			chunk, ok := batcher.next()
+			if !ok {
 				return
 			}
-
-			// Send stdout frame
-			frame := make([]byte, 1+n)
-			frame[0] = FrameStdout
-			copy(frame[1:], buf[:n])
+			if chunk.Event != nil {
+				event, _ := json.Marshal(chunk.Event)
+				frame = append(append(frame[:0], FrameEvent), event...)
+			} else if opts.offsets {
+				// [offset:u64][data], the offset just past the data
+				frame = append(frame[:0], FrameStdout)
+				frame = binary.BigEndian.AppendUint64(frame, chunk.Offset)
+				frame = append(frame, chunk.Data...)
+			} else {
+				frame = append(append(frame[:0], FrameStdout), chunk.Data...)
+			}
 
 			if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
 				log.Printf("websocket write error: %v", err)
@@ -330,17 +766,64 @@ func (s *Server) handleShellStream(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// Heartbeats: pings carry the time they were sent, so each pong gives
+	// the round trip time. A client that answers neither pings nor anything
+	// else for the timeout is gone, even if TCP hasn't noticed yet.
+	pingInterval := time.Duration(s.cfg.StreamPingSecs) * time.Second
+	peerTimeout := time.Duration(s.cfg.StreamTimeoutSecs) * time.Second
+	if pingInterval > 0 {
+		conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		// Runs on the reader goroutine, which is also the one to set opts
+		// from a HELLO
+		conn.SetPongHandler(func(data string) error {
+			conn.SetReadDeadline(time.Now().Add(peerTimeout))
+			if len(data) != 8 || !opts.rtt {
+				return nil
+			}
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+			frame := make([]byte, 5)
+			frame[0] = FrameRTT
+			binary.BigEndian.PutUint32(frame[1:], uint32(time.Since(sent).Microseconds()))
+			return conn.WriteMessage(websocket.BinaryMessage, frame)
+		})
+		stopPings := make(chan struct{})
+		defer close(stopPings)
+		go func() {
+			ticker := time.NewTicker(pingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-stopPings:
+					return
+				}
+				payload := binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+				if err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(pingInterval)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
 	// Read from WebSocket, write to PTY
+	clientGone := make(chan struct{})
 	go func() {
+		defer close(clientGone)
 		for {
 			messageType, data, err := conn.ReadMessage()
 			if err != nil {
-				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					log.Printf("client of session %s stopped answering, detaching", session.ID)
+				} else if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 					log.Printf("websocket read error: %v", err)
 				}
 				// Don't close session on disconnect - allow reconnection
 				return
 			}
+			if pingInterval > 0 {
+				conn.SetReadDeadline(time.Now().Add(peerTimeout))
+			}
 
 			if messageType != websocket.BinaryMessage || len(data) < 1 {
 				continue
@@ -351,6 +834,10 @@ func (s *Server) handleShellStream(w http.ResponseWriter, r *http.Request) {
 
 			switch frameType {
 			case FrameStdin:
+				// Read-only viewers can watch but never type
+				if viewer.ReadOnly {
+					continue
+				}
 				if _, err := session.Write(payload); err != nil {
 					log.Printf("pty write error: %v", err)
 					return
@@ -362,52 +849,96 @@ func (s *Server) handleShellStream(w http.ResponseWriter, r *http.Request) {
 					rows := binary.BigEndian.Uint16(payload[2:4])
 
 					// Apply resize first so dimensions are correct
-					if err := session.Resize(cols, rows); err != nil {
-						log.Printf("resize error: %v", err)
+					if !viewer.ReadOnly {
+						if err := session.Resize(cols, rows); err != nil {
+							log.Printf("resize error: %v", err)
+						}
 					}
 
-					// Send scrollback after first resize (correct dimensions now set)
-					if !scrollbackSent {
-						scrollbackSent = true
-						if len(scrollback) > 0 {
-							frame := make([]byte, 1+len(scrollback))
-							frame[0] = FrameStdout
-							copy(frame[1:], scrollback)
-							if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
-								log.Printf("websocket scrollback write error: %v", err)
-							}
-						}
-						scrollback = nil // Free memory
+					// Start output once dimensions are correct
+					if startTimer.Stop() {
+						start()
 					}
 				}
 
+			case FrameAck:
+				if len(payload) >= 4 {
+					session.Ack(viewer, int(binary.BigEndian.Uint32(payload[0:4])))
+				}
+
+			case FrameHello:
+				var hello clientHello
+				if err := json.Unmarshal(payload, &hello); err != nil {
+					closeStream(conn, CloseInvalidRequest, "invalid HELLO")
+					return
+				}
+				if hello.Version < minProtocolVersion {
+					closeStream(conn, CloseUnsupportedVersion,
+						fmt.Sprintf("protocol version %d is not supported, need %d or later", hello.Version, minProtocolVersion))
+					return
+				}
+				// Newer clients get the features of this version
+				startMu.Lock()
+				if started || helloed {
+					startMu.Unlock()
+					closeStream(conn, CloseProtocolError, "HELLO must come before output starts")
+					return
+				}
+				helloOpts, err := helloStreamOptions(hello, viewer.ReadOnly)
+				if err != nil {
+					startMu.Unlock()
+					closeStream(conn, CloseInvalidRequest, err.Error())
+					return
+				}
+				helloOpts.rtt = helloOpts.rtt && pingInterval > 0
+				opts, helloed = helloOpts, true
+				session.SetWindow(viewer, opts.window)
+				// Sent before output can start, which needs startMu
+				reply, _ := json.Marshal(opts.hello(compression, viewer.ReadOnly, s.cfg.StreamPingSecs, s.cfg.MaxUploadSize))
+				conn.WriteMessage(websocket.BinaryMessage, append([]byte{FrameHello}, reply...))
+				startMu.Unlock()
+
 			case FrameFileStart:
-				// Format: [size:u32][name_len:u16][name:utf8]
-				if len(payload) < 6 {
+				// Format: [size:u32][name_len:u16][name:utf8], with the
+				// uploads feature [size:u64][name_len:u16][name:utf8]
+				if viewer.ReadOnly {
+					sendFileAck(conn, FileAckError, "read-only session")
+					continue
+				}
+				sizeLen := 4
+				if opts.uploads {
+					sizeLen = 8
+				}
+				if len(payload) < sizeLen+2 {
 					sendFileAck(conn, FileAckError, "invalid frame")
 					continue
 				}
 
-				// Cleanup any previous incomplete transfer
-				if activeTransfer != nil && activeTransfer.file != nil {
-					activeTransfer.file.Close()
-					os.Remove(activeTransfer.path)
+				// Stop any previous incomplete transfer; what it received
+				// is kept to be resumed
+				if activeTransfer != nil {
+					activeTransfer.upload.Abort()
 					activeTransfer = nil
 				}
 
-				fileSize := binary.BigEndian.Uint32(payload[0:4])
-				nameLen := binary.BigEndian.Uint16(payload[4:6])
+				var fileSize int64
+				if opts.uploads {
+					fileSize = int64(binary.BigEndian.Uint64(payload[0:8]))
+				} else {
+					fileSize = int64(binary.BigEndian.Uint32(payload[0:4]))
+				}
+				nameLen := int(binary.BigEndian.Uint16(payload[sizeLen : sizeLen+2]))
 
-				if len(payload) < int(6+nameLen) {
+				if len(payload) < sizeLen+2+nameLen {
 					sendFileAck(conn, FileAckError, "invalid frame")
 					continue
 				}
 
-				fileName := string(payload[6 : 6+nameLen])
+				fileName := string(payload[sizeLen+2 : sizeLen+2+nameLen])
 
 				// Validate file size
-				if fileSize > MaxFileSize {
-					sendFileAck(conn, FileAckError, "file too large (max 100MB)")
+				if fileSize < 0 || (s.cfg.MaxUploadSize > 0 && fileSize > s.cfg.MaxUploadSize) {
+					sendFileAck(conn, FileAckError, fmt.Sprintf("file too large (max %dMB)", s.cfg.MaxUploadSize>>20))
 					continue
 				}
 
@@ -417,111 +948,145 @@ func (s *Server) handleShellStream(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 
-				// Get current working directory
-				cwd, err := session.GetWorkingDir()
-				if err != nil {
-					log.Printf("get cwd error: %v", err)
-					sendFileAck(conn, FileAckError, "failed to get working directory")
-					continue
-				}
-
-				// Construct full path
-				filePath := filepath.Join(cwd, fileName)
-
-				// Ensure the resolved path is still within cwd (defense in depth)
-				cleanPath := filepath.Clean(filePath)
-				if !strings.HasPrefix(cleanPath, cwd) {
-					sendFileAck(conn, FileAckError, "invalid path")
+				if session.ShellPid() == 0 {
+					sendFileAck(conn, FileAckError, "uploads are not supported for this session")
 					continue
 				}
 
-				// Create file with O_EXCL to prevent overwrite
-				f, err := os.OpenFile(cleanPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+				// Created in the shell's working directory, as the
+				// session's account. Only clients that know where to
+				// resume from get a partial upload back; for others it
+				// is removed when the upload fails.
+				upload, err := transfer.StartUpload(s.starter, session.Account, session.ShellPid(), fileName, fileSize, opts.uploads)
 				if err != nil {
-					if os.IsExist(err) {
-						sendFileAck(conn, FileAckError, "file already exists")
-					} else {
-						log.Printf("create file error: %v", err)
-						sendFileAck(conn, FileAckError, "failed to create file")
-					}
+					sendFileAck(conn, FileAckError, err.Error())
 					continue
 				}
 
 				activeTransfer = &fileTransfer{
 					name:     fileName,
 					size:     fileSize,
-					received: 0,
-					file:     f,
-					path:     cleanPath,
+					received: upload.Offset,
+					wide:     opts.uploads,
+					upload:   upload,
 				}
 
-				log.Printf("file upload started: %s (%d bytes)", fileName, fileSize)
-				sendFileAck(conn, FileAckProgress, "")
+				if upload.Offset > 0 {
+					log.Printf("file upload resumed: %s (%d of %d bytes)", fileName, upload.Offset, fileSize)
+				} else {
+					log.Printf("file upload started: %s (%d bytes)", fileName, fileSize)
+				}
+				// Older clients learn an empty file is done from the first ACK
+				if !activeTransfer.wide && fileSize == 0 {
+					finishUpload(conn, activeTransfer, nil)
+					activeTransfer = nil
+					continue
+				}
+				sendFileProgress(conn, activeTransfer)
 
 			case FrameFileChunk:
-				// Format: [offset:u32][data...]
+				// Format: [offset:u32][data...], with the uploads feature
+				// [offset:u64][data...]
 				if activeTransfer == nil {
 					sendFileAck(conn, FileAckError, "no active transfer")
 					continue
 				}
 
-				if len(payload) < 4 {
+				offsetLen := 4
+				if activeTransfer.wide {
+					offsetLen = 8
+				}
+				if len(payload) < offsetLen {
 					sendFileAck(conn, FileAckError, "invalid chunk")
 					continue
 				}
 
-				offset := binary.BigEndian.Uint32(payload[0:4])
-				chunkData := payload[4:]
+				var offset int64
+				if activeTransfer.wide {
+					offset = int64(binary.BigEndian.Uint64(payload[0:8]))
+				} else {
+					offset = int64(binary.BigEndian.Uint32(payload[0:4]))
+				}
+				chunkData := payload[offsetLen:]
 
 				// Verify offset matches expected position
-				if offset != activeTransfer.received {
+				if offset != activeTransfer.received || int64(len(chunkData)) > activeTransfer.size-offset {
 					log.Printf("chunk offset mismatch: expected %d, got %d", activeTransfer.received, offset)
 					sendFileAck(conn, FileAckError, "offset mismatch")
-					activeTransfer.file.Close()
-					os.Remove(activeTransfer.path)
+					activeTransfer.upload.Abort()
 					activeTransfer = nil
 					continue
 				}
 
 				// Write chunk
-				n, err := activeTransfer.file.Write(chunkData)
+				n, err := activeTransfer.upload.Write(chunkData)
 				if err != nil {
 					log.Printf("write chunk error: %v", err)
 					sendFileAck(conn, FileAckError, "write failed")
-					activeTransfer.file.Close()
-					os.Remove(activeTransfer.path)
+					activeTransfer.upload.Abort()
 					activeTransfer = nil
 					continue
 				}
 
-				activeTransfer.received += uint32(n)
+				activeTransfer.received += int64(n)
 
-				// Check if transfer complete
-				if activeTransfer.received >= activeTransfer.size {
-					activeTransfer.file.Close()
-					log.Printf("file upload complete: %s", activeTransfer.name)
-					sendFileAck(conn, FileAckSuccess, activeTransfer.name)
+				// Older clients finish with the last chunk, the others
+				// with a FILE_END
+				if !activeTransfer.wide && activeTransfer.received >= activeTransfer.size {
+					finishUpload(conn, activeTransfer, nil)
 					activeTransfer = nil
 				} else {
 					// Send progress ACK
-					sendFileAck(conn, FileAckProgress, "")
+					sendFileProgress(conn, activeTransfer)
 				}
+
+			case FrameFileEnd:
+				// Format: [sha256:32], or empty to skip the check
+				if activeTransfer == nil || !activeTransfer.wide {
+					sendFileAck(conn, FileAckError, "no active transfer")
+					continue
+				}
+				if len(payload) != 0 && len(payload) != sha256.Size {
+					sendFileAck(conn, FileAckError, "invalid checksum")
+					continue
+				}
+				if activeTransfer.received != activeTransfer.size {
+					sendFileAck(conn, FileAckError, "upload incomplete")
+					activeTransfer.upload.Abort()
+					activeTransfer = nil
+					continue
+				}
+				finishUpload(conn, activeTransfer, payload)
+				activeTransfer = nil
 			}
 		}
 	}()
 
-	// Wait for PTY to exit
-	exitCode, _ := session.Wait()
-
-	// Send exit frame
-	exitFrame := make([]byte, 5)
-	exitFrame[0] = FrameExit
-	binary.BigEndian.PutUint32(exitFrame[1:], uint32(exitCode))
-	conn.WriteMessage(websocket.BinaryMessage, exitFrame)
-
-	// Clean up the session since PTY has exited
-	s.sessionManager.Delete(session.ID)
+	// Wait for the shell to exit or the client to go away
+	select {
+	case <-outputDone:
+	case <-clientGone:
+		log.Printf("client detached for user %s (session: %s)", claims.Username, session.ID)
+		return
+	}
 
-	<-done
-	log.Printf("shell session ended for user %s (session: %s)", claims.Username, session.ID)
+	select {
+	case <-session.Done():
+		// All output has been delivered; send exit frame
+		exitCode, _ := session.Wait()
+		exitFrame := make([]byte, 5)
+		exitFrame[0] = FrameExit
+		binary.BigEndian.PutUint32(exitFrame[1:], uint32(exitCode))
+		conn.WriteMessage(websocket.BinaryMessage, exitFrame)
+		log.Printf("shell session ended for user %s (session: %s)", claims.Username, session.ID)
+	default:
+		// Output channel closed without exit: this viewer fell too far
+		// behind, or lost its access
+		if viewer.Revoked() {
+			log.Printf("access of user %s to session %s was revoked, detaching", claims.Username, session.ID)
+			closeStream(conn, CloseForbidden, "access revoked")
+			return
+		}
+		closeStream(conn, websocket.CloseTryAgainLater, "connection too slow")
+	}
 }
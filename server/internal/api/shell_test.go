@@ -0,0 +1,324 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/auth"
+	"github.com/eddison/sshttp/server/internal/config"
+	"github.com/eddison/sshttp/server/internal/mds"
+	"github.com/eddison/sshttp/server/internal/privsep"
+	"github.com/eddison/sshttp/server/internal/pty"
+	"github.com/eddison/sshttp/server/internal/pty/ptytest"
+	"github.com/eddison/sshttp/server/internal/store"
+	"github.com/gorilla/websocket"
+)
+
+// testServer is the API with sessions on in-memory backends
+type testServer struct {
+	*httptest.Server
+	token    string
+	backends chan *ptytest.Backend // One for each session created
+	cfg      *config.Config
+	store    store.Store
+	tokens   *auth.TokenManager
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.Load(dir)
+	st, err := store.NewSQLiteStore(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	if err := st.CreateUser(context.Background(), &store.User{ID: "u1", Username: "alice", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	wa, err := auth.NewWebAuthnHandler(cfg, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := auth.NewTokenManager(cfg.JWTSecret, 15)
+
+	ts := &testServer{backends: make(chan *ptytest.Backend, 16), cfg: cfg, store: st, tokens: tm}
+	sm := pty.NewSessionManager(cfg, privsep.Local{})
+	sm.SetBackend(func(opts pty.SessionOptions) (pty.Backend, error) {
+		b := ptytest.NewBackend()
+		ts.backends <- b
+		return b, nil
+	})
+	s := NewServer(cfg, st, wa, tm, sm, mds.New(dir), privsep.Local{})
+	ts.Server = httptest.NewServer(s.Router())
+	t.Cleanup(ts.Close)
+	if ts.token, err = tm.Issue("u1", "alice", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// as returns a copy of ts that makes requests as another, new user
+func (ts *testServer) as(t *testing.T, id, username string) *testServer {
+	t.Helper()
+	if err := ts.store.CreateUser(context.Background(), &store.User{ID: id, Username: username, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	other := *ts
+	var err error
+	if other.token, err = ts.tokens.Issue(id, username, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	return &other
+}
+
+// do makes an API request and returns the status and body
+func (ts *testServer) do(t *testing.T, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+ts.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// create creates a session and returns its ID and backend
+func (ts *testServer) create(t *testing.T, body string) (string, *ptytest.Backend) {
+	t.Helper()
+	status, resp := ts.do(t, "POST", "/v1/shell/sessions", body)
+	if status != http.StatusOK {
+		t.Fatalf("create session: %d %s", status, resp)
+	}
+	var created createSessionResponse
+	if err := json.Unmarshal([]byte(resp), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created.ID, <-ts.backends
+}
+
+// attach opens a stream to a session
+func (ts *testServer) attach(t *testing.T, id string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/shell/stream?sessionId=" + id + "&token=" + ts.token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func send(t *testing.T, conn *websocket.Conn, frameType byte, payload []byte) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte{frameType}, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads frames until one of the given type
+func readFrame(t *testing.T, conn *websocket.Conn, frameType byte) []byte {
+	t.Helper()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for frame 0x%02x: %v", frameType, err)
+		}
+		if len(data) > 0 && data[0] == frameType {
+			return data[1:]
+		}
+	}
+}
+
+// readOutput reads output frames until one contains want
+func readOutput(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	var output []byte
+	for !strings.Contains(string(output), want) {
+		output = append(output, readFrame(t, conn, FrameStdout)...)
+	}
+}
+
+// eventually waits for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func resizeFrame(cols, rows uint16) []byte {
+	p := binary.BigEndian.AppendUint16(nil, cols)
+	return binary.BigEndian.AppendUint16(p, rows)
+}
+
+func TestShellSession(t *testing.T) {
+	ts := newTestServer(t)
+	id, backend := ts.create(t, `{"name":"work"}`)
+
+	status, resp := ts.do(t, "GET", "/v1/shell/sessions", "")
+	if status != http.StatusOK {
+		t.Fatalf("list sessions: %d %s", status, resp)
+	}
+	var list listSessionsResponse
+	if err := json.Unmarshal([]byte(resp), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != 1 || list.Sessions[0].ID != id || list.Sessions[0].Name != "work" {
+		t.Fatalf("sessions = %+v, want only %s named work", list.Sessions, id)
+	}
+
+	conn := ts.attach(t, id)
+	send(t, conn, FrameResize, resizeFrame(120, 40))
+	eventually(t, "resize", func() bool {
+		cols, rows := backend.Size()
+		return cols == 120 && rows == 40
+	})
+
+	backend.Output([]byte("hello from the shell\r\n"))
+	readOutput(t, conn, "hello from the shell")
+
+	send(t, conn, FrameStdin, []byte("ls -l\r"))
+	eventually(t, "input", func() bool { return string(backend.Input()) == "ls -l\r" })
+
+	backend.Output([]byte("total 0\r\n"))
+	backend.Exit(3)
+	readOutput(t, conn, "total 0")
+	exit := readFrame(t, conn, FrameExit)
+	if len(exit) != 4 || binary.BigEndian.Uint32(exit) != 3 {
+		t.Fatalf("exit frame = %x, want code 3", exit)
+	}
+
+	eventually(t, "session removal", func() bool {
+		_, resp := ts.do(t, "GET", "/v1/shell/sessions", "")
+		return strings.Contains(resp, `"sessions":[]`)
+	})
+}
+
+func TestShellSessionSignal(t *testing.T) {
+	ts := newTestServer(t)
+	id, backend := ts.create(t, "")
+
+	status, resp := ts.do(t, "POST", "/v1/shell/sessions/signal", `{"id":"`+id+`","signal":"INT"}`)
+	if status != http.StatusOK {
+		t.Fatalf("signal: %d %s", status, resp)
+	}
+	signals := backend.Signals()
+	if len(signals) == 0 || signals[len(signals)-1] != syscall.SIGINT {
+		t.Fatalf("signals = %v, want SIGINT last", signals)
+	}
+
+	if status, _ := ts.do(t, "POST", "/v1/shell/sessions/signal", `{"id":"`+id+`","signal":"BOGUS"}`); status != http.StatusBadRequest {
+		t.Fatalf("unknown signal: got %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestShellSessionReadOnly(t *testing.T) {
+	ts := newTestServer(t)
+	id, backend := ts.create(t, "")
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1/shell/stream?sessionId=" + id + "&readOnly=true&token=" + ts.token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	send(t, conn, FrameResize, resizeFrame(100, 30))
+	send(t, conn, FrameStdin, []byte("rm -rf /\r"))
+	// Output sent after the input shows the input had its chance
+	backend.Output([]byte("still here\r\n"))
+	readOutput(t, conn, "still here")
+	if input := backend.Input(); len(input) != 0 {
+		t.Fatalf("read-only viewer typed %q", input)
+	}
+	if cols, rows := backend.Size(); cols == 100 && rows == 30 {
+		t.Fatal("read-only viewer resized the terminal")
+	}
+}
+
+func TestShellSessionDelete(t *testing.T) {
+	ts := newTestServer(t)
+	id, backend := ts.create(t, "")
+	conn := ts.attach(t, id)
+
+	if status, resp := ts.do(t, "POST", "/v1/shell/sessions/delete", `{"id":"`+id+`"}`); status != http.StatusOK {
+		t.Fatalf("delete: %d %s", status, resp)
+	}
+	readFrame(t, conn, FrameExit)
+	if code, _ := backend.Wait(); code != 128+int(syscall.SIGHUP) {
+		t.Fatalf("shell exit code = %d, want it hung up on", code)
+	}
+	if status, _ := ts.do(t, "GET", "/v1/shell/sessions/scrollback?id="+id, ""); status != http.StatusNotFound {
+		t.Fatalf("scrollback of deleted session: got %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+// readClose reads until the stream is closed and returns its close code
+func readClose(t *testing.T, conn *websocket.Conn) int {
+	t.Helper()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("waiting for close: %v", err)
+			}
+			return closeErr.Code
+		}
+	}
+}
+
+func TestShellSessionUnshare(t *testing.T) {
+	ts := newTestServer(t)
+	bob := ts.as(t, "u2", "bob")
+	id, backend := ts.create(t, "")
+	share := func(readOnly bool) {
+		t.Helper()
+		body := fmt.Sprintf(`{"id":"%s","username":"bob","readOnly":%v}`, id, readOnly)
+		if status, resp := ts.do(t, "POST", "/v1/shell/sessions/share", body); status != http.StatusOK {
+			t.Fatalf("share: %d %s", status, resp)
+		}
+	}
+	share(false)
+	owner := ts.attach(t, id)
+	conn := bob.attach(t, id)
+
+	// Made read-only, bob's read-write viewer is detached
+	share(true)
+	if code := readClose(t, conn); code != CloseForbidden {
+		t.Fatalf("close code = %d, want %d", code, CloseForbidden)
+	}
+	conn = bob.attach(t, id)
+	backend.Output([]byte("watching\r\n"))
+	readOutput(t, conn, "watching")
+
+	// Revoked, all of bob's viewers are, but not the owner's
+	if status, resp := ts.do(t, "POST", "/v1/shell/sessions/unshare", `{"id":"`+id+`","username":"bob"}`); status != http.StatusOK {
+		t.Fatalf("unshare: %d %s", status, resp)
+	}
+	if code := readClose(t, conn); code != CloseForbidden {
+		t.Fatalf("close code = %d, want %d", code, CloseForbidden)
+	}
+	backend.Output([]byte("still yours\r\n"))
+	readOutput(t, owner, "still yours")
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/eddison/sshttp/server/internal/middleware"
+)
+
+// targetInfo is an SSH target a user can open sessions on
+type targetInfo struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	User string `json:"user"` // Remote account
+}
+
+type listTargetsResponse struct {
+	Targets []targetInfo `json:"targets"`
+}
+
+// handleListTargets lists the configured SSH targets the user may use, to
+// pass as target when creating a session
+func (s *Server) handleListTargets(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetClaims(r.Context())
+	if claims == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp := listTargetsResponse{Targets: []targetInfo{}}
+	for _, target := range s.cfg.Targets {
+		if !target.Allows(claims.Username) {
+			continue
+		}
+		resolved := target.For(claims.Username)
+		resp.Targets = append(resp.Targets, targetInfo{
+			Name: resolved.Name,
+			Host: resolved.Host,
+			User: resolved.User,
+		})
+	}
+	sort.Slice(resp.Targets, func(i, j int) bool { return resp.Targets[i].Name < resp.Targets[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -38,10 +42,145 @@ type Config struct {
 
 	// Session
 	SessionIdleTimeoutMins int
+	SessionCloseGraceSecs  int // Between SIGHUP, SIGTERM and SIGKILL when closing a session
+	PersistSessions        bool
+	RecordSessions         bool
+	ScrollbackSize         int   // Bytes of output kept in memory per session
+	ScrollbackDiskMB       int   // Older output kept compressed on disk per session
+	HistoryRetentionDays   int   // Command history of closed sessions, 0 to keep it
+	TmuxSessions           bool  // List the windows of users' tmux sessions as sessions
+	StreamCompression      bool  // Allow permessage-deflate on WebSocket streams
+	StreamPingSecs         int   // Between pings on shell streams, 0 to disable
+	StreamTimeoutSecs      int   // Without a pong or message before a client is dropped
+	MaxUploadSize          int64 // Bytes, 0 for no limit
+
+	// Privilege separation
+	MultiUser bool   // Run each user's shells as their own Unix account
+	RunAs     string // Account the daemon drops to in multi-user mode
+
+	// Resource limits
+	CgroupRoot string                    // Delegated cgroup v2 directory for sessions, empty to disable
+	Limits     ResourceLimits            // Per session
+	UserLimits map[string]ResourceLimits // Per username, replacing Limits
+
+	// Namespace sandboxes
+	Sandboxes     map[string]*Sandbox // By name
+	UserSandboxes map[string]string   // Username -> sandbox all their processes run in
+
+	// SSH targets
+	Targets map[string]*Target // By name
+
+	// Containers
+	DockerSocket   string              // Docker Engine API socket, empty to disable
+	Containers     []string            // Container patterns everyone may open shells in
+	UserContainers map[string][]string // Username -> patterns, replacing Containers
+
+	// User container shells run as, %u for the sshttp username and empty
+	// for the container's default user
+	ContainerUser      string
+	UserContainerUsers map[string]string // Username -> user, replacing ContainerUser
+}
+
+// Target is a host sessions can be opened on over SSH. User and Key may
+// contain %u, which stands for the sshttp username.
+type Target struct {
+	Name       string
+	Host       string   // host:port
+	User       string   // Remote account
+	Key        string   // Private key; a certificate next to it as <key>-cert.pub is presented too
+	KnownHosts string   // known_hosts file the host key must be in
+	Users      []string // sshttp users allowed to use it, empty for everyone
+}
+
+// Allows reports whether a user may open sessions on the target
+func (t *Target) Allows(username string) bool {
+	return len(t.Users) == 0 || slices.Contains(t.Users, username)
+}
+
+// For returns the target with %u replaced by a user's name
+func (t *Target) For(username string) *Target {
+	resolved := *t
+	resolved.User = strings.ReplaceAll(t.User, "%u", username)
+	resolved.Key = strings.ReplaceAll(t.Key, "%u", username)
+	return &resolved
 }
 
-func Load() *Config {
-	dataDir := getDefaultDataDir()
+// Sandbox is a named set of namespaces sessions can be started in. It
+// always includes a private mount namespace.
+type Sandbox struct {
+	Name      string  `json:"name"`
+	Mounts    []Mount `json:"mounts,omitempty"`    // Applied in order
+	PID       bool    `json:"pid,omitempty"`       // Own PID namespace with a fresh /proc
+	NoNetwork bool    `json:"noNetwork,omitempty"` // Own network namespace with only loopback
+
+	// Directories masked with an empty read-only tmpfs after the layout,
+	// where it left them visible. Always the data directory.
+	Hide []string `json:"hide,omitempty"`
+}
+
+// Mount is one entry of a sandbox's mount layout
+type Mount struct {
+	Type   string `json:"type"`             // "ro" or "rw" bind mount, or "tmpfs"
+	Source string `json:"source,omitempty"` // Bind mounts only
+	Target string `json:"target"`
+}
+
+// ResourceLimits are the cgroup v2 limits applied to one session
+type ResourceLimits struct {
+	CPUWeight int   // cpu.weight (1-10000), 0 for the kernel default
+	MemoryMax int64 // memory.max in bytes, 0 for no limit
+	PidsMax   int64 // pids.max, 0 for no limit
+}
+
+// LimitsFor returns the session limits for a user
+func (c *Config) LimitsFor(username string) ResourceLimits {
+	if limits, ok := c.UserLimits[username]; ok {
+		return limits
+	}
+	return c.Limits
+}
+
+// SandboxFor returns the name of the sandbox a user is confined to, or ""
+func (c *Config) SandboxFor(username string) string {
+	return c.UserSandboxes[username]
+}
+
+// ContainerUserFor returns the user a user's container shells run as,
+// empty for the container's default user
+func (c *Config) ContainerUserFor(username string) string {
+	user, ok := c.UserContainerUsers[username]
+	if !ok {
+		user = c.ContainerUser
+	}
+	return strings.ReplaceAll(user, "%u", username)
+}
+
+// ContainerAllowed reports whether a user may open shells in a container.
+// Patterns are globs on the container name, or key=glob on its labels.
+func (c *Config) ContainerAllowed(username, name string, labels map[string]string) bool {
+	patterns, ok := c.UserContainers[username]
+	if !ok {
+		patterns = c.Containers
+	}
+	for _, pattern := range patterns {
+		if key, value, isLabel := strings.Cut(pattern, "="); isLabel {
+			if label, ok := labels[key]; ok {
+				if matched, _ := path.Match(value, label); matched {
+					return true
+				}
+			}
+		} else if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the configuration from dataDir, or from ~/.sshttp if empty
+func Load(dataDir string) *Config {
+	if dataDir == "" {
+		dataDir = getDefaultDataDir()
+	}
 
 	// Ensure data directory exists
 	if err := os.MkdirAll(dataDir, 0700); err != nil {
@@ -66,6 +205,28 @@ func loadOrCreateConfig(configPath, dataDir string) *Config {
 		"rp_origin":                 "https://localhost:4422",
 		"token_expiry_mins":         "15",
 		"session_idle_timeout_mins": "30",
+		"session_close_grace_secs":  "5",
+		"persist_sessions":          "true",
+		"record_sessions":           "false",
+		"scrollback_size":           "65536",
+		"scrollback_disk_mb":        "32",
+		"history_retention_days":    "90",
+		"tmux_sessions":             "false",
+		"stream_compression":        "true",
+		"stream_ping_secs":          "15",
+		"stream_timeout_secs":       "45",
+		"max_upload_size":           "10G",
+		"multi_user":                "false",
+		"run_as":                    "sshttp",
+		"cgroup_root":               "",
+		"cpu_weight":                "0",
+		"memory_max":                "max",
+		"pids_max":                  "max",
+		"ssh_key":                   "",
+		"ssh_known_hosts":           filepath.Join(dataDir, "known_hosts"),
+		"docker_socket":             "",
+		"containers":                "",
+		"container_user":            "%u",
 	}
 
 	values := make(map[string]string)
@@ -84,6 +245,87 @@ func loadOrCreateConfig(configPath, dataDir string) *Config {
 		log.Printf("Warning: could not read config file: %v", err)
 	}
 
+	limits := parseLimits(values, "", ResourceLimits{})
+	userLimits := make(map[string]ResourceLimits)
+	userSandboxes := make(map[string]string)
+	userContainers := make(map[string][]string)
+	userContainerUsers := make(map[string]string)
+	sandboxes := make(map[string]*Sandbox)
+	targets := make(map[string]*Target)
+	for key, value := range values {
+		// user.<name>.<limit> overrides one limit for one user,
+		// user.<name>.sandbox confines them to a sandbox and
+		// user.<name>.containers replaces the containers they may use and
+		// user.<name>.container_user who they are in them
+		if rest, ok := strings.CutPrefix(key, "user."); ok {
+			if name, ok := strings.CutSuffix(rest, ".sandbox"); ok && name != "" {
+				userSandboxes[name] = value
+			} else if name, ok := strings.CutSuffix(rest, ".containers"); ok && name != "" {
+				userContainers[name] = strings.Fields(value)
+			} else if name, ok := strings.CutSuffix(rest, ".container_user"); ok && name != "" {
+				userContainerUsers[name] = value
+			} else if i := strings.LastIndex(rest, "."); i > 0 {
+				name := rest[:i]
+				if _, done := userLimits[name]; !done {
+					userLimits[name] = parseLimits(values, "user."+name+".", limits)
+				}
+			}
+		}
+
+		// sandbox.<name>.<setting> defines a sandbox
+		if rest, ok := strings.CutPrefix(key, "sandbox."); ok {
+			if i := strings.LastIndex(rest, "."); i > 0 {
+				name := rest[:i]
+				if _, done := sandboxes[name]; done {
+					continue
+				}
+				sb, err := parseSandbox(values, name, dataDir)
+				if err != nil {
+					// Users confined to it can't start anything
+					log.Printf("Warning: sandbox %s: %v", name, err)
+					sandboxes[name] = nil
+					continue
+				}
+				sandboxes[name] = sb
+			}
+		}
+
+		// target.<name>.<setting> defines an SSH target
+		if rest, ok := strings.CutPrefix(key, "target."); ok {
+			if i := strings.LastIndex(rest, "."); i > 0 {
+				name := rest[:i]
+				if _, done := targets[name]; done {
+					continue
+				}
+				t, err := parseTarget(values, name)
+				if err != nil {
+					log.Printf("Warning: target %s: %v", name, err)
+					targets[name] = nil
+					continue
+				}
+				targets[name] = t
+			}
+		}
+	}
+	for name, t := range targets {
+		if t == nil {
+			delete(targets, name)
+		}
+	}
+	for name, sb := range sandboxes {
+		if sb == nil {
+			delete(sandboxes, name)
+		}
+	}
+
+	// A client needs time to answer a ping before it counts as gone
+	pingSecs := parseInt(values["stream_ping_secs"], 15)
+	timeoutSecs := parseInt(values["stream_timeout_secs"], 45)
+	if pingSecs > 0 && timeoutSecs <= pingSecs {
+		log.Printf("Warning: stream_timeout_secs must be longer than stream_ping_secs, using %d", 3*pingSecs)
+		timeoutSecs = 3 * pingSecs
+	}
+
 	return &Config{
 		Addr:                   values["addr"],
 		DataDir:                dataDir,
@@ -96,7 +338,140 @@ func loadOrCreateConfig(configPath, dataDir string) *Config {
 		JWTSecret:              getOrCreateSecret(dataDir),
 		TokenExpiryMins:        parseInt(values["token_expiry_mins"], 15),
 		SessionIdleTimeoutMins: parseInt(values["session_idle_timeout_mins"], 30),
+		SessionCloseGraceSecs:  parseInt(values["session_close_grace_secs"], 5),
+		PersistSessions:        parseBool(values["persist_sessions"], true),
+		RecordSessions:         parseBool(values["record_sessions"], false),
+		ScrollbackSize:         parseInt(values["scrollback_size"], 65536),
+		ScrollbackDiskMB:       parseInt(values["scrollback_disk_mb"], 32),
+		HistoryRetentionDays:   parseInt(values["history_retention_days"], 90),
+		TmuxSessions:           parseBool(values["tmux_sessions"], false),
+		StreamCompression:      parseBool(values["stream_compression"], true),
+		StreamPingSecs:         pingSecs,
+		StreamTimeoutSecs:      timeoutSecs,
+		MaxUploadSize:          parseSize(values["max_upload_size"]),
+		MultiUser:              parseBool(values["multi_user"], false),
+		RunAs:                  values["run_as"],
+		CgroupRoot:             values["cgroup_root"],
+		Limits:                 limits,
+		UserLimits:             userLimits,
+		Sandboxes:              sandboxes,
+		UserSandboxes:          userSandboxes,
+		Targets:                targets,
+		DockerSocket:           values["docker_socket"],
+		Containers:             strings.Fields(values["containers"]),
+		UserContainers:         userContainers,
+		ContainerUser:          values["container_user"],
+		UserContainerUsers:     userContainerUsers,
+	}
+}
+
+// parseTarget reads the target.<name>.* keys, falling back to ssh_key and
+// ssh_known_hosts. The remote account defaults to the sshttp username.
+func parseTarget(values map[string]string, name string) (*Target, error) {
+	prefix := "target." + name + "."
+	t := &Target{
+		Name:       name,
+		Host:       values[prefix+"host"],
+		User:       values[prefix+"user"],
+		Key:        values[prefix+"key"],
+		KnownHosts: values[prefix+"known_hosts"],
+		Users:      strings.Fields(values[prefix+"users"]),
+	}
+	if t.Host == "" {
+		return nil, fmt.Errorf("no host")
+	}
+	if _, _, err := net.SplitHostPort(t.Host); err != nil {
+		t.Host = net.JoinHostPort(t.Host, "22")
+	}
+	if t.User == "" {
+		t.User = "%u"
+	}
+	if t.Key == "" {
+		t.Key = values["ssh_key"]
+	}
+	if t.Key == "" {
+		return nil, fmt.Errorf("no key")
+	}
+	if t.KnownHosts == "" {
+		t.KnownHosts = values["ssh_known_hosts"]
+	}
+	return t, nil
+}
+
+// parseSandbox reads the sandbox.<name>.* keys. mounts is a space
+// separated list of ro:/path, rw:/path (optionally :/target) and tmpfs:/path.
+// The data directory, with the JWT secret and everyone's recordings, is
+// hidden whatever the layout.
+func parseSandbox(values map[string]string, name, dataDir string) (*Sandbox, error) {
+	prefix := "sandbox." + name + "."
+	sb := &Sandbox{
+		Name:      name,
+		PID:       parseBool(values[prefix+"pid"], true),
+		NoNetwork: !parseBool(values[prefix+"network"], true),
+	}
+	for _, entry := range strings.Fields(values[prefix+"mounts"]) {
+		parts := strings.Split(entry, ":")
+		m := Mount{Type: parts[0]}
+		switch {
+		case (m.Type == "ro" || m.Type == "rw") && len(parts) == 2:
+			m.Source, m.Target = parts[1], parts[1]
+		case (m.Type == "ro" || m.Type == "rw") && len(parts) == 3:
+			m.Source, m.Target = parts[1], parts[2]
+		case m.Type == "tmpfs" && len(parts) == 2:
+			m.Target = parts[1]
+		default:
+			return nil, fmt.Errorf("invalid mount %q", entry)
+		}
+		if (m.Source != "" && !filepath.IsAbs(m.Source)) || !filepath.IsAbs(m.Target) {
+			return nil, fmt.Errorf("mount %q needs absolute paths", entry)
+		}
+		sb.Mounts = append(sb.Mounts, m)
+	}
+	hide, err := filepath.Abs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	sb.Hide = []string{hide}
+	return sb, nil
+}
+
+// parseLimits reads the limit keys with a prefix, keeping base for the
+// ones not set
+func parseLimits(values map[string]string, prefix string, base ResourceLimits) ResourceLimits {
+	limits := base
+	if v, ok := values[prefix+"cpu_weight"]; ok {
+		limits.CPUWeight = min(max(parseInt(v, 0), 0), 10000)
+	}
+	if v, ok := values[prefix+"memory_max"]; ok {
+		limits.MemoryMax = parseSize(v)
+	}
+	if v, ok := values[prefix+"pids_max"]; ok {
+		limits.PidsMax = parseSize(v)
 	}
+	return limits
+}
+
+// parseSize parses a number with an optional K, M or G suffix. "max",
+// empty and invalid values mean no limit (0).
+func parseSize(s string) int64 {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1024
+	case strings.HasSuffix(s, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n * mult
 }
 
 func parseConfig(content string, values map[string]string) {
@@ -143,6 +518,90 @@ token_expiry_mins = 15
 
 # Shell session idle timeout in minutes
 session_idle_timeout_mins = 30
+
+# Seconds closed sessions get to exit after SIGHUP, and again after SIGTERM
+session_close_grace_secs = 5
+
+# Keep shells running across daemon restarts and upgrades
+persist_sessions = true
+
+# Record every session as an asciicast v2 file in the data directory
+record_sessions = false
+
+# Bytes of terminal output kept in memory per session (default 64KB)
+scrollback_size = 65536
+
+# Older output kept compressed on disk per session, in MB (0 = disabled)
+scrollback_disk_mb = 32
+
+# Days the command history of closed sessions is kept (0 = forever)
+history_retention_days = 90
+
+# Show the windows of each user's tmux sessions as sessions, and allow
+# opening new ones, through a tmux control mode client
+tmux_sessions = false
+
+# Compress terminal output on WebSocket streams when the client supports it
+# (permessage-deflate); costs some CPU, saves a lot of bandwidth
+stream_compression = true
+
+# Seconds between pings on shell streams (0 = no pings), and seconds
+# without a pong or message after which the client is considered gone
+stream_ping_secs = 15
+stream_timeout_secs = 45
+
+# Largest file that can be uploaded, with a K, M or G suffix (max = no limit)
+max_upload_size = 10G
+
+# Run each user's shells as the Unix account with the same name. Requires
+# starting sshttpd as root; it drops to the run_as account after startup.
+multi_user = false
+run_as = sshttp
+
+# Delegated cgroup v2 directory; each session gets a child cgroup with the
+# limits below (empty = disabled)
+cgroup_root =
+
+# Session limits: cpu.weight (1-10000, 0 = default), memory.max (K/M/G
+# suffixes) and pids.max; "max" means unlimited
+cpu_weight = 0
+memory_max = max
+pids_max = max
+
+# Per-user overrides, e.g.
+# user.alice.memory_max = 8G
+
+# Sandboxes start sessions in new namespaces: a private mount namespace with
+# the layout below (ro:/path, rw:/path[:/target], tmpfs:/path, in order), a
+# PID namespace and optionally no network. Launch profiles can pick one, and
+# user.<name>.sandbox confines everything a user starts to one.
+# sandbox.scratch.mounts = ro:/ tmpfs:/tmp tmpfs:/home rw:/srv/scratch:/home/contractor
+# sandbox.scratch.pid = true
+# sandbox.scratch.network = false
+# user.contractor.sandbox = scratch
+
+# SSH targets sessions can be opened on instead of a local shell. Host keys
+# are checked against ssh_known_hosts. In user and key, %u stands for the
+# sshttp username; a <key>-cert.pub next to the key is presented as its
+# certificate. users limits who may use a target (empty = everyone).
+ssh_key =
+ssh_known_hosts = ` + defaults["ssh_known_hosts"] + `
+# target.web1.host = web1.internal:22
+# target.web1.user = %u
+# target.web1.key = /etc/sshttp/keys/%u
+# target.web1.users = alice bob
+
+# Docker Engine API socket for shells in local containers (empty = disabled).
+# containers are the ones users may open shells in: globs on the container
+# name, or label=glob on its labels, e.g. web-* com.example.team=ops.
+# user.<name>.containers replaces the list for one user. Shells run as
+# container_user in the container, %u for the sshttp username; empty runs
+# them as the container's default user, often root.
+docker_socket =
+containers =
+container_user = %u
+# user.alice.containers = dev-alice-*
+# user.alice.container_user = 1000:1000
 `
 
 	if err := os.WriteFile(configPath, []byte(content), 0600); err != nil {
@@ -179,3 +638,10 @@ func parseInt(s string, defaultVal int) int {
 	}
 	return defaultVal
 }
+
+func parseBool(s string, defaultVal bool) bool {
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return defaultVal
+}
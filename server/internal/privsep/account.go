@@ -0,0 +1,143 @@
+package privsep
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Account is a Unix user that processes are started as
+type Account struct {
+	Username string
+	Uid      uint32
+	Gid      uint32
+	Groups   []uint32 // Supplementary groups
+	Home     string
+	Shell    string
+}
+
+// defaultPath is PATH for processes started as another account, before
+// their login shell sets its own
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// LookupAccount resolves a Unix account from the user and group databases
+func LookupAccount(username string) (*Account, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("unix account %q not found", username)
+	}
+	return newAccount(u)
+}
+
+// CurrentAccount returns the account the daemon runs as
+func CurrentAccount() (*Account, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("get current user: %w", err)
+	}
+	return newAccount(u)
+}
+
+func newAccount(u *user.User) (*Account, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid for %s: %s", u.Username, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid for %s: %s", u.Username, u.Gid)
+	}
+	a := &Account{
+		Username: u.Username,
+		Uid:      uint32(uid),
+		Gid:      uint32(gid),
+		Home:     u.HomeDir,
+		Shell:    getUserShell(u.Username),
+	}
+	if a.Shell == "" {
+		a.Shell = "/bin/bash"
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("get groups for %s: %w", u.Username, err)
+	}
+	for _, g := range groupIDs {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			a.Groups = append(a.Groups, uint32(id))
+		}
+	}
+	return a, nil
+}
+
+// getUserShell reads the user's shell from /etc/passwd
+func getUserShell(username string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, username+":") {
+			fields := strings.Split(line, ":")
+			if len(fields) >= 7 {
+				return fields[6] // shell is the 7th field
+			}
+		}
+	}
+	return ""
+}
+
+// IsCurrent reports whether this is the account the daemon runs as
+func (a *Account) IsCurrent() bool {
+	return a.Uid == uint32(os.Getuid())
+}
+
+// Environ returns the environment for a login as the account. Processes
+// started as the daemon's own account inherit the daemon's environment;
+// other accounts get a clean one so nothing of the daemon's leaks.
+func (a *Account) Environ() []string {
+	var env []string
+	if a.IsCurrent() {
+		env = os.Environ()
+	} else {
+		env = []string{"PATH=" + defaultPath}
+		for _, key := range []string{"LANG", "LC_ALL", "TZ"} {
+			if v, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+v)
+			}
+		}
+	}
+	// Later entries win, so these override anything inherited
+	return append(env, a.loginVars()...)
+}
+
+func (a *Account) loginVars() []string {
+	return []string{
+		"HOME=" + a.Home,
+		"SHELL=" + a.Shell,
+		"USER=" + a.Username,
+		"LOGNAME=" + a.Username,
+	}
+}
+
+// ExpandHome resolves a leading ~ against the account's home directory
+func (a *Account) ExpandHome(dir string) string {
+	if a.Home == "" {
+		return dir
+	}
+	if dir == "~" {
+		return a.Home
+	}
+	if rest, ok := strings.CutPrefix(dir, "~/"); ok {
+		return filepath.Join(a.Home, rest)
+	}
+	return dir
+}
@@ -0,0 +1,69 @@
+package privsep
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ChownTree gives a directory and everything in it to an account, so the
+// daemon can still use its data after dropping privileges. Directories
+// handed over to a session's account keep their owner, and so does what is
+// in them: holders that survived a restart still write there.
+func ChownTree(dir string, a *Account) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir && handedOver(path, a) {
+			return fs.SkipDir
+		}
+		return os.Lchown(path, int(a.Uid), int(a.Gid))
+	})
+}
+
+// handedOver reports whether a directory was handed over to another account
+// by the spawner: setgid, in the daemon's group, owned by someone else
+func handedOver(path string, daemon *Account) bool {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	return st.Mode&syscall.S_ISGID != 0 && st.Gid == daemon.Gid && st.Uid != daemon.Uid && st.Uid != 0
+}
+
+// DropPrivileges permanently switches the daemon to an account. Go applies
+// these to every thread of the process.
+func DropPrivileges(a *Account) error {
+	groups := make([]int, len(a.Groups))
+	for i, g := range a.Groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(int(a.Gid)); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(int(a.Uid)); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if syscall.Setuid(0) == nil {
+		return fmt.Errorf("still able to regain root")
+	}
+	return nil
+}
+
+// DelegateCgroup gives a cgroup v2 directory to an account so it can create
+// and configure child cgroups. Only the files delegation needs change owner;
+// the directory's own limits stay with whoever set them up.
+func DelegateCgroup(dir string, a *Account) error {
+	for _, name := range []string{".", "cgroup.procs", "cgroup.threads", "cgroup.subtree_control"} {
+		if err := os.Chown(filepath.Join(dir, name), int(a.Uid), int(a.Gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package privsep
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// A daemon restart chowns the data directory again. Spill directories
+// handed over to a session's account have to stay writable for holders
+// that survived it.
+func TestChownTreeKeepsHandedOverDirs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	daemon := &Account{Username: "daemon", Uid: 4001, Gid: 4001}
+	user := &Account{Username: "user", Uid: 4002, Gid: 4002}
+
+	data := t.TempDir()
+	logDir := filepath.Join(data, "sessions", "sess-1.log")
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChownTree(data, daemon); err != nil {
+		t.Fatal(err)
+	}
+
+	// What the spawner does when starting the session's holder
+	f, err := os.Open(logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sp := &spawner{cfg: spawnerConfig{DaemonUid: daemon.Uid, DaemonGid: daemon.Gid}}
+	if err := sp.handOver(f, user); err != nil {
+		t.Fatal(err)
+	}
+	writeSegment(t, f, user, "0000000000000000.seg")
+
+	// The restart
+	if err := ChownTree(data, daemon); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(logDir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Uid != user.Uid || st.Gid != daemon.Gid {
+		t.Errorf("log directory owned by %d:%d, want %d:%d", st.Uid, st.Gid, user.Uid, daemon.Gid)
+	}
+	if err := syscall.Stat(filepath.Join(data, "sessions"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Uid != daemon.Uid {
+		t.Errorf("sessions directory owned by %d, want %d", st.Uid, daemon.Uid)
+	}
+	// Rotating to a new segment, as the holder does through its descriptor
+	writeSegment(t, f, user, "0000000000001000.seg")
+}
+
+// writeSegment creates a file in dir as the account, reaching dir only
+// through the descriptor like a holder does
+func writeSegment(t *testing.T, dir *os.File, a *Account, name string) {
+	t.Helper()
+	cmd := exec.Command("/bin/sh", "-c", `echo data > /dev/fd/3/"$1"`, "sh", name)
+	cmd.ExtraFiles = []*os.File{dir}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: a.Uid, Gid: a.Gid}}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("create %s as %d: %v: %s", name, a.Uid, err, out)
+	}
+}
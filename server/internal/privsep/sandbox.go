@@ -0,0 +1,336 @@
+package privsep
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/eddison/sshttp/server/internal/config"
+)
+
+// Sandboxed processes are started through a stage: the daemon binary
+// re-executed with --sandbox inside the new namespaces. It still has the
+// privileges to set up the mount layout, then drops them and executes the
+// real process.
+
+// sandboxStage is passed to the stage as its argument
+type sandboxStage struct {
+	Sandbox    *config.Sandbox     `json:"sandbox"`
+	Credential *syscall.Credential `json:"credential,omitempty"` // Nil to keep the current ids
+	Path       string              `json:"path"`
+	Args       []string            `json:"args,omitempty"`
+	Dir        string              `json:"dir,omitempty"`
+}
+
+// Capabilities the stage needs when it runs in a user namespace
+const (
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+// Not in the syscall package
+const (
+	oPath              = 0x200000
+	prSetNoNewPrivs    = 38
+	prCapAmbient       = 47
+	prCapAmbientClrAll = 4
+)
+
+// sandbox rewrites a command to start through the sandbox stage. cred is
+// the account the stage drops to; without it the process keeps the
+// starter's account, and an unprivileged starter gets a user namespace to
+// be allowed to create the others.
+func (spec *Spec) sandbox(cmd *exec.Cmd, cred *syscall.Credential) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate executable: %w", err)
+	}
+	stage, err := json.Marshal(sandboxStage{
+		Sandbox:    spec.Sandbox,
+		Credential: cred,
+		Path:       spec.Path,
+		Args:       spec.Args,
+		Dir:        cmd.Dir,
+	})
+	if err != nil {
+		return err
+	}
+	cmd.Path = exe
+	cmd.Args = []string{exe, "--sandbox", string(stage)}
+	// The working directory may only exist inside the sandbox
+	cmd.Dir = "/"
+
+	attr := cmd.SysProcAttr
+	attr.Cloneflags = syscall.CLONE_NEWNS
+	if spec.Sandbox.PID {
+		attr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	if spec.Sandbox.NoNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if cred == nil && os.Geteuid() != 0 {
+		uid, gid := os.Getuid(), os.Getgid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+		attr.AmbientCaps = []uintptr{capSysAdmin, capNetAdmin}
+	}
+	return nil
+}
+
+// RunSandbox runs the sandbox stage, with the JSON sandboxStage given after
+// --sandbox. It only returns on failure.
+func RunSandbox(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: --sandbox <stage>")
+	}
+	var stage sandboxStage
+	if err := json.Unmarshal([]byte(args[0]), &stage); err != nil || stage.Sandbox == nil {
+		return fmt.Errorf("invalid stage")
+	}
+
+	// No-new-privs and ambient capabilities are per thread, so stay on
+	// the one that executes
+	runtime.LockOSThread()
+
+	// Keep our mounts from propagating back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+
+	// The layout may hide the executable, in particular the daemon binary
+	// for holders
+	exe, err := os.OpenFile(stage.Path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	var tmpfs []string
+	for _, m := range stage.Sandbox.Mounts {
+		if err := mountEntry(m, tmpfs); err != nil {
+			return fmt.Errorf("mount %s: %w", m.Target, err)
+		}
+		if m.Type == "tmpfs" {
+			tmpfs = append(tmpfs, m.Target)
+		}
+	}
+	for _, dir := range stage.Sandbox.Hide {
+		if err := hide(dir); err != nil {
+			return fmt.Errorf("hide %s: %w", dir, err)
+		}
+	}
+	if stage.Sandbox.PID {
+		if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("mount /proc: %w", err)
+		}
+	}
+	if stage.Sandbox.NoNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("loopback: %w", err)
+		}
+	}
+
+	if err := os.Chdir(stage.Dir); err != nil {
+		return fmt.Errorf("working directory %s is not in the sandbox", stage.Dir)
+	}
+
+	if c := stage.Credential; c != nil {
+		groups := make([]int, len(c.Groups))
+		for i, g := range c.Groups {
+			groups[i] = int(g)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(int(c.Gid)); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+		if err := syscall.Setuid(int(c.Uid)); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+	// Nothing inside gains privileges, not even through setuid binaries
+	prctl(prCapAmbient, prCapAmbientClrAll)
+	if err := prctl(prSetNoNewPrivs, 1); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+
+	argv := append([]string{stage.Path}, stage.Args...)
+	err = syscall.Exec(stage.Path, argv, os.Environ())
+	if errors.Is(err, syscall.ENOENT) {
+		err = syscall.Exec(fmt.Sprintf("/proc/self/fd/%d", exe.Fd()), argv, os.Environ())
+	}
+	return fmt.Errorf("exec %s: %w", stage.Path, err)
+}
+
+// mountEntry applies one entry of the mount layout. A missing mount point
+// is only created inside one of the tmpfs mounted before; anywhere else it
+// would be created on the host, as root.
+func mountEntry(m config.Mount, tmpfs []string) error {
+	if _, err := os.Stat(m.Target); os.IsNotExist(err) {
+		if !inTmpfs(m.Target, tmpfs) {
+			return fmt.Errorf("mount point does not exist")
+		}
+		if err := os.MkdirAll(m.Target, 0755); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	switch m.Type {
+	case "tmpfs":
+		return syscall.Mount("tmpfs", m.Target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+	case "ro", "rw":
+		if err := syscall.Mount(m.Source, m.Target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+		// Bind mounts copy the source's flags, which may be read-only
+		// from an earlier entry
+		return remount(m.Target, m.Type == "ro")
+	}
+	return fmt.Errorf("unknown mount type %q", m.Type)
+}
+
+// inTmpfs reports whether a path is below one of the tmpfs mount points
+func inTmpfs(path string, tmpfs []string) bool {
+	for _, dir := range tmpfs {
+		if strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hide covers a directory with an empty read-only tmpfs, if it is visible
+// in the layout
+func hide(dir string) error {
+	if fi, err := os.Stat(dir); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0755")
+}
+
+// remount makes a mount and every mount below it read-only or writable,
+// except for the kernel's virtual filesystems
+func remount(target string, readOnly bool) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Flags a mount already has must be kept, a user namespace can't
+	// clear them
+	keep := map[string]uintptr{
+		"nosuid":     syscall.MS_NOSUID,
+		"nodev":      syscall.MS_NODEV,
+		"noexec":     syscall.MS_NOEXEC,
+		"noatime":    syscall.MS_NOATIME,
+		"nodiratime": syscall.MS_NODIRATIME,
+		"relatime":   syscall.MS_RELATIME,
+	}
+	type mountPoint struct {
+		path  string
+		flags uintptr
+	}
+	var mountPoints []mountPoint
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mount-point options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mp := unescapeMountInfo(fields[4])
+		if mp != target && !strings.HasPrefix(mp, strings.TrimSuffix(target, "/")+"/") {
+			continue
+		}
+		if mp != target && isVirtualMount(mp) {
+			continue
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT)
+		if readOnly {
+			flags |= syscall.MS_RDONLY
+		}
+		for _, opt := range strings.Split(fields[5], ",") {
+			flags |= keep[opt]
+		}
+		mountPoints = append(mountPoints, mountPoint{mp, flags})
+	}
+
+	for _, mp := range mountPoints {
+		if err := syscall.Mount("", mp.path, "", mp.flags, ""); err != nil {
+			return fmt.Errorf("remount %s: %w", mp.path, err)
+		}
+	}
+	return nil
+}
+
+func isVirtualMount(mp string) bool {
+	for _, dir := range []string{"/proc", "/sys", "/dev"} {
+		if mp == dir || strings.HasPrefix(mp, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeMountInfo decodes the octal escapes mountinfo uses for spaces
+// and the like
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%3o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// loopbackUp brings up lo in a new network namespace, where it starts down
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq: the name, then a union holding the flags
+	var ifr [40]byte
+	copy(ifr[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	flags := *(*uint16)(unsafe.Pointer(&ifr[16])) | syscall.IFF_UP
+	*(*uint16)(unsafe.Pointer(&ifr[16])) = flags
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func prctl(option, arg uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package privsep
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eddison/sshttp/server/internal/config"
+)
+
+// The test binary plays the daemon binary for the sandbox stage
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "--sandbox" {
+		fmt.Fprintln(os.Stderr, RunSandbox(os.Args[2:]))
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// runSandboxed runs a shell script with arguments in a sandbox and returns
+// its exit code and output
+func runSandboxed(t *testing.T, sb *config.Sandbox, script string, args ...string) (int, string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	spec := &Spec{Path: "/bin/sh", Args: append([]string{"-c", script, "sh"}, args...), Dir: "/", Sandbox: sb}
+	proc, err := Local{}.Start(spec, []*os.File{nil, w, w})
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	out.ReadFrom(r)
+	return proc.Wait(), out.String()
+}
+
+func TestSandboxHidesDataDir(t *testing.T) {
+	data := t.TempDir()
+	if err := os.WriteFile(filepath.Join(data, ".jwt_secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sb := &config.Sandbox{Name: "test", Mounts: []config.Mount{{Type: "rw", Source: "/", Target: "/"}}, Hide: []string{data}}
+	code, out := runSandboxed(t, sb, `ls -A "$1"; touch "$1/x" 2>/dev/null || echo read-only`, data)
+	if code != 0 || out != "read-only\n" {
+		t.Fatalf("data directory in the sandbox: exit %d, %q; want it empty and read-only", code, out)
+	}
+}
+
+func TestSandboxMountPoints(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("shared\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Created inside a tmpfs of the layout
+	sb := &config.Sandbox{Name: "test", Mounts: []config.Mount{
+		{Type: "tmpfs", Target: "/mnt"},
+		{Type: "ro", Source: src, Target: "/mnt/new/dir"},
+	}}
+	if code, out := runSandboxed(t, sb, `cat /mnt/new/dir/file`); code != 0 || out != "shared\n" {
+		t.Fatalf("mount in tmpfs: exit %d, %q", code, out)
+	}
+
+	// Never on the host
+	missing := filepath.Join(t.TempDir(), "missing")
+	sb = &config.Sandbox{Name: "test", Mounts: []config.Mount{{Type: "ro", Source: src, Target: missing}}}
+	if code, out := runSandboxed(t, sb, `true`); code == 0 || !strings.Contains(out, "mount point does not exist") {
+		t.Fatalf("mount on a missing host path: exit %d, %q", code, out)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("mount point created on the host: %v", err)
+	}
+}
@@ -0,0 +1,463 @@
+package privsep
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// In multi_user mode the daemon drops root right after startup. Before it
+// does, it starts the spawner: the daemon binary re-executed with
+// --spawner, which keeps root and does nothing but start processes as the
+// mapped user accounts and signal the processes it started. The two talk
+// over a SOCK_SEQPACKET socket pair, one JSON message per packet, with the
+// new process's files passed alongside as SCM_RIGHTS.
+
+// spawnerProcessName is the process name the spawner runs under
+const spawnerProcessName = "sshttpd-spawner"
+
+// Bounds for one spawner message and the files passed with it
+const (
+	maxSpawnerMsgSize = 1024 * 1024
+	maxSpawnerFiles   = 16
+)
+
+// spawnerConfig is sent to the spawner on stdin
+type spawnerConfig struct {
+	DaemonUid  uint32 `json:"daemonUid"` // The account the daemon drops to
+	DaemonGid  uint32 `json:"daemonGid"`
+	CgroupRoot string `json:"cgroupRoot,omitempty"` // Processes may only be placed below it
+}
+
+// spawnerMsg is a request, a reply or an exit notification
+type spawnerMsg struct {
+	ID     uint64 `json:"id,omitempty"`
+	Op     string `json:"op,omitempty"` // "start", "signal", or "exit" from the spawner
+	Spec   *Spec  `json:"spec,omitempty"`
+	Files  []int  `json:"files,omitempty"` // Index into the passed descriptors per file, -1 for none
+	Pid    int    `json:"pid,omitempty"`
+	Signal int    `json:"signal,omitempty"`
+	Group  bool   `json:"group,omitempty"`
+	Code   int    `json:"code,omitempty"` // Exit code
+	Error  string `json:"error,omitempty"`
+}
+
+// Spawner is the daemon's connection to the spawner. It implements Starter.
+type Spawner struct {
+	conn    *net.UnixConn
+	writeMu sync.Mutex // Serializes requests
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*spawnerCall
+	procs   map[int]*Process
+	err     error // Set once the spawner is gone
+}
+
+type spawnerCall struct {
+	reply spawnerMsg
+	proc  *Process // Set for a successful start
+	done  chan struct{}
+}
+
+// StartSpawner starts the spawner. It must be called while the daemon is
+// still root, before DropPrivileges to the daemon account.
+func StartSpawner(daemon *Account, cgroupRoot string) (*Spawner, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("locate executable: %w", err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create spawner socket: %w", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "spawner")
+	remote := os.NewFile(uintptr(fds[1]), "spawner")
+	defer local.Close()
+	defer remote.Close()
+
+	cfgJSON, _ := json.Marshal(spawnerConfig{
+		DaemonUid:  daemon.Uid,
+		DaemonGid:  daemon.Gid,
+		CgroupRoot: cgroupRoot,
+	})
+	cmd := exec.Command(exe, "--spawner")
+	cmd.Stdin = bytes.NewReader(cfgJSON)
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start spawner: %w", err)
+	}
+	go cmd.Wait()
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("spawner connection: %w", err)
+	}
+	s := &Spawner{
+		conn:    conn.(*net.UnixConn),
+		pending: make(map[uint64]*spawnerCall),
+		procs:   make(map[int]*Process),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// Start asks the spawner to start a process as spec.User
+func (s *Spawner) Start(spec *Spec, files []*os.File) (*Process, error) {
+	if spec.User == "" {
+		return nil, fmt.Errorf("multi_user requires an account for every process")
+	}
+	msg := spawnerMsg{Op: "start", Spec: spec, Files: make([]int, len(files))}
+	var fds []int
+	for i, f := range files {
+		msg.Files[i] = -1
+		if f != nil {
+			msg.Files[i] = len(fds)
+			fds = append(fds, int(f.Fd()))
+		}
+	}
+	call, err := s.call(&msg, fds)
+	if err != nil {
+		return nil, err
+	}
+	return call.proc, nil
+}
+
+func (s *Spawner) signal(pid int, sig syscall.Signal, group bool) error {
+	_, err := s.call(&spawnerMsg{Op: "signal", Pid: pid, Signal: int(sig), Group: group}, nil)
+	return err
+}
+
+// call sends a request and waits for its reply
+func (s *Spawner) call(msg *spawnerMsg, fds []int) (*spawnerCall, error) {
+	call := &spawnerCall{done: make(chan struct{})}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	msg.ID = s.nextID
+	s.pending[msg.ID] = call
+	s.mu.Unlock()
+
+	data, _ := json.Marshal(msg)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	s.writeMu.Lock()
+	_, _, err := s.conn.WriteMsgUnix(data, oob, nil)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.mu.Lock()
+		delete(s.pending, msg.ID)
+		s.mu.Unlock()
+		return nil, fmt.Errorf("spawner: %w", err)
+	}
+
+	<-call.done
+	if call.reply.Error != "" {
+		return nil, errors.New(call.reply.Error)
+	}
+	return call, nil
+}
+
+// readLoop dispatches replies and exit notifications from the spawner
+func (s *Spawner) readLoop() {
+	buf := make([]byte, maxSpawnerMsgSize)
+	for {
+		n, _, _, _, err := s.conn.ReadMsgUnix(buf, nil)
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		var msg spawnerMsg
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			log.Printf("spawner: invalid message: %v", err)
+			continue
+		}
+
+		s.mu.Lock()
+		if msg.Op == "exit" {
+			if p, ok := s.procs[msg.Pid]; ok {
+				delete(s.procs, msg.Pid)
+				p.exited(msg.Code)
+			}
+		} else if call, ok := s.pending[msg.ID]; ok {
+			delete(s.pending, msg.ID)
+			call.reply = msg
+			// Registered before any exit notification for it is read
+			if msg.Error == "" && msg.Pid != 0 && msg.Op == "start" {
+				pid := msg.Pid
+				call.proc = newProcess(pid, func(sig syscall.Signal, group bool) error {
+					return s.signal(pid, sig, group)
+				})
+				s.procs[pid] = call.proc
+			}
+			close(call.done)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// fail fails pending and future calls once the spawner is gone. Processes
+// it started can no longer be tracked and are reported as exited.
+func (s *Spawner) fail(err error) {
+	log.Printf("spawner exited: %v", err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = fmt.Errorf("spawner is not running")
+	for id, call := range s.pending {
+		delete(s.pending, id)
+		call.reply.Error = s.err.Error()
+		close(call.done)
+	}
+	for pid, p := range s.procs {
+		delete(s.procs, pid)
+		p.exited(-1)
+	}
+}
+
+// spawner is the privileged side
+type spawner struct {
+	conn *net.UnixConn
+	cfg  spawnerConfig
+
+	mu    sync.Mutex // Serializes writes and guards procs
+	procs map[int]*Spec
+}
+
+// RunSpawner runs the spawner. It is invoked by the daemon re-executing
+// itself with --spawner: the socket is inherited as fd 3 and the
+// spawnerConfig is read from stdin. It returns once the daemon is gone.
+func RunSpawner() error {
+	os.WriteFile("/proc/self/comm", []byte(spawnerProcessName), 0)
+
+	// The daemon handles terminal signals; we exit when its socket closes
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE)
+
+	var cfg spawnerConfig
+	if err := json.NewDecoder(os.Stdin).Decode(&cfg); err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	os.Stdin.Close()
+
+	// FileConn dups the socket; close the original so the processes we
+	// start don't keep it open after the daemon is gone
+	f := os.NewFile(3, "spawner")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("inherit socket: %w", err)
+	}
+	sp := &spawner{conn: conn.(*net.UnixConn), cfg: cfg, procs: make(map[int]*Spec)}
+	defer sp.killAll()
+
+	buf := make([]byte, maxSpawnerMsgSize)
+	oob := make([]byte, syscall.CmsgSpace(maxSpawnerFiles*4))
+	for {
+		n, oobn, _, _, err := sp.conn.ReadMsgUnix(buf, oob)
+		if err != nil || n == 0 {
+			return nil
+		}
+		files := receiveFiles(oob[:oobn])
+		var msg spawnerMsg
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			closeFiles(files)
+			continue
+		}
+
+		reply := spawnerMsg{ID: msg.ID, Op: msg.Op}
+		switch msg.Op {
+		case "start":
+			cmd, err := sp.start(&msg, files)
+			if err != nil {
+				reply.Error = err.Error()
+				sp.send(&reply)
+				break
+			}
+			reply.Pid = cmd.Process.Pid
+			sp.send(&reply)
+			// Only after the reply, so the daemon knows the pid first
+			go sp.wait(cmd)
+		case "signal":
+			if err := sp.signal(&msg); err != nil {
+				reply.Error = err.Error()
+			}
+			sp.send(&reply)
+		default:
+			reply.Error = fmt.Sprintf("unknown op %q", msg.Op)
+			sp.send(&reply)
+		}
+		closeFiles(files)
+	}
+}
+
+func receiveFiles(oob []byte) []*os.File {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	var files []*os.File
+	for _, m := range msgs {
+		fds, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "passed"))
+		}
+	}
+	return files
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func (sp *spawner) send(msg *spawnerMsg) {
+	data, _ := json.Marshal(msg)
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.conn.Write(data)
+}
+
+// start starts a process as the requested account, which must exist and
+// must not be root
+func (sp *spawner) start(msg *spawnerMsg, passed []*os.File) (*exec.Cmd, error) {
+	spec := msg.Spec
+	if spec == nil || spec.User == "" {
+		return nil, fmt.Errorf("no account given")
+	}
+	acct, err := LookupAccount(spec.User)
+	if err != nil {
+		return nil, err
+	}
+	if acct.Uid == 0 {
+		return nil, fmt.Errorf("refusing to start processes as root")
+	}
+	if spec.Cgroup != "" {
+		rel, err := filepath.Rel(sp.cfg.CgroupRoot, filepath.Clean(spec.Cgroup))
+		if sp.cfg.CgroupRoot == "" || err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("cgroup outside cgroup_root")
+		}
+	}
+
+	files := make([]*os.File, len(msg.Files))
+	for i, idx := range msg.Files {
+		if idx >= 0 && idx < len(passed) {
+			files[i] = passed[idx]
+		}
+	}
+	for _, i := range spec.HandOver {
+		if i < 0 || i >= len(files) || files[i] == nil {
+			return nil, fmt.Errorf("invalid hand-over file %d", i)
+		}
+		if err := sp.handOver(files[i], acct); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := spec.command(files)
+	cmd.Env = append(cmd.Env, acct.loginVars()...)
+	if cmd.Dir == "" {
+		cmd.Dir = acct.Home
+	}
+	groups := acct.Groups
+	if groups == nil {
+		groups = []uint32{}
+	}
+	cred := &syscall.Credential{Uid: acct.Uid, Gid: acct.Gid, Groups: groups}
+	if spec.Sandbox != nil {
+		// The stage drops to the account once the namespaces are set up
+		if err := spec.sandbox(cmd, cred); err != nil {
+			return nil, err
+		}
+	} else {
+		cmd.SysProcAttr.Credential = cred
+	}
+	if err := spec.start(cmd); err != nil {
+		return nil, err
+	}
+
+	sp.mu.Lock()
+	sp.procs[cmd.Process.Pid] = spec
+	sp.mu.Unlock()
+	return cmd, nil
+}
+
+// handOver gives one of the daemon's directories to an account. The daemon
+// keeps access through the group, which new files inherit.
+func (sp *spawner) handOver(f *os.File, acct *Account) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR || st.Uid != sp.cfg.DaemonUid {
+		return fmt.Errorf("only the daemon's own directories can be handed over")
+	}
+	if err := f.Chown(int(acct.Uid), int(sp.cfg.DaemonGid)); err != nil {
+		return err
+	}
+	return f.Chmod(os.ModeDir | os.ModeSetgid | 0770)
+}
+
+func (sp *spawner) wait(cmd *exec.Cmd) {
+	cmd.Wait()
+	sp.mu.Lock()
+	delete(sp.procs, cmd.Process.Pid)
+	sp.mu.Unlock()
+	sp.send(&spawnerMsg{Op: "exit", Pid: cmd.Process.Pid, Code: cmd.ProcessState.ExitCode()})
+}
+
+// signal signals a process the spawner started and that is still running
+func (sp *spawner) signal(msg *spawnerMsg) error {
+	sp.mu.Lock()
+	_, ok := sp.procs[msg.Pid]
+	sp.mu.Unlock()
+	if !ok || msg.Pid <= 0 {
+		return fmt.Errorf("no such process")
+	}
+	if msg.Group {
+		return syscall.Kill(-msg.Pid, syscall.Signal(msg.Signal))
+	}
+	return syscall.Kill(msg.Pid, syscall.Signal(msg.Signal))
+}
+
+// killAll kills the processes that would have been stopped by the daemon.
+// Processes in their own session, like holders, are left running.
+func (sp *spawner) killAll() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for pid, spec := range sp.procs {
+		if spec.Setsid {
+			continue
+		}
+		if spec.Setpgid {
+			syscall.Kill(-pid, syscall.SIGKILL)
+		} else {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package privsep
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/eddison/sshttp/server/internal/config"
+)
+
+// Spec describes a process to start
+type Spec struct {
+	User    string   `json:"user,omitempty"` // Account to run as, empty for the daemon's own
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"` // Excluding argv[0]
+	Env     []string `json:"env,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+	Setsid  bool     `json:"setsid,omitempty"`  // Own session, so the process outlives the daemon
+	Setpgid bool     `json:"setpgid,omitempty"` // Own process group, signalled as a whole
+	Cgroup  string   `json:"cgroup,omitempty"`  // cgroup v2 directory the process starts in
+
+	// Namespaces to start the process in, nil for the host's
+	Sandbox *config.Sandbox `json:"sandbox,omitempty"`
+
+	// Directories among the files that are handed over to the account, so
+	// it can write to them while the daemon keeps group access
+	HandOver []int `json:"handOver,omitempty"`
+}
+
+// Starter starts processes. The files become the process's stdin, stdout,
+// stderr and then fd 3 onwards; nil entries are connected to /dev/null.
+// The caller keeps ownership of the files and may close them once Start
+// returns.
+type Starter interface {
+	Start(spec *Spec, files []*os.File) (*Process, error)
+}
+
+// Process is a process started by a Starter
+type Process struct {
+	Pid int
+
+	done   chan struct{}
+	code   int
+	signal func(sig syscall.Signal, group bool) error
+}
+
+func newProcess(pid int, signal func(sig syscall.Signal, group bool) error) *Process {
+	return &Process{Pid: pid, done: make(chan struct{}), signal: signal}
+}
+
+func (p *Process) exited(code int) {
+	p.code = code
+	close(p.done)
+}
+
+// Done returns a channel that is closed once the process has exited
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until the process exits and returns its exit code, or -1 if
+// it was killed by a signal
+func (p *Process) Wait() int {
+	<-p.done
+	return p.code
+}
+
+// Signal sends a signal to the process, or to its whole process group
+func (p *Process) Signal(sig syscall.Signal, group bool) error {
+	select {
+	case <-p.done:
+		return os.ErrProcessDone
+	default:
+	}
+	return p.signal(sig, group)
+}
+
+// Local starts processes as the daemon's own account. It is used unless
+// multi_user is enabled.
+type Local struct{}
+
+func (Local) Start(spec *Spec, files []*os.File) (*Process, error) {
+	if spec.User != "" {
+		if current, err := CurrentAccount(); err != nil || current.Username != spec.User {
+			return nil, fmt.Errorf("cannot start processes as %s without multi_user", spec.User)
+		}
+	}
+	cmd := spec.command(files)
+	if spec.Sandbox != nil {
+		if err := spec.sandbox(cmd, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := spec.start(cmd); err != nil {
+		return nil, err
+	}
+	return watch(cmd), nil
+}
+
+// command builds the exec.Cmd for a spec, without credentials
+func (spec *Spec) command(files []*os.File) *exec.Cmd {
+	cmd := exec.Command(spec.Path, spec.Args...)
+	cmd.Env = spec.Env
+	cmd.Dir = spec.Dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: spec.Setsid, Setpgid: spec.Setpgid}
+
+	// exec.Cmd leaves a nil *os.File as nil, which it connects to /dev/null
+	file := func(i int) *os.File {
+		if i < len(files) {
+			return files[i]
+		}
+		return nil
+	}
+	if f := file(0); f != nil {
+		cmd.Stdin = f
+	}
+	if f := file(1); f != nil {
+		cmd.Stdout = f
+	}
+	if f := file(2); f != nil {
+		cmd.Stderr = f
+	}
+	if len(files) > 3 {
+		cmd.ExtraFiles = files[3:]
+	}
+	return cmd
+}
+
+// start starts the command, directly in the spec's cgroup if it has one so
+// that nothing escapes the cgroup's limits (CLONE_INTO_CGROUP)
+func (spec *Spec) start(cmd *exec.Cmd) error {
+	if spec.Cgroup == "" {
+		return cmd.Start()
+	}
+	cg, err := os.Open(spec.Cgroup)
+	if err != nil {
+		return fmt.Errorf("open cgroup: %w", err)
+	}
+	defer cg.Close()
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.Fd())
+	return cmd.Start()
+}
+
+// watch reaps a started command and returns it as a Process
+func watch(cmd *exec.Cmd) *Process {
+	pid := cmd.Process.Pid
+	p := newProcess(pid, func(sig syscall.Signal, group bool) error {
+		if group {
+			return syscall.Kill(-pid, sig)
+		}
+		return cmd.Process.Signal(sig)
+	})
+	go func() {
+		cmd.Wait()
+		p.exited(cmd.ProcessState.ExitCode())
+	}()
+	return p
+}
@@ -0,0 +1,135 @@
+package pty
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/recording"
+)
+
+// Backend runs a session's shell and carries its I/O. Sessions normally
+// run on a local PTY owned by a holder process; other backends reach
+// shells elsewhere, such as tmux windows. A Session keeps everything else:
+// the screen, scrollback, viewers, recording and command events.
+type Backend interface {
+	// Read returns the next output of the shell. It fails once the shell
+	// has exited or the backend is gone.
+	Read() ([]byte, error)
+	// Write sends input to the shell
+	Write(p []byte) error
+	Resize(cols, rows uint16) error
+	// Signal sends a signal to a process of the session, or to the
+	// terminal's foreground process group if pid is 0. Pids are as seen by
+	// the daemon.
+	Signal(pid int, sig syscall.Signal) error
+	// Wait returns the shell's exit code, -1 if unknown, and how many
+	// processes a teardown had to terminate. It is called once Read failed.
+	Wait() (code, terminated int)
+	// Terminate starts tearing the shell and its processes down, with
+	// grace between the stages if the backend has them. Read fails once
+	// that is done.
+	Terminate(grace time.Duration) error
+	// Close releases the daemon's end, leaving the shell as it is
+	Close() error
+	// Pid returns the shell's pid as seen by the daemon
+	Pid() int
+	// Cwd returns the shell's working directory
+	Cwd() (string, error)
+}
+
+// Screen is the output a backend already has when a session is set up on
+// it, to rebuild the screen from
+type Screen struct {
+	Cols, Rows     int
+	Data           []byte // The latest output
+	Offset         uint64 // Output offset just past Data
+	ScrollbackSize int    // Bytes of output kept in memory, 0 for the default
+}
+
+// AddSession registers a session for a shell that an external backend
+// already started
+func (m *SessionManager) AddSession(userID, name string, b Backend, screen Screen) *Session {
+	return m.register(sessionMeta{
+		ID:        generateID(),
+		UserID:    userID,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}, b, screen)
+}
+
+// SetBackend has sessions that would run a local shell run on the backend
+// start returns instead, such as an in-memory one in tests
+func (m *SessionManager) SetBackend(start func(opts SessionOptions) (Backend, error)) {
+	m.startBackend = start
+}
+
+// createOn opens a session on a backend from the function given to
+// SetBackend
+func (m *SessionManager) createOn(userID string, opts SessionOptions) (*Session, error) {
+	b, err := m.startBackend(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = fmt.Sprintf("Session %d", m.countUserSessions(userID)+1)
+	}
+	sessionAccount := ""
+	if opts.Account != nil {
+		sessionAccount = opts.Account.Username
+	}
+	session := m.register(sessionMeta{
+		ID:        generateID(),
+		UserID:    userID,
+		Name:      name,
+		Profile:   opts.Profile,
+		Account:   sessionAccount,
+		CreatedAt: time.Now(),
+	}, b, Screen{Cols: 80, Rows: 24})
+
+	if opts.Startup != "" {
+		startup := opts.Startup
+		if !strings.HasSuffix(startup, "\n") {
+			startup += "\n"
+		}
+		session.Write([]byte(startup))
+	}
+	return session, nil
+}
+
+// register sets up, records and starts a session that runs on b
+func (m *SessionManager) register(meta sessionMeta, b Backend, screen Screen) *Session {
+	session := m.newSession(meta)
+	if screen.ScrollbackSize == 0 {
+		screen.ScrollbackSize = m.scrollbackSize
+	}
+	session.start(b, screen, true)
+	if m.record {
+		rec, err := recording.Create(m.RecordingPath(meta.UserID, meta.ID), meta.Name)
+		if err != nil {
+			log.Printf("record session %s: %v", meta.ID, err)
+		} else {
+			session.recorder = rec
+		}
+	}
+	m.sessions.Store(session.ID, session)
+	go session.pump()
+	return session
+}
+
+// procCwd returns the working directory of a process
+func procCwd(pid int) (string, error) {
+	if pid == 0 {
+		return "", fmt.Errorf("process not running")
+	}
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err != nil {
+		return "", fmt.Errorf("read cwd: %w", err)
+	}
+	return cwd, nil
+}
@@ -0,0 +1,205 @@
+package pty
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/config"
+)
+
+// With cgroup_root set, every session gets its own cgroup v2 directory below
+// it, named after the session ID. The holder is started directly inside it,
+// so the shell and everything it runs share the session's limits. Exec
+// commands run in one cgroup per user, exec-<user ID>, with the same limits.
+
+// cgroup2SuperMagic is the filesystem type of a cgroup v2 mount
+const cgroup2SuperMagic = 0x63677270
+
+// cgroupControllers are the controllers session limits need
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+// cgroupTree is the delegated directory session cgroups are created in
+type cgroupTree struct {
+	root        string
+	controllers []string // Enabled for session cgroups
+}
+
+// openCgroupTree checks that root is a cgroup v2 directory and enables the
+// controllers for its children. Controllers that were not delegated are
+// skipped, and so are the limits that need them.
+func openCgroupTree(root string) (*cgroupTree, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return nil, fmt.Errorf("cgroup_root: %w", err)
+	}
+	if st.Type != cgroup2SuperMagic {
+		return nil, fmt.Errorf("cgroup_root %s is not on a cgroup v2 filesystem", root)
+	}
+
+	available, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("cgroup_root: %w", err)
+	}
+	tree := &cgroupTree{root: root}
+	var enable []string
+	for _, c := range cgroupControllers {
+		if slices.Contains(strings.Fields(string(available)), c) {
+			tree.controllers = append(tree.controllers, c)
+			enable = append(enable, "+"+c)
+		} else {
+			log.Printf("cgroup controller %s is not available in %s, its limits are ignored", c, root)
+		}
+	}
+	if len(enable) > 0 {
+		err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0)
+		if errors.Is(err, syscall.EBUSY) {
+			// The "no internal processes" rule
+			return nil, fmt.Errorf("cgroup_root %s must not contain processes itself, use a child cgroup", root)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("enable cgroup controllers: %w", err)
+		}
+	}
+	return tree, nil
+}
+
+// path returns the cgroup directory of a session
+func (t *cgroupTree) path(sessionID string) string {
+	return filepath.Join(t.root, sessionID)
+}
+
+// create makes a session's cgroup and applies its limits
+func (t *cgroupTree) create(sessionID string, limits config.ResourceLimits) (string, error) {
+	dir := t.path(sessionID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("create cgroup: %w", err)
+	}
+	if err := t.setLimits(dir, limits); err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// ExecCgroup returns the cgroup a user's exec commands start in, with the
+// limits applied, or "" without cgroup_root. All of a user's running
+// commands share it.
+func (m *SessionManager) ExecCgroup(userID string, limits config.ResourceLimits) (string, error) {
+	if m.cgroups == nil {
+		return "", nil
+	}
+	dir := m.cgroups.path("exec-" + userID)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("create cgroup: %w", err)
+	}
+	// Again every time, the configuration may have changed
+	if err := m.cgroups.setLimits(dir, limits); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// setLimits applies limits to a cgroup; a limit of 0 sets the kernel
+// default, in case the cgroup had another one before
+func (t *cgroupTree) setLimits(dir string, limits config.ResourceLimits) error {
+	set := func(controller, file, value string) error {
+		if !slices.Contains(t.controllers, controller) {
+			return nil
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+			return fmt.Errorf("set %s: %w", file, err)
+		}
+		return nil
+	}
+	limit := func(v int64) string {
+		if v <= 0 {
+			return "max"
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	weight := limits.CPUWeight
+	if weight <= 0 {
+		weight = 100
+	}
+	err := set("cpu", "cpu.weight", strconv.Itoa(weight))
+	if err == nil {
+		err = set("memory", "memory.max", limit(limits.MemoryMax))
+	}
+	if err == nil {
+		err = set("pids", "pids.max", limit(limits.PidsMax))
+	}
+	return err
+}
+
+// removeCgroup kills whatever is left in a session's cgroup and removes it.
+// A cgroup can only be removed once its processes are reaped, so removal is
+// retried in the background for a while.
+func removeCgroup(dir string) {
+	// cgroup.kill needs Linux 5.14; without it stragglers keep the cgroup
+	os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0)
+	if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+		return
+	}
+	go func() {
+		for range 50 {
+			time.Sleep(100 * time.Millisecond)
+			if err := os.Remove(dir); err == nil || os.IsNotExist(err) {
+				return
+			}
+		}
+		log.Printf("cgroup %s still has processes, leaving it", dir)
+	}()
+}
+
+// CgroupUsage is the current resource usage of a session's cgroup. Fields
+// whose controller is not enabled are 0.
+type CgroupUsage struct {
+	MemoryBytes int64 // memory.current
+	MemoryMax   int64 // memory.max, 0 for no limit
+	CPUUsec     int64 // Total CPU time used
+	Pids        int64 // pids.current
+	PidsMax     int64 // pids.max, 0 for no limit
+}
+
+// readCgroupUsage reads the usage counters of a session's cgroup
+func readCgroupUsage(dir string) (*CgroupUsage, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	read := func(file string) int64 {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return 0
+		}
+		n, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		return n // "max" parses as 0
+	}
+	usage := &CgroupUsage{
+		MemoryBytes: read("memory.current"),
+		MemoryMax:   read("memory.max"),
+		Pids:        read("pids.current"),
+		PidsMax:     read("pids.max"),
+	}
+
+	// cpu.stat is present even without the cpu controller
+	if f, err := os.Open(filepath.Join(dir, "cpu.stat")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if v, ok := strings.CutPrefix(scanner.Text(), "usage_usec "); ok {
+				usage.CPUUsec, _ = strconv.ParseInt(v, 10, 64)
+				break
+			}
+		}
+		f.Close()
+	}
+	return usage, nil
+}
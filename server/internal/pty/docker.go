@@ -0,0 +1,332 @@
+package pty
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dockerTimeout bounds Docker Engine API requests, other than the exec
+// stream itself
+const dockerTimeout = 10 * time.Second
+
+// dockerShell starts bash if the image has it, otherwise sh
+const dockerShell = "if command -v bash >/dev/null 2>&1; then exec bash -l; else exec sh -l; fi"
+
+// ErrContainersDisabled is returned when no Docker socket is configured
+var ErrContainersDisabled = errors.New("containers are not enabled")
+
+// Container is a running container shells can be opened in
+type Container struct {
+	ID     string
+	Name   string
+	Image  string
+	State  string
+	Labels map[string]string
+}
+
+// dockerClient talks to the Docker Engine API over its unix socket
+type dockerClient struct {
+	socket string
+	http   *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	return &dockerClient{
+		socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{DialContext: dial},
+			Timeout:   dockerTimeout,
+		},
+	}
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out, if not nil
+func (d *dockerClient) do(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://docker"+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return dockerError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// dockerError turns an error response into an error with its message
+func dockerError(resp *http.Response) error {
+	var e struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e)
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	return fmt.Errorf("docker: %s", e.Message)
+}
+
+// containers lists the running containers
+func (d *dockerClient) containers() ([]Container, error) {
+	var list []struct {
+		ID     string            `json:"Id"`
+		Names  []string          `json:"Names"`
+		Image  string            `json:"Image"`
+		State  string            `json:"State"`
+		Labels map[string]string `json:"Labels"`
+	}
+	if err := d.do("GET", "/containers/json", nil, &list); err != nil {
+		return nil, err
+	}
+	containers := make([]Container, 0, len(list))
+	for _, c := range list {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		containers = append(containers, Container{
+			ID:     c.ID,
+			Name:   name,
+			Image:  c.Image,
+			State:  c.State,
+			Labels: c.Labels,
+		})
+	}
+	return containers, nil
+}
+
+// startExec runs a command with a TTY in a container and returns the
+// hijacked connection carrying its I/O
+func (d *dockerClient) startExec(execID string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("unix", d.socket, dockerTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := `{"Detach":false,"Tty":true}`
+	req, _ := http.NewRequest("POST", "http://docker/exec/"+url.PathEscape(execID)+"/start", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// The stream follows the response headers, so the reader has to be
+	// kept for the data it already buffered
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		err := dockerError(resp)
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, br, nil
+}
+
+// dockerBackend runs a session in a docker exec with a TTY
+type dockerBackend struct {
+	client *dockerClient
+	execID string
+	conn   net.Conn
+	stream *bufio.Reader
+	pid    int // Host pid of the exec'd process
+	code   int // Set once the process has exited
+}
+
+// exec starts opts.Command, or a shell, with a TTY in opts.Container
+func (d *dockerClient) exec(opts SessionOptions, cols, rows int) (*dockerBackend, error) {
+	term := opts.Term
+	if term == "" {
+		term = "xterm-256color"
+	}
+	cmd := []string{"sh", "-c", dockerShell}
+	if opts.Command != "" {
+		cmd = append([]string{opts.Command}, opts.Args...)
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err := d.do("POST", "/containers/"+url.PathEscape(opts.Container.ID)+"/exec", map[string]any{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          true,
+		"Cmd":          cmd,
+		"User":         opts.ContainerUser,
+		"Env":          append([]string{"TERM=" + term}, opts.Env...),
+		"WorkingDir":   opts.Dir,
+		"ConsoleSize":  []int{rows, cols},
+	}, &created)
+	if err != nil {
+		return nil, err
+	}
+	conn, stream, err := d.startExec(created.ID)
+	if err != nil {
+		return nil, err
+	}
+	b := &dockerBackend{client: d, execID: created.ID, conn: conn, stream: stream, code: -1}
+	var inspect struct {
+		Pid int `json:"Pid"`
+	}
+	if err := d.do("GET", "/exec/"+url.PathEscape(created.ID)+"/json", nil, &inspect); err == nil {
+		b.pid = inspect.Pid
+	}
+	return b, nil
+}
+
+// createDocker opens a session in a container
+func (m *SessionManager) createDocker(userID string, opts SessionOptions) (*Session, error) {
+	if m.docker == nil {
+		return nil, ErrContainersDisabled
+	}
+	if opts.Sandbox != nil {
+		return nil, fmt.Errorf("%w: container sessions can't be sandboxed", ErrInvalidOptions)
+	}
+	if opts.Dir != "" && !filepath.IsAbs(opts.Dir) {
+		return nil, fmt.Errorf("%w: working directory in a container must be absolute", ErrInvalidOptions)
+	}
+	b, err := m.docker.exec(opts, 80, 24)
+	if err != nil {
+		return nil, err
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = opts.Container.Name
+	}
+	session := m.register(sessionMeta{
+		ID:        generateID(),
+		UserID:    userID,
+		Name:      name,
+		Profile:   opts.Profile,
+		Container: opts.Container.Name,
+		CreatedAt: time.Now(),
+	}, b, Screen{Cols: 80, Rows: 24})
+
+	if opts.Startup != "" {
+		startup := opts.Startup
+		if !strings.HasSuffix(startup, "\n") {
+			startup += "\n"
+		}
+		session.Write([]byte(startup))
+	}
+	return session, nil
+}
+
+// Containers lists the running containers, if a Docker socket is
+// configured
+func (m *SessionManager) Containers() ([]Container, error) {
+	if m.docker == nil {
+		return nil, ErrContainersDisabled
+	}
+	return m.docker.containers()
+}
+
+func (b *dockerBackend) Read() ([]byte, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := b.stream.Read(buf)
+		if n > 0 {
+			return buf[:n], nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	var inspect struct {
+		Running  bool `json:"Running"`
+		ExitCode int  `json:"ExitCode"`
+	}
+	if err := b.client.do("GET", "/exec/"+url.PathEscape(b.execID)+"/json", nil, &inspect); err == nil && !inspect.Running {
+		b.code = inspect.ExitCode
+	}
+	return nil, io.EOF
+}
+
+func (b *dockerBackend) Write(p []byte) error {
+	_, err := b.conn.Write(p)
+	return err
+}
+
+func (b *dockerBackend) Resize(cols, rows uint16) error {
+	return b.client.do("POST", fmt.Sprintf("/exec/%s/resize?h=%d&w=%d", url.PathEscape(b.execID), rows, cols), nil, nil)
+}
+
+// Signal signals the process directly; Docker has no API for signaling an
+// exec. That needs the daemon to be allowed to, and the exec's pid.
+func (b *dockerBackend) Signal(pid int, sig syscall.Signal) error {
+	if b.pid <= 0 {
+		return fmt.Errorf("process not running")
+	}
+	if pid == 0 {
+		foreground, err := foregroundGroup(b.pid)
+		if err != nil {
+			return err
+		}
+		pid = -foreground
+	}
+	return syscall.Kill(pid, sig)
+}
+
+func (b *dockerBackend) Wait() (int, int) {
+	return b.code, 0
+}
+
+// Terminate hangs up on the process and drops the stream. Docker can't
+// stop an exec, so what the process started in the container may be left.
+func (b *dockerBackend) Terminate(grace time.Duration) error {
+	if b.pid > 0 {
+		syscall.Kill(b.pid, syscall.SIGHUP)
+	}
+	return b.conn.Close()
+}
+
+func (b *dockerBackend) Close() error {
+	return b.conn.Close()
+}
+
+func (b *dockerBackend) Pid() int {
+	return b.pid
+}
+
+func (b *dockerBackend) Cwd() (string, error) {
+	return procCwd(b.pid)
+}
@@ -0,0 +1,373 @@
+package pty
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/eddison/sshttp/server/internal/config"
+	"github.com/eddison/sshttp/server/internal/privsep"
+)
+
+// dockerTestServer is a Docker Engine API on a unix socket. It has a
+// running container "c1" and a stopped one "c2". Execs run nothing: the
+// test plays the process on the hijacked connection.
+type dockerTestServer struct {
+	socket  string
+	streams chan net.Conn // Hijacked connections of started execs
+
+	mu    sync.Mutex
+	execs map[string]*dockerTestExec
+}
+
+type dockerTestExec struct {
+	container string
+	config    map[string]any // Body of the create request
+	resizes   []string       // e.g. "100x40"
+	running   bool
+	exitCode  int
+}
+
+func newDockerTestServer(t *testing.T) *dockerTestServer {
+	t.Helper()
+	s := &dockerTestServer{
+		socket:  filepath.Join(t.TempDir(), "docker.sock"),
+		streams: make(chan net.Conn, 4),
+		execs:   make(map[string]*dockerTestExec),
+	}
+	ln, err := net.Listen("unix", s.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/json", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"Id":"c1","Names":["/web"],"Image":"nginx","State":"running","Labels":{"app":"web"}}]`)
+	})
+	mux.HandleFunc("POST /containers/{id}/exec", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if id != "c1" && id != "c2" {
+			dockerTestError(w, http.StatusNotFound, "No such container: "+id)
+			return
+		}
+		var config map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			dockerTestError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.mu.Lock()
+		execID := fmt.Sprintf("exec%d", len(s.execs)+1)
+		s.execs[execID] = &dockerTestExec{container: id, config: config}
+		s.mu.Unlock()
+		fmt.Fprintf(w, `{"Id":%q}`, execID)
+	})
+	mux.HandleFunc("POST /exec/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		e := s.exec(r.PathValue("id"))
+		switch {
+		case e == nil:
+			dockerTestError(w, http.StatusNotFound, "No such exec instance: "+r.PathValue("id"))
+			return
+		case e.container == "c2":
+			dockerTestError(w, http.StatusConflict, "container c2 is not running")
+			return
+		case r.Header.Get("Upgrade") != "tcp":
+			dockerTestError(w, http.StatusBadRequest, "no upgrade requested")
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		e.running = true
+		s.mu.Unlock()
+		// The first output comes along with the headers
+		buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n$ ")
+		buf.Flush()
+		s.streams <- conn
+	})
+	mux.HandleFunc("POST /exec/{id}/resize", func(w http.ResponseWriter, r *http.Request) {
+		e := s.exec(r.PathValue("id"))
+		if e == nil {
+			dockerTestError(w, http.StatusNotFound, "No such exec instance: "+r.PathValue("id"))
+			return
+		}
+		s.mu.Lock()
+		e.resizes = append(e.resizes, r.URL.Query().Get("w")+"x"+r.URL.Query().Get("h"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("GET /exec/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		e := s.exec(r.PathValue("id"))
+		if e == nil {
+			dockerTestError(w, http.StatusNotFound, "No such exec instance: "+r.PathValue("id"))
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		fmt.Fprintf(w, `{"ID":%q,"Running":%v,"ExitCode":%d,"Pid":4242}`, r.PathValue("id"), e.running, e.exitCode)
+	})
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = ln
+	server.Start()
+	t.Cleanup(server.Close)
+	return s
+}
+
+func dockerTestError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"message":%q}`, msg)
+}
+
+func (s *dockerTestServer) exec(id string) *dockerTestExec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.execs[id]
+}
+
+// exit ends an exec's process with a code, or has Docker forget the exec
+// if code is negative
+func (s *dockerTestServer) exit(id string, conn net.Conn, code int) {
+	s.mu.Lock()
+	if code < 0 {
+		delete(s.execs, id)
+	} else {
+		s.execs[id].running = false
+		s.execs[id].exitCode = code
+	}
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func TestDockerExec(t *testing.T) {
+	server := newDockerTestServer(t)
+	d := newDockerClient(server.socket)
+
+	containers, err := d.containers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Container{{ID: "c1", Name: "web", Image: "nginx", State: "running", Labels: map[string]string{"app": "web"}}}
+	if !reflect.DeepEqual(containers, want) {
+		t.Fatalf("containers = %+v, want %+v", containers, want)
+	}
+
+	b, err := d.exec(SessionOptions{Container: &containers[0], ContainerUser: "alice", Env: []string{"LANG=C.UTF-8"}, Dir: "/srv"}, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	conn := <-server.streams
+	e := server.exec(b.execID)
+	wantConfig := map[string]any{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          true,
+		"Cmd":          []any{"sh", "-c", dockerShell},
+		"User":         "alice",
+		"Env":          []any{"TERM=xterm-256color", "LANG=C.UTF-8"},
+		"WorkingDir":   "/srv",
+		"ConsoleSize":  []any{24.0, 80.0},
+	}
+	if !reflect.DeepEqual(e.config, wantConfig) {
+		t.Fatalf("exec config = %v, want %v", e.config, wantConfig)
+	}
+	if b.Pid() != 4242 {
+		t.Fatalf("pid = %d, want the one from inspecting the exec", b.Pid())
+	}
+
+	// Output the server sent with the response headers isn't lost
+	if data, err := b.Read(); err != nil || string(data) != "$ " {
+		t.Fatalf("Read = %q, %v; want the prompt", data, err)
+	}
+	if err := b.Write([]byte("ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "ls\r" {
+		t.Fatalf("server got %q, %v; want the input", buf[:n], err)
+	}
+	conn.Write([]byte("file.txt\r\n"))
+	if data, err := b.Read(); err != nil || string(data) != "file.txt\r\n" {
+		t.Fatalf("Read = %q, %v; want the output", data, err)
+	}
+
+	if err := b.Resize(100, 40); err != nil {
+		t.Fatal(err)
+	}
+	if e := server.exec(b.execID); !reflect.DeepEqual(e.resizes, []string{"100x40"}) {
+		t.Fatalf("resizes = %v, want 100x40", e.resizes)
+	}
+
+	server.exit(b.execID, conn, 3)
+	if _, err := b.Read(); err != io.EOF {
+		t.Fatalf("Read after exit = %v, want EOF", err)
+	}
+	if code, _ := b.Wait(); code != 3 {
+		t.Fatalf("exit code = %d, want 3", code)
+	}
+}
+
+func TestDockerExecCommand(t *testing.T) {
+	server := newDockerTestServer(t)
+	d := newDockerClient(server.socket)
+
+	b, err := d.exec(SessionOptions{Container: &Container{ID: "c1"}, Command: "top", Args: []string{"-d", "1"}, Term: "xterm"}, 120, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	conn := <-server.streams
+	e := server.exec(b.execID)
+	if cmd := e.config["Cmd"]; !reflect.DeepEqual(cmd, []any{"top", "-d", "1"}) {
+		t.Fatalf("Cmd = %v, want the command as is", cmd)
+	}
+	if env := e.config["Env"]; !reflect.DeepEqual(env, []any{"TERM=xterm"}) {
+		t.Fatalf("Env = %v, want the TERM asked for", env)
+	}
+	if size := e.config["ConsoleSize"]; !reflect.DeepEqual(size, []any{50.0, 120.0}) {
+		t.Fatalf("ConsoleSize = %v, want rows and columns", size)
+	}
+
+	// Docker may forget an exec before its exit code is asked for
+	b.Read()
+	server.exit(b.execID, conn, -1)
+	if _, err := b.Read(); err != io.EOF {
+		t.Fatalf("Read after exit = %v, want EOF", err)
+	}
+	if code, _ := b.Wait(); code != -1 {
+		t.Fatalf("exit code = %d, want -1 for unknown", code)
+	}
+	if err := b.Resize(80, 24); err == nil || !strings.Contains(err.Error(), "No such exec instance") {
+		t.Fatalf("Resize of a forgotten exec = %v, want Docker's error", err)
+	}
+}
+
+func TestDockerExecErrors(t *testing.T) {
+	server := newDockerTestServer(t)
+	d := newDockerClient(server.socket)
+
+	_, err := d.exec(SessionOptions{Container: &Container{ID: "nope"}}, 80, 24)
+	if err == nil || err.Error() != "docker: No such container: nope" {
+		t.Fatalf("exec in a missing container = %v, want Docker's message", err)
+	}
+	_, err = d.exec(SessionOptions{Container: &Container{ID: "c2"}}, 80, 24)
+	if err == nil || err.Error() != "docker: container c2 is not running" {
+		t.Fatalf("exec in a stopped container = %v, want Docker's message", err)
+	}
+	if _, _, err := d.startExec("missing"); err == nil || !strings.Contains(err.Error(), "No such exec instance") {
+		t.Fatalf("starting a missing exec = %v, want Docker's message", err)
+	}
+
+	gone := newDockerClient(filepath.Join(t.TempDir(), "gone.sock"))
+	if _, err := gone.containers(); err == nil {
+		t.Fatal("listed containers without a Docker daemon")
+	}
+	if _, err := gone.exec(SessionOptions{Container: &Container{ID: "c1"}}, 80, 24); err == nil {
+		t.Fatal("started an exec without a Docker daemon")
+	}
+}
+
+func TestDockerSession(t *testing.T) {
+	server := newDockerTestServer(t)
+	cfg := config.Load(t.TempDir())
+	m := NewSessionManager(cfg, privsep.Local{})
+	container := &Container{ID: "c1", Name: "web"}
+
+	if _, err := m.CreateWithOptions("u1", SessionOptions{Container: container}); !errors.Is(err, ErrContainersDisabled) {
+		t.Fatalf("create without a Docker socket = %v, want ErrContainersDisabled", err)
+	}
+
+	cfg.DockerSocket = server.socket
+	m = NewSessionManager(cfg, privsep.Local{})
+	_, err := m.CreateWithOptions("u1", SessionOptions{Container: container, Dir: "srv"})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("create with a relative directory = %v, want ErrInvalidOptions", err)
+	}
+	_, err = m.CreateWithOptions("u1", SessionOptions{Container: container, Sandbox: &config.Sandbox{Name: "jail"}})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("create in a sandbox = %v, want ErrInvalidOptions", err)
+	}
+
+	session, err := m.CreateWithOptions("u1", SessionOptions{Container: container, Startup: "make"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Name != "web" || session.Container != "web" {
+		t.Fatalf("session %q in %q, want both named after the container", session.Name, session.Container)
+	}
+	conn := <-server.streams
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "make\n" {
+		t.Fatalf("server got %q, %v; want the startup input", buf[:n], err)
+	}
+
+	server.exit(session.backend.(*dockerBackend).execID, conn, 2)
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session didn't end with the exec")
+	}
+	if code, _ := session.Wait(); code != 2 {
+		t.Fatalf("exit code = %d, want 2", code)
+	}
+}
+
+// Docker has no API for signals, so they are sent to the exec's processes
+// directly. Only groups of the exec's own process tree may be signalled.
+func TestDockerSignal(t *testing.T) {
+	// Without a controlling terminal there is no foreground group, and
+	// tpgid is -1
+	cmd := exec.Command("sleep", "100")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	b := &dockerBackend{pid: cmd.Process.Pid}
+	if err := b.Signal(0, syscall.SIGTERM); err == nil {
+		t.Fatal("signalled a foreground group without a terminal")
+	}
+	if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Fatalf("process is gone: %v", err)
+	}
+	if err := (&dockerBackend{}).Signal(0, syscall.SIGTERM); err == nil {
+		t.Fatal("signalled the foreground group of an exec without a pid")
+	}
+
+	// With one, the foreground job is signalled
+	cmd = exec.Command("sh", "-c", "sleep 100")
+	tty, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	defer cmd.Process.Kill()
+	b = &dockerBackend{pid: cmd.Process.Pid}
+	if err := b.Signal(0, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+		t.Fatalf("shell ended with %v, want SIGTERM", err)
+	}
+}
@@ -0,0 +1,319 @@
+package pty
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/vt"
+)
+
+// Command event kinds
+const (
+	EventPrompt = "prompt" // The shell shows a prompt
+	EventStart  = "start"  // A command was entered
+	EventFinish = "finish" // A command finished
+	EventCwd    = "cwd"    // The working directory changed
+)
+
+// CommandEvent is a structured event from a shell with OSC 133/OSC 7
+// integration
+type CommandEvent struct {
+	Kind     string    `json:"kind"`
+	Session  string    `json:"session,omitempty"` // Set in history searches
+	Time     time.Time `json:"time"`
+	Offset   uint64    `json:"offset"` // Output offset, for finding it in the scrollback
+	Command  string    `json:"command,omitempty"`
+	Cwd      string    `json:"cwd,omitempty"`
+	ExitCode *int      `json:"exitCode,omitempty"` // Finished commands, if the shell reported it
+	Duration float64   `json:"duration,omitempty"` // Finished commands, in seconds
+}
+
+// shellState follows the shell through its prompts and commands
+type shellState struct {
+	cwd     string
+	command string
+	started time.Time // Zero while no command runs
+}
+
+// shellEvents turns the marks the terminal saw in output starting at the
+// given offset into command events. Called with s.mu held.
+func (s *Session) shellEvents(marks []vt.Mark, base uint64) []CommandEvent {
+	var events []CommandEvent
+	now := time.Now()
+	for _, mark := range marks {
+		ev := CommandEvent{Time: now, Offset: base + uint64(mark.Pos)}
+		switch mark.Kind {
+		case vt.MarkPrompt:
+			ev.Kind = EventPrompt
+		case vt.MarkCommandExecuted:
+			if mark.Command == "" {
+				// Enter on an empty command line
+				continue
+			}
+			s.shell.command = mark.Command
+			s.shell.started = now
+			ev.Kind = EventStart
+			ev.Command = mark.Command
+		case vt.MarkCommandFinished:
+			if s.shell.started.IsZero() {
+				continue
+			}
+			ev.Kind = EventFinish
+			ev.Command = s.shell.command
+			ev.Duration = now.Sub(s.shell.started).Seconds()
+			if mark.ExitCode >= 0 {
+				code := mark.ExitCode
+				ev.ExitCode = &code
+			}
+			s.shell.command = ""
+			s.shell.started = time.Time{}
+		case vt.MarkCwd:
+			if mark.Cwd == s.shell.cwd {
+				continue
+			}
+			s.shell.cwd = mark.Cwd
+			ev.Kind = EventCwd
+		default:
+			continue
+		}
+		ev.Cwd = s.shell.cwd
+		events = append(events, ev)
+	}
+	return events
+}
+
+// maxSessionEvents is how many of its latest command events a session
+// keeps
+const maxSessionEvents = 10000
+
+// saveEvents appends events to the session's history file. Called with
+// s.mu held.
+func (s *Session) saveEvents(events []CommandEvent) {
+	if err := s.loadEvents(); err != nil {
+		log.Printf("session %s: command history: %v", s.ID, err)
+	} else {
+		s.events = append(s.events, events...)
+		// Rewrite in batches so appends stay amortized O(1)
+		if len(s.events) > maxSessionEvents+maxSessionEvents/4 {
+			s.events = slices.Clone(s.events[len(s.events)-maxSessionEvents:])
+			if s.history != nil {
+				s.history.Close()
+				s.history = nil
+			}
+			err := writeEvents(s.historyPath, s.events)
+			if err == nil {
+				return
+			}
+			// The file is untouched, the events are still appended
+			log.Printf("session %s: command history: %v", s.ID, err)
+		}
+	}
+
+	if s.history == nil {
+		if err := os.MkdirAll(filepath.Dir(s.historyPath), 0700); err != nil {
+			log.Printf("session %s: command history: %v", s.ID, err)
+			return
+		}
+		f, err := os.OpenFile(s.historyPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("session %s: command history: %v", s.ID, err)
+			return
+		}
+		s.history = f
+	}
+	enc := json.NewEncoder(s.history)
+	for _, ev := range events {
+		enc.Encode(ev)
+	}
+}
+
+// loadEvents reads the history file on first use; a recovered session
+// picks up the events from before the restart. Called with s.mu held.
+func (s *Session) loadEvents() error {
+	if s.eventsRead {
+		return nil
+	}
+	events, err := readEvents(s.historyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.events = events
+	s.eventsRead = true
+	return nil
+}
+
+func (s *Session) closeHistory() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.history != nil {
+		s.history.Close()
+		s.history = nil
+	}
+}
+
+// Events returns the session's command events, oldest first
+func (s *Session) Events() ([]CommandEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadEvents(); err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.events), nil
+}
+
+func readEvents(path string) ([]CommandEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []CommandEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var ev CommandEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err == nil {
+			events = append(events, ev)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// writeEvents replaces a history file with events
+func writeEvents(path string, events []CommandEvent) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		enc.Encode(ev)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// historyFile is the finished commands read from a closed session's
+// history file, valid while the file's size and time are unchanged
+type historyFile struct {
+	size     int64
+	modTime  time.Time
+	commands []CommandEvent
+}
+
+// closedCommands returns the finished commands in the history file of a
+// session that is not running. Such files only change if the session is
+// recovered, so they are decoded once.
+func (m *SessionManager) closedCommands(path string) ([]CommandEvent, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	m.historyMu.Lock()
+	defer m.historyMu.Unlock()
+	if c, ok := m.historyCache[path]; ok && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.commands, nil
+	}
+	events, err := readEvents(path)
+	if err != nil {
+		return nil, err
+	}
+	var commands []CommandEvent
+	for _, ev := range events {
+		if ev.Kind == EventFinish {
+			commands = append(commands, ev)
+		}
+	}
+	m.historyCache[path] = &historyFile{size: info.Size(), modTime: info.ModTime(), commands: commands}
+	return commands, nil
+}
+
+// HistoryDir returns the directory holding a user's command history
+func (m *SessionManager) HistoryDir(userID string) string {
+	return filepath.Join(m.historyDir, userID)
+}
+
+// CommandHistory returns a user's finished commands across all their
+// sessions, including closed ones, newest first. Only commands containing
+// query are returned if it is not empty.
+func (m *SessionManager) CommandHistory(userID, query string, limit int) ([]CommandEvent, error) {
+	files, err := filepath.Glob(filepath.Join(m.HistoryDir(userID), "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	var commands []CommandEvent
+	for _, path := range files {
+		sessionID := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+		var events []CommandEvent
+		if session, ok := m.Get(sessionID); ok && session.historyPath == path {
+			events, err = session.Events()
+		} else {
+			events, err = m.closedCommands(path)
+		}
+		if err != nil {
+			continue
+		}
+		for _, ev := range events {
+			if ev.Kind != EventFinish || !strings.Contains(strings.ToLower(ev.Command), query) {
+				continue
+			}
+			ev.Session = sessionID
+			commands = append(commands, ev)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Time.After(commands[j].Time)
+	})
+	if len(commands) > limit {
+		commands = commands[:limit]
+	}
+	return commands, nil
+}
+
+// PruneHistory removes the history files of sessions that are no longer
+// running and had no events for history_retention_days
+func (m *SessionManager) PruneHistory() {
+	if m.historyKeep <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(m.historyDir, "*", "*.jsonl"))
+	if err != nil {
+		return
+	}
+	for _, path := range files {
+		if _, live := m.Get(strings.TrimSuffix(filepath.Base(path), ".jsonl")); live {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < m.historyKeep {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("prune command history: %v", err)
+			continue
+		}
+		m.historyMu.Lock()
+		delete(m.historyCache, path)
+		m.historyMu.Unlock()
+	}
+}
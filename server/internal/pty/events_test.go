@@ -0,0 +1,101 @@
+package pty
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/config"
+	"github.com/eddison/sshttp/server/internal/privsep"
+)
+
+func finished(command string, at time.Time) CommandEvent {
+	return CommandEvent{Kind: EventFinish, Time: at, Command: command}
+}
+
+func TestSessionEventsCap(t *testing.T) {
+	m := NewSessionManager(config.Load(t.TempDir()), privsep.Local{})
+	s := m.newSession(sessionMeta{ID: "sess-1", UserID: "u1"})
+	start := time.Now()
+	for i := range maxSessionEvents * 2 {
+		s.mu.Lock()
+		s.saveEvents([]CommandEvent{finished(fmt.Sprint(i), start.Add(time.Duration(i)))})
+		s.mu.Unlock()
+	}
+	s.closeHistory()
+
+	events, err := s.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) > maxSessionEvents+maxSessionEvents/4 || events[len(events)-1].Command != fmt.Sprint(maxSessionEvents*2-1) {
+		t.Fatalf("%d events, last %q", len(events), events[len(events)-1].Command)
+	}
+	// The file holds the same, also for a recovered session
+	onDisk, err := readEvents(s.historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onDisk) != len(events) || onDisk[0].Command != events[0].Command {
+		t.Errorf("file has %d events from %q, session %d from %q", len(onDisk), onDisk[0].Command, len(events), events[0].Command)
+	}
+	recovered, _ := m.newSession(sessionMeta{ID: "sess-1", UserID: "u1"}).Events()
+	if len(recovered) != len(events) {
+		t.Errorf("recovered session has %d events, want %d", len(recovered), len(events))
+	}
+}
+
+func TestCommandHistory(t *testing.T) {
+	cfg := config.Load(t.TempDir())
+	cfg.HistoryRetentionDays = 30
+	m := NewSessionManager(cfg, privsep.Local{})
+	dir := m.HistoryDir("u1")
+	os.MkdirAll(dir, 0700)
+	now := time.Now()
+
+	// A running session, a closed one and one closed long ago
+	live := m.newSession(sessionMeta{ID: "sess-live", UserID: "u1"})
+	live.mu.Lock()
+	live.saveEvents([]CommandEvent{finished("make", now), {Kind: EventStart, Time: now, Command: "vim"}})
+	live.mu.Unlock()
+	m.sessions.Store(live.ID, live)
+	closed := filepath.Join(dir, "sess-closed.jsonl")
+	writeEvents(closed, []CommandEvent{finished("make test", now.Add(-time.Hour))})
+	old := filepath.Join(dir, "sess-old.jsonl")
+	writeEvents(old, []CommandEvent{finished("make old", now.Add(-60*24*time.Hour))})
+	os.Chtimes(old, now.Add(-60*24*time.Hour), now.Add(-60*24*time.Hour))
+	// The running session's file is never pruned
+	os.Chtimes(live.historyPath, now.Add(-60*24*time.Hour), now.Add(-60*24*time.Hour))
+
+	history := func() string {
+		t.Helper()
+		commands, err := m.CommandHistory("u1", "MAKE", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range commands {
+			got = append(got, c.Session+":"+c.Command)
+		}
+		return fmt.Sprint(got)
+	}
+	if got, want := history(), "[sess-live:make sess-closed:make test sess-old:make old]"; got != want {
+		t.Errorf("history = %s, want %s", got, want)
+	}
+
+	m.PruneHistory()
+	if got, want := history(), "[sess-live:make sess-closed:make test]"; got != want {
+		t.Errorf("history after pruning = %s, want %s", got, want)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old history file not removed: %v", err)
+	}
+
+	// A changed file is read again
+	writeEvents(closed, []CommandEvent{finished("make test", now.Add(-time.Hour)), finished("make install", now.Add(-time.Minute))})
+	if got, want := history(), "[sess-live:make sess-closed:make install sess-closed:make test]"; got != want {
+		t.Errorf("history after a change = %s, want %s", got, want)
+	}
+}
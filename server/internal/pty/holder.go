@@ -0,0 +1,474 @@
+package pty
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/creack/pty"
+)
+
+// A holder is a small per-session process that owns the PTY master and the
+// scrollback for one shell. The daemon talks to it over a unix socket, so
+// shells survive daemon restarts and upgrades.
+
+// Holder protocol messages: [type:u8][len:u32][payload]
+const (
+	msgHello      byte = 0x01 // holder -> daemon: JSON holderHello
+	msgScrollback byte = 0x02 // holder -> daemon: buffered output
+	msgOutput     byte = 0x03 // holder -> daemon: PTY output
+	msgExit       byte = 0x04 // holder -> daemon: exit_code:i32, terminated:u32
+	msgInput      byte = 0x10 // daemon -> holder: PTY input
+	msgResize     byte = 0x11 // daemon -> holder: cols:u16, rows:u16
+	msgSignal     byte = 0x12 // daemon -> holder: signal:u32
+	msgClose      byte = 0x13 // daemon -> holder: grace_ms:u32, tear the session down
+	msgKill       byte = 0x14 // daemon -> holder: pid:i32 (0 for the foreground process group), signal:u32
+)
+
+// holderProtocolVersion is bumped on incompatible protocol changes so a
+// restarted daemon can detect holders started by an older binary.
+const holderProtocolVersion = 1
+
+// maxMsgSize bounds a single holder message
+const maxMsgSize = 16 * 1024 * 1024
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER, not in the syscall package
+const prSetChildSubreaper = 36
+
+// holderProcessName is the process name holders run under, so that
+// `pkill -x sshttpd` only stops the daemon
+const holderProcessName = "sshttpd-holder"
+
+// holderSpec describes the shell a holder should start (sent on stdin)
+type holderSpec struct {
+	Path           string   `json:"path"`
+	Args           []string `json:"args"`
+	Dir            string   `json:"dir"`
+	Env            []string `json:"env"`
+	ScrollbackSize int      `json:"scrollbackSize"`
+	Log            bool     `json:"log,omitempty"` // Spill evicted scrollback to the directory at fd 4
+	LogMaxSize     int64    `json:"logMaxSize,omitempty"`
+}
+
+// holderHello is sent by the holder to every daemon connection
+type holderHello struct {
+	Version  int    `json:"version"`
+	ShellPid int    `json:"shellPid"`
+	Cols     uint16 `json:"cols"`
+	Rows     uint16 `json:"rows"`
+
+	// Output offset just past the scrollback that follows, and its capacity
+	Offset         uint64 `json:"offset"`
+	ScrollbackSize int    `json:"scrollbackSize"`
+}
+
+func writeMsg(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readMsg(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[1:5])
+	if size > maxMsgSize {
+		return 0, nil, fmt.Errorf("holder message too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+type holder struct {
+	ptmx       *os.File
+	cmd        *exec.Cmd
+	scrollback *RingBuffer
+	size       int
+	log        *scrollbackLog // Nil if spilling is disabled
+	written    uint64         // Total bytes of output
+
+	mu         sync.Mutex
+	conn       net.Conn      // current daemon connection, nil while the daemon is away
+	writeMu    sync.Mutex    // Orders writes to conn; taken under mu, held without it
+	exited     bool          // The shell has exited
+	reported   bool          // The exit has been reported, no more connections
+	closing    chan struct{} // Closed when a teardown the daemon asked for is done
+	terminated int           // Processes the teardown terminated
+}
+
+// RunHolder runs the holder side of a session. It is invoked by the daemon
+// re-executing itself with --hold: the listening socket is inherited as fd 3,
+// the scrollback log directory as fd 4, and the holderSpec is read from
+// stdin.
+func RunHolder() error {
+	// Rename so the daemon's restart scripts don't kill us
+	os.WriteFile("/proc/self/comm", []byte(holderProcessName), 0)
+
+	// We live in our own session; only the daemon decides when we exit.
+	// Catch rather than ignore, as ignored signals stay ignored in the
+	// shell and its jobs.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGHUP, syscall.SIGINT, syscall.SIGPIPE)
+
+	// Adopt orphaned jobs, so a teardown finds nohup'd and daemonized
+	// processes too
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		log.Printf("holder: set child subreaper: %v", errno)
+	}
+
+	var spec holderSpec
+	if err := json.NewDecoder(os.Stdin).Decode(&spec); err != nil {
+		return fmt.Errorf("read spec: %w", err)
+	}
+	os.Stdin.Close()
+
+	// Keep the inherited descriptors out of the shell
+	syscall.CloseOnExec(3)
+	syscall.CloseOnExec(4)
+
+	ln, err := net.FileListener(os.NewFile(3, "listener"))
+	if err != nil {
+		return fmt.Errorf("inherit listener: %w", err)
+	}
+	defer ln.Close()
+
+	cmd := exec.Command(spec.Path, spec.Args...)
+	cmd.Dir = spec.Dir
+	cmd.Env = spec.Env
+
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return fmt.Errorf("start pty: %w", err)
+	}
+
+	size := spec.ScrollbackSize
+	if size <= 0 {
+		size = DefaultScrollbackSize
+	}
+	h := &holder{
+		ptmx:       ptmx,
+		cmd:        cmd,
+		scrollback: NewRingBuffer(size),
+		size:       size,
+	}
+	if spec.Log {
+		h.log = openScrollbackLog(os.NewFile(4, "scrollback log"), spec.LogMaxSize)
+	}
+
+	go h.acceptLoop(ln)
+
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		h.pumpOutput()
+	}()
+
+	exitCode := h.waitShell()
+
+	// Report the exit only once a teardown has dealt with the jobs too
+	h.mu.Lock()
+	h.exited = true
+	closing := h.closing
+	h.mu.Unlock()
+	if closing != nil {
+		<-closing
+	}
+
+	// Give the reader a moment to drain output written just before exit;
+	// background jobs may keep the PTY open indefinitely.
+	select {
+	case <-readerDone:
+	case <-time.After(time.Second):
+	}
+
+	h.mu.Lock()
+	conn := h.conn
+	h.reported = true
+	exit := make([]byte, 8)
+	binary.BigEndian.PutUint32(exit[0:4], uint32(int32(exitCode)))
+	binary.BigEndian.PutUint32(exit[4:8], uint32(h.terminated))
+	h.writeMu.Lock()
+	h.mu.Unlock()
+	if conn != nil {
+		writeMsg(conn, msgExit, exit)
+		conn.Close()
+	}
+	h.writeMu.Unlock()
+	ptmx.Close()
+	if h.log != nil {
+		h.log.Close()
+	}
+	return nil
+}
+
+// waitShell waits for the shell to exit and returns its exit code. As a
+// subreaper, and as the init of a sandbox's PID namespace, the holder also
+// inherits orphaned processes, and has to reap them.
+func (h *holder) waitShell() int {
+	exitCode := -1
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if pid == h.cmd.Process.Pid {
+			if status.Exited() {
+				exitCode = status.ExitStatus()
+			}
+			break
+		}
+	}
+	go func() {
+		for {
+			var status syscall.WaitStatus
+			if _, err := syscall.Wait4(-1, &status, 0, nil); err != nil && err != syscall.EINTR {
+				return
+			}
+		}
+	}()
+	return exitCode
+}
+
+// pumpOutput reads the PTY, records scrollback and forwards to the daemon.
+// The write happens outside mu, so a stalled daemon doesn't keep a new
+// connection or a teardown waiting.
+func (h *holder) pumpOutput() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := h.ptmx.Read(buf)
+		if n > 0 {
+			h.mu.Lock()
+			h.spill(buf[:n])
+			h.scrollback.Write(buf[:n])
+			h.written += uint64(n)
+			conn := h.conn
+			h.writeMu.Lock()
+			h.mu.Unlock()
+			if conn != nil {
+				if err := writeMsg(conn, msgOutput, buf[:n]); err != nil {
+					h.dropConn(conn)
+				}
+			}
+			h.writeMu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dropConn forgets a daemon connection that failed, unless it was already
+// replaced
+func (h *holder) dropConn(conn net.Conn) {
+	conn.Close()
+	h.mu.Lock()
+	if h.conn == conn {
+		h.conn = nil
+	}
+	h.mu.Unlock()
+}
+
+// spill writes the output about to fall out of the scrollback to the log
+func (h *holder) spill(p []byte) {
+	if h.log == nil {
+		return
+	}
+	evicted := h.scrollback.Evicted(len(p))
+	if over := len(p) - h.size; over > 0 {
+		evicted = append(evicted, p[:over]...)
+	}
+	if err := h.log.Write(evicted); err != nil {
+		log.Printf("holder: scrollback log: %v", err)
+		h.log.Close()
+		h.log = nil
+	}
+}
+
+// acceptLoop accepts daemon connections. A new connection replaces the
+// previous one, which is what happens when the daemon restarts.
+func (h *holder) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		// Closing the old connection unblocks a pending write in pumpOutput
+		h.mu.Lock()
+		old := h.conn
+		h.mu.Unlock()
+		if old != nil {
+			old.Close()
+		}
+
+		h.mu.Lock()
+		if h.reported {
+			h.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		hello := holderHello{
+			Version:        holderProtocolVersion,
+			ShellPid:       h.cmd.Process.Pid,
+			Offset:         h.written,
+			ScrollbackSize: h.size,
+		}
+		if ws, err := pty.GetsizeFull(h.ptmx); err == nil {
+			hello.Cols, hello.Rows = ws.Cols, ws.Rows
+		}
+		helloJSON, _ := json.Marshal(hello)
+		scrollback := h.scrollback.Bytes()
+		// Output after this snapshot goes to the new connection, once the
+		// snapshot has been written
+		h.conn = conn
+		h.writeMu.Lock()
+		h.mu.Unlock()
+		err = writeMsg(conn, msgHello, helloJSON)
+		if err == nil {
+			err = writeMsg(conn, msgScrollback, scrollback)
+		}
+		h.writeMu.Unlock()
+		if err != nil {
+			h.dropConn(conn)
+			continue
+		}
+
+		go h.serve(conn)
+	}
+}
+
+// kill signals a process of the session, or the terminal's foreground
+// process group if pid is 0
+func (h *holder) kill(pid int, sig syscall.Signal) {
+	if pid == 0 {
+		var pgrp int32
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, h.ptmx.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+			log.Printf("holder: get foreground process group: %v", errno)
+			return
+		}
+		pid = -int(pgrp)
+	} else if !slices.Contains(descendants(os.Getpid()), pid) {
+		log.Printf("holder: signal %d: not a process of the session", pid)
+		return
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		log.Printf("holder: signal %d: %v", pid, err)
+	}
+}
+
+// terminate tears the session down in stages: SIGHUP first, so shells save
+// their history and jobs can clean up, then SIGTERM and finally SIGKILL for
+// whatever is still running after the grace period. It returns how many
+// processes were terminated.
+func (h *holder) terminate(grace time.Duration) int {
+	seen := make(map[int]bool)
+	for _, sig := range []syscall.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGKILL} {
+		pids := descendants(os.Getpid())
+		if len(pids) == 0 {
+			break
+		}
+		for _, pid := range pids {
+			seen[pid] = true
+			syscall.Kill(pid, sig)
+			if sig != syscall.SIGKILL {
+				// Stopped jobs have to run to handle the signal
+				syscall.Kill(pid, syscall.SIGCONT)
+			}
+		}
+		// After SIGKILL, only wait for the reaper to catch up
+		wait := grace
+		if sig == syscall.SIGKILL {
+			wait = time.Second
+		}
+		for deadline := time.Now().Add(wait); time.Now().Before(deadline); {
+			if len(descendants(os.Getpid())) == 0 {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return len(seen)
+}
+
+// serve handles requests from one daemon connection
+func (h *holder) serve(conn net.Conn) {
+	for {
+		typ, payload, err := readMsg(conn)
+		if err != nil {
+			h.mu.Lock()
+			if h.conn == conn {
+				h.conn = nil
+			}
+			h.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		switch typ {
+		case msgInput:
+			if _, err := h.ptmx.Write(payload); err != nil {
+				log.Printf("holder: pty write error: %v", err)
+			}
+
+		case msgResize:
+			if len(payload) >= 4 {
+				pty.Setsize(h.ptmx, &pty.Winsize{
+					Cols: binary.BigEndian.Uint16(payload[0:2]),
+					Rows: binary.BigEndian.Uint16(payload[2:4]),
+				})
+			}
+
+		case msgSignal:
+			if len(payload) >= 4 {
+				sig := syscall.Signal(binary.BigEndian.Uint32(payload[0:4]))
+				h.cmd.Process.Signal(sig)
+			}
+
+		case msgClose:
+			var grace time.Duration
+			if len(payload) >= 4 {
+				grace = time.Duration(binary.BigEndian.Uint32(payload[0:4])) * time.Millisecond
+			}
+			h.mu.Lock()
+			if h.closing == nil && !h.exited {
+				h.closing = make(chan struct{})
+				go func() {
+					terminated := h.terminate(grace)
+					h.mu.Lock()
+					h.terminated = terminated
+					h.mu.Unlock()
+					close(h.closing)
+				}()
+			}
+			h.mu.Unlock()
+
+		case msgKill:
+			if len(payload) >= 8 {
+				pid := int(int32(binary.BigEndian.Uint32(payload[0:4])))
+				h.kill(pid, syscall.Signal(binary.BigEndian.Uint32(payload[4:8])))
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package pty
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// localBackend is the daemon's end of a holder process, which owns the
+// session's PTY
+type localBackend struct {
+	conn      net.Conn
+	writeMu   sync.Mutex // Serializes messages sent to the holder
+	shellPid  int        // As seen by the daemon, also for sandboxed shells
+	holderPid int
+	sandboxed bool // The holder sees pids of its own PID namespace
+
+	// Reported by the holder when the shell exits
+	code       int
+	terminated int
+}
+
+// dialHolder connects to a session's holder and returns the backend along
+// with the holder's scrollback
+func dialHolder(sockPath string, holderPid int, sandboxed bool) (*localBackend, Screen, error) {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, Screen{}, fmt.Errorf("dial holder: %w", err)
+	}
+
+	typ, payload, err := readMsg(conn)
+	if err != nil || typ != msgHello {
+		conn.Close()
+		return nil, Screen{}, fmt.Errorf("holder handshake failed")
+	}
+	var hello holderHello
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		conn.Close()
+		return nil, Screen{}, fmt.Errorf("decode holder hello: %w", err)
+	}
+	if hello.Version != holderProtocolVersion {
+		conn.Close()
+		return nil, Screen{}, fmt.Errorf("holder protocol version %d, want %d", hello.Version, holderProtocolVersion)
+	}
+
+	typ, payload, err = readMsg(conn)
+	if err != nil || typ != msgScrollback {
+		conn.Close()
+		return nil, Screen{}, fmt.Errorf("holder handshake failed")
+	}
+
+	b := &localBackend{
+		conn:      conn,
+		shellPid:  hello.ShellPid,
+		holderPid: holderPid,
+		sandboxed: sandboxed,
+		code:      -1,
+	}
+	if sandboxed {
+		// The holder reports the pid in the sandbox's PID namespace
+		b.shellPid = hostPid(holderPid, hello.ShellPid)
+	}
+	return b, Screen{
+		Cols:           int(hello.Cols),
+		Rows:           int(hello.Rows),
+		Data:           payload,
+		Offset:         max(hello.Offset, uint64(len(payload))),
+		ScrollbackSize: hello.ScrollbackSize,
+	}, nil
+}
+
+// send sends a request to the holder process
+func (b *localBackend) send(typ byte, payload []byte) error {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return writeMsg(b.conn, typ, payload)
+}
+
+func (b *localBackend) Read() ([]byte, error) {
+	for {
+		typ, payload, err := readMsg(b.conn)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case msgOutput:
+			return payload, nil
+		case msgExit:
+			if len(payload) >= 4 {
+				b.code = int(int32(binary.BigEndian.Uint32(payload[0:4])))
+			}
+			if len(payload) >= 8 {
+				b.terminated = int(binary.BigEndian.Uint32(payload[4:8]))
+			}
+			return nil, io.EOF
+		}
+	}
+}
+
+func (b *localBackend) Write(p []byte) error {
+	return b.send(msgInput, p)
+}
+
+func (b *localBackend) Resize(cols, rows uint16) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], cols)
+	binary.BigEndian.PutUint16(payload[2:4], rows)
+	return b.send(msgResize, payload)
+}
+
+// Signal has the holder deliver the signal, since it runs as the session's
+// account
+func (b *localBackend) Signal(pid int, sig syscall.Signal) error {
+	if pid != 0 && b.sandboxed {
+		// The holder needs the pid in its own namespace
+		if pid = nsPid(pid); pid == 0 {
+			return ErrNoSuchProcess
+		}
+	}
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(int32(pid)))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(sig))
+	return b.send(msgKill, payload)
+}
+
+func (b *localBackend) Wait() (int, int) {
+	return b.code, b.terminated
+}
+
+// Terminate has the holder hang up on the shell and its jobs, and after
+// the grace period terminate and finally kill whatever is left
+func (b *localBackend) Terminate(grace time.Duration) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(grace.Milliseconds()))
+	return b.send(msgClose, payload)
+}
+
+func (b *localBackend) Close() error {
+	return b.conn.Close()
+}
+
+func (b *localBackend) Pid() int {
+	return b.shellPid
+}
+
+func (b *localBackend) Cwd() (string, error) {
+	return procCwd(b.shellPid)
+}
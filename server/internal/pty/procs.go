@@ -0,0 +1,280 @@
+package pty
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat. It is
+// 100 on every architecture Linux supports today.
+const clockTicks = 100
+
+// ErrNoSuchProcess is returned when signalling a pid outside the session
+var ErrNoSuchProcess = errors.New("no such process in session")
+
+// Process is one process of a session's process tree
+type Process struct {
+	Pid        int
+	PPid       int
+	Pgid       int
+	Command    string   // Name of the executable
+	Args       []string // Command line, empty for kernel threads and zombies
+	State      string   // R, S, D, T, Z, ...
+	CPUTime    time.Duration
+	RSS        int64 // Resident memory in bytes
+	Started    time.Time
+	Foreground bool // In the terminal's foreground process group
+}
+
+// procStat holds the fields of /proc/<pid>/stat we use
+type procStat struct {
+	comm       string
+	state      string
+	ppid, pgrp int
+	tpgid      int // Foreground process group of the controlling terminal
+	utime      uint64
+	stime      uint64
+	starttime  uint64 // Clock ticks after boot
+	rssPages   int64
+}
+
+func readProcStat(pid int) (*procStat, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parentheses and may contain anything
+	open, end := strings.IndexByte(string(data), '('), strings.LastIndexByte(string(data), ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("malformed stat for %d", pid)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// Fields from state (3) onwards, so field n is fields[n-3]
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed stat for %d", pid)
+	}
+	st := &procStat{comm: string(data[open+1 : end]), state: fields[0]}
+	st.ppid, _ = strconv.Atoi(fields[1])
+	st.pgrp, _ = strconv.Atoi(fields[2])
+	st.tpgid, _ = strconv.Atoi(fields[5])
+	st.utime, _ = strconv.ParseUint(fields[11], 10, 64)
+	st.stime, _ = strconv.ParseUint(fields[12], 10, 64)
+	st.starttime, _ = strconv.ParseUint(fields[19], 10, 64)
+	st.rssPages, _ = strconv.ParseInt(fields[21], 10, 64)
+	return st, nil
+}
+
+// procTree is a snapshot of the processes in /proc, by parent
+type procTree struct {
+	stats    map[int]*procStat
+	children map[int][]int
+}
+
+func readProcTree() (*procTree, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	t := &procTree{stats: make(map[int]*procStat), children: make(map[int][]int)}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		st, err := readProcStat(pid)
+		if err != nil {
+			continue // Exited meanwhile
+		}
+		t.stats[pid] = st
+		t.children[st.ppid] = append(t.children[st.ppid], pid)
+	}
+	return t, nil
+}
+
+// below lists the processes below pid, parents before their children
+func (t *procTree) below(pid int) []int {
+	var pids []int
+	queue := t.children[pid]
+	for len(queue) > 0 {
+		pids = append(pids, queue[0])
+		queue = append(queue[1:], t.children[queue[0]]...)
+	}
+	return pids
+}
+
+// descendants lists the live processes below a process. Zombies are left
+// out, they are dead already and only wait to be reaped.
+func descendants(pid int) []int {
+	t, err := readProcTree()
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, p := range t.below(pid) {
+		if t.stats[p].state != "Z" {
+			pids = append(pids, p)
+		}
+	}
+	return pids
+}
+
+// bootTime reads when the system booted, which process start times are
+// relative to
+func bootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
+
+// Processes returns the session's process tree, the shell first and
+// parents before their children, along with the terminal's foreground
+// process group. Pids are as seen by the daemon, also for sandboxed
+// sessions.
+func (s *Session) Processes() ([]Process, int, error) {
+	shellPid := s.backend.Pid()
+	if shellPid == 0 {
+		return nil, 0, fmt.Errorf("process not running")
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return nil, 0, err
+	}
+	tree, err := readProcTree()
+	if err != nil {
+		return nil, 0, err
+	}
+	shell, ok := tree.stats[shellPid]
+	if !ok {
+		return nil, 0, fmt.Errorf("process not running")
+	}
+
+	pageSize := int64(os.Getpagesize())
+	var procs []Process
+	for _, pid := range append([]int{shellPid}, tree.below(shellPid)...) {
+		st := tree.stats[pid]
+		p := Process{
+			Pid:        pid,
+			PPid:       st.ppid,
+			Pgid:       st.pgrp,
+			Command:    st.comm,
+			State:      st.state,
+			CPUTime:    time.Duration(st.utime+st.stime) * time.Second / clockTicks,
+			RSS:        st.rssPages * pageSize,
+			Started:    boot.Add(time.Duration(st.starttime) * time.Second / clockTicks),
+			Foreground: st.pgrp == shell.tpgid,
+		}
+		if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+			p.Args = strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+		}
+		procs = append(procs, p)
+	}
+	return procs, shell.tpgid, nil
+}
+
+// Signal sends a signal to a process in the session's tree, or to the
+// terminal's foreground process group if pid is 0. The backend delivers
+// it as the session's account.
+func (s *Session) Signal(pid int, sig syscall.Signal) error {
+	if pid != 0 {
+		procs, _, err := s.Processes()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, p := range procs {
+			found = found || p.Pid == pid
+		}
+		if !found {
+			return ErrNoSuchProcess
+		}
+	}
+	return s.backend.Signal(pid, sig)
+}
+
+// foregroundGroup returns the foreground process group of a shell's
+// terminal, for signalling. It has to be a group of the shell's own tree:
+// without a controlling terminal tpgid is -1, and kill(-1) or kill(0)
+// would reach far beyond the session.
+func foregroundGroup(shellPid int) (int, error) {
+	st, err := readProcStat(shellPid)
+	if err != nil {
+		return 0, fmt.Errorf("process not running")
+	}
+	if st.tpgid <= 0 {
+		return 0, fmt.Errorf("no foreground process group")
+	}
+	if !groupInTree(shellPid, st.pgrp, st.tpgid) {
+		return 0, ErrNoSuchProcess
+	}
+	return st.tpgid, nil
+}
+
+// groupInTree reports whether a process group has a member in the process
+// tree of root, whose own group is rootGroup
+func groupInTree(root, rootGroup, pgid int) bool {
+	if pgid == rootGroup {
+		return true
+	}
+	tree, err := readProcTree()
+	if err != nil {
+		return false
+	}
+	for _, pid := range tree.below(root) {
+		if tree.stats[pid].pgrp == pgid {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPid finds the pid of a holder's child that has the given pid in the
+// holder's PID namespace, or returns 0
+func hostPid(holderPid, pid int) int {
+	tree, err := readProcTree()
+	if err != nil {
+		return 0
+	}
+	for _, candidate := range tree.children[holderPid] {
+		if nsPid(candidate) == pid {
+			return candidate
+		}
+	}
+	return 0
+}
+
+// nsPid returns a process's pid in its innermost PID namespace
+func nsPid(pid int) int {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, "NSpid:"); ok {
+			fields := strings.Fields(v)
+			if len(fields) > 0 {
+				n, _ := strconv.Atoi(fields[len(fields)-1])
+				return n
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,140 @@
+// Package ptytest provides an in-memory session backend for tests
+package ptytest
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backend is a pty.Backend without a shell. Tests play the shell: they
+// produce its output with Output and end it with Exit, and look at what
+// the session sent it.
+type Backend struct {
+	output chan []byte
+	done   chan struct{}
+
+	mu         sync.Mutex
+	input      []byte
+	cols, rows uint16
+	signals    []syscall.Signal
+	code       int
+	ended      bool
+}
+
+// NewBackend returns a backend whose shell is running
+func NewBackend() *Backend {
+	return &Backend{
+		output: make(chan []byte, 64),
+		done:   make(chan struct{}),
+	}
+}
+
+// Output has the shell write data to the terminal
+func (b *Backend) Output(data []byte) {
+	b.output <- append([]byte(nil), data...)
+}
+
+// Exit ends the shell with an exit code, once the output before it has
+// been read
+func (b *Backend) Exit(code int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ended {
+		b.ended = true
+		b.code = code
+		close(b.done)
+	}
+}
+
+// Input returns everything typed into the terminal so far
+func (b *Backend) Input() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.input...)
+}
+
+// Size returns the terminal size last set, 0x0 if it never was
+func (b *Backend) Size() (cols, rows uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cols, b.rows
+}
+
+// Signals returns the signals sent to the shell's foreground group so far
+func (b *Backend) Signals() []syscall.Signal {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]syscall.Signal(nil), b.signals...)
+}
+
+func (b *Backend) Read() ([]byte, error) {
+	select {
+	case data := <-b.output:
+		return data, nil
+	case <-b.done:
+		select {
+		case data := <-b.output:
+			return data, nil
+		default:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (b *Backend) Write(p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ended {
+		return errors.New("shell exited")
+	}
+	b.input = append(b.input, p...)
+	return nil
+}
+
+func (b *Backend) Resize(cols, rows uint16) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cols, b.rows = cols, rows
+	return nil
+}
+
+// Signal records signals for the foreground group. There are no other
+// processes to signal.
+func (b *Backend) Signal(pid int, sig syscall.Signal) error {
+	if pid != 0 {
+		return errors.New("no such process")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.signals = append(b.signals, sig)
+	return nil
+}
+
+func (b *Backend) Wait() (code, terminated int) {
+	<-b.done
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.code, 0
+}
+
+// Terminate ends the shell as if it was hung up on
+func (b *Backend) Terminate(grace time.Duration) error {
+	b.Exit(128 + int(syscall.SIGHUP))
+	return nil
+}
+
+func (b *Backend) Close() error {
+	b.Exit(-1)
+	return nil
+}
+
+func (b *Backend) Pid() int {
+	return 0
+}
+
+func (b *Backend) Cwd() (string, error) {
+	return "", errors.New("no working directory")
+}
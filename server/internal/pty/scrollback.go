@@ -0,0 +1,301 @@
+package pty
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/eddison/sshttp/server/internal/search"
+)
+
+// Output that falls out of a session's in-memory scrollback is spilled to a
+// compressed log on disk. The log is a directory of segments, each a
+// DEFLATE stream named after the output offset of its first byte. Writes
+// are sync-flushed so everything evicted from memory is readable at once.
+
+// scrollbackSegmentSize is the uncompressed size at which a new segment is
+// started; the oldest segments are deleted to stay under the disk limit
+const scrollbackSegmentSize = 1024 * 1024
+
+const segmentSuffix = ".z"
+
+// scrollbackLog is the holder-side writer of a spill log. The holder gets
+// the log directory as an open descriptor: in multi_user mode it runs as
+// the session's account, which cannot reach the daemon's data directory.
+type scrollbackLog struct {
+	dir     *os.File
+	maxSize int64 // Compressed bytes kept on disk
+
+	segs     []segment // Segments written so far, oldest first
+	f        *os.File
+	zw       *flate.Writer
+	segBytes int    // Uncompressed bytes in the current segment
+	end      uint64 // Offset just past the last byte written
+}
+
+func openScrollbackLog(dir *os.File, maxSize int64) *scrollbackLog {
+	return &scrollbackLog{dir: dir, maxSize: maxSize}
+}
+
+func (l *scrollbackLog) Write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if l.f == nil || l.segBytes >= scrollbackSegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := l.zw.Write(p); err != nil {
+		return err
+	}
+	if err := l.zw.Flush(); err != nil {
+		return err
+	}
+	l.segBytes += len(p)
+	l.end += uint64(len(p))
+	return nil
+}
+
+// rotate finishes the current segment, starts a new one and deletes the
+// oldest segments over the size limit
+func (l *scrollbackLog) rotate() error {
+	l.Close()
+
+	name := fmt.Sprintf("%016x%s", l.end, segmentSuffix)
+	// Group-readable: in multi_user mode the daemon reads through the group
+	fd, err := syscall.Openat(int(l.dir.Fd()), name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_CLOEXEC, 0640)
+	if err != nil {
+		return fmt.Errorf("create scrollback segment: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), name)
+	zw, _ := flate.NewWriter(f, flate.DefaultCompression)
+	l.f = f
+	l.zw = zw
+	l.segBytes = 0
+	l.segs = append(l.segs, segment{path: name, start: l.end})
+
+	var total int64
+	for _, seg := range l.segs {
+		total += seg.size
+	}
+	// Never delete the segment just started
+	for total > l.maxSize && len(l.segs) > 1 {
+		syscall.Unlinkat(int(l.dir.Fd()), l.segs[0].path)
+		total -= l.segs[0].size
+		l.segs = l.segs[1:]
+	}
+	return nil
+}
+
+func (l *scrollbackLog) Close() {
+	if l.f != nil {
+		l.zw.Close()
+		if fi, err := l.f.Stat(); err == nil {
+			l.segs[len(l.segs)-1].size = fi.Size()
+		}
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+type segment struct {
+	path  string // Just the name for segments tracked by the writer
+	start uint64
+	size  int64
+}
+
+// listSegments returns a log's segments ordered by offset
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		start, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segs = append(segs, segment{path: filepath.Join(dir, name), start: start, size: fi.Size()})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].start < segs[j].start })
+	return segs, nil
+}
+
+// readScrollbackLog reads up to limit bytes of spilled output starting at
+// offset, or at the oldest retained offset if that is later. It returns
+// the data, the oldest retained offset, and false if nothing is on disk.
+func readScrollbackLog(dir string, offset uint64, limit int) ([]byte, uint64, bool) {
+	segs, err := listSegments(dir)
+	if err != nil || len(segs) == 0 {
+		return nil, 0, false
+	}
+	oldest := segs[0].start
+	offset = max(offset, oldest)
+
+	var data []byte
+	for i, seg := range segs {
+		if i+1 < len(segs) && segs[i+1].start <= offset {
+			continue
+		}
+		pos := offset + uint64(len(data))
+		if pos < seg.start {
+			// Deleted while we were reading
+			break
+		}
+		chunk, err := readSegment(seg.path, pos-seg.start, limit-len(data))
+		data = append(data, chunk...)
+		if err != nil || len(data) >= limit {
+			break
+		}
+	}
+	return data, oldest, true
+}
+
+// readSegment decompresses up to limit bytes at skip within a segment. The
+// segment still being written has no final block and ends with
+// io.ErrUnexpectedEOF, which just means the data so far was read.
+func readSegment(path string, skip uint64, limit int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr := flate.NewReader(f)
+	defer zr.Close()
+	if _, err := io.CopyN(io.Discard, zr, int64(skip)); err != nil {
+		return nil, io.EOF
+	}
+	buf := make([]byte, limit)
+	n, err := io.ReadFull(zr, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// ScrollbackPage is a range of a session's output. Offsets count bytes of
+// output since the shell started.
+type ScrollbackPage struct {
+	Offset uint64 // Offset of the first byte of Data
+	Start  uint64 // Oldest offset still available
+	End    uint64 // Offset just past the latest output
+	Data   []byte
+}
+
+// ReadScrollback returns up to limit bytes of output starting at offset,
+// reading from the on-disk log for output no longer held in memory. A
+// negative offset returns the latest output.
+func (s *Session) ReadScrollback(offset int64, limit int) ScrollbackPage {
+	s.mu.Lock()
+	mem := s.scrollback.Bytes()
+	end := s.outputEnd
+	s.mu.Unlock()
+	memStart := end - uint64(len(mem))
+
+	pos := end - min(end, uint64(limit))
+	if offset >= 0 {
+		pos = min(uint64(offset), end)
+	}
+	page := ScrollbackPage{Offset: max(pos, memStart), Start: memStart, End: end}
+
+	if pos < memStart {
+		// The log may already hold output newer than our snapshot of memory
+		data, oldest, ok := readScrollbackLog(s.logDir(), pos, limit)
+		if ok && oldest < memStart {
+			pos = max(pos, oldest)
+			data = data[:min(uint64(len(data)), memStart-pos)]
+			page.Offset = pos
+			page.Start = oldest
+			page.Data = data
+			if pos+uint64(len(data)) < memStart {
+				return page
+			}
+			limit -= len(data)
+		}
+		pos = memStart
+	}
+
+	n := min(uint64(limit), end-pos)
+	page.Data = append(page.Data, mem[pos-memStart:pos-memStart+n]...)
+	return page
+}
+
+// ScrollbackStart returns the offset of the oldest output still retained
+func (s *Session) ScrollbackStart() uint64 {
+	s.mu.Lock()
+	start := s.outputEnd - uint64(s.scrollback.Len())
+	s.mu.Unlock()
+	if segs, _ := listSegments(s.logDir()); len(segs) > 0 {
+		start = min(start, segs[0].start)
+	}
+	return start
+}
+
+// Search scans the session's retained output, the spilled log and then
+// what is in memory, until the searcher is full
+func (s *Session) Search(sr *search.Searcher) {
+	s.mu.Lock()
+	mem := s.scrollback.Bytes()
+	end := s.outputEnd
+	s.mu.Unlock()
+	memStart := end - uint64(len(mem))
+
+	segs, _ := listSegments(s.logDir())
+	if len(segs) > 0 && segs[0].start < memStart {
+		sr.Start(segs[0].start)
+		for _, seg := range segs {
+			if sr.Full() || seg.start >= memStart {
+				break
+			}
+			if seg.start != sr.Offset() {
+				// Deleted or rotated while we were reading
+				break
+			}
+			searchSegment(seg.path, sr, memStart-seg.start)
+		}
+	}
+	if sr.Offset() != memStart {
+		sr.Start(memStart)
+	}
+	for pos := 0; pos < len(mem) && !sr.Full(); pos += scrollbackSegmentSize {
+		sr.Write(mem[pos:min(pos+scrollbackSegmentSize, len(mem))])
+	}
+}
+
+// searchSegment feeds up to limit bytes of a segment to a searcher
+func searchSegment(path string, sr *search.Searcher, limit uint64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	zr := flate.NewReader(f)
+	defer zr.Close()
+	buf := make([]byte, 32*1024)
+	for read := uint64(0); read < limit && !sr.Full(); {
+		n, err := zr.Read(buf[:min(uint64(len(buf)), limit-read)])
+		sr.Write(buf[:n])
+		read += uint64(n)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -1,18 +1,25 @@
 package pty
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"net"
 	"os"
 	"os/exec"
-	"os/user"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/creack/pty"
+	"github.com/eddison/sshttp/server/internal/config"
+	"github.com/eddison/sshttp/server/internal/privsep"
+	"github.com/eddison/sshttp/server/internal/recording"
+	"github.com/eddison/sshttp/server/internal/vt"
 )
 
 // RingBuffer is a fixed-size circular buffer for storing recent terminal output
@@ -64,6 +71,29 @@ func (rb *RingBuffer) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// Evicted returns a copy of the oldest buffered bytes that writing n more
+// bytes would overwrite
+func (rb *RingBuffer) Evicted(n int) []byte {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	over := min(rb.len+n-rb.size, rb.len)
+	if over <= 0 {
+		return nil
+	}
+	result := make([]byte, over)
+	first := copy(result, rb.data[rb.start:min(rb.start+over, rb.size)])
+	copy(result[first:], rb.data[:over-first])
+	return result
+}
+
+// Len returns the number of bytes in the buffer
+func (rb *RingBuffer) Len() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.len
+}
+
 // Bytes returns a copy of the buffer contents in order
 func (rb *RingBuffer) Bytes() []byte {
 	rb.mu.Lock()
@@ -87,59 +117,158 @@ func (rb *RingBuffer) Bytes() []byte {
 // DefaultScrollbackSize is the default size of the scrollback buffer (64KB)
 const DefaultScrollbackSize = 64 * 1024
 
+// Bounds for a session's in-memory scrollback. The whole buffer is sent to
+// the daemon in one holder message, so it must stay below maxMsgSize.
+const (
+	MinScrollbackSize = 4 * 1024
+	MaxScrollbackSize = 8 * 1024 * 1024
+)
+
+// HistoryLines is how many lines of scrollback the terminal emulator keeps
+const HistoryLines = 2000
+
 type Session struct {
 	ID        string
 	UserID    string
 	Name      string
-	PTY       *os.File
-	Cmd       *exec.Cmd
+	Profile   string
+	Account   string // Unix account the shell runs as, empty for the daemon's own
+	Sandbox   string // Sandbox the shell runs in, empty for none
+	Target    string // SSH target the shell runs on, empty for a local one
+	Container string // Container the shell runs in, empty for a local one
 	CreatedAt time.Time
 	LastInput time.Time
 
 	mu         sync.Mutex
 	closed     bool
-	attached   bool
-	scrollback *RingBuffer
-	onKick     func() // Called when this connection is kicked by a new one
+	viewers    map[*Viewer]struct{}
+	shares     map[string]bool     // User ID -> read-only, for other users' access
+	term       *vt.Terminal        // Screen state, for redrawing on attach
+	scrollback *RingBuffer         // Mirrors the holder's scrollback
+	outputEnd  uint64              // Output offset just past the scrollback
+	recorder   *recording.Recorder // Nil unless the session is recorded
+	shell      shellState          // Shell integration state
+	history    *os.File            // Command events, opened on the first one
+	events     []CommandEvent      // What the history file holds, once loaded
+	eventsRead bool                // events was loaded from the history file
+	onExit     func()              // Called once the shell has exited
+	credit     *sync.Cond          // Signaled when viewers acknowledge output or leave
+
+	backend     Backend // Runs the shell
+	exited      chan struct{}
+	exitCode    int
+	killed      int    // Processes terminated when the session was closed
+	dir         string // Directory holding the session's socket, metadata and scrollback log
+	historyPath string // The session's command events, kept after it closes
+	cgroup      string // The session's cgroup, empty without resource limits
+}
+
+// sessionMeta is persisted next to the holder socket so a restarted daemon
+// can re-register the session
+type sessionMeta struct {
+	ID        string          `json:"id"`
+	UserID    string          `json:"userId"`
+	Name      string          `json:"name"`
+	Profile   string          `json:"profile,omitempty"`
+	Account   string          `json:"account,omitempty"`
+	Sandbox   string          `json:"sandbox,omitempty"`
+	Target    string          `json:"target,omitempty"`
+	Container string          `json:"container,omitempty"`
+	HolderPid int             `json:"holderPid,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Shares    map[string]bool `json:"shares,omitempty"`
+	Recorded  bool            `json:"recorded,omitempty"`
 }
 
 type SessionManager struct {
-	sessions sync.Map
-	shell    string
+	sessions       sync.Map
+	starter        privsep.Starter
+	dir            string
+	recordingsDir  string
+	historyDir     string
+	historyKeep    time.Duration // Retention of closed sessions' history, 0 for no limit
+	historyMu      sync.Mutex
+	historyCache   map[string]*historyFile // Finished commands of closed sessions, by path
+	record         bool
+	scrollbackSize int
+	logMaxSize     int64       // Disk space for each session's spilled scrollback, 0 to disable
+	cgroups        *cgroupTree // Nil without resource limits
+	closeGrace     time.Duration
+
+	tmuxPath string // Empty unless tmux sessions are enabled
+	tmuxMu   sync.Mutex
+	tmux     map[string]*tmuxClient // By user ID and tmux session ID
+
+	docker *dockerClient // Nil unless a Docker socket is configured
+
+	startBackend func(SessionOptions) (Backend, error) // Replaces local shells if set, see SetBackend
 }
 
-func NewSessionManager() *SessionManager {
-	// Get current user's shell from /etc/passwd
-	shell := "/bin/bash"
-	if u, err := user.Current(); err == nil {
-		if userShell := getUserShell(u.Username); userShell != "" {
-			shell = userShell
+// ErrInvalidOptions is returned when session options name a command or
+// directory that doesn't exist
+var ErrInvalidOptions = errors.New("invalid session options")
+
+// SessionOptions customizes a new session
+type SessionOptions struct {
+	Name           string
+	Account        *privsep.Account // Unix account to run as, nil for the daemon's own
+	Profile        string           // Launch profile the options came from
+	Command        string           // Program to run instead of the login shell
+	Args           []string         // Arguments for Command
+	Dir            string           // Working directory, ~ expanded; defaults to the account's home
+	Env            []string         // Extra KEY=value environment variables
+	Term           string           // TERM value, defaults to xterm-256color
+	Startup        string           // Input typed into the terminal once it starts
+	ScrollbackSize int              // In-memory scrollback in bytes, 0 for the configured default
+	Limits         config.ResourceLimits
+	Sandbox        *config.Sandbox // Namespaces to start the shell in, nil for none
+	Tmux           string          // tmux session to open a new window in instead, created if needed
+	Target         *config.Target  // SSH target to open the session on instead
+	Container      *Container      // Container to open the session in instead
+	ContainerUser  string          // User to be in the container, empty for its default user
+}
+
+func NewSessionManager(cfg *config.Config, starter privsep.Starter) *SessionManager {
+	m := &SessionManager{
+		starter:        starter,
+		dir:            filepath.Join(cfg.DataDir, "sessions"),
+		recordingsDir:  filepath.Join(cfg.DataDir, "recordings"),
+		historyDir:     filepath.Join(cfg.DataDir, "history"),
+		historyKeep:    time.Duration(cfg.HistoryRetentionDays) * 24 * time.Hour,
+		historyCache:   make(map[string]*historyFile),
+		record:         cfg.RecordSessions,
+		scrollbackSize: clampScrollbackSize(cfg.ScrollbackSize),
+		logMaxSize:     int64(cfg.ScrollbackDiskMB) * 1024 * 1024,
+		closeGrace:     time.Duration(cfg.SessionCloseGraceSecs) * time.Second,
+		tmux:           make(map[string]*tmuxClient),
+	}
+	if cfg.DockerSocket != "" {
+		m.docker = newDockerClient(cfg.DockerSocket)
+	}
+	if cfg.CgroupRoot != "" {
+		cgroups, err := openCgroupTree(cfg.CgroupRoot)
+		if err != nil {
+			log.Printf("Warning: resource limits disabled: %v", err)
+		} else {
+			m.cgroups = cgroups
 		}
 	}
-	return &SessionManager{
-		shell: shell,
+	if cfg.TmuxSessions {
+		path, err := exec.LookPath("tmux")
+		if err != nil {
+			log.Printf("Warning: tmux sessions disabled: %v", err)
+		} else {
+			m.tmuxPath = path
+		}
 	}
+	return m
 }
 
-// getUserShell reads the user's shell from /etc/passwd
-func getUserShell(username string) string {
-	f, err := os.Open("/etc/passwd")
-	if err != nil {
-		return ""
-	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, username+":") {
-			fields := strings.Split(line, ":")
-			if len(fields) >= 7 {
-				return fields[6] // shell is the 7th field
-			}
-		}
+func clampScrollbackSize(size int) int {
+	if size <= 0 {
+		return DefaultScrollbackSize
 	}
-	return ""
+	return min(max(size, MinScrollbackSize), MaxScrollbackSize)
 }
 
 // Create spawns a new PTY session
@@ -149,42 +278,376 @@ func (m *SessionManager) Create(userID string) (*Session, error) {
 
 // CreateNamed spawns a new PTY session with a name
 func (m *SessionManager) CreateNamed(userID, name string) (*Session, error) {
-	cmd := exec.Command(m.shell, "-l")
+	return m.CreateWithOptions(userID, SessionOptions{Name: name})
+}
 
-	// Mimic SSH: start in home directory
-	if home := os.Getenv("HOME"); home != "" {
-		cmd.Dir = home
+// CreateWithOptions spawns a new PTY session
+func (m *SessionManager) CreateWithOptions(userID string, opts SessionOptions) (*Session, error) {
+	if opts.Tmux != "" {
+		return m.createTmux(userID, opts)
+	}
+	if opts.Target != nil {
+		return m.createSSH(userID, opts)
+	}
+	if opts.Container != nil {
+		return m.createDocker(userID, opts)
+	}
+	if m.startBackend != nil {
+		return m.createOn(userID, opts)
+	}
+	sessionID := generateID()
+	account := opts.Account
+	if account == nil {
+		var err error
+		if account, err = privsep.CurrentAccount(); err != nil {
+			return nil, err
+		}
+	}
+	term := opts.Term
+	if term == "" {
+		term = "xterm-256color"
+	}
+	spec := holderSpec{
+		Path:           account.Shell,
+		Args:           []string{"-l"},
+		Env:            append(append(account.Environ(), "TERM="+term), opts.Env...),
+		ScrollbackSize: m.scrollbackSize,
+	}
+	if opts.Command != "" {
+		path, err := exec.LookPath(opts.Command)
+		if err != nil {
+			return nil, fmt.Errorf("%w: command %q not found", ErrInvalidOptions, opts.Command)
+		}
+		spec.Path = path
+		spec.Args = opts.Args
+	}
+	if opts.ScrollbackSize != 0 {
+		spec.ScrollbackSize = clampScrollbackSize(opts.ScrollbackSize)
+	}
+	if m.logMaxSize > 0 {
+		spec.Log = true
+		spec.LogMaxSize = m.logMaxSize
 	}
 
-	cmd.Env = append(os.Environ(),
-		"TERM=xterm-256color",
-	)
-
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("start pty: %w", err)
+	// Mimic SSH: start in home directory
+	spec.Dir = account.Home
+	if opts.Dir != "" {
+		dir := account.ExpandHome(opts.Dir)
+		// Another account's directories may not be visible to the daemon
+		if fi, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) || (err == nil && !fi.IsDir()) {
+			return nil, fmt.Errorf("%w: working directory %q does not exist", ErrInvalidOptions, opts.Dir)
+		}
+		spec.Dir = dir
 	}
 
-	sessionID := generateID()
+	name := opts.Name
 	if name == "" {
 		name = fmt.Sprintf("Session %d", m.countUserSessions(userID)+1)
 	}
 
-	session := &Session{
-		ID:         sessionID,
-		UserID:     userID,
-		Name:       name,
-		PTY:        ptmx,
-		Cmd:        cmd,
-		CreatedAt:  time.Now(),
-		LastInput:  time.Now(),
-		scrollback: NewRingBuffer(DefaultScrollbackSize),
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return nil, fmt.Errorf("create sessions dir: %w", err)
+	}
+	sessionAccount := ""
+	if opts.Account != nil {
+		sessionAccount = opts.Account.Username
+	}
+	cgroup := ""
+	if m.cgroups != nil {
+		var err error
+		if cgroup, err = m.cgroups.create(sessionID, opts.Limits); err != nil {
+			return nil, err
+		}
+	}
+	holderPid, err := m.startHolder(sessionID, sessionAccount, cgroup, opts.Sandbox, &spec)
+	if err != nil {
+		if cgroup != "" {
+			removeCgroup(cgroup)
+		}
+		return nil, err
+	}
+
+	sandbox := ""
+	if opts.Sandbox != nil {
+		sandbox = opts.Sandbox.Name
+	}
+	backend, screen, err := dialHolder(filepath.Join(m.dir, sessionID+".sock"), holderPid, opts.Sandbox != nil)
+	if err != nil {
+		m.stopHolder(sessionID)
+		os.Remove(filepath.Join(m.dir, sessionID+".sock"))
+		os.RemoveAll(m.logDir(sessionID))
+		if cgroup != "" {
+			removeCgroup(cgroup)
+		}
+		return nil, err
+	}
+	session := m.newSession(sessionMeta{
+		ID:        sessionID,
+		UserID:    userID,
+		Name:      name,
+		Profile:   opts.Profile,
+		Account:   sessionAccount,
+		Sandbox:   sandbox,
+		CreatedAt: time.Now(),
+	})
+	session.start(backend, screen, true)
+	if m.record {
+		rec, err := recording.Create(m.RecordingPath(userID, sessionID), name)
+		if err != nil {
+			m.stopHolder(sessionID)
+			backend.Close()
+			session.removeFiles()
+			return nil, err
+		}
+		session.recorder = rec
+	}
+	if err := session.saveMeta(); err != nil {
+		m.stopHolder(sessionID)
+		backend.Close()
+		session.removeFiles()
+		session.closeRecorder()
+		return nil, err
 	}
 
 	m.sessions.Store(session.ID, session)
+	go session.pump()
+
+	if opts.Startup != "" {
+		startup := opts.Startup
+		if !strings.HasSuffix(startup, "\n") {
+			startup += "\n"
+		}
+		session.Write([]byte(startup))
+	}
 	return session, nil
 }
 
+// newSession builds the daemon-side state for a session
+func (m *SessionManager) newSession(meta sessionMeta) *Session {
+	session := &Session{
+		ID:        meta.ID,
+		UserID:    meta.UserID,
+		Name:      meta.Name,
+		Profile:   meta.Profile,
+		Account:   meta.Account,
+		Sandbox:   meta.Sandbox,
+		Target:    meta.Target,
+		Container: meta.Container,
+		CreatedAt: meta.CreatedAt,
+		LastInput: time.Now(),
+		viewers:   make(map[*Viewer]struct{}),
+		shares:    meta.Shares,
+		dir:       m.dir,
+	}
+	session.historyPath = filepath.Join(m.HistoryDir(meta.UserID), meta.ID+".jsonl")
+	if m.cgroups != nil {
+		if _, err := os.Stat(m.cgroups.path(meta.ID)); err == nil {
+			session.cgroup = m.cgroups.path(meta.ID)
+		}
+	}
+	session.credit = sync.NewCond(&session.mu)
+	if session.shares == nil {
+		session.shares = make(map[string]bool)
+	}
+	// Sessions remove themselves once the shell is gone
+	session.onExit = func() {
+		m.Close(session.ID)
+	}
+	return session
+}
+
+// logDir returns the directory of a session's spilled scrollback
+func (m *SessionManager) logDir(sessionID string) string {
+	return filepath.Join(m.dir, sessionID+".log")
+}
+
+// RecordingsDir returns the directory holding a user's recordings
+func (m *SessionManager) RecordingsDir(userID string) string {
+	return filepath.Join(m.recordingsDir, userID)
+}
+
+// RecordingPath returns the asciicast file for a session
+func (m *SessionManager) RecordingPath(userID, sessionID string) string {
+	return filepath.Join(m.RecordingsDir(userID), sessionID+".cast")
+}
+
+// startHolder re-executes the daemon binary as a holder process for the
+// session, running as the given account, in the given cgroup and sandbox,
+// and returns its pid. The daemon creates the listening
+// socket and the scrollback log directory and hands them over, so the
+// socket exists before the holder is ready to accept.
+func (m *SessionManager) startHolder(id, account, cgroup string, sandbox *config.Sandbox, spec *holderSpec) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("locate executable: %w", err)
+	}
+
+	sockPath := filepath.Join(m.dir, id+".sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+	if err != nil {
+		return 0, fmt.Errorf("listen holder socket: %w", err)
+	}
+	ln.SetUnlinkOnClose(false)
+	defer ln.Close()
+
+	lnFile, err := ln.File()
+	if err != nil {
+		os.Remove(sockPath)
+		return 0, fmt.Errorf("holder socket file: %w", err)
+	}
+	defer lnFile.Close()
+
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		os.Remove(sockPath)
+		return 0, fmt.Errorf("encode holder spec: %w", err)
+	}
+	stdin, specWriter, err := os.Pipe()
+	if err != nil {
+		os.Remove(sockPath)
+		return 0, fmt.Errorf("holder spec pipe: %w", err)
+	}
+	defer stdin.Close()
+
+	files := []*os.File{stdin, nil, os.Stderr, lnFile}
+	procSpec := &privsep.Spec{
+		User: account,
+		Path: exe,
+		Args: []string{"--hold"},
+		Env:  spec.Env,
+		Dir:  "/",
+		// Own session so the holder outlives the daemon and its process group
+		Setsid:  true,
+		Cgroup:  cgroup,
+		Sandbox: sandbox,
+	}
+	if spec.Log {
+		logDir, err := m.openLogDir(id)
+		if err != nil {
+			specWriter.Close()
+			os.Remove(sockPath)
+			return 0, err
+		}
+		defer logDir.Close()
+		files = append(files, logDir)
+		procSpec.HandOver = []int{4}
+	}
+
+	proc, err := m.starter.Start(procSpec, files)
+	if err != nil {
+		specWriter.Close()
+		os.Remove(sockPath)
+		os.RemoveAll(m.logDir(id))
+		return 0, fmt.Errorf("start holder: %w", err)
+	}
+	go func() {
+		defer specWriter.Close()
+		specWriter.Write(specJSON)
+	}()
+	return proc.Pid, nil
+}
+
+// openLogDir creates a session's scrollback log directory and opens it for
+// handing to the holder
+func (m *SessionManager) openLogDir(id string) (*os.File, error) {
+	dir := m.logDir(id)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create scrollback log: %w", err)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("open scrollback log: %w", err)
+	}
+	return f, nil
+}
+
+// stopHolder asks a holder that never became a session to terminate
+func (m *SessionManager) stopHolder(id string) {
+	conn, err := net.Dial("unix", filepath.Join(m.dir, id+".sock"))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	writeMsg(conn, msgClose, nil)
+}
+
+// Recover re-registers sessions whose holders survived a daemon restart.
+// Sessions whose holder is gone are cleaned up.
+func (m *SessionManager) Recover() {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("recover sessions: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var meta sessionMeta
+		if err := json.Unmarshal(data, &meta); err != nil || meta.ID == "" {
+			log.Printf("recover sessions: invalid metadata %s", entry.Name())
+			continue
+		}
+
+		session := m.newSession(meta)
+		backend, screen, err := dialHolder(session.sockPath(), meta.HolderPid, meta.Sandbox != "")
+		if err != nil {
+			log.Printf("session %s is gone: %v", meta.ID, err)
+			session.removeFiles()
+			continue
+		}
+		session.start(backend, screen, false)
+		if meta.Recorded {
+			rec, err := recording.Resume(m.RecordingPath(meta.UserID, meta.ID))
+			if err != nil {
+				log.Printf("resume recording for session %s: %v", meta.ID, err)
+			} else {
+				// Output produced while the daemon was down was not captured
+				rec.Marker("daemon restarted")
+				session.recorder = rec
+			}
+		}
+
+		m.sessions.Store(session.ID, session)
+		go session.pump()
+		log.Printf("recovered session %s (%s)", session.ID, session.Name)
+	}
+
+	// Remove sockets and scrollback logs left behind without metadata
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if ext == ".sock" || ext == ".log" {
+			if _, ok := m.Get(strings.TrimSuffix(name, ext)); !ok {
+				os.RemoveAll(filepath.Join(m.dir, name))
+			}
+		}
+	}
+
+	// And cgroups of sessions that are gone
+	if m.cgroups != nil {
+		cgroups, _ := os.ReadDir(m.cgroups.root)
+		for _, entry := range cgroups {
+			if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "sess-") {
+				continue
+			}
+			if _, ok := m.Get(entry.Name()); !ok {
+				removeCgroup(m.cgroups.path(entry.Name()))
+			}
+		}
+	}
+
+	m.PruneHistory()
+}
+
 func (m *SessionManager) countUserSessions(userID string) int {
 	count := 0
 	m.sessions.Range(func(key, value any) bool {
@@ -206,40 +669,67 @@ func (m *SessionManager) Get(id string) (*Session, bool) {
 	return val.(*Session), true
 }
 
-// Close terminates a session
-func (m *SessionManager) Close(id string) error {
+// Close terminates a session and returns how many of its processes had
+// to be terminated
+func (m *SessionManager) Close(id string) (int, error) {
 	val, ok := m.sessions.LoadAndDelete(id)
 	if !ok {
-		return nil
+		return 0, nil
 	}
 
 	session := val.(*Session)
-	return session.Close()
+	killed, err := session.Close(m.closeGrace)
+	if killed > 0 {
+		log.Printf("session %s closed, %d processes terminated", id, killed)
+	}
+	return killed, err
 }
 
 // Delete is an alias for Close
-func (m *SessionManager) Delete(id string) error {
+func (m *SessionManager) Delete(id string) (int, error) {
 	return m.Close(id)
 }
 
-// CloseAllForUser closes all sessions for a user
-func (m *SessionManager) CloseAllForUser(userID string) {
+// closeMatching closes the sessions a filter selects. They are closed
+// concurrently since each may take the grace period. tmux windows are left
+// to tmux.
+func (m *SessionManager) closeMatching(match func(*Session) bool) {
+	var wg sync.WaitGroup
 	m.sessions.Range(func(key, value any) bool {
 		session := value.(*Session)
-		if session.UserID == userID {
-			m.Close(session.ID)
+		if _, tmux := session.backend.(*tmuxBackend); !tmux && match(session) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.Close(session.ID)
+			}()
 		}
 		return true
 	})
+	wg.Wait()
+}
+
+// CloseAllForUser closes all sessions for a user
+func (m *SessionManager) CloseAllForUser(userID string) {
+	m.closeMatching(func(session *Session) bool {
+		return session.UserID == userID
+	})
+}
+
+// CloseAll closes every session
+func (m *SessionManager) CloseAll() {
+	m.closeMatching(func(*Session) bool { return true })
 }
 
 // CloseIdleSessions closes sessions that have been idle for too long
 func (m *SessionManager) CloseIdleSessions(maxIdle time.Duration) {
-	m.sessions.Range(func(key, value any) bool {
-		session := value.(*Session)
-		if time.Since(session.LastInput) > maxIdle {
-			m.Close(session.ID)
+	m.closeMatching(func(session *Session) bool {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		if time.Since(session.LastInput) <= maxIdle {
+			return false
 		}
+		log.Printf("closing idle session %s", session.ID)
 		return true
 	})
 }
@@ -247,136 +737,284 @@ func (m *SessionManager) CloseIdleSessions(maxIdle time.Duration) {
 // SessionInfo contains info about a session for listing
 type SessionInfo struct {
 	ID        string
+	UserID    string
 	Name      string
+	Profile   string
+	Sandbox   string
+	Target    string
+	Container string
 	CreatedAt time.Time
 	Attached  bool
+	Viewers   int
+	Shared    bool // Owned by another user and shared with this one
+	ReadOnly  bool
+	Usage     *CgroupUsage // Nil without resource limits
+	Tmux      string       // tmux session of a tmux window
 }
 
-// ListUserSessions returns all sessions for a user
+// ListUserSessions returns all sessions owned by or shared with a user
 func (m *SessionManager) ListUserSessions(userID string) []SessionInfo {
 	var sessions []SessionInfo
 	m.sessions.Range(func(key, value any) bool {
 		session := value.(*Session)
-		if session.UserID == userID && !session.closed {
+		allowed, readOnly := session.Access(userID)
+		if !allowed {
+			return true
+		}
+		session.mu.Lock()
+		closed := session.closed
+		if !closed {
 			sessions = append(sessions, SessionInfo{
 				ID:        session.ID,
+				UserID:    session.UserID,
 				Name:      session.Name,
+				Profile:   session.Profile,
+				Sandbox:   session.Sandbox,
+				Target:    session.Target,
+				Container: session.Container,
 				CreatedAt: session.CreatedAt,
-				Attached:  session.attached,
+				Attached:  len(session.viewers) > 0,
+				Viewers:   len(session.viewers),
+				Shared:    session.UserID != userID,
+				ReadOnly:  readOnly,
 			})
+			if b, ok := session.backend.(*tmuxBackend); ok {
+				sessions[len(sessions)-1].Tmux = b.client.sessionName()
+			}
+		}
+		session.mu.Unlock()
+		if !closed && session.cgroup != "" {
+			if usage, err := readCgroupUsage(session.cgroup); err == nil {
+				sessions[len(sessions)-1].Usage = usage
+			}
 		}
 		return true
 	})
 	return sessions
 }
 
-// Attach marks a session as attached (kicks out previous connection if any)
-func (s *Session) Attach(onKick func()) bool {
+// Rename changes the session name
+func (s *Session) Rename(name string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.closed {
-		return false
+	s.Name = name
+	s.mu.Unlock()
+	if b, ok := s.backend.(*tmuxBackend); ok {
+		b.rename(name)
+		return
 	}
-	// If already attached, kick out the old connection
-	if s.attached && s.onKick != nil {
-		// Call outside the lock to avoid deadlock
-		kickCallback := s.onKick
-		s.mu.Unlock()
-		kickCallback()
-		s.mu.Lock()
+	if err := s.saveMeta(); err != nil {
+		log.Printf("save session metadata: %v", err)
 	}
-	s.attached = true
-	s.onKick = onKick
-	return true
 }
 
-// Detach marks a session as detached
-func (s *Session) Detach() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.attached = false
+// Session methods
+
+func (s *Session) metaPath() string {
+	return filepath.Join(s.dir, s.ID+".json")
 }
 
-// IsAttached returns whether the session is attached
-func (s *Session) IsAttached() bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.attached
+func (s *Session) sockPath() string {
+	return filepath.Join(s.dir, s.ID+".sock")
 }
 
-// Rename changes the session name
-func (s *Session) Rename(name string) {
+func (s *Session) saveMeta() error {
+	local, ok := s.backend.(*localBackend)
+	if !ok {
+		// Only sessions with a holder survive a restart
+		return nil
+	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.Name = name
+	meta := sessionMeta{
+		ID:        s.ID,
+		UserID:    s.UserID,
+		Name:      s.Name,
+		Profile:   s.Profile,
+		Account:   s.Account,
+		Sandbox:   s.Sandbox,
+		HolderPid: local.holderPid,
+		CreatedAt: s.CreatedAt,
+		Shares:    make(map[string]bool, len(s.shares)),
+		Recorded:  s.recorder != nil,
+	}
+	for userID, readOnly := range s.shares {
+		meta.Shares[userID] = readOnly
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := s.metaPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write session metadata: %w", err)
+	}
+	return os.Rename(tmp, s.metaPath())
 }
 
-// Session methods
+func (s *Session) logDir() string {
+	return filepath.Join(s.dir, s.ID+".log")
+}
+
+func (s *Session) removeFiles() {
+	os.Remove(s.metaPath())
+	os.Remove(s.sockPath())
+	os.RemoveAll(s.logDir())
+	if s.cgroup != "" {
+		removeCgroup(s.cgroup)
+	}
+}
+
+// start sets the session up on its backend, rebuilding the screen from the
+// output the backend already has. Command events in it are only reported
+// for a session that just started; a restarted daemon already did.
+func (s *Session) start(b Backend, screen Screen, fresh bool) {
+	// Replaying raw output is only approximate if the terminal was resized
+	// since, but leaves the emulator at the current screen
+	s.term = vt.New(screen.Cols, screen.Rows, HistoryLines)
+	s.term.Write(screen.Data)
+	s.scrollback = NewRingBuffer(clampScrollbackSize(screen.ScrollbackSize))
+	s.scrollback.Write(screen.Data)
+	s.outputEnd = max(screen.Offset, uint64(len(screen.Data)))
+	if marks := s.term.Marks(); fresh {
+		if events := s.shellEvents(marks, s.outputEnd-uint64(len(screen.Data))); len(events) > 0 {
+			s.saveEvents(events)
+		}
+	} else {
+		for _, mark := range marks {
+			if mark.Kind == vt.MarkCwd {
+				s.shell.cwd = mark.Cwd
+			}
+		}
+	}
+
+	s.backend = b
+	s.exited = make(chan struct{})
+}
 
-func (s *Session) Close() error {
+// setExited records the shell's exit code and how many processes a
+// teardown terminated, and wakes up Wait
+func (s *Session) setExited(code, killed int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	select {
+	case <-s.exited:
+	default:
+		s.exitCode = code
+		s.killed = killed
+		close(s.exited)
+	}
+}
 
+// Close tears the session down. The backend hangs up on the shell and its
+// jobs; for the holder, after the grace period it terminates and finally
+// kills whatever is left. Close returns how many processes that took.
+func (s *Session) Close(grace time.Duration) (int, error) {
+	s.mu.Lock()
 	if s.closed {
-		return nil
+		s.mu.Unlock()
+		return 0, nil
 	}
 	s.closed = true
+	// The pump may be waiting for viewers, and the backend needs it to
+	// read what is left for the teardown to finish
+	s.credit.Broadcast()
+	s.mu.Unlock()
 
-	s.PTY.Close()
-	if s.Cmd.Process != nil {
-		s.Cmd.Process.Kill()
+	select {
+	case <-s.exited:
+	default:
+		if err := s.backend.Terminate(grace); err == nil {
+			// Two grace periods for SIGHUP and SIGTERM, then time to
+			// kill and drain
+			select {
+			case <-s.exited:
+			case <-time.After(2*grace + 5*time.Second):
+				log.Printf("session %s: backend did not finish the teardown", s.ID)
+			}
+		}
+	}
+	s.backend.Close()
+	// Removing the cgroup kills anything that escaped the teardown
+	s.removeFiles()
+	s.closeRecorder()
+	s.closeHistory()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.killed, nil
+}
+
+func (s *Session) closeRecorder() {
+	if s.recorder != nil {
+		s.recorder.Close()
 	}
-	return nil
 }
 
 func (s *Session) Write(p []byte) (int, error) {
 	s.mu.Lock()
 	s.LastInput = time.Now()
 	s.mu.Unlock()
-	return s.PTY.Write(p)
+	if err := s.backend.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func (s *Session) Read(p []byte) (int, error) {
-	n, err := s.PTY.Read(p)
-	if n > 0 {
-		s.scrollback.Write(p[:n])
+// pump reads output from the backend and fans it out to attached viewers
+// until the shell exits or the backend goes away
+func (s *Session) pump() {
+	for {
+		s.waitForViewers()
+		data, err := s.backend.Read()
+		if err != nil {
+			break
+		}
+		s.broadcast(data)
 	}
-	return n, err
+	s.setExited(s.backend.Wait())
+	s.finish()
 }
 
-// Scrollback returns the buffered terminal output
-func (s *Session) Scrollback() []byte {
-	return s.scrollback.Bytes()
+// finish detaches every viewer once the shell is gone and removes the
+// session
+func (s *Session) finish() {
+	s.mu.Lock()
+	for v := range s.viewers {
+		delete(s.viewers, v)
+		close(v.output)
+	}
+	s.mu.Unlock()
+
+	if s.onExit != nil {
+		s.onExit()
+	}
 }
 
 func (s *Session) Resize(cols, rows uint16) error {
-	return pty.Setsize(s.PTY, &pty.Winsize{
-		Cols: cols,
-		Rows: rows,
-	})
+	if s.recorder != nil {
+		s.recorder.Resize(cols, rows)
+	}
+	s.term.Resize(int(cols), int(rows))
+	return s.backend.Resize(cols, rows)
 }
 
 // Redraw sends SIGWINCH to the shell to force a prompt redraw
 func (s *Session) Redraw() {
-	if s.Cmd.Process != nil {
-		s.Cmd.Process.Signal(syscall.SIGWINCH)
-	}
+	s.backend.Signal(s.backend.Pid(), syscall.SIGWINCH)
 }
 
-func (s *Session) Wait() (int, error) {
-	err := s.Cmd.Wait()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return exitErr.ExitCode(), nil
-		}
-		return -1, err
-	}
-	return 0, nil
+// Done returns a channel that is closed once the shell has exited
+func (s *Session) Done() <-chan struct{} {
+	return s.exited
 }
 
-// Reader returns an io.Reader for the PTY output
-func (s *Session) Reader() io.Reader {
-	return s.PTY
+// Wait blocks until the shell exits (or the holder goes away)
+func (s *Session) Wait() (int, error) {
+	<-s.exited
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exitCode, nil
 }
 
 // Writer returns an io.Writer for the PTY input
@@ -384,17 +1022,14 @@ func (s *Session) Writer() io.Writer {
 	return s
 }
 
+// ShellPid returns the pid of the session's shell
+func (s *Session) ShellPid() int {
+	return s.backend.Pid()
+}
+
 // GetWorkingDir returns the current working directory of the shell process
 func (s *Session) GetWorkingDir() (string, error) {
-	if s.Cmd.Process == nil {
-		return "", fmt.Errorf("process not running")
-	}
-	pid := s.Cmd.Process.Pid
-	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
-	if err != nil {
-		return "", fmt.Errorf("read cwd: %w", err)
-	}
-	return cwd, nil
+	return s.backend.Cwd()
 }
 
 func generateID() string {
@@ -0,0 +1,253 @@
+package pty
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialTimeout bounds connecting to a target, including the handshake
+const sshDialTimeout = 15 * time.Second
+
+// ErrTargetUnreachable is returned when a session can't be opened on an
+// SSH target
+var ErrTargetUnreachable = errors.New("target unreachable")
+
+// sshSignals are the signals SSH can name, RFC 4254 section 6.10
+var sshSignals = map[syscall.Signal]ssh.Signal{
+	syscall.SIGABRT: ssh.SIGABRT,
+	syscall.SIGALRM: ssh.SIGALRM,
+	syscall.SIGFPE:  ssh.SIGFPE,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGILL:  ssh.SIGILL,
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGKILL: ssh.SIGKILL,
+	syscall.SIGPIPE: ssh.SIGPIPE,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGSEGV: ssh.SIGSEGV,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// sshBackend runs a session in a shell on an SSH target
+type sshBackend struct {
+	client  *ssh.Client
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	code    int // Set once the shell has exited
+}
+
+// sshSigner loads a private key, along with its certificate if there is
+// one next to it as <key>-cert.pub, like OpenSSH does
+func sshSigner(keyPath string) (ssh.Signer, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse key %s: %w", keyPath, err)
+	}
+	data, err = os.ReadFile(keyPath + "-cert.pub")
+	if errors.Is(err, os.ErrNotExist) {
+		return signer, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read certificate: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s-cert.pub is not a certificate", keyPath)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// dialSSH connects to a target, requests a PTY and starts the shell, or
+// opts.Command, on it
+func dialSSH(target *config.Target, opts SessionOptions, cols, rows int) (*sshBackend, error) {
+	signer, err := sshSigner(target.Key)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(target.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %w", err)
+	}
+	client, err := ssh.Dial("tcp", target.Host, &ssh.ClientConfig{
+		User:            target.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         sshDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	b := &sshBackend{client: client, session: session, code: -1}
+	if b.stdin, err = session.StdinPipe(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if b.stdout, err = session.StdoutPipe(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	// Servers only accept the names their AcceptEnv allows
+	for _, kv := range opts.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			session.Setenv(k, v)
+		}
+	}
+	term := opts.Term
+	if term == "" {
+		term = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 38400, ssh.TTY_OP_OSPEED: 38400}
+	if err := session.RequestPty(term, rows, cols, modes); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("request pty: %w", err)
+	}
+	if opts.Command != "" {
+		// The remote login shell parses the command line
+		cmd := shellQuote(opts.Command)
+		for _, arg := range opts.Args {
+			cmd += " " + shellQuote(arg)
+		}
+		err = session.Start(cmd)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("start shell: %w", err)
+	}
+	return b, nil
+}
+
+// createSSH opens a session on an SSH target
+func (m *SessionManager) createSSH(userID string, opts SessionOptions) (*Session, error) {
+	if opts.Sandbox != nil {
+		return nil, fmt.Errorf("%w: sessions on SSH targets can't be sandboxed", ErrInvalidOptions)
+	}
+	if opts.Dir != "" {
+		return nil, fmt.Errorf("%w: sessions on SSH targets start in the remote home directory", ErrInvalidOptions)
+	}
+	b, err := dialSSH(opts.Target, opts, 80, 24)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrTargetUnreachable, opts.Target.Name, err)
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = opts.Target.Name
+	}
+	sessionAccount := ""
+	if opts.Account != nil {
+		sessionAccount = opts.Account.Username
+	}
+	session := m.register(sessionMeta{
+		ID:        generateID(),
+		UserID:    userID,
+		Name:      name,
+		Profile:   opts.Profile,
+		Account:   sessionAccount,
+		Target:    opts.Target.Name,
+		CreatedAt: time.Now(),
+	}, b, Screen{Cols: 80, Rows: 24})
+
+	if opts.Startup != "" {
+		startup := opts.Startup
+		if !strings.HasSuffix(startup, "\n") {
+			startup += "\n"
+		}
+		session.Write([]byte(startup))
+	}
+	return session, nil
+}
+
+// shellQuote quotes a word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (b *sshBackend) Read() ([]byte, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := b.stdout.Read(buf)
+		if n > 0 {
+			return buf[:n], nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	var exitErr *ssh.ExitError
+	if err := b.session.Wait(); err == nil {
+		b.code = 0
+	} else if errors.As(err, &exitErr) {
+		b.code = exitErr.ExitStatus()
+	}
+	return nil, io.EOF
+}
+
+func (b *sshBackend) Write(p []byte) error {
+	_, err := b.stdin.Write(p)
+	return err
+}
+
+func (b *sshBackend) Resize(cols, rows uint16) error {
+	return b.session.WindowChange(int(rows), int(cols))
+}
+
+// Signal asks the server to signal the remote shell. SSH can't reach any
+// other process, so pid 0 means the shell rather than the foreground job.
+func (b *sshBackend) Signal(pid int, sig syscall.Signal) error {
+	name, ok := sshSignals[sig]
+	if pid != 0 || !ok {
+		return fmt.Errorf("signal %v is not supported on SSH sessions", sig)
+	}
+	return b.session.Signal(name)
+}
+
+// Wait returns the remote shell's exit code, -1 if the server didn't send
+// one. Remote processes are not counted.
+func (b *sshBackend) Wait() (int, int) {
+	return b.code, 0
+}
+
+// Terminate closes the channel; the server hangs up on the shell and its
+// jobs
+func (b *sshBackend) Terminate(grace time.Duration) error {
+	return b.session.Close()
+}
+
+func (b *sshBackend) Close() error {
+	return b.client.Close()
+}
+
+// Pid returns 0; the shell is not a process the daemon can see
+func (b *sshBackend) Pid() int {
+	return 0
+}
+
+func (b *sshBackend) Cwd() (string, error) {
+	return "", fmt.Errorf("working directory of a remote shell is not known")
+}
@@ -0,0 +1,309 @@
+package pty
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTestServer is an SSH server without shells. It reports the requests
+// sessions make, and the test plays the shell on the session's channel.
+type sshTestServer struct {
+	addr     string
+	hostKey  ssh.Signer
+	events   chan string      // Requests made, e.g. "window-change 100x40"
+	input    chan []byte      // Data the client sent
+	channels chan ssh.Channel // Sessions whose shell was started
+}
+
+func newSSHTestServer(t *testing.T, clientKey ssh.PublicKey) *sshTestServer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &sshTestServer{
+		addr:     ln.Addr().String(),
+		hostKey:  hostKey,
+		events:   make(chan string, 16),
+		input:    make(chan []byte, 16),
+		channels: make(chan ssh.Channel, 1),
+	}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, cfg)
+		}
+	}()
+	return s
+}
+
+func (s *sshTestServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, err := channel.Read(buf)
+				if err != nil {
+					return
+				}
+				s.input <- append([]byte(nil), buf[:n]...)
+			}
+		}()
+		go s.handleRequests(channel, reqs)
+	}
+}
+
+func (s *sshTestServer) handleRequests(channel ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok := true
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			ok = ssh.Unmarshal(req.Payload, &env) == nil
+			s.events <- fmt.Sprintf("env %s=%s", env.Name, env.Value)
+		case "pty-req":
+			var ptyReq struct {
+				Term                      string
+				Cols, Rows, Width, Height uint32
+				Modes                     string
+			}
+			ok = ssh.Unmarshal(req.Payload, &ptyReq) == nil
+			s.events <- fmt.Sprintf("pty-req %s %dx%d", ptyReq.Term, ptyReq.Cols, ptyReq.Rows)
+		case "window-change":
+			var size struct{ Cols, Rows, Width, Height uint32 }
+			ok = ssh.Unmarshal(req.Payload, &size) == nil
+			s.events <- fmt.Sprintf("window-change %dx%d", size.Cols, size.Rows)
+		case "signal":
+			var sig struct{ Signal string }
+			ok = ssh.Unmarshal(req.Payload, &sig) == nil
+			s.events <- "signal " + sig.Signal
+		case "exec":
+			var exec struct{ Command string }
+			ok = ssh.Unmarshal(req.Payload, &exec) == nil
+			s.events <- "exec " + exec.Command
+			s.channels <- channel
+		case "shell":
+			s.events <- "shell"
+			s.channels <- channel
+		default:
+			ok = false
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// next returns the next request the server got
+func (s *sshTestServer) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case event := <-s.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a request")
+		return ""
+	}
+}
+
+// sshTestKey writes a client key and returns its path and public key
+func sshTestKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyPath, clientKey
+}
+
+// target returns a target for the server that logs in with the key at
+// keyPath and expects hostKey, nil for a host that isn't known
+func (s *sshTestServer) target(t *testing.T, keyPath string, hostKey ssh.PublicKey) *config.Target {
+	t.Helper()
+	var knownHostsData []byte
+	if hostKey != nil {
+		knownHostsData = []byte(knownhosts.Line([]string{s.addr}, hostKey) + "\n")
+	}
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, knownHostsData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &config.Target{Name: "test", Host: s.addr, User: "alice", Key: keyPath, KnownHosts: knownHosts}
+}
+
+func TestSSHBackend(t *testing.T) {
+	keyPath, clientKey := sshTestKey(t)
+	server := newSSHTestServer(t, clientKey)
+	target := server.target(t, keyPath, server.hostKey.PublicKey())
+
+	b, err := dialSSH(target, SessionOptions{Term: "xterm", Env: []string{"LANG=C.UTF-8"}}, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, want := range []string{"env LANG=C.UTF-8", "pty-req xterm 80x24", "shell"} {
+		if got := server.next(t); got != want {
+			t.Fatalf("request = %q, want %q", got, want)
+		}
+	}
+	channel := <-server.channels
+
+	channel.Write([]byte("$ "))
+	if data, err := b.Read(); err != nil || string(data) != "$ " {
+		t.Fatalf("Read = %q, %v; want the prompt", data, err)
+	}
+	if err := b.Write([]byte("ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-server.input; string(data) != "ls\r" {
+		t.Fatalf("server got %q, want the input", data)
+	}
+
+	if err := b.Resize(100, 40); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.next(t); got != "window-change 100x40" {
+		t.Fatalf("request = %q, want the new size", got)
+	}
+
+	if err := b.Signal(0, syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.next(t); got != "signal INT" {
+		t.Fatalf("request = %q, want SIGINT", got)
+	}
+	// Neither processes nor signals SSH can't name can be reached
+	if err := b.Signal(0, syscall.SIGWINCH); err == nil {
+		t.Fatal("SIGWINCH was sent")
+	}
+	if err := b.Signal(1234, syscall.SIGINT); err == nil {
+		t.Fatal("a signal for a process was sent")
+	}
+
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{7}))
+	channel.Close()
+	if _, err := b.Read(); err != io.EOF {
+		t.Fatalf("Read after exit = %v, want EOF", err)
+	}
+	if code, _ := b.Wait(); code != 7 {
+		t.Fatalf("exit code = %d, want 7", code)
+	}
+}
+
+func TestSSHBackendCommand(t *testing.T) {
+	keyPath, clientKey := sshTestKey(t)
+	server := newSSHTestServer(t, clientKey)
+	target := server.target(t, keyPath, server.hostKey.PublicKey())
+
+	b, err := dialSSH(target, SessionOptions{Command: "top", Args: []string{"-d", "it's 1"}}, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	server.next(t) // pty-req
+	if got, want := server.next(t), `exec 'top' '-d' 'it'\''s 1'`; got != want {
+		t.Fatalf("request = %q, want %q", got, want)
+	}
+	channel := <-server.channels
+	// A shell killed by a signal has no exit status
+	channel.Close()
+	if _, err := b.Read(); err != io.EOF {
+		t.Fatalf("Read after exit = %v, want EOF", err)
+	}
+	if code, _ := b.Wait(); code != -1 {
+		t.Fatalf("exit code = %d, want -1", code)
+	}
+}
+
+func TestSSHBackendHostKeyMismatch(t *testing.T) {
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewSignerFromKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, clientKey := sshTestKey(t)
+	server := newSSHTestServer(t, clientKey)
+
+	// known_hosts has a different key for the server's address
+	_, err = dialSSH(server.target(t, keyPath, otherKey.PublicKey()), SessionOptions{}, 80, 24)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		t.Fatalf("dial = %v, want a host key mismatch", err)
+	}
+	select {
+	case event := <-server.events:
+		t.Fatalf("server got %q from a client that should have hung up", event)
+	default:
+	}
+
+	// A host missing from known_hosts is refused as well
+	_, err = dialSSH(server.target(t, keyPath, nil), SessionOptions{}, 80, 24)
+	if !errors.As(err, &keyErr) || len(keyErr.Want) != 0 {
+		t.Fatalf("dial = %v, want an unknown host", err)
+	}
+}
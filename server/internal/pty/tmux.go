@@ -0,0 +1,880 @@
+package pty
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/privsep"
+)
+
+// Sessions can also be the windows of tmux sessions on the host, so the
+// same workspaces are reachable from sshttp and from an SSH login. For each
+// tmux session the daemon runs a control mode client (tmux -C; -CC is the
+// same protocol but insists on a terminal) as the session's account. Control
+// mode is line based: commands go to the client's stdin and their replies
+// come back between %begin and %end (or %error) lines, interleaved with
+// notifications such as %output for the output of a pane.
+
+// tmuxWindowFormat describes a window and its active pane, the one the
+// session shows. The name goes last since it may contain spaces.
+const tmuxWindowFormat = "#{window_id} #{pane_id} #{pane_pid} #{pane_width} #{pane_height} #{cursor_x} #{cursor_y} #{window_name}"
+
+// tmuxOutputLimit is how much of a pane's output may wait for the session
+// before it is dropped and the pane redrawn instead
+const tmuxOutputLimit = 4 << 20
+
+// tmuxKeysPerCommand bounds the input bytes sent with one send-keys
+const tmuxKeysPerCommand = 1024
+
+// tmuxTimeout bounds waiting for tmux to answer
+const tmuxTimeout = 5 * time.Second
+
+// tmuxNameRegex restricts the names of tmux sessions sshttp creates; ':'
+// and '.' would be taken as window and pane in tmux targets
+var tmuxNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,64}$`)
+
+var errTmuxGone = errors.New("tmux client is gone")
+
+// tmuxBackend runs a session in a tmux window
+type tmuxBackend struct {
+	client  *tmuxClient
+	window  string // Window ID, e.g. @3
+	pane    string // Pane ID, e.g. %5
+	pid     int
+	session *Session
+
+	// Output waiting for the session. The client's reader serves all
+	// windows, so it queues without waiting for one whose viewers are slow.
+	outMu    sync.Mutex
+	output   [][]byte
+	queued   int           // Bytes in output
+	dropping bool          // Output is dropped until the pane is redrawn
+	closed   bool          // Set by the client's reader when the window closes
+	ready    chan struct{} // Signalled when output is queued or closed
+
+	tornDown   chan struct{} // Closed once Terminate's teardown is done, nil before
+	terminated int           // Processes the teardown terminated
+}
+
+// tmuxClient is a control mode client attached to one tmux session
+type tmuxClient struct {
+	m       *SessionManager
+	userID  string
+	account string // Empty for the daemon's own
+	target  string // tmux session ID, e.g. $2
+	stdin   *os.File
+
+	writeMu sync.Mutex // Serializes commands, which tmux answers in order
+	mu      sync.Mutex
+	name    string                  // tmux session name
+	pending []func([]string, error) // Reply handlers, oldest first; run by the reader
+	windows map[string]*tmuxBackend // By window ID
+	panes   map[string]*tmuxBackend // By pane ID
+	waiting map[string]chan *Session
+	gone    bool
+}
+
+// tmuxSpec returns the spec for running tmux as an account, nil for the
+// daemon's own
+func (m *SessionManager) tmuxSpec(account *privsep.Account, args ...string) (*privsep.Spec, error) {
+	spec := &privsep.Spec{Path: m.tmuxPath, Args: args}
+	if account == nil {
+		var err error
+		if account, err = privsep.CurrentAccount(); err != nil {
+			return nil, err
+		}
+	} else {
+		spec.User = account.Username
+	}
+	spec.Env = account.Environ()
+	spec.Dir = account.Home
+	return spec, nil
+}
+
+// runTmux runs a tmux command as an account and returns its output lines
+func (m *SessionManager) runTmux(account *privsep.Account, args ...string) ([]string, error) {
+	spec, err := m.tmuxSpec(account, args...)
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	proc, err := m.starter.Start(spec, []*os.File{nil, w, w})
+	w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("start tmux: %w", err)
+	}
+	out, _ := io.ReadAll(r)
+	output := strings.TrimRight(string(out), "\n")
+	if code := proc.Wait(); code != 0 {
+		return nil, fmt.Errorf("tmux %s: %s", args[0], output)
+	}
+	if output == "" {
+		return nil, nil
+	}
+	return strings.Split(output, "\n"), nil
+}
+
+// tmuxNoServer reports whether a tmux command failed only because the
+// account has no tmux server running
+func tmuxNoServer(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "no server running") || strings.Contains(msg, "error connecting to")
+}
+
+// SyncTmux attaches to the tmux sessions of a user's account that the user
+// has no sessions for yet, so their windows are listed. account is nil for
+// the daemon's own.
+func (m *SessionManager) SyncTmux(userID string, account *privsep.Account) error {
+	if m.tmuxPath == "" {
+		return nil
+	}
+	lines, err := m.runTmux(account, "list-sessions", "-F", "#{session_id} #{session_name}")
+	if err != nil {
+		if tmuxNoServer(err) {
+			return nil
+		}
+		return err
+	}
+	for _, line := range lines {
+		target, name, _ := strings.Cut(line, " ")
+		if _, err := m.attachTmux(userID, account, target, name); err != nil {
+			log.Printf("attach tmux session %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// attachTmux returns the user's client for a tmux session, starting one
+// and registering the session's windows if there is none yet
+func (m *SessionManager) attachTmux(userID string, account *privsep.Account, target, name string) (*tmuxClient, error) {
+	key := userID + " " + target
+	m.tmuxMu.Lock()
+	if c, ok := m.tmux[key]; ok {
+		m.tmuxMu.Unlock()
+		return c, nil
+	}
+	c, stdout, err := m.startTmuxClient(userID, account, target, name)
+	if err != nil {
+		m.tmuxMu.Unlock()
+		return nil, err
+	}
+	m.tmux[key] = c
+	m.tmuxMu.Unlock()
+	go c.read(stdout, key)
+
+	lines, err := c.run("list-windows -F " + tmuxQuote(tmuxWindowFormat))
+	if err != nil {
+		c.stdin.Close()
+		return nil, err
+	}
+	for _, line := range lines {
+		c.capture(line)
+	}
+	// Replies come in order, so once this one is in the windows are
+	// registered
+	c.run("display-message -p ''")
+	return c, nil
+}
+
+// startTmuxClient starts a control mode client attached to a tmux session
+// and returns it with its output
+func (m *SessionManager) startTmuxClient(userID string, account *privsep.Account, target, name string) (*tmuxClient, *os.File, error) {
+	spec, err := m.tmuxSpec(account, "-C", "attach-session", "-t", target)
+	if err != nil {
+		return nil, nil, err
+	}
+	stdin, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stdin.Close()
+	stdoutReader, stdout, err := os.Pipe()
+	if err != nil {
+		stdinWriter.Close()
+		return nil, nil, err
+	}
+	defer stdout.Close()
+
+	if _, err := m.starter.Start(spec, []*os.File{stdin, stdout, nil}); err != nil {
+		stdinWriter.Close()
+		stdoutReader.Close()
+		return nil, nil, fmt.Errorf("start tmux client: %w", err)
+	}
+	return &tmuxClient{
+		m:       m,
+		userID:  userID,
+		account: spec.User,
+		target:  target,
+		stdin:   stdinWriter,
+		name:    name,
+		windows: make(map[string]*tmuxBackend),
+		panes:   make(map[string]*tmuxBackend),
+		waiting: make(map[string]chan *Session),
+	}, stdoutReader, nil
+}
+
+// tmuxQuote quotes an argument for a tmux command line
+func tmuxQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// command sends a command to tmux. done, if not nil, is called by the
+// reader with the reply lines, so it must not wait for other replies.
+func (c *tmuxClient) command(cmd string, done func([]string, error)) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	if c.gone {
+		c.mu.Unlock()
+		return errTmuxGone
+	}
+	c.pending = append(c.pending, done)
+	c.mu.Unlock()
+	_, err := io.WriteString(c.stdin, cmd+"\n")
+	return err
+}
+
+// run sends a command and waits for its reply. It must not be called by
+// the reader.
+func (c *tmuxClient) run(cmd string) ([]string, error) {
+	type reply struct {
+		lines []string
+		err   error
+	}
+	ch := make(chan reply, 1)
+	if err := c.command(cmd, func(lines []string, err error) {
+		ch <- reply{lines, err}
+	}); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		return r.lines, r.err
+	case <-time.After(tmuxTimeout):
+		return nil, fmt.Errorf("tmux did not answer %q", strings.Fields(cmd)[0])
+	}
+}
+
+// read handles replies and notifications until the client exits
+func (c *tmuxClient) read(r *os.File, key string) {
+	defer r.Close()
+	br := bufio.NewReader(r)
+	var block []string
+	var blockEnd, blockError string // Lines ending the current reply
+	inBlock, ours := false, false
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if inBlock {
+			// Command output may itself start with %end, so only the
+			// line matching the %begin ends it
+			if line != blockEnd && line != blockError {
+				block = append(block, line)
+				continue
+			}
+			inBlock = false
+			if ours {
+				var replyErr error
+				if line == blockError {
+					replyErr = fmt.Errorf("tmux: %s", strings.Join(block, "; "))
+				}
+				c.reply(block, replyErr)
+			}
+			continue
+		}
+
+		kind, args, _ := strings.Cut(line, " ")
+		switch kind {
+		case "%begin":
+			// %begin time number flags; flags is 1 for commands sent by
+			// this client, 0 for the attach-session it started with
+			fields := strings.Fields(args)
+			inBlock, block = true, nil
+			ours = len(fields) == 3 && fields[2] == "1"
+			blockEnd, blockError = "%end "+args, "%error "+args
+		case "%output":
+			pane, data, _ := strings.Cut(args, " ")
+			c.mu.Lock()
+			b := c.panes[pane]
+			c.mu.Unlock()
+			if b != nil {
+				b.queue(tmuxUnescape(data))
+			}
+		case "%window-add":
+			c.command("display-message -p -t "+args+" "+tmuxQuote(tmuxWindowFormat), func(lines []string, err error) {
+				if err == nil && len(lines) == 1 {
+					c.capture(lines[0])
+				}
+			})
+		case "%window-close", "%unlinked-window-close":
+			c.mu.Lock()
+			b := c.windows[args]
+			c.forget(b)
+			c.mu.Unlock()
+			if b != nil {
+				b.closeOutput()
+			}
+		case "%window-renamed":
+			window, name, _ := strings.Cut(args, " ")
+			c.mu.Lock()
+			b := c.windows[window]
+			c.mu.Unlock()
+			if b != nil {
+				b.session.mu.Lock()
+				b.session.Name = name
+				b.session.mu.Unlock()
+			}
+		case "%layout-change":
+			// %layout-change window layout visible-layout flags; the
+			// layout starts with the window's size
+			fields := strings.Fields(args)
+			if len(fields) < 2 {
+				break
+			}
+			c.mu.Lock()
+			b := c.windows[fields[0]]
+			c.mu.Unlock()
+			if b != nil && !strings.ContainsAny(fields[1], "[{") {
+				// Only a window with a single pane has the pane's size
+				if cols, rows, ok := tmuxLayoutSize(fields[1]); ok {
+					b.session.term.Resize(cols, rows)
+				}
+			}
+		case "%session-renamed":
+			target, name, _ := strings.Cut(args, " ")
+			if target == c.target {
+				c.mu.Lock()
+				c.name = name
+				c.mu.Unlock()
+			}
+		}
+	}
+
+	// The tmux session ended or the client was detached
+	c.m.tmuxMu.Lock()
+	delete(c.m.tmux, key)
+	c.m.tmuxMu.Unlock()
+	c.stdin.Close()
+
+	c.mu.Lock()
+	c.gone = true
+	pending := c.pending
+	c.pending = nil
+	for _, b := range c.windows {
+		b.closeOutput()
+	}
+	c.windows = nil
+	c.panes = nil
+	c.mu.Unlock()
+	for _, done := range pending {
+		if done != nil {
+			done(nil, errTmuxGone)
+		}
+	}
+}
+
+func (c *tmuxClient) sessionName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// reply hands a command's reply to its handler
+func (c *tmuxClient) reply(lines []string, err error) {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	done := c.pending[0]
+	c.pending = c.pending[1:]
+	c.mu.Unlock()
+	if done != nil {
+		done(lines, err)
+	}
+}
+
+// capture reads the screen and history of a window, described by a
+// tmuxWindowFormat line, and registers it as a session. The session is
+// registered by the reader right after the capture, so none of the pane's
+// output goes missing.
+func (c *tmuxClient) capture(info string) {
+	fields := strings.SplitN(info, " ", 8)
+	if len(fields) != 8 {
+		return
+	}
+	window, pane, name := fields[0], fields[1], fields[7]
+	var n [5]int
+	for i := range n {
+		var err error
+		if n[i], err = strconv.Atoi(fields[2+i]); err != nil {
+			return
+		}
+	}
+	pid, cols, rows, cursorX, cursorY := n[0], n[1], n[2], n[3], n[4]
+
+	cmd := fmt.Sprintf("capture-pane -p -e -t %s -S -%d", pane, HistoryLines)
+	c.command(cmd, func(lines []string, err error) {
+		if err != nil {
+			return
+		}
+		screen := []byte(strings.Join(lines, "\r\n"))
+		screen = fmt.Appendf(screen, "\x1b[0m\x1b[%d;%dH", cursorY+1, cursorX+1)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.gone || c.windows[window] != nil {
+			return
+		}
+		b := &tmuxBackend{
+			client: c,
+			window: window,
+			pane:   pane,
+			pid:    pid,
+			ready:  make(chan struct{}, 1),
+		}
+		b.session = c.m.register(sessionMeta{
+			ID:        generateID(),
+			UserID:    c.userID,
+			Name:      name,
+			Account:   c.account,
+			CreatedAt: time.Now(),
+		}, b, Screen{Cols: cols, Rows: rows, Data: screen, Offset: uint64(len(screen))})
+		c.windows[window] = b
+		c.panes[pane] = b
+		if ch, ok := c.waiting[window]; ok {
+			delete(c.waiting, window)
+			ch <- b.session
+		}
+	})
+}
+
+// forget drops a window. Called with c.mu held.
+func (c *tmuxClient) forget(b *tmuxBackend) {
+	if b == nil {
+		return
+	}
+	delete(c.windows, b.window)
+	delete(c.panes, b.pane)
+}
+
+// window waits for a window to be registered as a session
+func (c *tmuxClient) window(id string) (*Session, error) {
+	c.mu.Lock()
+	if b, ok := c.windows[id]; ok {
+		c.mu.Unlock()
+		return b.session, nil
+	}
+	ch := make(chan *Session, 1)
+	c.waiting[id] = ch
+	c.mu.Unlock()
+
+	select {
+	case s := <-ch:
+		return s, nil
+	case <-time.After(tmuxTimeout):
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("tmux window %s did not show up", id)
+	}
+}
+
+// createTmux opens a new window in the named tmux session of the account,
+// creating the tmux session if it doesn't exist
+func (m *SessionManager) createTmux(userID string, opts SessionOptions) (*Session, error) {
+	if m.tmuxPath == "" {
+		return nil, fmt.Errorf("%w: tmux sessions are not enabled", ErrInvalidOptions)
+	}
+	if !tmuxNameRegex.MatchString(opts.Tmux) {
+		return nil, fmt.Errorf("%w: invalid tmux session name", ErrInvalidOptions)
+	}
+	if opts.Sandbox != nil {
+		return nil, fmt.Errorf("%w: tmux sessions can't run in a sandbox", ErrInvalidOptions)
+	}
+	account := opts.Account
+	home := ""
+	if account != nil {
+		home = account.Home
+	} else if current, err := privsep.CurrentAccount(); err == nil {
+		home = current.Home
+	}
+
+	// Arguments shared by new-session and new-window
+	var args []string
+	if opts.Dir != "" {
+		dir := opts.Dir
+		if strings.HasPrefix(dir, "~/") {
+			dir = home + dir[1:]
+		}
+		args = append(args, "-c", dir)
+	}
+	for _, kv := range opts.Env {
+		args = append(args, "-e", kv)
+	}
+	if opts.Name != "" {
+		args = append(args, "-n", opts.Name)
+	}
+	if opts.Command != "" {
+		args = append(args, opts.Command)
+		args = append(args, opts.Args...)
+	}
+
+	lines, err := m.runTmux(account, "list-sessions", "-F", "#{session_id} #{session_name}")
+	if err != nil && !tmuxNoServer(err) {
+		return nil, err
+	}
+	target := ""
+	for _, line := range lines {
+		if id, name, _ := strings.Cut(line, " "); name == opts.Tmux {
+			target = id
+		}
+	}
+
+	var window string
+	var c *tmuxClient
+	if target == "" {
+		newArgs := append([]string{"new-session", "-d", "-P", "-F", "#{session_id} #{window_id}", "-s", opts.Tmux}, args...)
+		lines, err := m.runTmux(account, newArgs...)
+		if err != nil || len(lines) != 1 {
+			return nil, fmt.Errorf("create tmux session: %v", err)
+		}
+		target, window, _ = strings.Cut(lines[0], " ")
+		if c, err = m.attachTmux(userID, account, target, opts.Tmux); err != nil {
+			return nil, err
+		}
+	} else {
+		if c, err = m.attachTmux(userID, account, target, opts.Tmux); err != nil {
+			return nil, err
+		}
+		cmd := "new-window -d -P -F '#{window_id}' -t " + tmuxQuote(target+":")
+		for _, arg := range args {
+			cmd += " " + tmuxQuote(arg)
+		}
+		lines, err := c.run(cmd)
+		if err != nil || len(lines) != 1 {
+			return nil, fmt.Errorf("create tmux window: %v", err)
+		}
+		window = lines[0]
+	}
+
+	session, err := c.window(window)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Startup != "" {
+		startup := opts.Startup
+		if !strings.HasSuffix(startup, "\n") {
+			startup += "\n"
+		}
+		session.Write([]byte(startup))
+	}
+	return session, nil
+}
+
+func (b *tmuxBackend) Read() ([]byte, error) {
+	for {
+		b.outMu.Lock()
+		if len(b.output) > 0 {
+			data := b.output[0]
+			b.output[0] = nil
+			b.output = b.output[1:]
+			b.queued -= len(data)
+			b.outMu.Unlock()
+			return data, nil
+		}
+		closed := b.closed
+		b.outMu.Unlock()
+		if closed {
+			return nil, io.EOF
+		}
+		<-b.ready
+	}
+}
+
+// queue adds a pane's output for Read. When too much piles up, the output
+// is dropped and replaced by a redraw of the pane.
+func (b *tmuxBackend) queue(data []byte) {
+	b.outMu.Lock()
+	if b.dropping {
+		b.outMu.Unlock()
+		return
+	}
+	if b.queued+len(data) > tmuxOutputLimit {
+		b.output, b.queued, b.dropping = nil, 0, true
+		b.outMu.Unlock()
+		go b.redraw()
+		return
+	}
+	b.output = append(b.output, data)
+	b.queued += len(data)
+	b.outMu.Unlock()
+	b.wake()
+}
+
+// redraw queues the pane's screen in place of the output that was dropped.
+// The capture's reply comes in order with the pane's output, so output is
+// queued again from exactly where the screen leaves off.
+func (b *tmuxBackend) redraw() {
+	var cursorX, cursorY int
+	lines, err := b.client.run(fmt.Sprintf("display-message -p -t %s '#{cursor_x} #{cursor_y}'", b.pane))
+	if err == nil && len(lines) == 1 {
+		fmt.Sscanf(lines[0], "%d %d", &cursorX, &cursorY)
+	}
+	err = b.client.command("capture-pane -p -e -t "+b.pane, func(lines []string, err error) {
+		b.outMu.Lock()
+		b.dropping = false
+		if err == nil {
+			screen := []byte("\x1b[0m\x1b[H\x1b[2J")
+			screen = append(screen, strings.Join(lines, "\r\n")...)
+			screen = fmt.Appendf(screen, "\x1b[0m\x1b[%d;%dH", cursorY+1, cursorX+1)
+			b.output = append(b.output, screen)
+			b.queued += len(screen)
+		}
+		b.outMu.Unlock()
+		b.wake()
+	})
+	if err != nil {
+		b.outMu.Lock()
+		b.dropping = false
+		b.outMu.Unlock()
+	}
+}
+
+// closeOutput ends the output once what is queued has been read
+func (b *tmuxBackend) closeOutput() {
+	b.outMu.Lock()
+	b.closed = true
+	b.outMu.Unlock()
+	b.wake()
+}
+
+func (b *tmuxBackend) wake() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Write types input into the window's pane
+func (b *tmuxBackend) Write(p []byte) error {
+	for len(p) > 0 {
+		n := min(len(p), tmuxKeysPerCommand)
+		var cmd strings.Builder
+		cmd.WriteString("send-keys -t " + b.pane + " -H")
+		for _, c := range p[:n] {
+			fmt.Fprintf(&cmd, " %02x", c)
+		}
+		if err := b.client.command(cmd.String(), nil); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// Resize sets the window's size for the daemon's client
+func (b *tmuxBackend) Resize(cols, rows uint16) error {
+	return b.client.command(fmt.Sprintf("refresh-client -C %s:%dx%d", b.window, cols, rows), nil)
+}
+
+// Signal has tmux run kill, as the session's account
+func (b *tmuxBackend) Signal(pid int, sig syscall.Signal) error {
+	if pid == 0 {
+		foreground, err := foregroundGroup(b.pid)
+		if err != nil {
+			return err
+		}
+		pid = -foreground
+	}
+	cmd := fmt.Sprintf("kill -%d %d", int(sig), pid)
+	return b.client.command("run-shell -b "+tmuxQuote(cmd), nil)
+}
+
+// Wait reports an unknown exit code; tmux doesn't report it. After
+// Terminate, it waits for the teardown to count the processes.
+func (b *tmuxBackend) Wait() (int, int) {
+	b.outMu.Lock()
+	tornDown := b.tornDown
+	b.outMu.Unlock()
+	if tornDown == nil {
+		return -1, 0
+	}
+	<-tornDown
+	b.outMu.Lock()
+	defer b.outMu.Unlock()
+	return -1, b.terminated
+}
+
+// Terminate tears the pane's processes down in stages like a holder does,
+// then closes the window. It returns right away; Wait has the outcome.
+func (b *tmuxBackend) Terminate(grace time.Duration) error {
+	b.outMu.Lock()
+	if b.tornDown != nil {
+		b.outMu.Unlock()
+		return nil
+	}
+	b.tornDown = make(chan struct{})
+	b.outMu.Unlock()
+	go b.teardown(grace)
+	return nil
+}
+
+// teardown sends SIGHUP to the pane's shell and everything below it, then
+// SIGTERM and finally SIGKILL to whatever is still running after the grace
+// period. Processes are tracked by pid and start time, since those whose
+// parent exits are no longer below the shell.
+func (b *tmuxBackend) teardown(grace time.Duration) {
+	procs := make(map[int]uint64)
+	running := func() []int {
+		for _, pid := range append([]int{b.pid}, descendants(b.pid)...) {
+			if _, ok := procs[pid]; !ok {
+				if st, err := readProcStat(pid); err == nil && st.state != "Z" {
+					procs[pid] = st.starttime
+				}
+			}
+		}
+		var pids []int
+		for pid, start := range procs {
+			if st, err := readProcStat(pid); err == nil && st.state != "Z" && st.starttime == start {
+				pids = append(pids, pid)
+			}
+		}
+		return pids
+	}
+
+	for _, sig := range []syscall.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGKILL} {
+		pids := running()
+		if len(pids) == 0 {
+			break
+		}
+		list := ""
+		for _, pid := range pids {
+			list += " " + strconv.Itoa(pid)
+		}
+		cmd := fmt.Sprintf("kill -%d%s", int(sig), list)
+		if sig != syscall.SIGKILL {
+			// Stopped jobs have to run to handle the signal
+			cmd += fmt.Sprintf("; kill -%d%s", int(syscall.SIGCONT), list)
+		}
+		if err := b.kill(cmd); err != nil {
+			log.Printf("tmux window %s: %v", b.window, err)
+			break
+		}
+		wait := grace
+		if sig == syscall.SIGKILL {
+			wait = time.Second
+		}
+		for deadline := time.Now().Add(wait); time.Now().Before(deadline); {
+			if len(running()) == 0 {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	b.outMu.Lock()
+	b.terminated = len(procs)
+	closed := b.closed
+	b.outMu.Unlock()
+	if !closed {
+		// A shell that is gone usually took the window with it
+		b.client.command("kill-window -t "+b.window, nil)
+	}
+	close(b.tornDown)
+}
+
+// Close leaves the window to tmux
+func (b *tmuxBackend) Close() error {
+	return nil
+}
+
+func (b *tmuxBackend) Pid() int {
+	return b.pid
+}
+
+func (b *tmuxBackend) Cwd() (string, error) {
+	return procCwd(b.pid)
+}
+
+// kill runs a kill command as the session's account. Not through tmux like
+// Signal: once the shell is gone, the tmux server may be too.
+func (b *tmuxBackend) kill(cmd string) error {
+	var account *privsep.Account
+	if b.client.account != "" {
+		var err error
+		if account, err = privsep.LookupAccount(b.client.account); err != nil {
+			return err
+		}
+	}
+	spec, err := b.client.m.tmuxSpec(account)
+	if err != nil {
+		return err
+	}
+	spec.Path, spec.Args = "/bin/sh", []string{"-c", cmd}
+	proc, err := b.client.m.starter.Start(spec, nil)
+	if err != nil {
+		return fmt.Errorf("kill: %w", err)
+	}
+	proc.Wait()
+	return nil
+}
+
+func (b *tmuxBackend) rename(name string) error {
+	return b.client.command("rename-window -t "+b.window+" "+tmuxQuote(name), nil)
+}
+
+// tmuxUnescape decodes %output data, in which tmux escapes control
+// characters and backslashes as octal
+func tmuxUnescape(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			out = append(out, (s[i+1]-'0')<<6|(s[i+2]-'0')<<3|(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return out
+}
+
+func isOctal(b byte) bool {
+	return b >= '0' && b <= '7'
+}
+
+// tmuxLayoutSize reads the size from a layout such as "b25e,80x24,0,0,1"
+func tmuxLayoutSize(layout string) (int, int, bool) {
+	parts := strings.SplitN(layout, ",", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	w, h, ok := strings.Cut(parts[1], "x")
+	if !ok {
+		return 0, 0, false
+	}
+	cols, err1 := strconv.Atoi(w)
+	rows, err2 := strconv.Atoi(h)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return cols, rows, true
+}
@@ -0,0 +1,320 @@
+package pty
+
+import (
+	"log"
+	"time"
+)
+
+// viewerBufferSize is how many output chunks a viewer may lag behind
+// before it is disconnected
+const viewerBufferSize = 256
+
+// Resuming replays at most maxResumeBytes of missed output, in chunks of
+// resumeChunkSize; a viewer further behind gets a redraw instead
+const (
+	maxResumeBytes  = 1024 * 1024
+	resumeChunkSize = 64 * 1024
+)
+
+// flowStallTimeout is how long a viewer with flow control may keep the
+// session waiting without acknowledging output before it is disconnected
+const flowStallTimeout = 30 * time.Second
+
+// Viewer is one connection attached to a session. Every viewer receives
+// the session's output; only read-write viewers may send input.
+type Viewer struct {
+	ReadOnly bool
+	userID   string
+	output   chan Chunk
+	started  bool // Receiving output; set once the initial screen was queued
+	revoked  bool // Detached because the user's access was revoked or made read-only
+
+	// Flow control: the session stops reading output while the viewer has
+	// window bytes unacknowledged. No flow control if window is 0.
+	window  uint64
+	unacked uint64
+	stalled time.Time // When the full window started holding up the session
+}
+
+// Chunk is one item of a viewer's output: terminal output, or a command
+// event
+type Chunk struct {
+	Data   []byte
+	Offset uint64 // Output offset just past Data; for a redraw, of the output it shows
+	Event  *CommandEvent
+}
+
+// Output returns the viewer's output channel. It is closed when the viewer
+// is detached, falls too far behind, or the session ends.
+func (v *Viewer) Output() <-chan Chunk {
+	return v.output
+}
+
+// Revoked reports whether the viewer was detached because its user lost
+// the access it was attached with. Valid once Output is closed.
+func (v *Viewer) Revoked() bool {
+	return v.revoked
+}
+
+// Attach adds a viewer for a user to the session. The viewer receives no
+// output until Start is called.
+func (s *Session) Attach(userID string, readOnly bool) (*Viewer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, false
+	}
+	select {
+	case <-s.exited:
+		return nil, false
+	default:
+	}
+
+	v := &Viewer{
+		ReadOnly: readOnly,
+		userID:   userID,
+		output:   make(chan Chunk, viewerBufferSize),
+	}
+	s.viewers[v] = struct{}{}
+	return v, true
+}
+
+// Start begins delivering output to a viewer. The first chunk redraws the
+// current screen with up to history lines of scrollback; it is captured
+// atomically with the start, so no output is lost or duplicated.
+func (s *Session) Start(v *Viewer, history int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.viewers[v]; !ok || v.started {
+		return
+	}
+	v.started = true
+	s.send(v, Chunk{Data: s.term.Redraw(min(history, HistoryLines)), Offset: s.outputEnd})
+}
+
+// Resume begins delivering output to a viewer that has seen the output up
+// to offset from, say before its connection dropped. It gets exactly the
+// output it missed if that is still retained, in memory or the spilled
+// log, and a redraw like from Start otherwise. Resume reports whether the
+// missed output was sent.
+func (s *Session) Resume(v *Viewer, from uint64, history int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.viewers[v]; !ok || v.started {
+		return false
+	}
+	v.started = true
+
+	missed, ok := s.missedOutput(from)
+	if !ok {
+		s.send(v, Chunk{Data: s.term.Redraw(min(history, HistoryLines)), Offset: s.outputEnd})
+		return false
+	}
+	for pos := 0; pos < len(missed); pos += resumeChunkSize {
+		end := min(pos+resumeChunkSize, len(missed))
+		s.send(v, Chunk{Data: missed[pos:end], Offset: from + uint64(end)})
+	}
+	return true
+}
+
+// missedOutput returns the output from an offset up to now, if it is all
+// retained and not too much to replay. Called with s.mu held, which keeps
+// output from being spilled meanwhile.
+func (s *Session) missedOutput(from uint64) ([]byte, bool) {
+	if from > s.outputEnd || s.outputEnd-from > maxResumeBytes {
+		return nil, false
+	}
+	mem := s.scrollback.Bytes()
+	memStart := s.outputEnd - uint64(len(mem))
+	if from >= memStart {
+		return mem[from-memStart:], true
+	}
+	// The holder writes the log, which may already hold output newer than
+	// what is in memory
+	need := memStart - from
+	data, oldest, ok := readScrollbackLog(s.logDir(), from, int(need))
+	if !ok || oldest > from || uint64(len(data)) < need {
+		return nil, false
+	}
+	return append(data[:need], mem...), true
+}
+
+// send queues a chunk that fits into the viewer's buffer. Called with s.mu
+// held.
+func (s *Session) send(v *Viewer, chunk Chunk) {
+	v.output <- chunk
+	v.unacked += uint64(len(chunk.Data))
+}
+
+// SetWindow turns on flow control for a viewer: once it has window bytes
+// of output unacknowledged, the session stops reading the shell's output
+// until it acknowledges some with Ack. That leaves the shell blocked on a
+// full terminal instead of output piling up, so an interrupt takes effect
+// right away. Read-only viewers can't hold up the session and don't get
+// flow control.
+func (s *Session) SetWindow(v *Viewer, window int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !v.ReadOnly {
+		v.window = uint64(window)
+	}
+}
+
+// Ack acknowledges n bytes of a viewer's output as processed
+func (s *Session) Ack(v *Viewer, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v.unacked -= min(uint64(n), v.unacked)
+	v.stalled = time.Time{}
+	s.credit.Broadcast()
+}
+
+// waitForViewers holds up reading more output while a viewer with flow
+// control has a full window. A viewer that keeps the session waiting for
+// flowStallTimeout is detached.
+func (s *Session) waitForViewers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed {
+		var full *Viewer
+		for v := range s.viewers {
+			if v.window > 0 && v.unacked >= v.window {
+				full = v
+				break
+			}
+		}
+		if full == nil {
+			return
+		}
+		if full.stalled.IsZero() {
+			full.stalled = time.Now()
+		}
+		stalled := time.Since(full.stalled)
+		if stalled >= flowStallTimeout {
+			log.Printf("viewer of session %s stopped acknowledging output, detaching", s.ID)
+			delete(s.viewers, full)
+			close(full.output)
+			continue
+		}
+		timer := time.AfterFunc(flowStallTimeout-stalled, s.wakePump)
+		s.credit.Wait()
+		timer.Stop()
+	}
+}
+
+// wakePump has waitForViewers check the viewers again
+func (s *Session) wakePump() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit.Broadcast()
+}
+
+// Detach removes a viewer from the session
+func (s *Session) Detach(v *Viewer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.viewers[v]; ok {
+		delete(s.viewers, v)
+		close(v.output)
+		s.credit.Broadcast()
+	}
+}
+
+// IsAttached returns whether any viewer is attached
+func (s *Session) IsAttached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.viewers) > 0
+}
+
+// broadcast updates the screen state and sends output, and the command
+// events found in it, to every viewer
+func (s *Session) broadcast(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.term.Write(data)
+	events := s.shellEvents(s.term.Marks(), s.outputEnd)
+	s.scrollback.Write(data)
+	s.outputEnd += uint64(len(data))
+	if s.recorder != nil {
+		s.recorder.Output(data)
+	}
+	if len(events) > 0 {
+		s.saveEvents(events)
+	}
+
+	chunks := []Chunk{{Data: data, Offset: s.outputEnd}}
+	for i := range events {
+		chunks = append(chunks, Chunk{Event: &events[i]})
+	}
+	for v := range s.viewers {
+		if !v.started {
+			// Included in the redraw it will get on Start
+			continue
+		}
+		for _, chunk := range chunks {
+			select {
+			case v.output <- chunk:
+				v.unacked += uint64(len(chunk.Data))
+				continue
+			default:
+			}
+			// Too slow to keep up; drop it rather than stall everyone else
+			log.Printf("viewer of session %s fell behind, detaching", s.ID)
+			delete(s.viewers, v)
+			close(v.output)
+			break
+		}
+	}
+}
+
+// Share grants another user access to the session. Made read-only, their
+// read-write viewers are detached.
+func (s *Session) Share(userID string, readOnly bool) error {
+	s.mu.Lock()
+	s.shares[userID] = readOnly
+	if readOnly {
+		s.revoke(userID, false)
+	}
+	s.mu.Unlock()
+	return s.saveMeta()
+}
+
+// Unshare revokes another user's access to the session and detaches their
+// viewers
+func (s *Session) Unshare(userID string) error {
+	s.mu.Lock()
+	delete(s.shares, userID)
+	s.revoke(userID, true)
+	s.mu.Unlock()
+	return s.saveMeta()
+}
+
+// revoke detaches a user's read-write viewers, and with readOnly their
+// read-only ones too. Called with s.mu held.
+func (s *Session) revoke(userID string, readOnly bool) {
+	if userID == s.UserID {
+		return
+	}
+	for v := range s.viewers {
+		if v.userID == userID && (readOnly || !v.ReadOnly) {
+			v.revoked = true
+			delete(s.viewers, v)
+			close(v.output)
+		}
+	}
+	s.credit.Broadcast()
+}
+
+// Access reports whether a user may attach to the session and whether
+// they are limited to read-only access
+func (s *Session) Access(userID string) (allowed, readOnly bool) {
+	if userID == s.UserID {
+		return true, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	readOnly, allowed = s.shares[userID]
+	return allowed, readOnly
+}
@@ -0,0 +1,248 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Header is the first line of an asciicast v2 file
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is one asciicast v2 event line: [time, code, data]
+type Event struct {
+	Time float64
+	Code string // "o" output, "r" resize, "m" marker
+	Data string
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time, e.Code, e.Data})
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return fmt.Errorf("invalid event")
+	}
+	if err := json.Unmarshal(raw[0], &e.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[1], &e.Code); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw[2], &e.Data)
+}
+
+// Default terminal size written to the header until the first resize
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// Recorder writes a session's output and resizes as an asciicast v2 file
+type Recorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	partial []byte // Incomplete UTF-8 sequence held back from the last output
+}
+
+// Create starts a new recording at path
+func Create(path, title string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("create recordings dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create recording: %w", err)
+	}
+
+	start := time.Now()
+	header, _ := json.Marshal(Header{
+		Version:   2,
+		Width:     defaultWidth,
+		Height:    defaultHeight,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	rec := &Recorder{f: f, w: bufio.NewWriter(f), start: start}
+	rec.w.Write(header)
+	rec.w.WriteByte('\n')
+	if err := rec.w.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Resume reopens an existing recording for appending, e.g. after a daemon
+// restart. Event times stay relative to the original header timestamp.
+func Resume(path string) (*Recorder, error) {
+	header, err := ReadHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+	return &Recorder{
+		f:     f,
+		w:     bufio.NewWriter(f),
+		start: time.Unix(header.Timestamp, 0),
+	}, nil
+}
+
+func (r *Recorder) writeEvent(code, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return
+	}
+	line, err := json.Marshal(Event{
+		Time: time.Since(r.start).Seconds(),
+		Code: code,
+		Data: data,
+	})
+	if err != nil {
+		return
+	}
+	r.w.Write(line)
+	r.w.WriteByte('\n')
+	// Flush per event so the file is complete if the daemon dies
+	r.w.Flush()
+}
+
+// Output records terminal output. Event data must be valid UTF-8, so a
+// multi-byte character split across reads is held back until complete.
+func (r *Recorder) Output(data []byte) {
+	r.mu.Lock()
+	buf := append(r.partial, data...)
+	cut := len(buf)
+	// Look back at most utf8.UTFMax-1 bytes for an unfinished rune
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-(utf8.UTFMax-1); i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.partial = append([]byte(nil), buf[cut:]...)
+	r.mu.Unlock()
+
+	if cut > 0 {
+		r.writeEvent("o", string(buf[:cut]))
+	}
+}
+
+// Resize records a terminal size change
+func (r *Recorder) Resize(cols, rows uint16) {
+	r.writeEvent("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Marker records a named marker
+func (r *Recorder) Marker(label string) {
+	r.writeEvent("m", label)
+}
+
+// Close finishes the recording
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	r.w.Flush()
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// ReadHeader reads the header of a recording
+func ReadHeader(path string) (*Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid recording header: %w", err)
+	}
+	if header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+	return &header, nil
+}
+
+// Info describes a stored recording
+type Info struct {
+	ID        string
+	Title     string
+	StartedAt time.Time
+	Size      int64
+}
+
+// List returns the recordings in dir, newest first
+func List(dir string) ([]Info, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var infos []Info
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".cast") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		header, err := ReadHeader(path)
+		if err != nil {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, Info{
+			ID:        strings.TrimSuffix(entry.Name(), ".cast"),
+			Title:     header.Title,
+			StartedAt: time.Unix(header.Timestamp, 0),
+			Size:      fi.Size(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.After(infos[j].StartedAt)
+	})
+	return infos, nil
+}
@@ -0,0 +1,261 @@
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/search"
+)
+
+// readEvents returns the events of a recording, without times
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	var events []Event
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q: %v", scanner.Text(), err)
+		}
+		ev.Time = 0
+		events = append(events, ev)
+	}
+	return events
+}
+
+// writeCast writes a recording with the given header timestamp and events
+func writeCast(t *testing.T, path string, timestamp int64, title string, events ...Event) {
+	t.Helper()
+	header, _ := json.Marshal(Header{Version: 2, Width: 80, Height: 24, Timestamp: timestamp, Title: title})
+	data := append(header, '\n')
+	for _, ev := range events {
+		line, _ := json.Marshal(ev)
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "u1", "sess-1.cast")
+	rec, err := Create(path, "bash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Output([]byte("hi"))
+	// 你 split across two reads
+	rec.Output([]byte(" \xe4"))
+	rec.Output([]byte("\xbd\xa0!"))
+	rec.Resize(120, 40)
+	rec.Marker("deploy")
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rec.Output([]byte("after close"))
+
+	header, err := ReadHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Width != 80 || header.Height != 24 || header.Title != "bash" || header.Env["TERM"] != "xterm-256color" {
+		t.Errorf("header = %+v", header)
+	}
+	want := []Event{
+		{Code: "o", Data: "hi"},
+		{Code: "o", Data: " "},
+		{Code: "o", Data: "你!"},
+		{Code: "r", Data: "120x40"},
+		{Code: "m", Data: "deploy"},
+	}
+	if got := readEvents(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+
+	if _, err := Create(path, "bash"); err == nil {
+		t.Error("Create overwrote an existing recording")
+	}
+}
+
+func TestResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sess-1.cast")
+	start := time.Now().Add(-time.Hour).Unix()
+	writeCast(t, path, start, "bash", Event{Time: 1, Code: "o", Data: "before"})
+
+	rec, err := Resume(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Output([]byte("after"))
+	rec.Close()
+
+	want := []Event{{Code: "o", Data: "before"}, {Code: "o", Data: "after"}}
+	if got := readEvents(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+	// Times stay relative to the original start
+	var last float64
+	Play(context.Background(), path, 1e9, 0, func(ev Event) error {
+		last = ev.Time
+		return nil
+	})
+	if last < 3600 {
+		t.Errorf("resumed event time = %v, want at least 3600", last)
+	}
+
+	if _, err := Resume(filepath.Join(t.TempDir(), "missing.cast")); err == nil {
+		t.Error("Resume of a missing recording succeeded")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `{"version":2,"width":100,"height":30,"timestamp":1}` + "\n", false},
+		{"no newline", `{"version":2,"width":100,"height":30,"timestamp":1}`, false},
+		{"version 1", `{"version":1,"width":100,"height":30}` + "\n", true},
+		{"not json", "hello\n", true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "a.cast")
+			os.WriteFile(path, []byte(tt.content), 0600)
+			header, err := ReadHeader(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (header.Width != 100 || header.Height != 30) {
+				t.Errorf("header = %+v", header)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	writeCast(t, filepath.Join(dir, "old.cast"), 1000, "old")
+	writeCast(t, filepath.Join(dir, "new.cast"), 2000, "new")
+	os.WriteFile(filepath.Join(dir, "broken.cast"), []byte("nope\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("{}"), 0600)
+	os.Mkdir(filepath.Join(dir, "dir.cast"), 0700)
+
+	infos, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, info := range infos {
+		ids = append(ids, fmt.Sprintf("%s:%s:%d", info.ID, info.Title, info.StartedAt.Unix()))
+		if info.Size == 0 {
+			t.Errorf("%s has size 0", info.ID)
+		}
+	}
+	if want := []string{"new:new:2000", "old:old:1000"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("recordings = %v, want %v", ids, want)
+	}
+
+	infos, err = List(filepath.Join(dir, "missing"))
+	if err != nil || infos != nil {
+		t.Errorf("List of a missing dir = %v, %v", infos, err)
+	}
+}
+
+func TestPlay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.cast")
+	writeCast(t, path, 1, "",
+		Event{Time: 0.5, Code: "o", Data: "a"},
+		Event{Time: 1, Code: "r", Data: "100x30"},
+		Event{Time: 3600, Code: "o", Data: "b"},
+	)
+	// A broken line is skipped
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("[1, 2]\n")
+	f.Close()
+
+	var got []Event
+	start := time.Now()
+	err := Play(context.Background(), path, 10, 50*time.Millisecond, func(ev Event) error {
+		got = append(got, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	want := []Event{
+		{Time: 0.5, Code: "o", Data: "a"},
+		{Time: 1, Code: "r", Data: "100x30"},
+		{Time: 3600, Code: "o", Data: "b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+	// 50ms, 50ms and the idle time shortened to 50ms
+	if elapsed < 140*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("playback took %v", elapsed)
+	}
+
+	// emit stops playback
+	stop := errors.New("stop")
+	err = Play(context.Background(), path, 1000, 0, func(ev Event) error { return stop })
+	if err != stop {
+		t.Errorf("err = %v, want %v", err, stop)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = Play(ctx, path, 1, 0, func(Event) error { return nil })
+	if err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.cast")
+	writeCast(t, path, 1, "",
+		Event{Time: 1, Code: "o", Data: "$ make\r\n"},
+		Event{Time: 2, Code: "r", Data: "100x30"},
+		Event{Time: 3, Code: "o", Data: "build \x1b[31mfail"},
+		Event{Time: 4, Code: "o", Data: "ed\r\n$ make\r\n"},
+	)
+
+	sr := search.New("FAILED", 0, 10)
+	if err := Search(path, sr, 0); err != nil {
+		t.Fatal(err)
+	}
+	matches := sr.Matches()
+	if len(matches) != 1 {
+		t.Fatalf("matches = %+v", matches)
+	}
+	m := matches[0]
+	if m.Line != "build failed" || m.Offset != 8 || m.Time != 3 {
+		t.Errorf("match = %+v", m)
+	}
+
+	// Only output before until is searched
+	sr = search.New("make", 0, 10)
+	if err := Search(path, sr, 8); err != nil {
+		t.Fatal(err)
+	}
+	if matches := sr.Matches(); len(matches) != 1 || matches[0].Offset != 0 {
+		t.Errorf("matches before offset 8 = %+v", matches)
+	}
+}
@@ -0,0 +1,65 @@
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// maxLineSize bounds a single event line when replaying
+const maxLineSize = 4 * 1024 * 1024
+
+// Play replays the events of a recording in real time divided by speed.
+// Pauses longer than maxIdle (after scaling) are shortened to maxIdle when
+// maxIdle is positive. emit is called for every event; returning an error
+// stops playback.
+func Play(ctx context.Context, path string, speed float64, maxIdle time.Duration, emit func(Event) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if speed <= 0 {
+		speed = 1
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	// Skip header
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+
+	last := 0.0
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+
+		delay := time.Duration((ev.Time - last) / speed * float64(time.Second))
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		last = ev.Time
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		if err := emit(ev); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
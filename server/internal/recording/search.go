@@ -0,0 +1,45 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/eddison/sshttp/server/internal/search"
+)
+
+// Search feeds the output recorded at path to a searcher until it is full.
+// Offsets count bytes of recorded output; if until is not zero, only
+// output before that offset is searched.
+func Search(path string, sr *search.Searcher, until uint64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	// Skip header
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+
+	for scanner.Scan() && !sr.Full() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || ev.Code != "o" {
+			continue
+		}
+		data := []byte(ev.Data)
+		if until > 0 {
+			if sr.Offset() >= until {
+				break
+			}
+			data = data[:min(uint64(len(data)), until-sr.Offset())]
+		}
+		sr.SetTime(ev.Time)
+		sr.Write(data)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,230 @@
+// Package search finds text in raw terminal output. Escape sequences are
+// stripped and carriage returns and backspaces overwrite the line like they
+// do on a terminal, so progress bars and prompts read as their final text.
+package search
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxLineRunes bounds a single line; longer lines are cut there
+const maxLineRunes = 4096
+
+// Match is a line of output containing the query
+type Match struct {
+	Offset uint64  // Output offset where the line starts
+	Time   float64 // Seconds into a recording, for recorded output
+	Line   string
+	Column int // Byte offset of the match in Line
+	Before []string
+	After  []string
+}
+
+type escState int
+
+const (
+	escNone escState = iota
+	escStart
+	escCSI
+	escString // OSC, DCS, SOS, PM and APC, up to BEL or ST
+	escStringEsc
+)
+
+// Searcher scans output written to it, in order, for lines containing a
+// query, ignoring case
+type Searcher struct {
+	query   string
+	context int
+	limit   int
+
+	matches []Match
+	pending []int    // Matches still collecting lines after them
+	recent  []string // Up to context lines before the current one
+
+	line      []rune
+	col       int
+	lineStart uint64
+	lineTime  float64
+	offset    uint64 // Output offset of the next byte
+	time      float64
+	esc       escState
+	partial   []byte // Incomplete UTF-8 sequence
+}
+
+// New returns a Searcher for query that keeps context lines before and
+// after each match and stops after limit matches
+func New(query string, context, limit int) *Searcher {
+	return &Searcher{query: strings.ToLower(query), context: context, limit: limit}
+}
+
+// Start sets the output offset of the next byte written, for output that
+// doesn't start at the beginning
+func (s *Searcher) Start(offset uint64) {
+	s.offset = offset
+	s.lineStart = offset
+}
+
+// SetTime sets the recording time of the output written next
+func (s *Searcher) SetTime(t float64) {
+	s.time = t
+	if len(s.line) == 0 {
+		s.lineTime = t
+	}
+}
+
+// Offset returns the output offset of the next byte
+func (s *Searcher) Offset() uint64 {
+	return s.offset
+}
+
+// Full reports whether the limit was reached and no match is waiting for
+// lines after it
+func (s *Searcher) Full() bool {
+	return len(s.matches) >= s.limit && len(s.pending) == 0
+}
+
+// Write scans output
+func (s *Searcher) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		s.offset++
+		if s.step(b) {
+			continue
+		}
+		// Printable text, possibly a multi-byte character
+		if b < 0x80 {
+			if len(s.partial) > 0 {
+				s.partial = s.partial[:0]
+				s.put(utf8.RuneError)
+			}
+			s.put(rune(b))
+			continue
+		}
+		s.partial = append(s.partial, b)
+		if utf8.FullRune(s.partial) {
+			r, _ := utf8.DecodeRune(s.partial)
+			s.partial = s.partial[:0]
+			s.put(r)
+		}
+	}
+	return len(p), nil
+}
+
+// step handles escape sequences and control characters. It returns false
+// for bytes of printable text.
+func (s *Searcher) step(b byte) bool {
+	switch s.esc {
+	case escStart:
+		switch b {
+		case '[':
+			s.esc = escCSI
+		case ']', 'P', 'X', '^', '_':
+			s.esc = escString
+		default:
+			if b < 0x20 || b > 0x2F {
+				s.esc = escNone
+			}
+		}
+		return true
+	case escCSI:
+		if b >= 0x40 && b <= 0x7E {
+			s.esc = escNone
+		}
+		return true
+	case escString:
+		if b == 0x07 {
+			s.esc = escNone
+		} else if b == 0x1B {
+			s.esc = escStringEsc
+		}
+		return true
+	case escStringEsc:
+		s.esc = escNone
+		if b != '\\' {
+			return s.step(b)
+		}
+		return true
+	}
+
+	switch b {
+	case 0x1B:
+		s.partial = s.partial[:0]
+		s.esc = escStart
+	case '\n':
+		s.endLine()
+	case '\r':
+		s.col = 0
+	case '\b':
+		s.col = max(s.col-1, 0)
+	case '\t':
+		s.put(' ')
+		for s.col%8 != 0 {
+			s.put(' ')
+		}
+	default:
+		// Other control characters are dropped
+		return b < 0x20 || b == 0x7F
+	}
+	return true
+}
+
+// put writes a character at the cursor
+func (s *Searcher) put(r rune) {
+	if s.col < len(s.line) {
+		s.line[s.col] = r
+	} else if len(s.line) < maxLineRunes {
+		s.line = append(s.line, r)
+	} else {
+		return
+	}
+	s.col++
+}
+
+func (s *Searcher) endLine() {
+	line := strings.TrimRight(string(s.line), " ")
+	s.line = s.line[:0]
+	s.col = 0
+
+	// Earlier matches collect this line as context after them
+	pending := s.pending[:0]
+	for _, i := range s.pending {
+		s.matches[i].After = append(s.matches[i].After, line)
+		if len(s.matches[i].After) < s.context {
+			pending = append(pending, i)
+		}
+	}
+	s.pending = pending
+
+	if len(s.matches) < s.limit {
+		if col := strings.Index(strings.ToLower(line), s.query); col >= 0 {
+			s.matches = append(s.matches, Match{
+				Offset: s.lineStart,
+				Time:   s.lineTime,
+				Line:   line,
+				Column: col,
+				Before: append([]string(nil), s.recent...),
+			})
+			if s.context > 0 {
+				s.pending = append(s.pending, len(s.matches)-1)
+			}
+		}
+	}
+
+	if s.context > 0 {
+		if len(s.recent) == s.context {
+			s.recent = s.recent[1:]
+		}
+		s.recent = append(s.recent, line)
+	}
+	s.lineStart = s.offset
+	s.lineTime = s.time
+}
+
+// Matches finishes the output written so far and returns the matches
+func (s *Searcher) Matches() []Match {
+	if len(s.line) > 0 {
+		s.endLine()
+	}
+	return s.matches
+}
@@ -0,0 +1,155 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		output []string // Separate writes
+		lines  []string // Lines of the matches
+		cols   []int
+	}{
+		{
+			name:   "plain",
+			query:  "world",
+			output: []string{"hello\r\nworld\r\n"},
+			lines:  []string{"world"},
+			cols:   []int{0},
+		},
+		{
+			name:   "ignores case",
+			query:  "Error",
+			output: []string{"an ERROR here\n"},
+			lines:  []string{"an ERROR here"},
+			cols:   []int{3},
+		},
+		{
+			name:   "escape sequences",
+			query:  "red text",
+			output: []string{"\x1b[1;31mred\x1b[0m \x1b]0;title\x07text\x1b]8;;http://x\x1b\\\x1b(B\n"},
+			lines:  []string{"red text"},
+			cols:   []int{0},
+		},
+		{
+			name:   "split escape sequence",
+			query:  "ab",
+			output: []string{"a\x1b[3", "1mb\n"},
+			lines:  []string{"ab"},
+			cols:   []int{0},
+		},
+		{
+			name:   "carriage return overwrites",
+			query:  "100%",
+			output: []string{"  0%\r 50%\r100%\n", "10%\n"},
+			lines:  []string{"100%"},
+			cols:   []int{0},
+		},
+		{
+			name:   "overwritten text is gone",
+			query:  "50%",
+			output: []string{" 50%\r100%\n"},
+		},
+		{
+			name:   "backspace",
+			query:  "cat",
+			output: []string{"cxx\b\bat\n"},
+			lines:  []string{"cat"},
+			cols:   []int{0},
+		},
+		{
+			name:   "tab",
+			query:  "a       b",
+			output: []string{"a\tb\n"},
+			lines:  []string{"a       b"},
+			cols:   []int{0},
+		},
+		{
+			name:   "split character",
+			query:  "日本",
+			output: []string{"x日\xe6", "\x9c\xac\n"},
+			lines:  []string{"x日本"},
+			cols:   []int{1},
+		},
+		{
+			name:   "unfinished line",
+			query:  "prompt",
+			output: []string{"out\n$ prompt"},
+			lines:  []string{"$ prompt"},
+			cols:   []int{2},
+		},
+		{
+			name:   "limit",
+			query:  "x",
+			output: []string{"x1\nx2\nx3\nx4\n"},
+			lines:  []string{"x1", "x2", "x3"},
+			cols:   []int{0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.query, 0, 3)
+			for _, out := range tt.output {
+				s.Write([]byte(out))
+			}
+			var lines []string
+			var cols []int
+			for _, m := range s.Matches() {
+				lines = append(lines, m.Line)
+				cols = append(cols, m.Column)
+			}
+			if !reflect.DeepEqual(lines, tt.lines) || !reflect.DeepEqual(cols, tt.cols) {
+				t.Errorf("matches = %q at %v, want %q at %v", lines, cols, tt.lines, tt.cols)
+			}
+		})
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	s := New("match", 2, 10)
+	s.Write([]byte("a\nb\nc\nmatch 1\nd\nmatch 2\ne\nf\ng\n"))
+	want := []Match{
+		{Offset: 6, Line: "match 1", Before: []string{"b", "c"}, After: []string{"d", "match 2"}},
+		{Offset: 16, Line: "match 2", Before: []string{"match 1", "d"}, After: []string{"e", "f"}},
+	}
+	if got := s.Matches(); !reflect.DeepEqual(got, want) {
+		t.Errorf("matches = %+v, want %+v", got, want)
+	}
+}
+
+func TestSearchFull(t *testing.T) {
+	s := New("x", 1, 1)
+	s.Write([]byte("x\n"))
+	if s.Full() {
+		t.Error("full while the match waits for the line after it")
+	}
+	s.Write([]byte("after\n"))
+	if !s.Full() {
+		t.Error("not full after the limit")
+	}
+	s.Write([]byte("x\n"))
+	if got := s.Matches(); len(got) != 1 || !reflect.DeepEqual(got[0].After, []string{"after"}) {
+		t.Errorf("matches = %+v", got)
+	}
+}
+
+func TestSearchOffsets(t *testing.T) {
+	s := New("b", 0, 10)
+	s.Start(100)
+	s.SetTime(1.5)
+	s.Write([]byte("a\n"))
+	s.SetTime(2)
+	s.Write([]byte("b"))
+	s.SetTime(3)
+	s.Write([]byte("b\n"))
+	if s.Offset() != 105 {
+		t.Errorf("offset = %d, want 105", s.Offset())
+	}
+	got := s.Matches()
+	if len(got) != 1 || got[0].Offset != 102 || got[0].Time != 2 {
+		t.Errorf("matches = %+v, want one at offset 102 and time 2", got)
+	}
+}
@@ -0,0 +1,100 @@
+package transfer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/eddison/sshttp/server/internal/privsep"
+)
+
+// Downloads are read by a helper like uploads are written, the daemon
+// binary re-executed with --send as the session's account, so only files
+// that account may read come out. The helper reports on stdout with one
+// line, "ok <size> <path>" or "error <message>", followed by the file.
+
+// ErrNoSuchFile is returned when the file to download doesn't exist
+var ErrNoSuchFile = errors.New("file not found")
+
+// Download is a file being streamed out of a session's working directory
+type Download struct {
+	Path string
+	Size int64
+
+	proc *privsep.Process
+	data *os.File // The helper's stdout
+	r    io.Reader
+}
+
+// StartDownload opens name in the working directory of the process pid,
+// as the given account (empty for the daemon's own). Errors are short
+// messages meant for the client.
+func StartDownload(starter privsep.Starter, account string, pid int, name string) (*Download, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.New("failed to open file")
+	}
+	dataR, dataW, err := os.Pipe()
+	if err != nil {
+		return nil, errors.New("failed to open file")
+	}
+	defer dataW.Close()
+
+	proc, err := starter.Start(&privsep.Spec{
+		User: account,
+		Path: exe,
+		Args: []string{"--send", strconv.Itoa(pid), name},
+		Dir:  "/",
+	}, []*os.File{nil, dataW, os.Stderr})
+	if err != nil {
+		dataR.Close()
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	d := &Download{proc: proc, data: dataR}
+	r := bufio.NewReader(dataR)
+	if err := d.readHeader(r); err != nil {
+		d.Close()
+		return nil, err
+	}
+	d.r = io.LimitReader(r, d.Size)
+	return d, nil
+}
+
+// readHeader reads the helper's status line
+func (d *Download) readHeader(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return errors.New("failed to open file")
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if msg, ok := strings.CutPrefix(line, "error "); ok {
+		if msg == ErrNoSuchFile.Error() {
+			return ErrNoSuchFile
+		}
+		return errors.New(msg)
+	}
+	size, path, ok := strings.Cut(strings.TrimPrefix(line, "ok "), " ")
+	if d.Size, err = strconv.ParseInt(size, 10, 64); err != nil || !ok {
+		return errors.New("failed to open file")
+	}
+	d.Path = path
+	return nil
+}
+
+// Read reads the file's contents
+func (d *Download) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+// Close ends the download, also when it was not read to the end
+func (d *Download) Close() error {
+	// The helper dies of SIGPIPE if it is still writing
+	err := d.data.Close()
+	go d.proc.Wait()
+	return err
+}
@@ -0,0 +1,165 @@
+package transfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxNameLen is the longest file name most filesystems allow
+const maxNameLen = 255
+
+// partialName is the name an upload is received under until it is
+// complete. Dot names can't be uploaded, so it doesn't clash with a file.
+func partialName(name string, size int64) string {
+	return fmt.Sprintf(".%s.%d.sshttp-part", name, size)
+}
+
+// RunReceiver runs the upload helper with the arguments given after
+// --receive: the pid whose working directory receives the file, the file
+// size, whether to resume a partial upload of it, and the file name. An
+// upload that can't be resumed doesn't leave its partial file behind
+// either.
+func RunReceiver(args []string) error {
+	if len(args) != 4 {
+		return fmt.Errorf("usage: --receive <pid> <size> <resume> <name>")
+	}
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid pid %q", args[0])
+	}
+	size, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid size %q", args[1])
+	}
+	resume, err := strconv.ParseBool(args[2])
+	if err != nil {
+		return fmt.Errorf("invalid resume %q", args[2])
+	}
+	name := args[3]
+
+	cwdLink := fmt.Sprintf("/proc/%d/cwd", pid)
+	cwd, err := os.Readlink(cwdLink)
+	if err != nil {
+		log.Printf("get cwd error: %v", err)
+		fmt.Println("error failed to get working directory")
+		return nil
+	}
+	path := filepath.Join(cwd, name)
+	if filepath.Base(name) != name || filepath.Dir(path) != filepath.Clean(cwd) {
+		fmt.Println("error invalid path")
+		return nil
+	}
+	if len(partialName(name, size)) > maxNameLen {
+		fmt.Println("error filename too long")
+		return nil
+	}
+
+	// Going through the link reaches the directory even if the shell sees
+	// a different mount layout (a sandbox). O_NOFOLLOW prevents following
+	// a planted symlink. The file itself is only checked here; the final
+	// link below is what refuses to overwrite it.
+	target := filepath.Join(cwdLink, name)
+	if _, err := os.Lstat(target); err == nil {
+		fmt.Println("error file already exists")
+		return nil
+	}
+	part := filepath.Join(cwdLink, partialName(name, size))
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		log.Printf("create file error: %v", err)
+		fmt.Println("error failed to create file")
+		return nil
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fmt.Println("error upload already in progress")
+		return nil
+	}
+	// The daemon stops reading once it aborts an upload, which mustn't
+	// kill the helper before it cleans up
+	signal.Ignore(syscall.SIGPIPE)
+	complete := false
+	defer func() {
+		if !resume && !complete {
+			os.Remove(part)
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		fmt.Println("error failed to create file")
+		return nil
+	}
+
+	// What an earlier upload left is hashed again, the rest as it arrives
+	offset := info.Size()
+	if !resume || offset > size {
+		if err := f.Truncate(0); err != nil {
+			log.Printf("truncate file error: %v", err)
+			fmt.Println("error failed to create file")
+			return nil
+		}
+		offset = 0
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(f, offset)); err != nil {
+		log.Printf("read partial file error: %v", err)
+		fmt.Println("error failed to resume upload")
+		return nil
+	}
+	fmt.Println("ok", offset, path)
+
+	// When the input ends early the partial file stays for a later upload
+	// to resume, if there can be one
+	in := bufio.NewReader(os.Stdin)
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(in, size-offset))
+	if err != nil || n != size-offset {
+		if err != nil {
+			log.Printf("write file error: %v", err)
+		}
+		fmt.Println("error write failed")
+		return nil
+	}
+
+	// The data is followed by a line with the file's SHA-256 in hex, empty
+	// when the client didn't send one
+	line, err := in.ReadString('\n')
+	if err != nil {
+		fmt.Println("error upload incomplete")
+		return nil
+	}
+	if sum := strings.TrimSpace(line); sum != "" && sum != hex.EncodeToString(hash.Sum(nil)) {
+		os.Remove(part)
+		fmt.Println("error checksum mismatch")
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		log.Printf("sync file error: %v", err)
+		fmt.Println("error write failed")
+		return nil
+	}
+
+	// Unlike a rename, a link doesn't replace a file created meanwhile
+	if err := os.Link(part, target); err != nil {
+		if os.IsExist(err) {
+			fmt.Println("error file already exists")
+		} else {
+			log.Printf("link file error: %v", err)
+			fmt.Println("error failed to create file")
+		}
+		return nil
+	}
+	complete = true
+	os.Remove(part)
+	fmt.Println("ok")
+	return nil
+}
@@ -0,0 +1,71 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// RunSender runs the download helper with the arguments given after
+// --send: the pid whose working directory holds the file, and the file
+// name.
+func RunSender(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: --send <pid> <name>")
+	}
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid pid %q", args[0])
+	}
+	name := args[1]
+
+	cwdLink := fmt.Sprintf("/proc/%d/cwd", pid)
+	cwd, err := os.Readlink(cwdLink)
+	if err != nil {
+		log.Printf("get cwd error: %v", err)
+		fmt.Println("error failed to get working directory")
+		return nil
+	}
+	path := filepath.Join(cwd, name)
+	if filepath.Base(name) != name || filepath.Dir(path) != filepath.Clean(cwd) {
+		fmt.Println("error invalid path")
+		return nil
+	}
+
+	// Like for uploads, the link reaches the directory the shell sees, and
+	// O_NOFOLLOW keeps a symlink from pointing elsewhere
+	f, err := os.OpenFile(filepath.Join(cwdLink, name), os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			fmt.Println("error " + ErrNoSuchFile.Error())
+		case errors.Is(err, syscall.ELOOP):
+			fmt.Println("error not a regular file")
+		default:
+			log.Printf("open file error: %v", err)
+			fmt.Println("error failed to open file")
+		}
+		return nil
+	}
+	defer f.Close()
+	// Devices, FIFOs and directories would block or make no sense
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		fmt.Println("error not a regular file")
+		return nil
+	}
+	size := info.Size()
+	fmt.Println("ok", size, path)
+
+	// A file that grows meanwhile is cut at the announced size; one that
+	// shrinks leaves the download short
+	if _, err := io.Copy(os.Stdout, io.LimitReader(f, size)); err != nil {
+		log.Printf("send file error: %v", err)
+	}
+	return nil
+}
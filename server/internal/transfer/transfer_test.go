@@ -0,0 +1,237 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eddison/sshttp/server/internal/privsep"
+)
+
+// The test binary plays the daemon binary for the helpers
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "--send":
+			RunSender(os.Args[2:])
+			os.Exit(0)
+		case "--receive":
+			RunReceiver(os.Args[2:])
+			os.Exit(0)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// shellIn starts a process in a new directory, standing in for a
+// session's shell, and returns its pid and the directory
+func shellIn(t *testing.T) (int, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cmd := exec.Command("sleep", "60")
+	cmd.Dir = dir
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd.Process.Pid, dir
+}
+
+// upload sends data as name in one go
+func upload(pid int, name string, data []byte, checksum []byte) error {
+	u, err := StartUpload(privsep.Local{}, "", pid, name, int64(len(data)), false)
+	if err != nil {
+		return err
+	}
+	if _, err := u.Write(data); err != nil {
+		u.Abort()
+		return err
+	}
+	return u.Finish(checksum)
+}
+
+// partialFiles lists the partial uploads in dir
+func partialFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, ".*.sshttp-part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDownload(t *testing.T) {
+	pid, dir := shellIn(t)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello\n"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "link"))
+
+	d, err := StartDownload(privsep.Local{}, "", pid, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(d)
+	d.Close()
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("downloaded %q, %v", data, err)
+	}
+	if d.Size != 6 || d.Path != filepath.Join(dir, "notes.txt") {
+		t.Errorf("download = %s, %d bytes", d.Path, d.Size)
+	}
+
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"missing", ErrNoSuchFile.Error()},
+		{"sub", "not a regular file"},
+		{"link", "not a regular file"},
+		{"../notes.txt", "invalid path"},
+		{"sub/file", "invalid path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := StartDownload(privsep.Local{}, "", pid, tt.name)
+			if err == nil {
+				d.Close()
+				t.Fatal("download succeeded")
+			}
+			if err.Error() != tt.err {
+				t.Errorf("err = %v, want %s", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := StartDownload(privsep.Local{}, "", pid, "missing"); !errors.Is(err, ErrNoSuchFile) {
+		t.Errorf("err = %v, want ErrNoSuchFile", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	pid, dir := shellIn(t)
+	data := []byte("uploaded data\n")
+	sum := sha256.Sum256(data)
+
+	if err := upload(pid, "a.txt", data, sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(got) != string(data) {
+		t.Errorf("a.txt = %q, want %q", got, data)
+	}
+	// Without a checksum
+	if err := upload(pid, "b.txt", data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if files := partialFiles(t, dir); len(files) != 0 {
+		t.Errorf("partial files left: %v", files)
+	}
+
+	tests := []struct {
+		name     string
+		checksum []byte
+		err      string
+	}{
+		{"a.txt", nil, "file already exists"},
+		{"c.txt", []byte("wrong"), "checksum mismatch"},
+		{"../c.txt", nil, "invalid path"},
+		{strings.Repeat("x", 250), nil, "filename too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := upload(pid, tt.name, data, tt.checksum)
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("err = %v, want %s", err, tt.err)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.txt")); !os.IsNotExist(err) {
+		t.Error("c.txt created despite the checksum mismatch")
+	}
+	if files := partialFiles(t, dir); len(files) != 0 {
+		t.Errorf("partial files left: %v", files)
+	}
+}
+
+// startUpload starts an upload, waiting for an aborted one of the same
+// file to let go of it
+func startUpload(t *testing.T, pid int, name string, size int64, resume bool) *Upload {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		u, err := StartUpload(privsep.Local{}, "", pid, name, size, resume)
+		if err == nil {
+			return u
+		}
+		if err.Error() != "upload already in progress" || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	pid, dir := shellIn(t)
+	data := []byte(strings.Repeat("0123456789", 100))
+	sum := sha256.Sum256(data)
+
+	u := startUpload(t, pid, "big", int64(len(data)), true)
+	if u.Offset != 0 {
+		t.Fatalf("offset = %d, want 0", u.Offset)
+	}
+	u.Write(data[:300])
+	u.Abort()
+
+	u = startUpload(t, pid, "big", int64(len(data)), true)
+	if u.Offset != 300 {
+		t.Fatalf("resumed at %d, want 300", u.Offset)
+	}
+	u.Write(data[u.Offset:])
+	if err := u.Finish(sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "big")); string(got) != string(data) {
+		t.Errorf("resumed file has %d bytes, want %d", len(got), len(data))
+	}
+	if files := partialFiles(t, dir); len(files) != 0 {
+		t.Errorf("partial files left: %v", files)
+	}
+
+	// Without resume the partial file is started over and removed on abort
+	u = startUpload(t, pid, "other", int64(len(data)), true)
+	u.Write(data[:300])
+	u.Abort()
+	u = startUpload(t, pid, "other", int64(len(data)), false)
+	if u.Offset != 0 {
+		t.Errorf("offset without resume = %d, want 0", u.Offset)
+	}
+	u.Write(data[:300])
+	u.Abort()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(partialFiles(t, dir)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("partial files left: %v", partialFiles(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadShort(t *testing.T) {
+	pid, dir := shellIn(t)
+	u := startUpload(t, pid, "short", 100, false)
+	u.Write([]byte("only some"))
+	if err := u.Finish(nil); err == nil {
+		t.Fatal("short upload succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "short")); !os.IsNotExist(err) {
+		t.Errorf("short upload created the file: %v", err)
+	}
+}
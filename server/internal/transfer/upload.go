@@ -0,0 +1,118 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/eddison/sshttp/server/internal/privsep"
+)
+
+// Uploads are written by a short-lived helper, the daemon binary
+// re-executed with --receive as the session's account, so files get the
+// right owner and permissions. The data goes to a partial file next to the
+// final one, which is kept when a resumable upload is cut off so a later
+// one can resume it, and is linked into place once complete and checked. The
+// helper reports on stdout with one line once the partial file is open,
+// "ok <offset> <path>", and one once the file is in place, "ok"; either
+// can be "error <message>" instead.
+
+// Upload is a file being streamed into a session's working directory
+type Upload struct {
+	Path   string
+	Offset int64 // Received by an earlier upload, not to be sent again
+
+	proc   *privsep.Process
+	data   *os.File // The helper's stdin
+	status *os.File // The helper's stdout
+	lines  *bufio.Reader
+}
+
+// StartUpload creates name in the working directory of the process pid,
+// as the given account (empty for the daemon's own). With resume, it picks
+// up a partial upload of the same name and size. Errors are short messages
+// meant for the client.
+func StartUpload(starter privsep.Starter, account string, pid int, name string, size int64, resume bool) (*Upload, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.New("failed to create file")
+	}
+	dataR, dataW, err := os.Pipe()
+	if err != nil {
+		return nil, errors.New("failed to create file")
+	}
+	defer dataR.Close()
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		dataW.Close()
+		return nil, errors.New("failed to create file")
+	}
+	defer statusW.Close()
+
+	proc, err := starter.Start(&privsep.Spec{
+		User: account,
+		Path: exe,
+		Args: []string{"--receive", strconv.Itoa(pid), strconv.FormatInt(size, 10), strconv.FormatBool(resume), name},
+		Dir:  "/",
+	}, []*os.File{dataR, statusW, os.Stderr})
+	if err != nil {
+		dataW.Close()
+		statusR.Close()
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+
+	u := &Upload{proc: proc, data: dataW, status: statusR, lines: bufio.NewReader(statusR)}
+	status, err := u.readStatus()
+	if err != nil {
+		u.Abort()
+		return nil, err
+	}
+	offset, path, _ := strings.Cut(status, " ")
+	if u.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+		u.Abort()
+		return nil, errors.New("failed to create file")
+	}
+	u.Path = path
+	return u, nil
+}
+
+// readStatus reads the helper's next status line
+func (u *Upload) readStatus() (string, error) {
+	line, err := u.lines.ReadString('\n')
+	if err != nil {
+		return "", errors.New("failed to create file")
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if msg, ok := strings.CutPrefix(line, "error "); ok {
+		return "", errors.New(msg)
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(line, "ok"), " "), nil
+}
+
+// Write appends data to the file
+func (u *Upload) Write(p []byte) (int, error) {
+	return u.data.Write(p)
+}
+
+// Finish completes the upload once all data has been written. The file
+// is only put in place if its SHA-256 matches checksum, unless that is nil.
+func (u *Upload) Finish(checksum []byte) error {
+	fmt.Fprintln(u.data, hex.EncodeToString(checksum))
+	u.data.Close()
+	defer u.status.Close()
+	_, err := u.readStatus()
+	u.proc.Wait()
+	return err
+}
+
+// Abort stops the upload. What was received is kept for a later upload
+// to resume if this one was started with resume, and removed otherwise.
+func (u *Upload) Abort() {
+	u.data.Close()
+	u.status.Close()
+	go u.proc.Wait()
+}
@@ -0,0 +1,166 @@
+package vt
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Shells set up for it mark their prompts and commands with OSC 133
+// sequences (FinalTerm's semantic prompts) and report their working
+// directory with OSC 7. The terminal collects them as marks for the
+// session to turn into command events.
+
+// Mark kinds, named after the OSC 133 sequences
+const (
+	MarkPrompt          byte = 'A' // The prompt starts
+	MarkCommandStart    byte = 'B' // The prompt ends and the command line starts
+	MarkCommandExecuted byte = 'C' // The command line was entered; its output follows
+	MarkCommandFinished byte = 'D' // The command finished
+	MarkCwd             byte = '7' // The shell reported its working directory
+)
+
+// maxMarks bounds the marks kept between calls to Marks
+const maxMarks = 256
+
+// Mark is a shell integration marker seen in the output
+type Mark struct {
+	Kind     byte
+	Pos      int    // Bytes into the Write that contained it, just past the marker
+	Command  string // MarkCommandExecuted: the command line, if known
+	ExitCode int    // MarkCommandFinished: the exit status, -1 if not reported
+	Cwd      string // MarkCwd: the directory
+}
+
+// commandLine is where the command line starts, as a line number counted
+// from the first line of output and a column
+type commandLine struct {
+	line, x int
+	valid   bool
+}
+
+// Marks returns the marks seen since the last call and forgets them
+func (t *Terminal) Marks() []Mark {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	marks := t.marks
+	t.marks = nil
+	return marks
+}
+
+func (t *Terminal) addMark(m Mark) {
+	if len(t.marks) < maxMarks {
+		t.marks = append(t.marks, m)
+	}
+}
+
+// semanticPrompt handles OSC 133 ; kind [; params]
+func (t *Terminal) semanticPrompt(text string, pos int) {
+	params := strings.Split(text, ";")
+	if len(params[0]) != 1 {
+		return
+	}
+	m := Mark{Kind: params[0][0], Pos: pos}
+	switch m.Kind {
+	case MarkPrompt:
+		t.cmdLine = commandLine{}
+	case MarkCommandStart:
+		if t.cur == t.primary {
+			t.cmdLine = commandLine{line: t.scrolled + t.cursor.y, x: t.cursor.x, valid: true}
+		}
+	case MarkCommandExecuted:
+		// Some shells send the command line along (kitty's extension),
+		// otherwise it is read back from the screen
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(p, "cmdline_url="); ok {
+				if cmd, err := url.PathUnescape(v); err == nil {
+					m.Command = cmd
+				}
+			} else if v, ok := strings.CutPrefix(p, "cmdline="); ok {
+				m.Command = v
+			}
+		}
+		if m.Command == "" && t.cmdLine.valid {
+			m.Command = t.commandText()
+		}
+		t.cmdLine = commandLine{}
+	case MarkCommandFinished:
+		m.ExitCode = -1
+		if len(params) > 1 {
+			if code, err := strconv.Atoi(params[1]); err == nil {
+				m.ExitCode = code
+			}
+		}
+	default:
+		return
+	}
+	t.addMark(m)
+}
+
+// currentDirectory handles OSC 7 ; file://host/path
+func (t *Terminal) currentDirectory(text string, pos int) {
+	u, err := url.Parse(text)
+	if err != nil || u.Scheme != "file" || u.Path == "" {
+		return
+	}
+	t.addMark(Mark{Kind: MarkCwd, Pos: pos, Cwd: u.Path})
+}
+
+// commandText reads the command line typed since MarkCommandStart. The
+// command was entered, so the cursor is usually at the start of the line
+// after it.
+func (t *Terminal) commandText() string {
+	end, endX := t.scrolled+t.cursor.y, t.cursor.x
+	if endX == 0 && end > t.cmdLine.line {
+		end, endX = end-1, t.cols
+	}
+
+	var b strings.Builder
+	for n := t.cmdLine.line; n <= end; n++ {
+		l := t.absLine(n)
+		if l == nil {
+			continue
+		}
+		from, to := 0, len(l.Cells)
+		if n == t.cmdLine.line {
+			from = t.cmdLine.x
+		}
+		if n == end {
+			to = min(to, endX)
+		}
+		for x := from; x < to; x++ {
+			c := l.Cells[x]
+			if c.Width == 0 {
+				continue
+			}
+			if c.Ch == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteRune(c.Ch)
+				for _, r := range c.Comb {
+					b.WriteRune(r)
+				}
+			}
+		}
+		if !l.Wrapped && n < end {
+			b.WriteByte('\n')
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// absLine returns a primary screen or scrollback line by its number
+// counted from the first line of output, nil if it is gone
+func (t *Terminal) absLine(n int) *Line {
+	y := n - t.scrolled
+	if y >= 0 {
+		if y < len(t.primary.lines) {
+			return &t.primary.lines[y]
+		}
+		return nil
+	}
+	if i := len(t.history) + y; i >= 0 {
+		return &t.history[i]
+	}
+	return nil
+}
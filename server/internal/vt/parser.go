@@ -0,0 +1,507 @@
+package vt
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type parserState int
+
+const (
+	stateGround parserState = iota
+	stateEscape
+	stateEscapeIntermediate
+	stateCSI
+	stateOSC
+	stateString // DCS, SOS, PM and APC strings, which are ignored
+)
+
+// Limits on sequence lengths so malformed output can't grow memory
+const (
+	maxParamBytes = 256
+	maxOSCBytes   = 4096
+	maxTitleLen   = 256
+)
+
+// parser is a state machine for the VT500-series escape sequence grammar
+type parser struct {
+	state   parserState
+	private byte   // CSI private marker: '?', '>', '<' or '='
+	params  []byte // Raw CSI parameter bytes
+	inter   []byte // Intermediate bytes
+	osc     []byte
+	utf8    []byte // Incomplete UTF-8 sequence
+	pos     int    // Bytes of the current feed consumed
+}
+
+func (p *parser) feed(t *Terminal, data []byte) {
+	for i, b := range data {
+		p.pos = i + 1
+		p.step(t, b)
+	}
+}
+
+func (p *parser) step(t *Terminal, b byte) {
+	// CAN and SUB abort any sequence; ESC starts a new one (and also
+	// terminates strings, where ESC \ is the string terminator)
+	switch b {
+	case 0x18, 0x1A:
+		p.state = stateGround
+		return
+	case 0x1B:
+		if p.state == stateOSC {
+			p.dispatchOSC(t)
+		}
+		p.utf8 = p.utf8[:0]
+		p.inter = p.inter[:0]
+		p.state = stateEscape
+		return
+	}
+
+	switch p.state {
+	case stateGround:
+		switch {
+		case len(p.utf8) > 0 || b >= 0x80:
+			p.decodeUTF8(t, b)
+		case b < 0x20:
+			p.execute(t, b)
+		case b == 0x7F:
+			// DEL is ignored
+		default:
+			t.print(rune(b))
+		}
+
+	case stateEscape:
+		switch {
+		case b < 0x20:
+			p.execute(t, b)
+		case b <= 0x2F:
+			p.inter = append(p.inter, b)
+			p.state = stateEscapeIntermediate
+		case b == '[':
+			p.private = 0
+			p.params = p.params[:0]
+			p.state = stateCSI
+		case b == ']':
+			p.osc = p.osc[:0]
+			p.state = stateOSC
+		case b == 'P' || b == 'X' || b == '^' || b == '_':
+			p.state = stateString
+		default:
+			p.dispatchEscape(t, b)
+			p.state = stateGround
+		}
+
+	case stateEscapeIntermediate:
+		switch {
+		case b < 0x20:
+			p.execute(t, b)
+		case b <= 0x2F:
+			if len(p.inter) < 4 {
+				p.inter = append(p.inter, b)
+			}
+		default:
+			p.dispatchEscape(t, b)
+			p.state = stateGround
+		}
+
+	case stateCSI:
+		switch {
+		case b < 0x20:
+			p.execute(t, b)
+		case b <= 0x2F:
+			if len(p.inter) < 4 {
+				p.inter = append(p.inter, b)
+			}
+		case b <= 0x3F:
+			if b >= '<' && len(p.params) == 0 && p.private == 0 {
+				p.private = b
+			} else if len(p.params) < maxParamBytes {
+				p.params = append(p.params, b)
+			}
+		case b <= 0x7E:
+			p.dispatchCSI(t, b)
+			p.state = stateGround
+		}
+
+	case stateOSC:
+		if b == 0x07 {
+			p.dispatchOSC(t)
+			p.state = stateGround
+		} else if b >= 0x20 && len(p.osc) < maxOSCBytes {
+			p.osc = append(p.osc, b)
+		}
+
+	case stateString:
+		// Ignored until ESC \ (handled above)
+	}
+}
+
+func (p *parser) decodeUTF8(t *Terminal, b byte) {
+	p.utf8 = append(p.utf8, b)
+	if !utf8.FullRune(p.utf8) {
+		return
+	}
+	r, size := utf8.DecodeRune(p.utf8)
+	rest := p.utf8[size:]
+	p.utf8 = p.utf8[:0]
+	t.print(r)
+	// An invalid sequence consumed one byte; reprocess the remainder
+	for _, c := range rest {
+		p.step(t, c)
+	}
+}
+
+// execute handles C0 control characters
+func (p *parser) execute(t *Terminal, b byte) {
+	switch b {
+	case 0x08:
+		t.backspace()
+	case 0x09:
+		t.tab(1)
+	case 0x0A, 0x0B, 0x0C:
+		t.index()
+		t.cursor.wrapNext = false
+	case 0x0D:
+		t.carriageReturn()
+	case 0x0E:
+		t.cursor.gl = 1
+	case 0x0F:
+		t.cursor.gl = 0
+	}
+}
+
+func (p *parser) dispatchEscape(t *Terminal, final byte) {
+	if len(p.inter) > 0 {
+		switch p.inter[0] {
+		case '(', ')':
+			g := 0
+			if p.inter[0] == ')' {
+				g = 1
+			}
+			t.cursor.charsets[g] = final == '0'
+		case '#':
+			if final == '8' {
+				t.alignmentTest()
+			}
+		}
+		return
+	}
+
+	switch final {
+	case '7':
+		t.saveCursor()
+	case '8':
+		t.restoreCursor()
+	case 'D':
+		t.index()
+	case 'E':
+		t.carriageReturn()
+		t.index()
+	case 'M':
+		t.reverseIndex()
+	case 'H':
+		t.setTab()
+	case 'c':
+		t.history = nil
+		t.reset()
+	case '=':
+		t.appKeypad = true
+	case '>':
+		t.appKeypad = false
+	}
+}
+
+// parseParams splits CSI parameters; sub-parameters separated by ':' are
+// kept together. Omitted values are -1.
+func parseParams(raw []byte) [][]int {
+	if len(raw) == 0 {
+		return nil
+	}
+	var params [][]int
+	for _, field := range strings.Split(string(raw), ";") {
+		var sub []int
+		for _, s := range strings.Split(field, ":") {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				n = -1
+			}
+			sub = append(sub, min(n, 65535))
+		}
+		params = append(params, sub)
+	}
+	return params
+}
+
+// param returns parameter i, or def when it is omitted or zero
+func param(params [][]int, i, def int) int {
+	if i >= len(params) || params[i][0] <= 0 {
+		return def
+	}
+	return params[i][0]
+}
+
+func (p *parser) dispatchCSI(t *Terminal, final byte) {
+	params := parseParams(p.params)
+	n := param(params, 0, 1)
+
+	if len(p.inter) > 0 {
+		switch {
+		case p.inter[0] == ' ' && final == 'q':
+			t.cursorStyle = param(params, 0, 0)
+		case p.inter[0] == '!' && final == 'p':
+			t.softReset()
+		}
+		return
+	}
+
+	if p.private == '?' {
+		switch final {
+		case 'h', 'l':
+			for _, m := range params {
+				t.setMode(true, m[0], final == 'h')
+			}
+		case 'J':
+			t.eraseDisplay(param(params, 0, 0))
+		case 'K':
+			t.eraseLine(param(params, 0, 0))
+		}
+		return
+	}
+	if p.private != 0 {
+		return
+	}
+
+	switch final {
+	case '@':
+		t.insertCells(n)
+	case 'A':
+		t.moveRel(0, -n)
+	case 'B', 'e':
+		t.moveRel(0, n)
+	case 'C', 'a':
+		t.moveRel(n, 0)
+	case 'D':
+		t.moveRel(-n, 0)
+	case 'E':
+		t.moveRel(0, n)
+		t.cursor.x = 0
+	case 'F':
+		t.moveRel(0, -n)
+		t.cursor.x = 0
+	case 'G', '`':
+		t.cursor.x = min(n-1, t.cols-1)
+		t.cursor.wrapNext = false
+	case 'H', 'f':
+		t.moveTo(param(params, 1, 1)-1, n-1)
+	case 'I':
+		t.tab(n)
+	case 'J':
+		t.eraseDisplay(param(params, 0, 0))
+	case 'K':
+		t.eraseLine(param(params, 0, 0))
+	case 'L':
+		t.insertLines(n)
+	case 'M':
+		t.deleteLines(n)
+	case 'P':
+		t.deleteCells(n)
+	case 'S':
+		t.scrollUp(t.cur.top, n)
+	case 'T':
+		if len(params) <= 1 {
+			t.scrollDown(t.cur.top, n)
+		}
+	case 'X':
+		t.eraseCells(t.cursor.y, t.cursor.x, t.cursor.x+n)
+		t.cursor.wrapNext = false
+	case 'Z':
+		t.backTab(n)
+	case 'b':
+		if t.lastChar != 0 {
+			for i := 0; i < min(n, t.cols*t.rows); i++ {
+				t.print(t.lastChar)
+			}
+		}
+	case 'd':
+		y := n - 1
+		if t.cursor.origin {
+			y = min(y, t.cur.bot-t.cur.top)
+		}
+		t.moveTo(t.cursor.x, y)
+	case 'g':
+		t.clearTabs(param(params, 0, 0))
+	case 'h', 'l':
+		for _, m := range params {
+			t.setMode(false, m[0], final == 'h')
+		}
+	case 'm':
+		t.sgr(params)
+	case 'r':
+		t.setScrollRegion(param(params, 0, 1), param(params, 1, t.rows))
+	case 's':
+		t.saveCursor()
+	case 'u':
+		t.restoreCursor()
+	}
+}
+
+func (p *parser) dispatchOSC(t *Terminal) {
+	code, text, _ := strings.Cut(string(p.osc), ";")
+	p.osc = p.osc[:0]
+	switch code {
+	case "0", "2":
+		if len(text) > maxTitleLen {
+			text = text[:maxTitleLen]
+		}
+		t.title = strings.ToValidUTF8(text, "")
+	case "133":
+		t.semanticPrompt(text, p.pos)
+	case "7":
+		t.currentDirectory(text, p.pos)
+	}
+}
+
+// sgr applies Select Graphic Rendition parameters
+func (t *Terminal) sgr(params [][]int) {
+	a := &t.cursor.attr
+	if len(params) == 0 {
+		*a = Attr{}
+		return
+	}
+
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		code := max(p[0], 0)
+		switch {
+		case code == 0:
+			*a = Attr{}
+		case code == 1:
+			a.Flags |= AttrBold
+		case code == 2:
+			a.Flags |= AttrDim
+		case code == 3:
+			a.Flags |= AttrItalic
+		case code == 4:
+			if len(p) > 1 && p[1] == 0 {
+				a.Flags &^= AttrUnderline
+			} else {
+				a.Flags |= AttrUnderline
+			}
+		case code == 5 || code == 6:
+			a.Flags |= AttrBlink
+		case code == 7:
+			a.Flags |= AttrReverse
+		case code == 8:
+			a.Flags |= AttrHidden
+		case code == 9:
+			a.Flags |= AttrStrike
+		case code == 21:
+			a.Flags |= AttrUnderline
+		case code == 22:
+			a.Flags &^= AttrBold | AttrDim
+		case code == 23:
+			a.Flags &^= AttrItalic
+		case code == 24:
+			a.Flags &^= AttrUnderline
+		case code == 25:
+			a.Flags &^= AttrBlink
+		case code == 27:
+			a.Flags &^= AttrReverse
+		case code == 28:
+			a.Flags &^= AttrHidden
+		case code == 29:
+			a.Flags &^= AttrStrike
+		case code >= 30 && code <= 37:
+			a.FG = IndexedColor(code - 30)
+		case code == 38:
+			c, skip := extendedColor(params, i)
+			a.FG = c
+			i += skip
+		case code == 39:
+			a.FG = ColorDefault
+		case code >= 40 && code <= 47:
+			a.BG = IndexedColor(code - 40)
+		case code == 48:
+			c, skip := extendedColor(params, i)
+			a.BG = c
+			i += skip
+		case code == 49:
+			a.BG = ColorDefault
+		case code == 58:
+			// Underline color is not tracked, but its arguments must be skipped
+			_, skip := extendedColor(params, i)
+			i += skip
+		case code >= 90 && code <= 97:
+			a.FG = IndexedColor(code - 90 + 8)
+		case code >= 100 && code <= 107:
+			a.BG = IndexedColor(code - 100 + 8)
+		}
+	}
+}
+
+// extendedColor parses 38/48 color arguments in either the colon form
+// (38:5:n, 38:2:[cs:]r:g:b) or the semicolon form (38;5;n, 38;2;r;g;b).
+// It returns the color and how many following parameters were consumed.
+func extendedColor(params [][]int, i int) (Color, int) {
+	p := params[i]
+	if len(p) > 1 {
+		switch {
+		case p[1] == 5 && len(p) >= 3:
+			return IndexedColor(max(p[2], 0)), 0
+		case p[1] == 2 && len(p) >= 6:
+			return RGBColor(max(p[3], 0), max(p[4], 0), max(p[5], 0)), 0
+		case p[1] == 2 && len(p) == 5:
+			return RGBColor(max(p[2], 0), max(p[3], 0), max(p[4], 0)), 0
+		}
+		return ColorDefault, 0
+	}
+
+	if i+1 >= len(params) {
+		return ColorDefault, 0
+	}
+	switch params[i+1][0] {
+	case 5:
+		if i+2 < len(params) {
+			return IndexedColor(max(params[i+2][0], 0)), 2
+		}
+		return ColorDefault, len(params) - i - 1
+	case 2:
+		if i+4 < len(params) {
+			return RGBColor(max(params[i+2][0], 0), max(params[i+3][0], 0), max(params[i+4][0], 0)), 4
+		}
+		return ColorDefault, len(params) - i - 1
+	}
+	return ColorDefault, 1
+}
+
+// softReset implements DECSTR
+func (t *Terminal) softReset() {
+	t.insert = false
+	t.cursor.origin = false
+	t.autowrap = true
+	t.cursorHidden = false
+	t.appCursor = false
+	t.appKeypad = false
+	t.cursor.attr = Attr{}
+	t.cursor.charsets = [2]bool{}
+	t.cursor.gl = 0
+	t.cur.top = 0
+	t.cur.bot = t.rows - 1
+	t.cur.saved = cursor{}
+}
+
+// alignmentTest implements DECALN: fill the screen with 'E'
+func (t *Terminal) alignmentTest() {
+	for y := range t.cur.lines {
+		l := blankLine(t.cols, Attr{})
+		for x := range l.Cells {
+			l.Cells[x].Ch = 'E'
+		}
+		t.cur.lines[y] = l
+	}
+	t.cur.top = 0
+	t.cur.bot = t.rows - 1
+	t.moveTo(0, 0)
+}
@@ -0,0 +1,218 @@
+package vt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Redraw returns output that reproduces the current terminal state on a
+// fresh xterm-compatible terminal: up to history lines of scrollback, the
+// primary and (if active) alternate screens, cursor, modes and title.
+func (t *Terminal) Redraw(history int) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b bytes.Buffer
+	// Start from a known state: primary screen, soft reset, everything cleared
+	b.WriteString("\x1b[?1049l\x1b[!p\x1b[0m\x1b[H\x1b[2J\x1b[3J")
+	pen := Attr{}
+
+	hist := t.history
+	if history <= 0 {
+		hist = nil
+	} else if len(hist) > history {
+		hist = hist[len(hist)-history:]
+	}
+	lines := make([]Line, 0, len(hist)+len(t.primary.lines))
+	lines = append(lines, hist...)
+	lines = append(lines, t.primary.lines...)
+	for i, l := range lines {
+		t.writeLine(&b, l, &pen)
+		if i == len(lines)-1 {
+			break
+		}
+		// A full soft-wrapped line continues by autowrap on the client
+		if l.Wrapped && len(l.Cells) == t.cols {
+			continue
+		}
+		if pen != (Attr{}) {
+			b.WriteString("\x1b[0m")
+			pen = Attr{}
+		}
+		b.WriteString("\r\n")
+	}
+
+	if t.cur == t.alternate {
+		// Entering the alternate screen saves the primary cursor
+		t.writeSavedCursor(&b, t.primary.saved, &pen)
+		b.WriteString("\x1b[?1049h")
+		for y, l := range t.alternate.lines {
+			fmt.Fprintf(&b, "\x1b[%d;1H", y+1)
+			t.writeLine(&b, l, &pen)
+		}
+	}
+	t.writeSavedCursor(&b, t.cur.saved, &pen)
+
+	if t.cur.top != 0 || t.cur.bot != t.rows-1 {
+		fmt.Fprintf(&b, "\x1b[%d;%dr", t.cur.top+1, t.cur.bot+1)
+	}
+
+	// Modes
+	if t.appCursor {
+		b.WriteString("\x1b[?1h")
+	}
+	if t.appKeypad {
+		b.WriteString("\x1b=")
+	}
+	if t.bracketedPaste {
+		b.WriteString("\x1b[?2004h")
+	}
+	modes := make([]int, 0, len(t.mouseModes))
+	for m := range t.mouseModes {
+		modes = append(modes, m)
+	}
+	sort.Ints(modes)
+	for _, m := range modes {
+		fmt.Fprintf(&b, "\x1b[?%dh", m)
+	}
+	if !t.autowrap {
+		b.WriteString("\x1b[?7l")
+	}
+	if t.insert {
+		b.WriteString("\x1b[4h")
+	}
+	if t.cursorStyle != 0 {
+		fmt.Fprintf(&b, "\x1b[%d q", t.cursorStyle)
+	}
+	if t.title != "" {
+		fmt.Fprintf(&b, "\x1b]2;%s\x07", t.title)
+	}
+
+	// Charsets
+	if t.cursor.charsets[0] {
+		b.WriteString("\x1b(0")
+	}
+	if t.cursor.charsets[1] {
+		b.WriteString("\x1b)0")
+	}
+	if t.cursor.gl == 1 {
+		b.WriteString("\x0e")
+	}
+
+	// Cursor
+	c := t.cursor
+	switch {
+	case c.origin:
+		b.WriteString("\x1b[?6h")
+		fmt.Fprintf(&b, "\x1b[%d;%dH", c.y-t.cur.top+1, c.x+1)
+	case c.wrapNext && t.line(c.y).Cells[c.x].Width == 1:
+		// Reprint the last column so the next character wraps as it would
+		// on the original terminal
+		cell := t.line(c.y).Cells[c.x]
+		fmt.Fprintf(&b, "\x1b[%d;%dH", c.y+1, c.x+1)
+		if cell.Attr != pen {
+			writeSGR(&b, cell.Attr)
+			pen = cell.Attr
+		}
+		writeCell(&b, cell)
+	default:
+		fmt.Fprintf(&b, "\x1b[%d;%dH", c.y+1, c.x+1)
+	}
+	if c.attr != pen {
+		writeSGR(&b, c.attr)
+	}
+	if t.cursorHidden {
+		b.WriteString("\x1b[?25l")
+	}
+	return b.Bytes()
+}
+
+// writeSavedCursor restores a DECSC state on the client and saves it there
+func (t *Terminal) writeSavedCursor(b *bytes.Buffer, s cursor, pen *Attr) {
+	if s == (cursor{}) {
+		return
+	}
+	fmt.Fprintf(b, "\x1b[%d;%dH", s.y+1, s.x+1)
+	if s.attr != *pen {
+		writeSGR(b, s.attr)
+		*pen = s.attr
+	}
+	b.WriteString("\x1b7")
+}
+
+// writeLine writes a line's cells without trailing blanks
+func (t *Terminal) writeLine(b *bytes.Buffer, l Line, pen *Attr) {
+	n := len(l.Cells)
+	for n > 0 && isBlank(l.Cells[n-1]) {
+		n--
+	}
+	for _, c := range l.Cells[:n] {
+		if c.Width == 0 {
+			continue
+		}
+		if c.Attr != *pen {
+			writeSGR(b, c.Attr)
+			*pen = c.Attr
+		}
+		writeCell(b, c)
+	}
+}
+
+func writeCell(b *bytes.Buffer, c Cell) {
+	if c.Ch == 0 {
+		b.WriteByte(' ')
+		return
+	}
+	b.WriteRune(c.Ch)
+	for _, r := range c.Comb {
+		b.WriteRune(r)
+	}
+}
+
+var sgrFlags = []struct {
+	flag uint16
+	code string
+}{
+	{AttrBold, "1"},
+	{AttrDim, "2"},
+	{AttrItalic, "3"},
+	{AttrUnderline, "4"},
+	{AttrBlink, "5"},
+	{AttrReverse, "7"},
+	{AttrHidden, "8"},
+	{AttrStrike, "9"},
+}
+
+// writeSGR writes the sequence that sets exactly attribute a
+func writeSGR(b *bytes.Buffer, a Attr) {
+	b.WriteString("\x1b[0")
+	for _, f := range sgrFlags {
+		if a.Flags&f.flag != 0 {
+			b.WriteByte(';')
+			b.WriteString(f.code)
+		}
+	}
+	writeColor(b, a.FG, 30)
+	writeColor(b, a.BG, 40)
+	b.WriteByte('m')
+}
+
+// writeColor writes a color parameter; base is 30 for foreground, 40 for
+// background
+func writeColor(b *bytes.Buffer, c Color, base int) {
+	v := int(c &^ colorTypeMask)
+	switch c & colorTypeMask {
+	case colorIndexed:
+		switch {
+		case v < 8:
+			fmt.Fprintf(b, ";%d", base+v)
+		case v < 16:
+			fmt.Fprintf(b, ";%d", base+60+v-8)
+		default:
+			fmt.Fprintf(b, ";%d;5;%d", base+8, v)
+		}
+	case colorRGB:
+		fmt.Fprintf(b, ";%d;2;%d;%d;%d", base+8, v>>16&0xFF, v>>8&0xFF, v&0xFF)
+	}
+}
@@ -0,0 +1,744 @@
+// Package vt implements a server-side terminal emulator that tracks the
+// screen state of a session, so a reattaching client can be sent a clean
+// redraw instead of a replay of raw output.
+package vt
+
+import (
+	"sync"
+)
+
+// Color is a cell color: default, one of the 256 indexed colors, or RGB
+type Color uint32
+
+const (
+	ColorDefault  Color = 0
+	colorIndexed  Color = 1 << 24
+	colorRGB      Color = 2 << 24
+	colorTypeMask Color = 0xFF << 24
+)
+
+// IndexedColor returns palette color i (0-255)
+func IndexedColor(i int) Color {
+	return colorIndexed | Color(i&0xFF)
+}
+
+// RGBColor returns a 24-bit color
+func RGBColor(r, g, b int) Color {
+	return colorRGB | Color(r&0xFF)<<16 | Color(g&0xFF)<<8 | Color(b&0xFF)
+}
+
+// Attribute flags
+const (
+	AttrBold uint16 = 1 << iota
+	AttrDim
+	AttrItalic
+	AttrUnderline
+	AttrBlink
+	AttrReverse
+	AttrHidden
+	AttrStrike
+)
+
+// Attr is the rendition of a cell
+type Attr struct {
+	FG    Color
+	BG    Color
+	Flags uint16
+}
+
+// Cell is one character cell of the screen
+type Cell struct {
+	Ch    rune   // 0 for an empty cell
+	Comb  []rune // Combining characters following Ch
+	Width uint8  // 1, 2 for a wide character, 0 for the cell after a wide character
+	Attr  Attr
+}
+
+// Line is one row of cells
+type Line struct {
+	Cells   []Cell
+	Wrapped bool // Continues on the next line (soft wrap)
+}
+
+// Mouse tracking modes
+const (
+	mouseX10       = 9
+	mouseNormal    = 1000
+	mouseButton    = 1002
+	mouseAny       = 1003
+	mouseSGR       = 1006
+	mouseUTF8      = 1005
+	mouseURXVT     = 1015
+	focusReporting = 1004
+)
+
+type cursor struct {
+	x, y     int
+	attr     Attr
+	wrapNext bool
+	origin   bool
+	charsets [2]bool // G0/G1 designated as DEC special graphics
+	gl       int     // Charset invoked into GL (0 = G0, 1 = G1)
+}
+
+type screen struct {
+	lines []Line
+	saved cursor // DECSC
+	top   int    // Scroll region, inclusive
+	bot   int
+}
+
+// Terminal is a VT100/xterm-compatible screen model
+type Terminal struct {
+	mu sync.Mutex
+
+	cols, rows int
+	primary    *screen
+	alternate  *screen
+	cur        *screen // Active screen
+	cursor     cursor
+	tabs       []bool
+
+	history    []Line // Lines scrolled off the top of the primary screen
+	maxHistory int
+	scrolled   int // Lines ever scrolled off the primary screen
+
+	// Shell integration
+	marks   []Mark
+	cmdLine commandLine
+
+	// Modes
+	autowrap       bool
+	insert         bool
+	cursorHidden   bool
+	appCursor      bool
+	appKeypad      bool
+	bracketedPaste bool
+	mouseModes     map[int]bool
+	cursorStyle    int
+	title          string
+
+	lastChar rune // For REP
+	parser   parser
+}
+
+// New creates a terminal of the given size that keeps up to maxHistory
+// lines of scrollback
+func New(cols, rows, maxHistory int) *Terminal {
+	if cols < 1 {
+		cols = 80
+	}
+	if rows < 1 {
+		rows = 24
+	}
+	t := &Terminal{
+		cols:       cols,
+		rows:       rows,
+		maxHistory: maxHistory,
+	}
+	t.reset()
+	return t
+}
+
+// reset performs a full reset (RIS)
+func (t *Terminal) reset() {
+	t.primary = newScreen(t.cols, t.rows)
+	t.alternate = newScreen(t.cols, t.rows)
+	t.cur = t.primary
+	t.cursor = cursor{}
+	t.cmdLine = commandLine{}
+	t.tabs = make([]bool, t.cols)
+	for i := 8; i < t.cols; i += 8 {
+		t.tabs[i] = true
+	}
+	t.autowrap = true
+	t.insert = false
+	t.cursorHidden = false
+	t.appCursor = false
+	t.appKeypad = false
+	t.bracketedPaste = false
+	t.mouseModes = make(map[int]bool)
+	t.cursorStyle = 0
+	t.title = ""
+}
+
+func newScreen(cols, rows int) *screen {
+	s := &screen{
+		lines: make([]Line, rows),
+		bot:   rows - 1,
+	}
+	for i := range s.lines {
+		s.lines[i] = blankLine(cols, Attr{})
+	}
+	return s
+}
+
+func blankLine(cols int, attr Attr) Line {
+	cells := make([]Cell, cols)
+	for i := range cells {
+		cells[i] = blankCell(attr)
+	}
+	return Line{Cells: cells}
+}
+
+// blankCell is an erased cell; erasing keeps the current background (BCE)
+func blankCell(attr Attr) Cell {
+	return Cell{Width: 1, Attr: Attr{BG: attr.BG}}
+}
+
+// Size returns the terminal dimensions
+func (t *Terminal) Size() (cols, rows int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cols, t.rows
+}
+
+// Title returns the window title set by the application
+func (t *Terminal) Title() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.title
+}
+
+// Write feeds terminal output into the emulator
+func (t *Terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.parser.feed(t, p)
+	return len(p), nil
+}
+
+// Resize changes the terminal dimensions. Rows that no longer fit above
+// the cursor move into the scrollback; columns are truncated or padded.
+func (t *Terminal) Resize(cols, rows int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cols < 1 || rows < 1 || (cols == t.cols && rows == t.rows) {
+		return
+	}
+
+	for _, s := range []*screen{t.primary, t.alternate} {
+		// Keep the cursor row visible when shrinking
+		if s == t.cur && t.cursor.y >= rows {
+			drop := t.cursor.y - rows + 1
+			if s == t.primary {
+				t.pushHistory(s.lines[:drop])
+			}
+			s.lines = s.lines[drop:]
+		}
+		if len(s.lines) > rows {
+			s.lines = s.lines[:rows]
+		}
+		for len(s.lines) < rows {
+			s.lines = append(s.lines, blankLine(cols, Attr{}))
+		}
+		for i := range s.lines {
+			s.lines[i] = resizeLine(s.lines[i], cols)
+		}
+		s.top = 0
+		s.bot = rows - 1
+		s.saved.x = min(s.saved.x, cols-1)
+		s.saved.y = min(s.saved.y, rows-1)
+	}
+
+	if t.cursor.y >= rows {
+		t.cursor.y = rows - 1
+	}
+	if t.cursor.x >= cols {
+		t.cursor.x = cols - 1
+	}
+	t.cursor.wrapNext = false
+
+	tabs := make([]bool, cols)
+	copy(tabs, t.tabs)
+	for i := (t.cols + 7) / 8 * 8; i < cols; i += 8 {
+		tabs[i] = true
+	}
+	t.tabs = tabs
+	t.cols = cols
+	t.rows = rows
+}
+
+func resizeLine(l Line, cols int) Line {
+	if len(l.Cells) == cols {
+		return l
+	}
+	if len(l.Cells) > cols {
+		l.Cells = l.Cells[:cols]
+		// Don't leave half of a wide character
+		if last := &l.Cells[cols-1]; last.Width == 2 {
+			*last = blankCell(last.Attr)
+		}
+		l.Wrapped = false
+		return l
+	}
+	for len(l.Cells) < cols {
+		l.Cells = append(l.Cells, blankCell(Attr{}))
+	}
+	l.Wrapped = false
+	return l
+}
+
+// pushHistory appends lines to the scrollback, trimming the oldest
+func (t *Terminal) pushHistory(lines []Line) {
+	t.scrolled += len(lines)
+	if t.maxHistory <= 0 {
+		return
+	}
+	for _, l := range lines {
+		t.history = append(t.history, trimLine(l))
+	}
+	// Trim in batches so appends stay amortized O(1)
+	if len(t.history) > t.maxHistory+t.maxHistory/4 {
+		t.history = append([]Line(nil), t.history[len(t.history)-t.maxHistory:]...)
+	}
+}
+
+// trimLine drops trailing blank cells to save memory in the scrollback
+func trimLine(l Line) Line {
+	n := len(l.Cells)
+	if !l.Wrapped {
+		for n > 0 && isBlank(l.Cells[n-1]) {
+			n--
+		}
+	}
+	cells := make([]Cell, n)
+	copy(cells, l.Cells[:n])
+	return Line{Cells: cells, Wrapped: l.Wrapped}
+}
+
+func isBlank(c Cell) bool {
+	return (c.Ch == 0 || c.Ch == ' ') && c.Attr == Attr{} && c.Width == 1
+}
+
+// History returns the number of scrollback lines retained
+func (t *Terminal) History() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return min(len(t.history), t.maxHistory)
+}
+
+// Screen operations. These are called by the parser with t.mu held.
+
+func (t *Terminal) line(y int) *Line {
+	return &t.cur.lines[y]
+}
+
+// print puts a character at the cursor and advances it
+func (t *Terminal) print(r rune) {
+	if t.cursor.charsets[t.cursor.gl] {
+		if g, ok := decSpecialGraphics[r]; ok {
+			r = g
+		}
+	}
+
+	w := runeWidth(r)
+	if w == 0 {
+		t.combine(r)
+		return
+	}
+
+	if t.cursor.wrapNext && t.autowrap {
+		t.line(t.cursor.y).Wrapped = true
+		t.cursor.x = 0
+		t.index()
+	}
+	t.cursor.wrapNext = false
+
+	// A wide character that doesn't fit wraps early
+	if w == 2 && t.cursor.x == t.cols-1 {
+		if !t.autowrap || t.cols < 2 {
+			return
+		}
+		l := t.line(t.cursor.y)
+		l.Cells[t.cursor.x] = blankCell(t.cursor.attr)
+		l.Wrapped = true
+		t.cursor.x = 0
+		t.index()
+	}
+
+	if t.insert {
+		t.insertCells(w)
+	}
+
+	l := t.line(t.cursor.y)
+	t.clearWide(l, t.cursor.x)
+	l.Cells[t.cursor.x] = Cell{Ch: r, Width: uint8(w), Attr: t.cursor.attr}
+	if w == 2 {
+		t.clearWide(l, t.cursor.x+1)
+		l.Cells[t.cursor.x+1] = Cell{Width: 0, Attr: t.cursor.attr}
+	}
+	t.lastChar = r
+
+	if t.cursor.x+w >= t.cols {
+		t.cursor.x = t.cols - 1
+		t.cursor.wrapNext = t.autowrap
+	} else {
+		t.cursor.x += w
+	}
+}
+
+// clearWide blanks the other half of a wide character about to be
+// partially overwritten at x
+func (t *Terminal) clearWide(l *Line, x int) {
+	c := l.Cells[x]
+	if c.Width == 2 && x+1 < len(l.Cells) {
+		l.Cells[x+1] = blankCell(c.Attr)
+	} else if c.Width == 0 && x > 0 {
+		l.Cells[x-1] = blankCell(l.Cells[x-1].Attr)
+	}
+}
+
+// combine attaches a zero-width character to the previous cell
+func (t *Terminal) combine(r rune) {
+	x := t.cursor.x
+	if !t.cursor.wrapNext {
+		x--
+	}
+	if x < 0 {
+		return
+	}
+	l := t.line(t.cursor.y)
+	if l.Cells[x].Width == 0 && x > 0 {
+		x--
+	}
+	if l.Cells[x].Ch != 0 && len(l.Cells[x].Comb) < 8 {
+		l.Cells[x].Comb = append(l.Cells[x].Comb, r)
+	}
+}
+
+// index moves the cursor down, scrolling at the bottom of the region (IND/LF)
+func (t *Terminal) index() {
+	if t.cursor.y == t.cur.bot {
+		t.scrollUp(t.cur.top, 1)
+	} else if t.cursor.y < t.rows-1 {
+		t.cursor.y++
+	}
+}
+
+// reverseIndex moves the cursor up, scrolling at the top of the region (RI)
+func (t *Terminal) reverseIndex() {
+	if t.cursor.y == t.cur.top {
+		t.scrollDown(t.cur.top, 1)
+	} else if t.cursor.y > 0 {
+		t.cursor.y--
+	}
+}
+
+// scrollUp scrolls lines top..bottom of the region up by n. Lines leaving
+// the top of a full-height primary screen go to the scrollback.
+func (t *Terminal) scrollUp(top, n int) {
+	bot := t.cur.bot
+	if top > bot {
+		return
+	}
+	n = min(n, bot-top+1)
+	if t.cur == t.primary && top == 0 {
+		t.pushHistory(t.cur.lines[:n])
+	}
+	lines := t.cur.lines
+	copy(lines[top:], lines[top+n:bot+1])
+	for i := bot - n + 1; i <= bot; i++ {
+		lines[i] = blankLine(t.cols, t.cursor.attr)
+	}
+}
+
+// scrollDown scrolls lines top..bottom of the region down by n
+func (t *Terminal) scrollDown(top, n int) {
+	bot := t.cur.bot
+	if top > bot {
+		return
+	}
+	n = min(n, bot-top+1)
+	lines := t.cur.lines
+	copy(lines[top+n:bot+1], lines[top:bot+1-n])
+	for i := top; i < top+n; i++ {
+		lines[i] = blankLine(t.cols, t.cursor.attr)
+	}
+}
+
+func (t *Terminal) carriageReturn() {
+	t.cursor.x = 0
+	t.cursor.wrapNext = false
+}
+
+func (t *Terminal) backspace() {
+	if t.cursor.x > 0 {
+		t.cursor.x--
+	}
+	t.cursor.wrapNext = false
+}
+
+func (t *Terminal) tab(n int) {
+	for ; n > 0 && t.cursor.x < t.cols-1; n-- {
+		t.cursor.x++
+		for t.cursor.x < t.cols-1 && !t.tabs[t.cursor.x] {
+			t.cursor.x++
+		}
+	}
+	t.cursor.wrapNext = false
+}
+
+func (t *Terminal) backTab(n int) {
+	for ; n > 0 && t.cursor.x > 0; n-- {
+		t.cursor.x--
+		for t.cursor.x > 0 && !t.tabs[t.cursor.x] {
+			t.cursor.x--
+		}
+	}
+	t.cursor.wrapNext = false
+}
+
+// moveTo positions the cursor, honoring origin mode for the row
+func (t *Terminal) moveTo(x, y int) {
+	minY, maxY := 0, t.rows-1
+	if t.cursor.origin {
+		y += t.cur.top
+		minY, maxY = t.cur.top, t.cur.bot
+	}
+	t.cursor.x = max(0, min(x, t.cols-1))
+	t.cursor.y = max(minY, min(y, maxY))
+	t.cursor.wrapNext = false
+}
+
+// moveRel moves the cursor relative to its position, stopping at the scroll
+// region margins when starting inside the region
+func (t *Terminal) moveRel(dx, dy int) {
+	x := max(0, min(t.cursor.x+dx, t.cols-1))
+	y := t.cursor.y + dy
+	top, bot := 0, t.rows-1
+	if t.cursor.y >= t.cur.top && t.cursor.y <= t.cur.bot {
+		top, bot = t.cur.top, t.cur.bot
+	}
+	t.cursor.x = x
+	t.cursor.y = max(top, min(y, bot))
+	t.cursor.wrapNext = false
+}
+
+func (t *Terminal) eraseCells(y, from, to int) {
+	l := t.line(y)
+	from = max(0, from)
+	to = min(to, t.cols)
+	if from < to {
+		t.clearWide(l, from)
+		if to < t.cols {
+			t.clearWide(l, to-1)
+		}
+	}
+	for x := from; x < to; x++ {
+		l.Cells[x] = blankCell(t.cursor.attr)
+	}
+}
+
+// eraseDisplay implements ED
+func (t *Terminal) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		t.eraseCells(t.cursor.y, t.cursor.x, t.cols)
+		t.line(t.cursor.y).Wrapped = false
+		for y := t.cursor.y + 1; y < t.rows; y++ {
+			t.cur.lines[y] = blankLine(t.cols, t.cursor.attr)
+		}
+	case 1:
+		for y := 0; y < t.cursor.y; y++ {
+			t.cur.lines[y] = blankLine(t.cols, t.cursor.attr)
+		}
+		t.eraseCells(t.cursor.y, 0, t.cursor.x+1)
+	case 2:
+		for y := 0; y < t.rows; y++ {
+			t.cur.lines[y] = blankLine(t.cols, t.cursor.attr)
+		}
+	case 3:
+		t.history = nil
+	}
+	t.cursor.wrapNext = false
+}
+
+// eraseLine implements EL
+func (t *Terminal) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		t.eraseCells(t.cursor.y, t.cursor.x, t.cols)
+		t.line(t.cursor.y).Wrapped = false
+	case 1:
+		t.eraseCells(t.cursor.y, 0, t.cursor.x+1)
+	case 2:
+		t.cur.lines[t.cursor.y] = blankLine(t.cols, t.cursor.attr)
+	}
+	t.cursor.wrapNext = false
+}
+
+// insertCells shifts cells right of the cursor by n (ICH)
+func (t *Terminal) insertCells(n int) {
+	l := t.line(t.cursor.y)
+	x := t.cursor.x
+	n = min(n, t.cols-x)
+	t.clearWide(l, x)
+	copy(l.Cells[x+n:], l.Cells[x:t.cols-n])
+	for i := x; i < x+n; i++ {
+		l.Cells[i] = blankCell(t.cursor.attr)
+	}
+	if last := &l.Cells[t.cols-1]; last.Width == 2 {
+		*last = blankCell(last.Attr)
+	}
+	l.Wrapped = false
+}
+
+// deleteCells removes n cells at the cursor, shifting the rest left (DCH)
+func (t *Terminal) deleteCells(n int) {
+	l := t.line(t.cursor.y)
+	x := t.cursor.x
+	n = min(n, t.cols-x)
+	t.clearWide(l, x)
+	if x+n < t.cols {
+		t.clearWide(l, x+n)
+	}
+	copy(l.Cells[x:], l.Cells[x+n:])
+	for i := t.cols - n; i < t.cols; i++ {
+		l.Cells[i] = blankCell(t.cursor.attr)
+	}
+	l.Wrapped = false
+	t.cursor.wrapNext = false
+}
+
+// insertLines inserts n blank lines at the cursor within the region (IL)
+func (t *Terminal) insertLines(n int) {
+	if t.cursor.y < t.cur.top || t.cursor.y > t.cur.bot {
+		return
+	}
+	t.scrollDown(t.cursor.y, n)
+	t.cursor.x = 0
+	t.cursor.wrapNext = false
+}
+
+// deleteLines deletes n lines at the cursor within the region (DL)
+func (t *Terminal) deleteLines(n int) {
+	if t.cursor.y < t.cur.top || t.cursor.y > t.cur.bot {
+		return
+	}
+	bot := t.cur.bot
+	n = min(n, bot-t.cursor.y+1)
+	lines := t.cur.lines
+	copy(lines[t.cursor.y:], lines[t.cursor.y+n:bot+1])
+	for i := bot - n + 1; i <= bot; i++ {
+		lines[i] = blankLine(t.cols, t.cursor.attr)
+	}
+	t.cursor.x = 0
+	t.cursor.wrapNext = false
+}
+
+// setScrollRegion implements DECSTBM (1-based, inclusive)
+func (t *Terminal) setScrollRegion(top, bot int) {
+	if top < 1 {
+		top = 1
+	}
+	if bot < 1 || bot > t.rows {
+		bot = t.rows
+	}
+	if top >= bot {
+		return
+	}
+	t.cur.top = top - 1
+	t.cur.bot = bot - 1
+	t.moveTo(0, 0)
+}
+
+func (t *Terminal) saveCursor() {
+	t.cur.saved = t.cursor
+}
+
+func (t *Terminal) restoreCursor() {
+	t.cursor = t.cur.saved
+	t.cursor.x = min(t.cursor.x, t.cols-1)
+	t.cursor.y = min(t.cursor.y, t.rows-1)
+}
+
+// useAlternate switches between the primary and alternate screens
+func (t *Terminal) useAlternate(on, clear bool) {
+	if on == (t.cur == t.alternate) {
+		return
+	}
+	if on {
+		t.cur = t.alternate
+		if clear {
+			for y := range t.cur.lines {
+				t.cur.lines[y] = blankLine(t.cols, Attr{})
+			}
+		}
+	} else {
+		if clear {
+			for y := range t.cur.lines {
+				t.cur.lines[y] = blankLine(t.cols, Attr{})
+			}
+		}
+		t.cur = t.primary
+	}
+	t.cursor.wrapNext = false
+}
+
+// setMode handles SM/RM (ANSI) and DECSET/DECRST (private) modes
+func (t *Terminal) setMode(private bool, mode int, on bool) {
+	if !private {
+		if mode == 4 {
+			t.insert = on
+		}
+		return
+	}
+
+	switch mode {
+	case 1:
+		t.appCursor = on
+	case 6:
+		t.cursor.origin = on
+		t.moveTo(0, 0)
+	case 7:
+		t.autowrap = on
+		if !on {
+			t.cursor.wrapNext = false
+		}
+	case 25:
+		t.cursorHidden = !on
+	case 47:
+		t.useAlternate(on, false)
+	case 1047:
+		t.useAlternate(on, !on)
+	case 1048:
+		if on {
+			t.saveCursor()
+		} else {
+			t.restoreCursor()
+		}
+	case 1049:
+		if on {
+			t.saveCursor()
+			t.useAlternate(true, true)
+		} else {
+			t.useAlternate(false, false)
+			t.restoreCursor()
+		}
+	case 2004:
+		t.bracketedPaste = on
+	case mouseX10, mouseNormal, mouseButton, mouseAny, mouseSGR, mouseUTF8, mouseURXVT, focusReporting:
+		if on {
+			t.mouseModes[mode] = true
+		} else {
+			delete(t.mouseModes, mode)
+		}
+	}
+}
+
+// setTab and clearTabs implement HTS and TBC
+func (t *Terminal) setTab() {
+	t.tabs[t.cursor.x] = true
+}
+
+func (t *Terminal) clearTabs(mode int) {
+	switch mode {
+	case 0:
+		t.tabs[t.cursor.x] = false
+	case 3:
+		for i := range t.tabs {
+			t.tabs[i] = false
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package vt
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lineText returns the characters of a line without trailing blanks; the
+// second half of a wide character is skipped
+func lineText(l Line) string {
+	var b strings.Builder
+	for _, c := range l.Cells {
+		if c.Width == 0 {
+			continue
+		}
+		if c.Ch == 0 {
+			b.WriteByte(' ')
+			continue
+		}
+		b.WriteRune(c.Ch)
+		for _, r := range c.Comb {
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+func linesText(lines []Line) []string {
+	text := make([]string, len(lines))
+	for i, l := range lines {
+		text[i] = lineText(l)
+	}
+	return text
+}
+
+func TestPrint(t *testing.T) {
+	tests := []struct {
+		name   string
+		cols   int
+		input  string
+		screen []string
+		cells  []Cell // Of the first line, when set
+		x, y   int
+	}{
+		{
+			name:   "wide",
+			cols:   10,
+			input:  "a你b",
+			screen: []string{"a你b", ""},
+			cells:  []Cell{{Ch: 'a', Width: 1}, {Ch: '你', Width: 2}, {Width: 0}, {Ch: 'b', Width: 1}},
+			x:      4,
+		},
+		{
+			name:   "combining",
+			cols:   10,
+			input:  "éx",
+			screen: []string{"éx", ""},
+			cells:  []Cell{{Ch: 'e', Comb: []rune{'́'}, Width: 1}, {Ch: 'x', Width: 1}},
+			x:      2,
+		},
+		{
+			name:   "combining on wide",
+			cols:   10,
+			input:  "你́",
+			screen: []string{"你́", ""},
+			x:      2,
+		},
+		{
+			name:   "combining in last column",
+			cols:   3,
+			input:  "abé",
+			screen: []string{"abé", ""},
+			x:      2,
+		},
+		{
+			name:   "wide wraps early",
+			cols:   3,
+			input:  "ab你",
+			screen: []string{"ab", "你"},
+			x:      2,
+			y:      1,
+		},
+		{
+			name:   "overwrite first half of wide",
+			cols:   10,
+			input:  "你\rx",
+			screen: []string{"x", ""},
+			x:      1,
+		},
+		{
+			name:   "overwrite second half of wide",
+			cols:   10,
+			input:  "你\x1b[2Gx",
+			screen: []string{" x", ""},
+			x:      2,
+		},
+		{
+			name:   "autowrap",
+			cols:   3,
+			input:  "abcd",
+			screen: []string{"abc", "d"},
+			x:      1,
+			y:      1,
+		},
+		{
+			name:   "no autowrap",
+			cols:   3,
+			input:  "\x1b[?7labcd",
+			screen: []string{"abd", ""},
+			x:      2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := New(tt.cols, 2, 0)
+			term.Write([]byte(tt.input))
+			if got := linesText(term.primary.lines); !slices.Equal(got, tt.screen) {
+				t.Errorf("screen = %q, want %q", got, tt.screen)
+			}
+			for i, want := range tt.cells {
+				got := term.primary.lines[0].Cells[i]
+				if got.Ch != want.Ch || got.Width != want.Width || !slices.Equal(got.Comb, want.Comb) {
+					t.Errorf("cell %d = %+v, want %+v", i, got, want)
+				}
+			}
+			if term.cursor.x != tt.x || term.cursor.y != tt.y {
+				t.Errorf("cursor = %d,%d, want %d,%d", term.cursor.x, term.cursor.y, tt.x, tt.y)
+			}
+		})
+	}
+}
+
+func TestScrollRegion(t *testing.T) {
+	const lines = "1\r\n2\r\n3\r\n4\r\n5"
+	tests := []struct {
+		name    string
+		input   string
+		screen  []string
+		history []string
+	}{
+		{
+			name:   "index at bottom of region",
+			input:  lines + "\x1b[2;4r\x1b[4;1H\n",
+			screen: []string{"1", "3", "4", "", "5"},
+		},
+		{
+			name:   "reverse index at top of region",
+			input:  lines + "\x1b[2;4r\x1b[2;1H\x1bM",
+			screen: []string{"1", "", "2", "3", "5"},
+		},
+		{
+			name:   "insert lines",
+			input:  lines + "\x1b[2;4r\x1b[3;1H\x1b[2L",
+			screen: []string{"1", "2", "", "", "5"},
+		},
+		{
+			name:   "delete lines",
+			input:  lines + "\x1b[2;4r\x1b[2;1H\x1b[M",
+			screen: []string{"1", "3", "4", "", "5"},
+		},
+		{
+			name:   "scroll up",
+			input:  lines + "\x1b[2;4r\x1b[2S",
+			screen: []string{"1", "4", "", "", "5"},
+		},
+		{
+			name:   "cursor below region",
+			input:  lines + "\x1b[2;4r\x1b[5;1H\n",
+			screen: []string{"1", "2", "3", "4", "5"},
+		},
+		{
+			name:    "region from the top goes to the scrollback",
+			input:   lines + "\x1b[1;4r\x1b[4;1H\nx",
+			screen:  []string{"2", "3", "4", "x", "5"},
+			history: []string{"1"},
+		},
+		{
+			name:   "invalid region",
+			input:  lines + "\x1b[4;2r\x1b[5;1H\n",
+			screen: []string{"2", "3", "4", "5", ""},
+			// The region is still the full screen
+			history: []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := New(10, 5, 100)
+			term.Write([]byte(tt.input))
+			if got := linesText(term.primary.lines); !slices.Equal(got, tt.screen) {
+				t.Errorf("screen = %q, want %q", got, tt.screen)
+			}
+			if got := linesText(term.history); !slices.Equal(got, tt.history) {
+				t.Errorf("history = %q, want %q", got, tt.history)
+			}
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		cols, rows int
+		screen     []string
+		history    []string
+		x, y       int
+	}{
+		{
+			name:    "shrink keeps the cursor row",
+			input:   "1\r\n2\r\n3\r\n4",
+			cols:    10,
+			rows:    2,
+			screen:  []string{"3", "4"},
+			history: []string{"1", "2"},
+			x:       1,
+			y:       1,
+		},
+		{
+			name:   "shrink below the cursor",
+			input:  "1\r\n2\x1b[H",
+			cols:   10,
+			rows:   2,
+			screen: []string{"1", "2"},
+		},
+		{
+			name:   "grow",
+			input:  "1\r\n2",
+			cols:   10,
+			rows:   6,
+			screen: []string{"1", "2", "", "", "", ""},
+			x:      1,
+			y:      1,
+		},
+		{
+			name:   "narrower cuts lines and wide characters",
+			input:  "abcdef\r\nab你",
+			cols:   3,
+			rows:   4,
+			screen: []string{"abc", "ab", "", ""},
+			x:      2,
+			y:      1,
+		},
+		{
+			name:    "scrollback is kept",
+			input:   "1\r\n2\r\n3\r\n4\r\n5\r\n6",
+			cols:    10,
+			rows:    1,
+			screen:  []string{"6"},
+			history: []string{"1", "2", "3", "4", "5"},
+			x:       1,
+		},
+		{
+			name:   "alternate screen",
+			input:  "1\r\n2\r\n3\r\n4\x1b[?1049ha\r\nb\r\nc\r\nd",
+			cols:   10,
+			rows:   2,
+			screen: []string{"c", "d"},
+			x:      1,
+			y:      1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := New(10, 4, 100)
+			term.Write([]byte(tt.input))
+			term.Resize(tt.cols, tt.rows)
+			if cols, rows := term.Size(); cols != tt.cols || rows != tt.rows {
+				t.Errorf("size = %dx%d, want %dx%d", cols, rows, tt.cols, tt.rows)
+			}
+			if got := linesText(term.cur.lines); !slices.Equal(got, tt.screen) {
+				t.Errorf("screen = %q, want %q", got, tt.screen)
+			}
+			if got := linesText(term.history); !slices.Equal(got, tt.history) {
+				t.Errorf("history = %q, want %q", got, tt.history)
+			}
+			if term.History() != len(tt.history) {
+				t.Errorf("History() = %d, want %d", term.History(), len(tt.history))
+			}
+			if term.cursor.x != tt.x || term.cursor.y != tt.y {
+				t.Errorf("cursor = %d,%d, want %d,%d", term.cursor.x, term.cursor.y, tt.x, tt.y)
+			}
+			for _, l := range term.cur.lines {
+				if len(l.Cells) != tt.cols {
+					t.Fatalf("line has %d cells, want %d", len(l.Cells), tt.cols)
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	term := New(10, 2, 8)
+	for i := range 100 {
+		term.Write([]byte{'a' + byte(i%26), '\r', '\n'})
+	}
+	if term.History() != 8 {
+		t.Fatalf("History() = %d, want 8", term.History())
+	}
+	// The newest lines are kept
+	if got := lineText(term.history[len(term.history)-1]); got != "u" {
+		t.Errorf("last history line = %q, want %q", got, "u")
+	}
+}
+
+// TestRedraw feeds a terminal's redraw into a fresh one of the same size,
+// which must end up in the same state
+func TestRedraw(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		after string // Written to both terminals after the redraw
+	}{
+		{
+			name:  "text",
+			input: "$ ls\r\nfile1  file2\r\n$ ",
+		},
+		{
+			name:  "scrollback",
+			input: strings.Repeat("line\r\n", 10) + "$ ",
+		},
+		{
+			name:  "attributes",
+			input: "\x1b[1;31mred\x1b[0m \x1b[38;5;200mx\x1b[48;2;1;2;3my\x1b[4m",
+		},
+		{
+			name:  "soft wrap",
+			input: "0123456789abc",
+		},
+		{
+			name:  "pending wrap",
+			input: "0123456789",
+			after: "x",
+		},
+		{
+			name:  "wide and combining",
+			input: "a你é\r\n012345678你",
+		},
+		{
+			name:  "alternate screen",
+			input: "$ vim\r\n\x1b[?1049h\x1b[Hfile\x1b[3;2Hcontent",
+		},
+		{
+			name:  "leaving the alternate screen",
+			input: "$ vim\r\n\x1b[?1049h\x1b[Hfile\x1b[3;2Hcontent",
+			after: "\x1b[?1049l",
+		},
+		{
+			name:  "alternate screen with scroll region",
+			input: "$ less\r\n\x1b[?1049h\x1b[1;3r\x1b[3;1Ha\nb\nc",
+		},
+		{
+			name:  "scroll region",
+			input: "1\r\n2\r\n3\x1b[2;4r\x1b[3;2H",
+			after: "\n\n\nx",
+		},
+		{
+			name:  "origin mode",
+			input: "\x1b[2;4r\x1b[?6h\x1b[2;3H",
+			after: "x",
+		},
+		{
+			name:  "modes",
+			input: "\x1b[?1h\x1b[?2004h\x1b[?1000h\x1b[?1006h\x1b[?25l\x1b]2;title\x07",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := New(10, 5, 100)
+			orig.Write([]byte(tt.input))
+			term := New(10, 5, 100)
+			term.Write(orig.Redraw(100))
+			orig.Write([]byte(tt.after))
+			term.Write([]byte(tt.after))
+
+			for _, s := range []struct {
+				name       string
+				orig, term []Line
+			}{
+				{"history", orig.history, term.history},
+				{"primary", orig.primary.lines, term.primary.lines},
+				{"alternate", orig.alternate.lines, term.alternate.lines},
+			} {
+				if got, want := linesText(s.term), linesText(s.orig); !slices.Equal(got, want) {
+					t.Errorf("%s = %q, want %q", s.name, got, want)
+				}
+			}
+			for y, l := range orig.cur.lines {
+				for x, c := range l.Cells {
+					if got := term.cur.lines[y].Cells[x]; got.Attr != c.Attr || got.Width != c.Width {
+						t.Errorf("cell %d,%d = %+v, want %+v", x, y, got, c)
+					}
+				}
+			}
+			if (term.cur == term.alternate) != (orig.cur == orig.alternate) {
+				t.Errorf("alternate screen active = %v, want %v", term.cur == term.alternate, orig.cur == orig.alternate)
+			}
+			if term.cursor.x != orig.cursor.x || term.cursor.y != orig.cursor.y || term.cursor.attr != orig.cursor.attr {
+				t.Errorf("cursor = %+v, want %+v", term.cursor, orig.cursor)
+			}
+			if term.cur.top != orig.cur.top || term.cur.bot != orig.cur.bot {
+				t.Errorf("scroll region = %d-%d, want %d-%d", term.cur.top, term.cur.bot, orig.cur.top, orig.cur.bot)
+			}
+			if term.appCursor != orig.appCursor || term.bracketedPaste != orig.bracketedPaste ||
+				term.cursorHidden != orig.cursorHidden || !maps.Equal(term.mouseModes, orig.mouseModes) {
+				t.Error("modes differ")
+			}
+			if term.Title() != orig.Title() {
+				t.Errorf("title = %q, want %q", term.Title(), orig.Title())
+			}
+		})
+	}
+}
+
+func TestRedrawHistoryLimit(t *testing.T) {
+	orig := New(10, 2, 100)
+	for range 20 {
+		orig.Write([]byte("line\r\n"))
+	}
+	term := New(10, 2, 100)
+	term.Write(orig.Redraw(5))
+	if term.History() != 5 {
+		t.Errorf("History() = %d, want 5", term.History())
+	}
+
+	term = New(10, 2, 100)
+	term.Write(orig.Redraw(0))
+	if term.History() != 0 {
+		t.Errorf("History() = %d, want 0", term.History())
+	}
+}